@@ -0,0 +1,28 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+const (
+	// IngressRedirectURIAnnotation opts an Ingress in to be proxied, its value is the redirectURI of the proxy
+	IngressRedirectURIAnnotation = "oauth2.infra.doodle.com/redirect-uri"
+
+	// IngressPathsAnnotation is a comma separated list of path prefixes whose redirects are rewritten, defaults to /
+	IngressPathsAnnotation = "oauth2.infra.doodle.com/paths"
+
+	// ManagedAnnotationsAnnotation lists the annotations the controller set on a generated object from its template
+	ManagedAnnotationsAnnotation = "oauth2.infra.doodle.com/managed-annotations"
+)
@@ -0,0 +1,560 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// OAUTH2ProxySpec defines the desired state of OAUTH2Proxy
+type OAUTH2ProxySpec struct {
+	// Host is the host the proxy rewrites redirects for.
+	// +required
+	Host string `json:"host"`
+
+	// Paths are the paths of the host which are rewritten.
+	// +optional
+	Paths []HTTPPathMatch `json:"paths,omitempty"`
+
+	// RedirectURI is the redirect_uri which is registered at the external IdP.
+	// +required
+	RedirectURI string `json:"redirectURI"`
+
+	// Backend is where requests are forwarded to.
+	// +required
+	Backend BackendRef `json:"backend"`
+
+	// TLS configures the proxy listener for the host and the host of the redirectURI.
+	// +optional
+	TLS ListenerTLS `json:"tls,omitzero"`
+
+	// Ingress generates an Ingress which routes the host, the paths and the host of the redirectURI to the proxy.
+	// The Ingress is owned by the OAUTH2Proxy and deleted along with it.
+	// +optional
+	Ingress *IngressTemplate `json:"ingress,omitempty"`
+
+	// GatewayRef generates HTTPRoutes attached to the referenced Gateway which route the host, the paths and
+	// the host of the redirectURI to the proxy.
+	// The HTTPRoutes are owned by the OAUTH2Proxy and deleted along with it.
+	// +optional
+	GatewayRef *GatewayReference `json:"gatewayRef,omitempty"`
+}
+
+// PathMatchType defines how the path of a request is matched
+// +kubebuilder:validation:Enum=Prefix;Exact
+type PathMatchType string
+
+const (
+	// PathMatchPrefix matches all paths starting with the value
+	PathMatchPrefix PathMatchType = "Prefix"
+
+	// PathMatchExact only matches the path equal to the value
+	PathMatchExact PathMatchType = "Exact"
+)
+
+// HTTPPathMatch matches the path of a request
+type HTTPPathMatch struct {
+	// Type defines how the path is matched.
+	// +kubebuilder:default=Prefix
+	// +optional
+	Type PathMatchType `json:"type,omitempty"`
+
+	// Value is the path to match.
+	// +kubebuilder:validation:Pattern=`^/`
+	// +required
+	Value string `json:"value"`
+}
+
+// BackendRef references the backend requests are forwarded to.
+// Either a service or an URL must be set.
+// +kubebuilder:validation:XValidation:rule="has(self.url) != (has(self.service) && has(self.service.name))",message="either url or service must be set"
+// +kubebuilder:validation:XValidation:rule="has(self.url) || (has(self.service) && has(self.service.port))",message="service.port is required for a service backend"
+type BackendRef struct {
+	// Service is the kubernetes service requests are forwarded to.
+	// +optional
+	Service ServiceBackendRef `json:"service,omitzero"`
+
+	// URL of a backend outside the cluster, for example https://idp.example.com/auth.
+	// The scheme must be http or https, the path is prepended to the path of forwarded requests.
+	// +kubebuilder:validation:Pattern=`^https?://`
+	// +optional
+	URL string `json:"url,omitempty"`
+
+	// Protocol defines how the proxy connects to the backend.
+	// +optional
+	Protocol BackendProtocol `json:"protocol,omitzero"`
+
+	// Timeouts for requests forwarded to the backend.
+	// +optional
+	Timeouts *BackendTimeouts `json:"timeouts,omitempty"`
+
+	// Retries of idempotent requests which failed to connect to the backend.
+	// +optional
+	Retries *RetryPolicy `json:"retries,omitempty"`
+
+	// CircuitBreaker stops forwarding requests to a failing backend for a while.
+	// +optional
+	CircuitBreaker *CircuitBreakerPolicy `json:"circuitBreaker,omitempty"`
+}
+
+// ServiceBackendRef references a kubernetes service
+type ServiceBackendRef struct {
+	// Name of the service.
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// Namespace of the service, defaults to the namespace of the OAUTH2Proxy.
+	// A service in another namespace must be permitted by a ReferenceGrant in that namespace.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// Port of the service.
+	// ExternalName services without ports require a port number.
+	// +optional
+	Port ServiceBackendPort `json:"port,omitzero"`
+
+	// Routing defines how the service is addressed.
+	// ClusterIP forwards requests to the cluster IP of the service.
+	// Endpoints balances requests across the ready endpoints of the service, which also supports headless services.
+	// +kubebuilder:validation:Enum=ClusterIP;Endpoints
+	// +kubebuilder:default=ClusterIP
+	// +optional
+	Routing string `json:"routing,omitempty"`
+
+	// IPFamily selects the address family used to reach dual-stack services.
+	// Defaults to the primary IP family of the service.
+	// +kubebuilder:validation:Enum=IPv4;IPv6
+	// +optional
+	IPFamily string `json:"ipFamily,omitempty"`
+}
+
+// ServiceBackendPort references a port of a service by name or number
+// +kubebuilder:validation:XValidation:rule="has(self.name) != has(self.number)",message="either name or number must be set"
+type ServiceBackendPort struct {
+	// Name of the service port.
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// Number of the service port.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	Number int32 `json:"number,omitempty"`
+}
+
+// BackendProtocol defines how the proxy connects to the backend
+type BackendProtocol struct {
+	// Scheme used to connect to the backend.
+	// +kubebuilder:validation:Enum=http;https
+	// +kubebuilder:default=http
+	// +optional
+	Scheme string `json:"scheme,omitempty"`
+
+	// TLS configures the connection to the backend if the scheme is https.
+	// +optional
+	TLS BackendTLS `json:"tls,omitzero"`
+}
+
+// BackendTLS configures the TLS connection to the backend
+type BackendTLS struct {
+	// ServerName is used to verify the certificate presented by the backend.
+	// Defaults to the cluster local name of the service <name>.<namespace>.svc or the host of the URL.
+	// +optional
+	ServerName string `json:"serverName,omitempty"`
+
+	// CASecretRef references a Secret holding the CA bundle used to verify the backend in the key ca.crt.
+	// If not set the system roots are used.
+	// +optional
+	CASecretRef *LocalObjectReference `json:"caSecretRef,omitempty"`
+
+	// ClientCertSecretRef references a Secret of type kubernetes.io/tls holding a client certificate
+	// which is presented to the backend.
+	// +optional
+	ClientCertSecretRef *LocalObjectReference `json:"clientCertSecretRef,omitempty"`
+}
+
+// ListenerTLS configures the proxy listener
+type ListenerTLS struct {
+	// SecretRef references a Secret of type kubernetes.io/tls holding the certificate served by the proxy listener.
+	// +optional
+	SecretRef *LocalObjectReference `json:"secretRef,omitempty"`
+}
+
+// IngressTemplate configures the generated Ingress
+type IngressTemplate struct {
+	// IngressClassName is the class of the generated Ingress.
+	// +optional
+	IngressClassName *string `json:"ingressClassName,omitempty"`
+
+	// Annotations are set on the generated Ingress, for example to configure the ingress controller.
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// TLS terminates TLS for the host and the host of the redirectURI at the ingress controller.
+	// +optional
+	TLS *IngressTLS `json:"tls,omitempty"`
+}
+
+// IngressTLS configures TLS of the generated Ingress
+type IngressTLS struct {
+	// SecretRef references a Secret of type kubernetes.io/tls holding the certificate served by the ingress controller.
+	// +required
+	SecretRef LocalObjectReference `json:"secretRef"`
+}
+
+// GatewayReference references the parent Gateway of the generated HTTPRoutes
+type GatewayReference struct {
+	// Name of the Gateway.
+	// +required
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+
+	// Namespace of the Gateway, defaults to the namespace of the OAUTH2Proxy.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// SectionName is the name of the Gateway listener the HTTPRoutes attach to, all listeners if empty.
+	// +optional
+	SectionName string `json:"sectionName,omitempty"`
+}
+
+// BackendTimeouts defines the timeouts for requests forwarded to the backend
+type BackendTimeouts struct {
+	// Connect is the maximum time to establish a connection to the backend.
+	// +optional
+	Connect *metav1.Duration `json:"connect,omitempty"`
+
+	// ResponseHeader is the maximum time to wait for the response headers once the request has been sent.
+	// +optional
+	ResponseHeader *metav1.Duration `json:"responseHeader,omitempty"`
+
+	// Request is the maximum time for the whole request including reading the response body.
+	// +optional
+	Request *metav1.Duration `json:"request,omitempty"`
+}
+
+// RetryPolicy defines how requests which failed to connect are retried
+type RetryPolicy struct {
+	// Attempts is the number of retries after the first attempt.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=10
+	// +kubebuilder:default=2
+	// +optional
+	Attempts int32 `json:"attempts,omitempty"`
+
+	// Backoff is the time to wait before each retry.
+	// +optional
+	Backoff *metav1.Duration `json:"backoff,omitempty"`
+}
+
+// CircuitBreakerPolicy defines when the circuit breaker opens and how requests are answered while it is open
+type CircuitBreakerPolicy struct {
+	// ConsecutiveFailures is the number of consecutive failed requests which open the circuit breaker.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=5
+	// +optional
+	ConsecutiveFailures int32 `json:"consecutiveFailures,omitempty"`
+
+	// OpenDuration is the time the circuit breaker stays open before a trial request is forwarded.
+	// Defaults to 30s.
+	// +optional
+	OpenDuration *metav1.Duration `json:"openDuration,omitempty"`
+
+	// StatusCode is the status code returned while the circuit breaker is open.
+	// +kubebuilder:validation:Minimum=400
+	// +kubebuilder:validation:Maximum=599
+	// +kubebuilder:default=503
+	// +optional
+	StatusCode int32 `json:"statusCode,omitempty"`
+
+	// Body is the response body returned while the circuit breaker is open.
+	// +optional
+	Body string `json:"body,omitempty"`
+}
+
+// LocalObjectReference references an object in the same namespace
+type LocalObjectReference struct {
+	// +required
+	Name string `json:"name"`
+}
+
+const (
+	SchemeHTTP  = "http"
+	SchemeHTTPS = "https"
+)
+
+const (
+	RoutingClusterIP = "ClusterIP"
+	RoutingEndpoints = "Endpoints"
+)
+
+const (
+	IPFamilyIPv4 = "IPv4"
+	IPFamilyIPv6 = "IPv6"
+)
+
+// OAUTH2ProxyStatus defines the observed state of OAUTH2Proxy
+type OAUTH2ProxyStatus struct {
+	// Conditions holds the conditions for the VaultBinding.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// ObservedGeneration is the generation of the spec the status has been computed from.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Backend is the address requests are forwarded to.
+	// +optional
+	Backend *BackendStatus `json:"backend,omitempty"`
+
+	// RedirectURI is the redirect_uri the proxy rewrites authorization requests to.
+	// +optional
+	RedirectURI string `json:"redirectURI,omitempty"`
+
+	// LastRoutedTime is the last time the proxy routed a request for this OAUTH2Proxy.
+	// +optional
+	LastRoutedTime *metav1.Time `json:"lastRoutedTime,omitempty"`
+
+	// Stats are the requests routed by the proxy within a rolling window.
+	// +optional
+	Stats *RequestStats `json:"stats,omitempty"`
+}
+
+// RequestStats counts the requests routed by the proxy within a rolling window
+type RequestStats struct {
+	// Window is the duration the counts are aggregated over.
+	Window metav1.Duration `json:"window"`
+
+	// Rewrites is the number of authorization redirects whose redirect_uri has been rewritten.
+	Rewrites int64 `json:"rewrites"`
+
+	// Callbacks is the number of callbacks which have been redirected to the original redirect_uri.
+	Callbacks int64 `json:"callbacks"`
+}
+
+// BackendStatus describes the address requests are forwarded to
+type BackendStatus struct {
+	// Address is the cluster IP, the DNS name of an ExternalName service or the host of the URL.
+	// Unset if requests are balanced across endpoints.
+	// +optional
+	Address string `json:"address,omitempty"`
+
+	// Port is the port requests are forwarded to.
+	// Unset if requests are balanced across endpoints.
+	// +optional
+	Port int32 `json:"port,omitempty"`
+
+	// Endpoints are the ready endpoints requests are balanced across as host:port.
+	// +optional
+	Endpoints []string `json:"endpoints,omitempty"`
+}
+
+const (
+	ReadyCondition              = "Ready"
+	CircuitBreakerOpenCondition = "CircuitBreakerOpen"
+	// BackendResolvedCondition is true once the address requests are forwarded to has been resolved
+	BackendResolvedCondition = "BackendResolved"
+	// RegisteredCondition is true once the current spec is served by the proxy
+	RegisteredCondition = "Registered"
+	// ReconcilingCondition is true while the OAUTH2Proxy is being reconciled or waits for a retry
+	ReconcilingCondition = "Reconciling"
+	// StalledCondition is true if the OAUTH2Proxy can not be reconciled without changing it or the objects it references
+	StalledCondition = "Stalled"
+	// HTTPRouteAcceptedCondition mirrors the Accepted condition the Gateway reported for the generated HTTPRoutes
+	HTTPRouteAcceptedCondition = "HTTPRouteAccepted"
+	// HTTPRouteResolvedRefsCondition mirrors the ResolvedRefs condition the Gateway reported for the generated HTTPRoutes
+	HTTPRouteResolvedRefsCondition = "HTTPRouteResolvedRefs"
+	// RoutesGeneratedCondition is true once the Ingress or HTTPRoutes requested by the OAUTH2Proxy have been generated
+	RoutesGeneratedCondition = "RoutesGenerated"
+)
+
+const (
+	ServicePortNotFoundReason    = "ServicePortNotFound"
+	ServiceNotFoundReason        = "ServiceNotFound"
+	ServiceBackendReadyReason    = "ServiceBackendReady"
+	NoReadyEndpointsReason       = "NoReadyEndpoints"
+	IPFamilyNotAvailableReason   = "IPFamilyNotAvailable"
+	InvalidURLReason             = "InvalidURL"
+	URLNotResolvableReason       = "URLNotResolvable"
+	URLBackendReadyReason        = "URLBackendReady"
+	RefNotPermittedReason        = "RefNotPermitted"
+	HTTPRoutePendingReason       = "Pending"
+	SecretNotFoundReason         = "SecretNotFound"
+	InvalidTLSConfigReason       = "InvalidTLSConfig"
+	CircuitBreakerOpenReason     = "Open"
+	CircuitBreakerHalfOpenReason = "HalfOpen"
+	CircuitBreakerClosedReason   = "Closed"
+	BackendNotResolvedReason     = "BackendNotResolved"
+	ProxyRegisteredReason        = "ProxyRegistered"
+	ProgressingWithRetryReason   = "ProgressingWithRetry"
+)
+
+const (
+	RoutesGeneratedReason           = "RoutesGenerated"
+	ProxyServiceNotConfiguredReason = "ProxyServiceNotConfigured"
+	GenerateFailedReason            = "GenerateFailed"
+)
+
+// ConditionalResource is a resource with conditions
+type conditionalResource interface {
+	GetStatusConditions() *[]metav1.Condition
+	GetGeneration() int64
+}
+
+// setResourceCondition sets the given condition with the given status,
+// reason and message on a resource.
+// The condition is observed for the current generation of the resource.
+func setResourceCondition(resource conditionalResource, condition string, status metav1.ConditionStatus, reason, message string) {
+	conditions := resource.GetStatusConditions()
+
+	newCondition := metav1.Condition{
+		Type:               condition,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: resource.GetGeneration(),
+	}
+
+	apimeta.SetStatusCondition(conditions, newCondition)
+}
+
+// OAUTH2ProxyNotReady
+func OAUTH2ProxyNotReady(clone OAUTH2Proxy, reason, message string) OAUTH2Proxy {
+	setResourceCondition(&clone, ReadyCondition, metav1.ConditionFalse, reason, message)
+	return clone
+}
+
+// OAUTH2ProxyReady sets the Ready condition and removes the Reconciling and Stalled conditions
+func OAUTH2ProxyReady(clone OAUTH2Proxy, reason, message string) OAUTH2Proxy {
+	setResourceCondition(&clone, ReadyCondition, metav1.ConditionTrue, reason, message)
+	apimeta.RemoveStatusCondition(&clone.Status.Conditions, ReconcilingCondition)
+	apimeta.RemoveStatusCondition(&clone.Status.Conditions, StalledCondition)
+	return clone
+}
+
+// OAUTH2ProxyBackendResolved sets the BackendResolved condition
+func OAUTH2ProxyBackendResolved(clone OAUTH2Proxy, resolved bool, reason, message string) OAUTH2Proxy {
+	status := metav1.ConditionFalse
+	if resolved {
+		status = metav1.ConditionTrue
+	}
+
+	setResourceCondition(&clone, BackendResolvedCondition, status, reason, message)
+	return clone
+}
+
+// OAUTH2ProxyRegistered sets the Registered condition
+func OAUTH2ProxyRegistered(clone OAUTH2Proxy, registered bool, reason, message string) OAUTH2Proxy {
+	status := metav1.ConditionFalse
+	if registered {
+		status = metav1.ConditionTrue
+	}
+
+	setResourceCondition(&clone, RegisteredCondition, status, reason, message)
+	return clone
+}
+
+// OAUTH2ProxyReconciling sets the Reconciling condition and removes the Stalled condition
+func OAUTH2ProxyReconciling(clone OAUTH2Proxy, reason, message string) OAUTH2Proxy {
+	setResourceCondition(&clone, ReconcilingCondition, metav1.ConditionTrue, reason, message)
+	apimeta.RemoveStatusCondition(&clone.Status.Conditions, StalledCondition)
+	return clone
+}
+
+// OAUTH2ProxyStalled sets the Stalled condition and removes the Reconciling condition
+func OAUTH2ProxyStalled(clone OAUTH2Proxy, reason, message string) OAUTH2Proxy {
+	setResourceCondition(&clone, StalledCondition, metav1.ConditionTrue, reason, message)
+	apimeta.RemoveStatusCondition(&clone.Status.Conditions, ReconcilingCondition)
+	return clone
+}
+
+// OAUTH2ProxyCircuitBreaker sets the CircuitBreakerOpen condition
+func OAUTH2ProxyCircuitBreaker(clone OAUTH2Proxy, open bool, reason, message string) OAUTH2Proxy {
+	status := metav1.ConditionFalse
+	if open {
+		status = metav1.ConditionTrue
+	}
+
+	setResourceCondition(&clone, CircuitBreakerOpenCondition, status, reason, message)
+	return clone
+}
+
+// OAUTH2ProxyHTTPRouteCondition sets a condition mirrored from the status of the generated HTTPRoutes
+func OAUTH2ProxyHTTPRouteCondition(clone OAUTH2Proxy, condition string, status metav1.ConditionStatus, reason, message string) OAUTH2Proxy {
+	setResourceCondition(&clone, condition, status, reason, message)
+	return clone
+}
+
+// OAUTH2ProxyNoHTTPRoutes removes the conditions mirrored from the status of the generated HTTPRoutes
+func OAUTH2ProxyNoHTTPRoutes(clone OAUTH2Proxy) OAUTH2Proxy {
+	apimeta.RemoveStatusCondition(&clone.Status.Conditions, HTTPRouteAcceptedCondition)
+	apimeta.RemoveStatusCondition(&clone.Status.Conditions, HTTPRouteResolvedRefsCondition)
+	return clone
+}
+
+// OAUTH2ProxyRoutesGenerated sets the RoutesGenerated condition
+func OAUTH2ProxyRoutesGenerated(clone OAUTH2Proxy, generated bool, reason, message string) OAUTH2Proxy {
+	status := metav1.ConditionFalse
+	if generated {
+		status = metav1.ConditionTrue
+	}
+
+	setResourceCondition(&clone, RoutesGeneratedCondition, status, reason, message)
+	return clone
+}
+
+// OAUTH2ProxyNoRoutes removes the RoutesGenerated condition
+func OAUTH2ProxyNoRoutes(clone OAUTH2Proxy) OAUTH2Proxy {
+	apimeta.RemoveStatusCondition(&clone.Status.Conditions, RoutesGeneratedCondition)
+	return clone
+}
+
+// GetStatusConditions returns a pointer to the Status.Conditions slice
+func (in *OAUTH2Proxy) GetStatusConditions() *[]metav1.Condition {
+	return &in.Status.Conditions
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:storageversion
+// +kubebuilder:resource:shortName=rc
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status",description=""
+// +kubebuilder:printcolumn:name="Status",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].message",description=""
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp",description=""
+
+// OAUTH2Proxy is the Schema for the OAUTH2Proxys API
+type OAUTH2Proxy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   OAUTH2ProxySpec   `json:"spec,omitempty"`
+	Status OAUTH2ProxyStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// OAUTH2ProxyList contains a list of OAUTH2Proxy
+type OAUTH2ProxyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []OAUTH2Proxy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&OAUTH2Proxy{}, &OAUTH2ProxyList{})
+}
@@ -0,0 +1,208 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"encoding/json"
+
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	v1 "github.com/DoodleScheduling/oauth2-redirect-controller/api/v1"
+)
+
+// ConversionDataAnnotation holds the v1 fields of an OAUTH2Proxy which can not be represented in v1beta1.
+// It is restored once the OAUTH2Proxy is converted back to v1.
+const ConversionDataAnnotation = "oauth2.infra.doodle.com/conversion-data"
+
+// conversionData are the v1 fields which are lost in v1beta1
+type conversionData struct {
+	Paths      []v1.HTTPPathMatch   `json:"paths,omitempty"`
+	Ingress    *v1.IngressTemplate  `json:"ingress,omitempty"`
+	GatewayRef *v1.GatewayReference `json:"gatewayRef,omitempty"`
+}
+
+var _ conversion.Convertible = &OAUTH2Proxy{}
+
+// ConvertTo converts this OAUTH2Proxy to the hub version v1
+func (src *OAUTH2Proxy) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1.OAUTH2Proxy)
+
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	dst.Spec = v1.OAUTH2ProxySpec{
+		Host:        src.Spec.Host,
+		RedirectURI: src.Spec.RedirectURI,
+		Backend: v1.BackendRef{
+			Service: v1.ServiceBackendRef{
+				Name:      src.Spec.Backend.ServiceName,
+				Namespace: src.Spec.Backend.Namespace,
+				Port:      convertServicePortToV1(src.Spec.Backend.ServicePort),
+				Routing:   src.Spec.Backend.Routing,
+				IPFamily:  src.Spec.Backend.IPFamily,
+			},
+			URL: src.Spec.Backend.URL,
+			Protocol: v1.BackendProtocol{
+				Scheme: src.Spec.Backend.Scheme,
+				TLS: v1.BackendTLS{
+					ServerName:          src.Spec.Backend.ServerName,
+					CASecretRef:         (*v1.LocalObjectReference)(src.Spec.Backend.CASecretRef.DeepCopy()),
+					ClientCertSecretRef: (*v1.LocalObjectReference)(src.Spec.Backend.ClientCertSecretRef.DeepCopy()),
+				},
+			},
+			Timeouts:       (*v1.BackendTimeouts)(src.Spec.Backend.Timeouts.DeepCopy()),
+			Retries:        (*v1.RetryPolicy)(src.Spec.Backend.Retries.DeepCopy()),
+			CircuitBreaker: (*v1.CircuitBreakerPolicy)(src.Spec.Backend.CircuitBreaker.DeepCopy()),
+		},
+		TLS: v1.ListenerTLS{
+			SecretRef: (*v1.LocalObjectReference)(src.Spec.TLSSecretRef.DeepCopy()),
+		},
+	}
+
+	if src.Spec.Paths != nil {
+		dst.Spec.Paths = make([]v1.HTTPPathMatch, 0, len(src.Spec.Paths))
+		for _, path := range src.Spec.Paths {
+			dst.Spec.Paths = append(dst.Spec.Paths, v1.HTTPPathMatch{
+				Type:  v1.PathMatchPrefix,
+				Value: path,
+			})
+		}
+	}
+
+	dst.Status = v1.OAUTH2ProxyStatus{
+		Conditions:         src.Status.DeepCopy().Conditions,
+		ObservedGeneration: src.Status.ObservedGeneration,
+		Backend:            (*v1.BackendStatus)(src.Status.Backend.DeepCopy()),
+		RedirectURI:        src.Status.RedirectURI,
+		LastRoutedTime:     src.Status.LastRoutedTime.DeepCopy(),
+		Stats:              (*v1.RequestStats)(src.Status.Stats.DeepCopy()),
+	}
+
+	return restoreConversionData(dst)
+}
+
+// ConvertFrom converts the hub version v1 to this OAUTH2Proxy
+func (dst *OAUTH2Proxy) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1.OAUTH2Proxy)
+
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	dst.Spec = OAUTH2ProxySpec{
+		Host:        src.Spec.Host,
+		RedirectURI: src.Spec.RedirectURI,
+		Backend: ServiceSelector{
+			ServiceName:         src.Spec.Backend.Service.Name,
+			Namespace:           src.Spec.Backend.Service.Namespace,
+			ServicePort:         convertServicePortFromV1(src.Spec.Backend.Service.Port),
+			URL:                 src.Spec.Backend.URL,
+			Routing:             src.Spec.Backend.Service.Routing,
+			IPFamily:            src.Spec.Backend.Service.IPFamily,
+			Scheme:              src.Spec.Backend.Protocol.Scheme,
+			ServerName:          src.Spec.Backend.Protocol.TLS.ServerName,
+			CASecretRef:         (*LocalObjectReference)(src.Spec.Backend.Protocol.TLS.CASecretRef.DeepCopy()),
+			ClientCertSecretRef: (*LocalObjectReference)(src.Spec.Backend.Protocol.TLS.ClientCertSecretRef.DeepCopy()),
+			Timeouts:            (*BackendTimeouts)(src.Spec.Backend.Timeouts.DeepCopy()),
+			Retries:             (*RetryPolicy)(src.Spec.Backend.Retries.DeepCopy()),
+			CircuitBreaker:      (*CircuitBreakerPolicy)(src.Spec.Backend.CircuitBreaker.DeepCopy()),
+		},
+		TLSSecretRef: (*LocalObjectReference)(src.Spec.TLS.SecretRef.DeepCopy()),
+	}
+
+	lossy := src.Spec.Ingress != nil || src.Spec.GatewayRef != nil
+	if src.Spec.Paths != nil {
+		dst.Spec.Paths = make([]string, 0, len(src.Spec.Paths))
+		for _, path := range src.Spec.Paths {
+			dst.Spec.Paths = append(dst.Spec.Paths, path.Value)
+			lossy = lossy || path.Type != v1.PathMatchPrefix
+		}
+	}
+
+	dst.Status = OAUTH2ProxyStatus{
+		Conditions:         src.Status.DeepCopy().Conditions,
+		ObservedGeneration: src.Status.ObservedGeneration,
+		Backend:            (*BackendStatus)(src.Status.Backend.DeepCopy()),
+		RedirectURI:        src.Status.RedirectURI,
+		LastRoutedTime:     src.Status.LastRoutedTime.DeepCopy(),
+		Stats:              (*RequestStats)(src.Status.Stats.DeepCopy()),
+	}
+
+	if !lossy {
+		return nil
+	}
+
+	data, err := json.Marshal(conversionData{
+		Paths:      src.Spec.Paths,
+		Ingress:    src.Spec.Ingress,
+		GatewayRef: src.Spec.GatewayRef,
+	})
+	if err != nil {
+		return err
+	}
+
+	if dst.Annotations == nil {
+		dst.Annotations = make(map[string]string)
+	}
+
+	dst.Annotations[ConversionDataAnnotation] = string(data)
+	return nil
+}
+
+// restoreConversionData restores the v1 fields stored by ConvertFrom.
+// Path types are only restored as long as the paths were not changed in v1beta1.
+func restoreConversionData(dst *v1.OAUTH2Proxy) error {
+	raw, ok := dst.Annotations[ConversionDataAnnotation]
+	if !ok {
+		return nil
+	}
+
+	delete(dst.Annotations, ConversionDataAnnotation)
+	if len(dst.Annotations) == 0 {
+		dst.Annotations = nil
+	}
+
+	var data conversionData
+	if err := json.Unmarshal([]byte(raw), &data); err != nil {
+		return err
+	}
+
+	for i := range dst.Spec.Paths {
+		if i < len(data.Paths) && data.Paths[i].Value == dst.Spec.Paths[i].Value {
+			dst.Spec.Paths[i].Type = data.Paths[i].Type
+		}
+	}
+
+	dst.Spec.Ingress = data.Ingress
+	dst.Spec.GatewayRef = data.GatewayRef
+
+	return nil
+}
+
+// convertServicePortToV1 converts a port name or number to a v1 service port
+func convertServicePortToV1(port intstr.IntOrString) v1.ServiceBackendPort {
+	if port.Type == intstr.String {
+		return v1.ServiceBackendPort{Name: port.StrVal}
+	}
+
+	return v1.ServiceBackendPort{Number: port.IntVal}
+}
+
+// convertServicePortFromV1 converts a v1 service port to a port name or number
+func convertServicePortFromV1(port v1.ServiceBackendPort) intstr.IntOrString {
+	if port.Name != "" {
+		return intstr.FromString(port.Name)
+	}
+
+	return intstr.FromInt32(port.Number)
+}
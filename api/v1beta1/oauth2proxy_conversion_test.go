@@ -0,0 +1,141 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/diff"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/randfill"
+
+	v1 "github.com/DoodleScheduling/oauth2-redirect-controller/api/v1"
+)
+
+// fuzzFuncs only produce service ports which are valid in both versions.
+// A port with both a name and a number or an empty port name are rejected by the API server.
+var fuzzFuncs = []any{
+	func(port *intstr.IntOrString, c randfill.Continue) {
+		if c.Bool() {
+			*port = intstr.FromInt32(c.Int31())
+			return
+		}
+
+		*port = intstr.FromString("port-" + c.String(0))
+	},
+	func(port *v1.ServiceBackendPort, c randfill.Continue) {
+		if c.Bool() {
+			*port = v1.ServiceBackendPort{Number: c.Int31()}
+			return
+		}
+
+		*port = v1.ServiceBackendPort{Name: "port-" + c.String(0)}
+	},
+}
+
+func TestConvertRoundTrip(t *testing.T) {
+	for seed := int64(0); seed < 1000; seed++ {
+		filler := randfill.NewWithSeed(seed).NilChance(0.2).Funcs(fuzzFuncs...)
+		testSpokeRoundTrip(t, filler)
+		testHubRoundTrip(t, filler)
+	}
+}
+
+func FuzzConvertV1beta1RoundTrip(f *testing.F) {
+	f.Add([]byte("oauth2proxy"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		testSpokeRoundTrip(t, randfill.NewFromGoFuzz(data).NilChance(0.2).Funcs(fuzzFuncs...))
+	})
+}
+
+func FuzzConvertV1RoundTrip(f *testing.F) {
+	f.Add([]byte("oauth2proxy"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		testHubRoundTrip(t, randfill.NewFromGoFuzz(data).NilChance(0.2).Funcs(fuzzFuncs...))
+	})
+}
+
+// testSpokeRoundTrip converts a v1beta1 OAUTH2Proxy to v1 and back
+func testSpokeRoundTrip(t *testing.T, filler *randfill.Filler) {
+	t.Helper()
+	g := NewWithT(t)
+
+	src := &OAUTH2Proxy{}
+	filler.Fill(src)
+
+	hub := &v1.OAUTH2Proxy{}
+	g.Expect(src.ConvertTo(hub)).To(Succeed())
+
+	dst := &OAUTH2Proxy{}
+	g.Expect(dst.ConvertFrom(hub)).To(Succeed())
+
+	// TypeMeta is set by the conversion webhook
+	dst.TypeMeta = src.TypeMeta
+	g.Expect(apiequality.Semantic.DeepEqual(src, dst)).To(BeTrue(), "v1beta1 round trip changed the OAUTH2Proxy:\n%s", diff.Diff(src, dst))
+}
+
+// testHubRoundTrip converts a v1 OAUTH2Proxy to v1beta1 and back
+func testHubRoundTrip(t *testing.T, filler *randfill.Filler) {
+	t.Helper()
+	g := NewWithT(t)
+
+	src := &v1.OAUTH2Proxy{}
+	filler.Fill(src)
+
+	spoke := &OAUTH2Proxy{}
+	g.Expect(spoke.ConvertFrom(src)).To(Succeed())
+
+	dst := &v1.OAUTH2Proxy{}
+	g.Expect(spoke.ConvertTo(dst)).To(Succeed())
+
+	// TypeMeta is set by the conversion webhook
+	dst.TypeMeta = src.TypeMeta
+	g.Expect(apiequality.Semantic.DeepEqual(src, dst)).To(BeTrue(), "v1 round trip changed the OAUTH2Proxy:\n%s", diff.Diff(src, dst))
+}
+
+func TestConvertPathTypes(t *testing.T) {
+	g := NewWithT(t)
+
+	src := &v1.OAUTH2Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: "idp"},
+		Spec: v1.OAUTH2ProxySpec{
+			Paths: []v1.HTTPPathMatch{
+				{Type: v1.PathMatchExact, Value: "/callback"},
+				{Type: v1.PathMatchPrefix, Value: "/auth"},
+			},
+		},
+	}
+
+	spoke := &OAUTH2Proxy{}
+	g.Expect(spoke.ConvertFrom(src)).To(Succeed())
+	g.Expect(spoke.Spec.Paths).To(Equal([]string{"/callback", "/auth"}))
+	g.Expect(spoke.Annotations).To(HaveKey(ConversionDataAnnotation))
+
+	// A path changed in v1beta1 is a prefix
+	spoke.Spec.Paths[0] = "/login"
+
+	dst := &v1.OAUTH2Proxy{}
+	g.Expect(spoke.ConvertTo(dst)).To(Succeed())
+	g.Expect(dst.Annotations).To(BeNil())
+	g.Expect(dst.Spec.Paths).To(Equal([]v1.HTTPPathMatch{
+		{Type: v1.PathMatchPrefix, Value: "/login"},
+		{Type: v1.PathMatchPrefix, Value: "/auth"},
+	}))
+}
@@ -19,6 +19,7 @@ package v1beta1
 import (
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // OAUTH2ProxySpec defines the desired state of OAUTH2Proxy
@@ -34,25 +35,239 @@ type OAUTH2ProxySpec struct {
 
 	// +required
 	Backend ServiceSelector `json:"backend"`
+
+	// TLSSecretRef references a Secret of type kubernetes.io/tls holding the certificate served by the proxy listener
+	// for the host and the host of the redirectURI.
+	// +optional
+	TLSSecretRef *LocalObjectReference `json:"tlsSecretRef,omitempty"`
 }
 
+// ServiceSelector selects the backend requests are forwarded to.
+// Either a service or an URL must be set.
+// +kubebuilder:validation:XValidation:rule="has(self.url) != has(self.serviceName)",message="either url or serviceName must be set"
+// +kubebuilder:validation:XValidation:rule="has(self.url) || has(self.servicePort)",message="servicePort is required for a service backend"
 type ServiceSelector struct {
-	ServiceName string `json:"serviceName"`
-	ServicePort string `json:"servicePort"`
+	// ServiceName is the name of the backend service.
+	// +optional
+	ServiceName string `json:"serviceName,omitempty"`
+
+	// Namespace of the backend service, defaults to the namespace of the OAUTH2Proxy.
+	// A service in another namespace must be permitted by a ReferenceGrant in that namespace.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// ServicePort is the name or number of the service port.
+	// ExternalName services without ports require a port number.
+	// +kubebuilder:validation:XIntOrString
+	// +optional
+	ServicePort intstr.IntOrString `json:"servicePort,omitzero"`
+
+	// URL of a backend outside the cluster, for example https://idp.example.com/auth.
+	// The scheme must be http or https, the path is prepended to the path of forwarded requests.
+	// The routing, ipFamily and scheme options do not apply to URL backends.
+	// +kubebuilder:validation:Pattern=`^https?://`
+	// +optional
+	URL string `json:"url,omitempty"`
+
+	// Routing defines how the backend service is addressed.
+	// ClusterIP forwards requests to the cluster IP of the service.
+	// Endpoints balances requests across the ready endpoints of the service, which also supports headless services.
+	// +kubebuilder:validation:Enum=ClusterIP;Endpoints
+	// +kubebuilder:default=ClusterIP
+	// +optional
+	Routing string `json:"routing,omitempty"`
+
+	// IPFamily selects the address family used to reach dual-stack services.
+	// Defaults to the primary IP family of the service.
+	// +kubebuilder:validation:Enum=IPv4;IPv6
+	// +optional
+	IPFamily string `json:"ipFamily,omitempty"`
+
+	// Scheme used to connect to the backend service.
+	// +kubebuilder:validation:Enum=http;https
+	// +kubebuilder:default=http
+	// +optional
+	Scheme string `json:"scheme,omitempty"`
+
+	// ServerName is used to verify the certificate presented by the backend.
+	// Defaults to the cluster local name of the service <serviceName>.<namespace>.svc or the host of the URL.
+	// Only used if the scheme is https.
+	// +optional
+	ServerName string `json:"serverName,omitempty"`
+
+	// CASecretRef references a Secret holding the CA bundle used to verify the backend in the key ca.crt.
+	// If not set the system roots are used.
+	// Only used if the scheme is https.
+	// +optional
+	CASecretRef *LocalObjectReference `json:"caSecretRef,omitempty"`
+
+	// ClientCertSecretRef references a Secret of type kubernetes.io/tls holding a client certificate
+	// which is presented to the backend.
+	// Only used if the scheme is https.
+	// +optional
+	ClientCertSecretRef *LocalObjectReference `json:"clientCertSecretRef,omitempty"`
+
+	// Timeouts for requests forwarded to the backend.
+	// +optional
+	Timeouts *BackendTimeouts `json:"timeouts,omitempty"`
+
+	// Retries of idempotent requests which failed to connect to the backend.
+	// +optional
+	Retries *RetryPolicy `json:"retries,omitempty"`
+
+	// CircuitBreaker stops forwarding requests to a failing backend for a while.
+	// +optional
+	CircuitBreaker *CircuitBreakerPolicy `json:"circuitBreaker,omitempty"`
+}
+
+// BackendTimeouts defines the timeouts for requests forwarded to the backend
+type BackendTimeouts struct {
+	// Connect is the maximum time to establish a connection to the backend.
+	// +optional
+	Connect *metav1.Duration `json:"connect,omitempty"`
+
+	// ResponseHeader is the maximum time to wait for the response headers once the request has been sent.
+	// +optional
+	ResponseHeader *metav1.Duration `json:"responseHeader,omitempty"`
+
+	// Request is the maximum time for the whole request including reading the response body.
+	// +optional
+	Request *metav1.Duration `json:"request,omitempty"`
+}
+
+// RetryPolicy defines how requests which failed to connect are retried
+type RetryPolicy struct {
+	// Attempts is the number of retries after the first attempt.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=10
+	// +kubebuilder:default=2
+	// +optional
+	Attempts int32 `json:"attempts,omitempty"`
+
+	// Backoff is the time to wait before each retry.
+	// +optional
+	Backoff *metav1.Duration `json:"backoff,omitempty"`
+}
+
+// CircuitBreakerPolicy defines when the circuit breaker opens and how requests are answered while it is open
+type CircuitBreakerPolicy struct {
+	// ConsecutiveFailures is the number of consecutive failed requests which open the circuit breaker.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=5
+	// +optional
+	ConsecutiveFailures int32 `json:"consecutiveFailures,omitempty"`
+
+	// OpenDuration is the time the circuit breaker stays open before a trial request is forwarded.
+	// Defaults to 30s.
+	// +optional
+	OpenDuration *metav1.Duration `json:"openDuration,omitempty"`
+
+	// StatusCode is the status code returned while the circuit breaker is open.
+	// +kubebuilder:validation:Minimum=400
+	// +kubebuilder:validation:Maximum=599
+	// +kubebuilder:default=503
+	// +optional
+	StatusCode int32 `json:"statusCode,omitempty"`
+
+	// Body is the response body returned while the circuit breaker is open.
+	// +optional
+	Body string `json:"body,omitempty"`
 }
 
+// LocalObjectReference references an object in the same namespace
+type LocalObjectReference struct {
+	// +required
+	Name string `json:"name"`
+}
+
+const (
+	SchemeHTTP  = "http"
+	SchemeHTTPS = "https"
+)
+
+const (
+	RoutingClusterIP = "ClusterIP"
+	RoutingEndpoints = "Endpoints"
+)
+
+const (
+	IPFamilyIPv4 = "IPv4"
+	IPFamilyIPv6 = "IPv6"
+)
+
 // OAUTH2ProxyStatus defines the observed state of OAUTH2Proxy
 type OAUTH2ProxyStatus struct {
 	// Conditions holds the conditions for the VaultBinding.
 	// +optional
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// ObservedGeneration is the generation of the spec the status has been computed from.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Backend is the address requests are forwarded to.
+	// +optional
+	Backend *BackendStatus `json:"backend,omitempty"`
+
+	// RedirectURI is the redirect_uri the proxy rewrites authorization requests to.
+	// +optional
+	RedirectURI string `json:"redirectURI,omitempty"`
+
+	// LastRoutedTime is the last time the proxy routed a request for this OAUTH2Proxy.
+	// +optional
+	LastRoutedTime *metav1.Time `json:"lastRoutedTime,omitempty"`
+
+	// Stats are the requests routed by the proxy within a rolling window.
+	// +optional
+	Stats *RequestStats `json:"stats,omitempty"`
+}
+
+// RequestStats counts the requests routed by the proxy within a rolling window
+type RequestStats struct {
+	// Window is the duration the counts are aggregated over.
+	Window metav1.Duration `json:"window"`
+
+	// Rewrites is the number of authorization redirects whose redirect_uri has been rewritten.
+	Rewrites int64 `json:"rewrites"`
+
+	// Callbacks is the number of callbacks which have been redirected to the original redirect_uri.
+	Callbacks int64 `json:"callbacks"`
+}
+
+// BackendStatus describes the address requests are forwarded to
+type BackendStatus struct {
+	// Address is the cluster IP, the DNS name of an ExternalName service or the host of the URL.
+	// Unset if requests are balanced across endpoints.
+	// +optional
+	Address string `json:"address,omitempty"`
+
+	// Port is the port requests are forwarded to.
+	// Unset if requests are balanced across endpoints.
+	// +optional
+	Port int32 `json:"port,omitempty"`
+
+	// Endpoints are the ready endpoints requests are balanced across as host:port.
+	// +optional
+	Endpoints []string `json:"endpoints,omitempty"`
 }
 
 const (
-	ReadyCondition            = "Ready"
-	ServicePortNotFoundReason = "ServicePortNotFound"
-	ServiceNotFoundReason     = "ServiceNotFound"
-	ServiceBackendReadyReason = "ServiceBackendReady"
+	ReadyCondition               = "Ready"
+	CircuitBreakerOpenCondition  = "CircuitBreakerOpen"
+	ServicePortNotFoundReason    = "ServicePortNotFound"
+	ServiceNotFoundReason        = "ServiceNotFound"
+	ServiceBackendReadyReason    = "ServiceBackendReady"
+	NoReadyEndpointsReason       = "NoReadyEndpoints"
+	IPFamilyNotAvailableReason   = "IPFamilyNotAvailable"
+	InvalidURLReason             = "InvalidURL"
+	URLNotResolvableReason       = "URLNotResolvable"
+	URLBackendReadyReason        = "URLBackendReady"
+	RefNotPermittedReason        = "RefNotPermitted"
+	SecretNotFoundReason         = "SecretNotFound"
+	InvalidTLSConfigReason       = "InvalidTLSConfig"
+	CircuitBreakerOpenReason     = "Open"
+	CircuitBreakerHalfOpenReason = "HalfOpen"
+	CircuitBreakerClosedReason   = "Closed"
 )
 
 // ConditionalResource is a resource with conditions
@@ -87,6 +302,17 @@ func OAUTH2ProxyReady(clone OAUTH2Proxy, reason, message string) OAUTH2Proxy {
 	return clone
 }
 
+// OAUTH2ProxyCircuitBreaker sets the CircuitBreakerOpen condition
+func OAUTH2ProxyCircuitBreaker(clone OAUTH2Proxy, open bool, reason, message string) OAUTH2Proxy {
+	status := metav1.ConditionFalse
+	if open {
+		status = metav1.ConditionTrue
+	}
+
+	setResourceCondition(&clone, CircuitBreakerOpenCondition, status, reason, message)
+	return clone
+}
+
 // GetStatusConditions returns a pointer to the Status.Conditions slice
 func (in *OAUTH2Proxy) GetStatusConditions() *[]metav1.Condition {
 	return &in.Status.Conditions
@@ -94,6 +320,7 @@ func (in *OAUTH2Proxy) GetStatusConditions() *[]metav1.Condition {
 
 // +kubebuilder:object:root=true
 // +kubebuilder:resource:shortName=rc
+// +kubebuilder:deprecatedversion:warning="oauth2.infra.doodle.com/v1beta1 OAUTH2Proxy is deprecated, use oauth2.infra.doodle.com/v1"
 // +kubebuilder:subresource:status
 // +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status",description=""
 // +kubebuilder:printcolumn:name="Status",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].message",description=""
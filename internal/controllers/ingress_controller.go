@@ -14,22 +14,21 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch
-// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
-// +kubebuilder:rbac:groups=oauth2.infra.doodle.com,resources=oauth2proxies,verbs=get;list;watch;create;update;patch;delete
-// +kubebuilder:rbac:groups=oauth2.infra.doodle.com,resources=oauth2proxies/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch
 
 package controllers
 
 import (
 	"context"
 	"fmt"
+	"net/url"
+	"strings"
+	"sync"
 
 	"github.com/go-logr/logr"
 	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -37,44 +36,62 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
-	v1beta1 "github.com/DoodleScheduling/oauth2-redirect-controller/api/v1beta1"
+	infrav1 "github.com/DoodleScheduling/oauth2-redirect-controller/api/v1"
 	"github.com/DoodleScheduling/oauth2-redirect-controller/internal/proxy"
 )
 
+const ingressServiceIndex = ".metadata.ingressService"
+
+// Event reasons recorded on Ingresses
 const (
-	serviceIndex = ".metadata.service"
+	invalidAnnotationReason = "InvalidAnnotation"
+	unsupportedHostReason   = "UnsupportedHost"
+	noServiceBackendReason  = "NoServiceBackend"
+	ingressRegisteredReason = "Registered"
 )
 
-// OAUTH2Proxy reconciles a OAUTH2Proxy object
-type OAUTH2ProxyReconciler struct {
+// ingressRegistrationPrefix prefixes the names of the keys hosts of Ingresses are registered with
+const ingressRegistrationPrefix = "Ingress"
+
+// IngressReconciler registers the hosts of Ingresses annotated with IngressRedirectURIAnnotation
+type IngressReconciler struct {
 	client.Client
 	HttpProxy *proxy.HttpProxy
 	Log       logr.Logger
-	Scheme    *runtime.Scheme
 	Recorder  record.EventRecorder
+
+	mutex sync.Mutex
+	// registered are the registrations of each Ingress
+	registered map[client.ObjectKey][]client.ObjectKey
 }
 
-type OAUTH2ProxyReconcilerOptions struct {
+type IngressReconcilerOptions struct {
 	MaxConcurrentReconciles int
 }
 
 // SetupWithManager adding controllers
-func (r *OAUTH2ProxyReconciler) SetupWithManager(mgr ctrl.Manager, opts OAUTH2ProxyReconcilerOptions) error {
-	// Index the ReqeustClones by the Service references they point at
-	if err := mgr.GetFieldIndexer().IndexField(context.TODO(), &v1beta1.OAUTH2Proxy{}, serviceIndex,
+func (r *IngressReconciler) SetupWithManager(mgr ctrl.Manager, opts IngressReconcilerOptions) error {
+	// Index the annotated Ingresses by the Services they route to
+	if err := mgr.GetFieldIndexer().IndexField(context.TODO(), &networkingv1.Ingress{}, ingressServiceIndex,
 		func(o client.Object) []string {
-			vb := o.(*v1beta1.OAUTH2Proxy)
-			r.Log.Info(fmt.Sprintf("%s/%s", vb.GetNamespace(), vb.Spec.Backend.ServiceName))
-			return []string{
-				fmt.Sprintf("%s/%s", vb.GetNamespace(), vb.Spec.Backend.ServiceName),
+			ing := o.(*networkingv1.Ingress)
+			if _, ok := ing.GetAnnotations()[infrav1.IngressRedirectURIAnnotation]; !ok {
+				return nil
 			}
+
+			var services []string
+			for _, backend := range ingressBackends(ing) {
+				services = append(services, fmt.Sprintf("%s/%s", ing.GetNamespace(), backend.Name))
+			}
+
+			return services
 		},
 	); err != nil {
 		return err
 	}
 
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&v1beta1.OAUTH2Proxy{}).
+		For(&networkingv1.Ingress{}).
 		Watches(
 			&v1.Service{},
 			handler.EnqueueRequestsFromMapFunc(r.requestsForServiceChange),
@@ -83,117 +100,278 @@ func (r *OAUTH2ProxyReconciler) SetupWithManager(mgr ctrl.Manager, opts OAUTH2Pr
 		Complete(r)
 }
 
-func (r *OAUTH2ProxyReconciler) requestsForServiceChange(ctx context.Context, o client.Object) []reconcile.Request {
+func (r *IngressReconciler) requestsForServiceChange(ctx context.Context, o client.Object) []reconcile.Request {
 	s, ok := o.(*v1.Service)
 	if !ok {
 		panic(fmt.Sprintf("expected a Service, got %T", o))
 	}
 
-	var list v1beta1.OAUTH2ProxyList
+	var list networkingv1.IngressList
 	if err := r.List(ctx, &list, client.MatchingFields{
-		serviceIndex: objectKey(s).String(),
+		ingressServiceIndex: objectKey(s).String(),
 	}); err != nil {
 		return nil
 	}
 
 	var reqs []reconcile.Request
 	for _, i := range list.Items {
-		r.Log.Info("referenced service from a oauth2proxy changed detected, reconcile oauth2proxy", "namespace", i.GetNamespace(), "name", i.GetName())
+		r.Log.Info("referenced service from an ingress changed detected, reconcile ingress", "namespace", i.GetNamespace(), "name", i.GetName())
 		reqs = append(reqs, reconcile.Request{NamespacedName: objectKey(&i)})
 	}
 
 	return reqs
 }
 
-// Reconcile OAUTH2Proxys
-func (r *OAUTH2ProxyReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	logger := r.Log.WithValues("Namespace", req.Namespace, "Name", req.NamespacedName)
-	logger.Info("reconciling OAUTH2Proxy")
-
-	// Fetch the OAUTH2Proxy instance
-	ph := v1beta1.OAUTH2Proxy{}
-
-	err := r.Get(ctx, req.NamespacedName, &ph)
+// Reconcile Ingresses
+func (r *IngressReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	ing := networkingv1.Ingress{}
+	err := r.Get(ctx, req.NamespacedName, &ing)
 	if err != nil {
 		if errors.IsNotFound(err) {
-			// Request object not found, could have been deleted after reconcile request.
-			// Owned objects are automatically garbage collected. For additional cleanup logic use finalizers.
-			// Return and don't requeue
+			r.register(req.NamespacedName, nil)
 			return reconcile.Result{}, nil
 		}
-		// Error reading the object - requeue the request.
+
 		return reconcile.Result{}, err
 	}
 
-	ph, result, reconcileErr := r.reconcile(ctx, ph)
+	// Ingresses which are not annotated are ignored, the hosts of Ingresses which are not annotated anymore are unregistered
+	if _, ok := ing.GetAnnotations()[infrav1.IngressRedirectURIAnnotation]; !ok || !ing.GetDeletionTimestamp().IsZero() {
+		r.register(req.NamespacedName, nil)
+		return reconcile.Result{}, nil
+	}
 
-	// Update status after reconciliation.
-	if err = r.patchStatus(ctx, &ph); err != nil {
-		logger.Error(err, "unable to update status after reconciliation")
-		return ctrl.Result{Requeue: true}, err
+	logger := r.Log.WithValues("Namespace", req.Namespace, "Name", req.NamespacedName)
+	logger.Info("reconciling Ingress")
+
+	registrations, err := r.reconcile(ctx, ing)
+	if err != nil {
+		return reconcile.Result{}, err
 	}
 
-	return result, reconcileErr
+	if r.register(req.NamespacedName, registrations) && len(registrations) > 0 {
+		var hosts []string
+		for _, registration := range registrations {
+			hosts = append(hosts, registration.Host)
+		}
+
+		r.Recorder.Event(&ing, v1.EventTypeNormal, ingressRegisteredReason, fmt.Sprintf("Registered hosts %s", strings.Join(hosts, ", ")))
+	}
+
+	return reconcile.Result{}, nil
 }
 
-func (r *OAUTH2ProxyReconciler) reconcile(ctx context.Context, ph v1beta1.OAUTH2Proxy) (v1beta1.OAUTH2Proxy, ctrl.Result, error) {
-	// Lookup matching service
-	svc := v1.Service{}
-	err := r.Get(ctx, client.ObjectKey{
-		Namespace: ph.GetNamespace(),
-		Name:      ph.Spec.Backend.ServiceName,
-	}, &svc)
+// reconcile returns the registrations for the hosts of an annotated Ingress.
+// Problems are recorded as Warning events on the Ingress, hosts which can not be served are skipped.
+func (r *IngressReconciler) reconcile(ctx context.Context, ing networkingv1.Ingress) ([]*proxy.OAUTH2Proxy, error) {
+	redirectURI := ing.GetAnnotations()[infrav1.IngressRedirectURIAnnotation]
+	if u, err := url.Parse(redirectURI); err != nil || u.Host == "" {
+		r.Recorder.Event(&ing, v1.EventTypeWarning, invalidAnnotationReason, fmt.Sprintf("Annotation %s must be an absolute URL", infrav1.IngressRedirectURIAnnotation))
+		return nil, nil
+	}
 
+	paths, err := ingressPaths(ing.GetAnnotations()[infrav1.IngressPathsAnnotation])
 	if err != nil {
-		msg := "Service not found"
-		r.Recorder.Event(&ph, "Normal", "info", msg)
-		return v1beta1.OAUTH2ProxyNotReady(ph, v1beta1.ServiceNotFoundReason, msg), ctrl.Result{}, nil
+		r.Recorder.Event(&ing, v1.EventTypeWarning, invalidAnnotationReason, err.Error())
+		return nil, nil
 	}
 
-	var port int32
-	for _, p := range svc.Spec.Ports {
-		if p.Name == ph.Spec.Backend.ServicePort {
-			port = p.Port
+	var registrations []*proxy.OAUTH2Proxy
+	seen := make(map[string]struct{})
+
+	for _, rule := range ing.Spec.Rules {
+		if _, ok := seen[rule.Host]; ok {
+			continue
+		}
+
+		seen[rule.Host] = struct{}{}
+
+		if rule.Host == "" || strings.HasPrefix(rule.Host, "*") {
+			r.Recorder.Event(&ing, v1.EventTypeWarning, unsupportedHostReason, fmt.Sprintf("Rule host %q is not supported, a fully qualified host is required", rule.Host))
+			continue
+		}
+
+		backend := ruleBackend(ing, rule)
+		if backend == nil {
+			r.Recorder.Event(&ing, v1.EventTypeWarning, noServiceBackendReason, fmt.Sprintf("Rule for host %s has no service backend", rule.Host))
+			continue
+		}
+
+		address, port, reason, err := r.resolveBackend(ctx, ing.GetNamespace(), *backend)
+		if err != nil {
+			if reason == "" {
+				return nil, err
+			}
+
+			r.Recorder.Event(&ing, v1.EventTypeWarning, reason, fmt.Sprintf("Backend for host %s: %s", rule.Host, err))
+			continue
 		}
+
+		registrations = append(registrations, &proxy.OAUTH2Proxy{
+			Host:        rule.Host,
+			Service:     address,
+			Port:        port,
+			Paths:       paths,
+			RedirectURI: redirectURI,
+			Object:      ingressRegistrationKey(ing, rule.Host),
+		})
 	}
 
-	if port == 0 {
-		msg := "Port not found in service"
-		r.Recorder.Event(&ph, "Normal", "info", msg)
-		return v1beta1.OAUTH2ProxyNotReady(ph, v1beta1.ServicePortNotFoundReason, msg), ctrl.Result{}, nil
+	return registrations, nil
+}
+
+// resolveBackend returns the address and port of an Ingress service backend.
+// If the backend can not be resolved the event reason is returned alongside the error, no reason is returned for errors which are retried.
+func (r *IngressReconciler) resolveBackend(ctx context.Context, namespace string, backend networkingv1.IngressServiceBackend) (string, int32, string, error) {
+	svc := v1.Service{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: namespace, Name: backend.Name}, &svc); err != nil {
+		if errors.IsNotFound(err) {
+			return "", 0, infrav1.ServiceNotFoundReason, fmt.Errorf("service %s not found", backend.Name)
+		}
+
+		return "", 0, "", err
 	}
 
-	_ = r.HttpProxy.RegisterOrUpdate(&proxy.OAUTH2Proxy{
-		Host:        ph.Spec.Host,
-		Service:     svc.Spec.ClusterIP,
-		Paths:       ph.Spec.Paths,
-		RedirectURI: ph.Spec.RedirectURI,
-		Port:        port,
-		Object: client.ObjectKey{
-			Namespace: ph.GetNamespace(),
-			Name:      ph.GetName(),
-		},
+	port, ok := servicePort(svc, infrav1.ServiceBackendPort{
+		Name:   backend.Port.Name,
+		Number: backend.Port.Number,
 	})
+	if !ok {
+		return "", 0, infrav1.ServicePortNotFoundReason, fmt.Errorf("port not found in service %s", backend.Name)
+	}
 
-	msg := "Service backend successfully registered"
-	r.Recorder.Event(&ph, "Normal", "info", msg)
-	return v1beta1.OAUTH2ProxyReady(ph, v1beta1.ServiceBackendReadyReason, msg), ctrl.Result{}, err
+	if svc.Spec.Type == v1.ServiceTypeExternalName {
+		return svc.Spec.ExternalName, port.Port, "", nil
+	}
+
+	address := serviceClusterIP(svc, ipFamily(svc, ""))
+	if address == "" {
+		return "", 0, infrav1.IPFamilyNotAvailableReason, fmt.Errorf("service %s has no cluster IP", backend.Name)
+	}
+
+	return address, port.Port, "", nil
 }
 
-func (r *OAUTH2ProxyReconciler) patchStatus(ctx context.Context, ph *v1beta1.OAUTH2Proxy) error {
-	key := client.ObjectKeyFromObject(ph)
-	latest := &v1beta1.OAUTH2Proxy{}
-	if err := r.Get(ctx, key, latest); err != nil {
-		return err
+// register replaces the registrations of an Ingress.
+// It returns true if the registered hosts changed.
+func (r *IngressReconciler) register(ing client.ObjectKey, registrations []*proxy.OAUTH2Proxy) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.registered == nil {
+		r.registered = make(map[client.ObjectKey][]client.ObjectKey)
+	}
+
+	keys := make([]client.ObjectKey, 0, len(registrations))
+	for _, registration := range registrations {
+		_ = r.HttpProxy.RegisterOrUpdate(registration)
+		keys = append(keys, registration.Object)
+	}
+
+	previous := r.registered[ing]
+	for _, key := range previous {
+		if !containsKey(keys, key) {
+			_ = r.HttpProxy.Unregister(key)
+		}
 	}
 
-	return r.Status().Patch(ctx, ph, client.MergeFrom(latest))
+	if len(keys) == 0 {
+		delete(r.registered, ing)
+	} else {
+		r.registered[ing] = keys
+	}
+
+	if len(keys) != len(previous) {
+		return true
+	}
+
+	for _, key := range keys {
+		if !containsKey(previous, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsKey(keys []client.ObjectKey, key client.ObjectKey) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
 }
 
-// objectKey returns client.ObjectKey for the object.
-func objectKey(object metav1.Object) client.ObjectKey {
+// ingressRegistrationKey returns the key a host of an Ingress is registered with.
+// The name contains slashes, so it never conflicts with the key of an OAUTH2Proxy.
+func ingressRegistrationKey(ing networkingv1.Ingress, host string) client.ObjectKey {
 	return client.ObjectKey{
-		Namespace: object.GetNamespace(),
-		Name:      object.GetName(),
+		Namespace: ing.GetNamespace(),
+		Name:      fmt.Sprintf("%s/%s/%s", ingressRegistrationPrefix, ing.GetName(), host),
+	}
+}
+
+// isIngressRegistration returns true if the key was returned by ingressRegistrationKey
+func isIngressRegistration(key client.ObjectKey) bool {
+	return strings.HasPrefix(key.Name, ingressRegistrationPrefix+"/")
+}
+
+// ingressPaths parses the paths annotation, all paths are matched as prefixes
+func ingressPaths(annotation string) ([]proxy.PathMatch, error) {
+	if strings.TrimSpace(annotation) == "" {
+		return []proxy.PathMatch{{Path: "/"}}, nil
 	}
+
+	var paths []proxy.PathMatch
+	for _, path := range strings.Split(annotation, ",") {
+		path = strings.TrimSpace(path)
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("annotation %s contains path %q which does not start with /", infrav1.IngressPathsAnnotation, path)
+		}
+
+		paths = append(paths, proxy.PathMatch{Path: path})
+	}
+
+	return paths, nil
+}
+
+// ruleBackend returns the service backend of the first path of a rule, or the default backend of the Ingress
+func ruleBackend(ing networkingv1.Ingress, rule networkingv1.IngressRule) *networkingv1.IngressServiceBackend {
+	if rule.HTTP != nil {
+		for _, path := range rule.HTTP.Paths {
+			if path.Backend.Service != nil {
+				return path.Backend.Service
+			}
+		}
+	}
+
+	if ing.Spec.DefaultBackend != nil {
+		return ing.Spec.DefaultBackend.Service
+	}
+
+	return nil
+}
+
+// ingressBackends returns the service backends of all rules of an Ingress
+func ingressBackends(ing *networkingv1.Ingress) []networkingv1.IngressServiceBackend {
+	var backends []networkingv1.IngressServiceBackend
+	seen := make(map[string]struct{})
+
+	for _, rule := range ing.Spec.Rules {
+		backend := ruleBackend(*ing, rule)
+		if backend == nil {
+			continue
+		}
+
+		if _, ok := seen[backend.Name]; ok {
+			continue
+		}
+
+		seen[backend.Name] = struct{}{}
+		backends = append(backends, *backend)
+	}
+
+	return backends
 }
@@ -0,0 +1,170 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	infrav1 "github.com/DoodleScheduling/oauth2-redirect-controller/api/v1"
+	"github.com/DoodleScheduling/oauth2-redirect-controller/internal/proxy"
+)
+
+func TestIngressPaths(t *testing.T) {
+	g := NewWithT(t)
+
+	paths, err := ingressPaths("")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(paths).To(Equal([]proxy.PathMatch{{Path: "/"}}))
+
+	paths, err = ingressPaths("/auth, /login")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(paths).To(Equal([]proxy.PathMatch{{Path: "/auth"}, {Path: "/login"}}))
+
+	_, err = ingressPaths("/auth,login")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestReconcileIngress(t *testing.T) {
+	g := NewWithT(t)
+
+	rule := func(host, service string) networkingv1.IngressRule {
+		return networkingv1.IngressRule{
+			Host: host,
+			IngressRuleValue: networkingv1.IngressRuleValue{
+				HTTP: &networkingv1.HTTPIngressRuleValue{
+					Paths: []networkingv1.HTTPIngressPath{
+						{
+							Path: "/",
+							Backend: networkingv1.IngressBackend{
+								Service: &networkingv1.IngressServiceBackend{
+									Name: service,
+									Port: networkingv1.ServiceBackendPort{Name: "http"},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	ing := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "idp",
+			Namespace: "default",
+			Annotations: map[string]string{
+				infrav1.IngressRedirectURIAnnotation: "https://oauth2proxy",
+				infrav1.IngressPathsAnnotation:       "/auth",
+			},
+		},
+		Spec: networkingv1.IngressSpec{
+			Rules: []networkingv1.IngressRule{
+				rule("idp.example.com", "idp"),
+				rule("missing.example.com", "missing"),
+				rule("*.example.com", "idp"),
+			},
+		},
+	}
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "idp", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.1",
+			Ports: []v1.ServicePort{
+				{Name: "http", Port: 80},
+			},
+		},
+	}
+
+	c := fake.NewClientBuilder().WithObjects(ing, svc).Build()
+	recorder := record.NewFakeRecorder(10)
+	httpProxy := proxy.New(logr.Discard(), nil)
+
+	r := &IngressReconciler{
+		Client:    c,
+		HttpProxy: httpProxy,
+		Log:       logr.Discard(),
+		Recorder:  recorder,
+	}
+
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ing)}
+	_, err := r.Reconcile(context.Background(), req)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	key := client.ObjectKey{Namespace: "default", Name: "Ingress/idp/idp.example.com"}
+	g.Expect(httpProxy.Stats()).To(HaveLen(1))
+	g.Expect(httpProxy.Stats()).To(HaveKey(key))
+
+	g.Expect(<-recorder.Events).To(Equal("Warning ServiceNotFound Backend for host missing.example.com: service missing not found"))
+	g.Expect(<-recorder.Events).To(HavePrefix("Warning UnsupportedHost "))
+	g.Expect(<-recorder.Events).To(Equal("Normal Registered Registered hosts idp.example.com"))
+
+	// Unchanged registrations are not recorded again
+	_, err = r.Reconcile(context.Background(), req)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(<-recorder.Events).To(HavePrefix("Warning ServiceNotFound "))
+	g.Expect(<-recorder.Events).To(HavePrefix("Warning UnsupportedHost "))
+	g.Expect(recorder.Events).To(BeEmpty())
+
+	// Removing the annotation unregisters the hosts
+	delete(ing.Annotations, infrav1.IngressRedirectURIAnnotation)
+	g.Expect(c.Update(context.Background(), ing)).To(Succeed())
+
+	_, err = r.Reconcile(context.Background(), req)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(httpProxy.Stats()).To(BeEmpty())
+}
+
+func TestReconcileIngressInvalidAnnotation(t *testing.T) {
+	g := NewWithT(t)
+
+	ing := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "idp",
+			Namespace: "default",
+			Annotations: map[string]string{
+				infrav1.IngressRedirectURIAnnotation: "oauth2proxy",
+			},
+		},
+	}
+
+	recorder := record.NewFakeRecorder(10)
+	httpProxy := proxy.New(logr.Discard(), nil)
+
+	r := &IngressReconciler{
+		Client:    fake.NewClientBuilder().WithObjects(ing).Build(),
+		HttpProxy: httpProxy,
+		Log:       logr.Discard(),
+		Recorder:  recorder,
+	}
+
+	_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ing)})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(httpProxy.Stats()).To(BeEmpty())
+	g.Expect(<-recorder.Events).To(Equal("Warning InvalidAnnotation Annotation oauth2.infra.doodle.com/redirect-uri must be an absolute URL"))
+}
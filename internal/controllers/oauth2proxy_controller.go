@@ -0,0 +1,909 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=discovery.k8s.io,resources=endpointslices,verbs=get;list;watch
+// +kubebuilder:rbac:groups=gateway.networking.k8s.io,resources=referencegrants,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups=oauth2.infra.doodle.com,resources=oauth2proxies,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=oauth2.infra.doodle.com,resources=oauth2proxies/status,verbs=get;update;patch
+
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+	gatewayv1beta1 "sigs.k8s.io/gateway-api/apis/v1beta1"
+
+	infrav1 "github.com/DoodleScheduling/oauth2-redirect-controller/api/v1"
+	"github.com/DoodleScheduling/oauth2-redirect-controller/internal/proxy"
+)
+
+// urlResolveInterval is the interval in which a backend URL which could not be resolved is retried
+const urlResolveInterval = time.Minute
+
+const (
+	serviceIndex        = ".metadata.service"
+	secretIndex         = ".metadata.secrets"
+	endpointsIndex      = ".metadata.endpoints"
+	referenceGrantIndex = ".metadata.referenceGrant"
+	redirectHostIndex   = ".spec.redirectHost"
+)
+
+// OAUTH2Proxy reconciles a OAUTH2Proxy object
+type OAUTH2ProxyReconciler struct {
+	client.Client
+	HttpProxy    *proxy.HttpProxy
+	Certificates *proxy.CertificateStore
+	Log          logr.Logger
+	Scheme       *runtime.Scheme
+	Recorder     record.EventRecorder
+	// Resolver verifies the host of backend URLs can be resolved, defaults to net.DefaultResolver
+	Resolver Resolver
+	// ProxyService is the DNS name of the Service exposing the proxy, generated Ingresses and HTTPRoutes route to it.
+	// Neither are generated if it is empty.
+	ProxyService string
+	// ProxyPort is the http port of ProxyService
+	ProxyPort int32
+	// CacheNamespaces are the namespaces objects are cached for, all namespaces if empty.
+	// Services in other namespaces can not be referenced.
+	CacheNamespaces []string
+
+	// referenceGrants is set if the ReferenceGrant API is installed, otherwise cross namespace references are denied
+	referenceGrants bool
+	// httpRoutes is set if the HTTPRoute API is installed, otherwise no HTTPRoutes are generated
+	httpRoutes bool
+}
+
+// Resolver looks up the addresses of a host
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+type OAUTH2ProxyReconcilerOptions struct {
+	MaxConcurrentReconciles int
+	// CircuitBreakerEvents triggers a reconcile of an OAUTH2Proxy whose circuit breaker changed its state
+	CircuitBreakerEvents <-chan event.GenericEvent
+}
+
+// SetupWithManager adding controllers
+func (r *OAUTH2ProxyReconciler) SetupWithManager(mgr ctrl.Manager, opts OAUTH2ProxyReconcilerOptions) error {
+	// Index the ReqeustClones by the Service references they point at
+	if err := mgr.GetFieldIndexer().IndexField(context.TODO(), &infrav1.OAUTH2Proxy{}, serviceIndex,
+		func(o client.Object) []string {
+			vb := o.(*infrav1.OAUTH2Proxy)
+			if vb.Spec.Backend.Service.Name == "" {
+				return nil
+			}
+
+			r.Log.Info(fmt.Sprintf("%s/%s", serviceNamespace(vb), vb.Spec.Backend.Service.Name))
+			return []string{
+				fmt.Sprintf("%s/%s", serviceNamespace(vb), vb.Spec.Backend.Service.Name),
+			}
+		},
+	); err != nil {
+		return err
+	}
+
+	// Index the OAUTH2Proxies by the Secrets referenced for the backend and listener TLS configuration
+	if err := mgr.GetFieldIndexer().IndexField(context.TODO(), &infrav1.OAUTH2Proxy{}, secretIndex, secretRefs); err != nil {
+		return err
+	}
+
+	// Index the OAUTH2Proxies routing to the endpoints of a Service
+	if err := mgr.GetFieldIndexer().IndexField(context.TODO(), &infrav1.OAUTH2Proxy{}, endpointsIndex,
+		func(o client.Object) []string {
+			vb := o.(*infrav1.OAUTH2Proxy)
+			if vb.Spec.Backend.Service.Name == "" || vb.Spec.Backend.Service.Routing != infrav1.RoutingEndpoints {
+				return nil
+			}
+
+			return []string{
+				fmt.Sprintf("%s/%s", serviceNamespace(vb), vb.Spec.Backend.Service.Name),
+			}
+		},
+	); err != nil {
+		return err
+	}
+
+	// Index the OAUTH2Proxies by the namespace of a backend service in another namespace
+	if err := mgr.GetFieldIndexer().IndexField(context.TODO(), &infrav1.OAUTH2Proxy{}, referenceGrantIndex,
+		func(o client.Object) []string {
+			vb := o.(*infrav1.OAUTH2Proxy)
+			if vb.Spec.Backend.Service.Name == "" || serviceNamespace(vb) == vb.GetNamespace() {
+				return nil
+			}
+
+			return []string{serviceNamespace(vb)}
+		},
+	); err != nil {
+		return err
+	}
+
+	// Index the OAUTH2Proxies by the host of their redirectURI, the host is routed by one of them only
+	if err := mgr.GetFieldIndexer().IndexField(context.TODO(), &infrav1.OAUTH2Proxy{}, redirectHostIndex, redirectHostRefs); err != nil {
+		return err
+	}
+
+	installed, err := referenceGrantsInstalled(mgr.GetRESTMapper())
+	if err != nil {
+		return err
+	}
+
+	r.referenceGrants = installed
+
+	b := ctrl.NewControllerManagedBy(mgr)
+	if opts.CircuitBreakerEvents != nil {
+		b = b.WatchesRawSource(source.Channel(opts.CircuitBreakerEvents, &handler.EnqueueRequestForObject{}))
+	}
+
+	if r.referenceGrants {
+		b = b.Watches(
+			&gatewayv1beta1.ReferenceGrant{},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForReferenceGrantChange),
+		)
+	} else {
+		r.Log.Info("ReferenceGrants are not installed, cross namespace service references are not permitted")
+	}
+
+	installed, err = httpRoutesInstalled(mgr.GetRESTMapper())
+	if err != nil {
+		return err
+	}
+
+	r.httpRoutes = installed
+	if r.httpRoutes {
+		b = b.Owns(&gatewayv1.HTTPRoute{})
+	} else {
+		r.Log.Info("HTTPRoutes are not installed, gatewayRef is not supported")
+	}
+
+	return b.
+		// Status updates, including the serving stats, do not change the generation and need no reconcile
+		For(&infrav1.OAUTH2Proxy{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(
+			&infrav1.OAUTH2Proxy{},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForRedirectHostChange),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{}),
+		).
+		Owns(&networkingv1.Ingress{}).
+		Owns(&v1.Service{}).
+		Watches(
+			&v1.Service{},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForServiceChange),
+		).
+		// Only the metadata of Secrets is watched, their data is read uncached for the referenced Secrets only
+		WatchesMetadata(
+			&v1.Secret{},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForSecretChange),
+		).
+		Watches(
+			&discoveryv1.EndpointSlice{},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForEndpointSliceChange),
+		).
+		WithOptions(controller.Options{MaxConcurrentReconciles: opts.MaxConcurrentReconciles}).
+		Complete(r)
+}
+
+func (r *OAUTH2ProxyReconciler) requestsForServiceChange(ctx context.Context, o client.Object) []reconcile.Request {
+	s, ok := o.(*v1.Service)
+	if !ok {
+		panic(fmt.Sprintf("expected a Service, got %T", o))
+	}
+
+	var list infrav1.OAUTH2ProxyList
+	if err := r.List(ctx, &list, client.MatchingFields{
+		serviceIndex: objectKey(s).String(),
+	}); err != nil {
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for _, i := range list.Items {
+		r.Log.Info("referenced service from a oauth2proxy changed detected, reconcile oauth2proxy", "namespace", i.GetNamespace(), "name", i.GetName())
+		reqs = append(reqs, reconcile.Request{NamespacedName: objectKey(&i)})
+	}
+
+	return reqs
+}
+
+// secretRefs returns the Secrets referenced by an OAUTH2Proxy for the backend and listener TLS configuration
+func secretRefs(o client.Object) []string {
+	vb := o.(*infrav1.OAUTH2Proxy)
+	var secrets []string
+	for _, ref := range []*infrav1.LocalObjectReference{vb.Spec.Backend.Protocol.TLS.CASecretRef, vb.Spec.Backend.Protocol.TLS.ClientCertSecretRef, vb.Spec.TLS.SecretRef} {
+		if ref != nil {
+			secrets = append(secrets, fmt.Sprintf("%s/%s", vb.GetNamespace(), ref.Name))
+		}
+	}
+
+	return secrets
+}
+
+// requestsForSecretChange enqueues the OAUTH2Proxies referencing a Secret, it receives the metadata of the Secret only
+func (r *OAUTH2ProxyReconciler) requestsForSecretChange(ctx context.Context, o client.Object) []reconcile.Request {
+	var list infrav1.OAUTH2ProxyList
+	if err := r.List(ctx, &list, client.MatchingFields{
+		secretIndex: objectKey(o).String(),
+	}); err != nil {
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for _, i := range list.Items {
+		r.Log.Info("referenced secret from a oauth2proxy changed detected, reconcile oauth2proxy", "namespace", i.GetNamespace(), "name", i.GetName())
+		reqs = append(reqs, reconcile.Request{NamespacedName: objectKey(&i)})
+	}
+
+	return reqs
+}
+
+func (r *OAUTH2ProxyReconciler) requestsForEndpointSliceChange(ctx context.Context, o client.Object) []reconcile.Request {
+	s, ok := o.(*discoveryv1.EndpointSlice)
+	if !ok {
+		panic(fmt.Sprintf("expected an EndpointSlice, got %T", o))
+	}
+
+	svc, ok := s.Labels[discoveryv1.LabelServiceName]
+	if !ok {
+		return nil
+	}
+
+	var list infrav1.OAUTH2ProxyList
+	if err := r.List(ctx, &list, client.MatchingFields{
+		endpointsIndex: fmt.Sprintf("%s/%s", s.GetNamespace(), svc),
+	}); err != nil {
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for _, i := range list.Items {
+		r.Log.Info("referenced endpoints from a oauth2proxy changed detected, reconcile oauth2proxy", "namespace", i.GetNamespace(), "name", i.GetName())
+		reqs = append(reqs, reconcile.Request{NamespacedName: objectKey(&i)})
+	}
+
+	return reqs
+}
+
+// Reconcile OAUTH2Proxys
+func (r *OAUTH2ProxyReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := r.Log.WithValues("Namespace", req.Namespace, "Name", req.NamespacedName)
+	logger.Info("reconciling OAUTH2Proxy")
+
+	// Fetch the OAUTH2Proxy instance
+	ph := infrav1.OAUTH2Proxy{}
+
+	err := r.Get(ctx, req.NamespacedName, &ph)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			// Request object not found, could have been deleted after reconcile request.
+			// Owned objects are automatically garbage collected. For additional cleanup logic use finalizers.
+			// Stop proxying and serving certificates for it. Return and don't requeue
+			// The namespace might not need to reference the proxy Service anymore.
+			_ = r.HttpProxy.Unregister(req.NamespacedName)
+			r.Certificates.Delete(req.NamespacedName)
+			return reconcile.Result{}, r.reconcileProxyReferenceGrant(ctx)
+		}
+		// Error reading the object - requeue the request.
+		return reconcile.Result{}, err
+	}
+
+	ph, result, reconcileErr := r.reconcile(ctx, ph)
+	ph.Status.ObservedGeneration = ph.Generation
+
+	ph, err = r.reconcileGenerated(ctx, ph)
+	if err != nil {
+		r.Recorder.Event(&ph, v1.EventTypeWarning, infrav1.GenerateFailedReason, err.Error())
+		ph = infrav1.OAUTH2ProxyRoutesGenerated(ph, false, infrav1.GenerateFailedReason, err.Error())
+		reconcileErr = kerrors.NewAggregate([]error{reconcileErr, err})
+	}
+
+	// Update status after reconciliation.
+	if err = r.patchStatus(ctx, &ph); err != nil {
+		logger.Error(err, "unable to update status after reconciliation")
+		return ctrl.Result{Requeue: true}, err
+	}
+
+	return result, reconcileErr
+}
+
+func (r *OAUTH2ProxyReconciler) reconcile(ctx context.Context, ph infrav1.OAUTH2Proxy) (infrav1.OAUTH2Proxy, ctrl.Result, error) {
+	// The backend and redirect uri are only reported once they have been registered
+	ph.Status.Backend = nil
+	ph.Status.RedirectURI = ""
+
+	backend := &infrav1.BackendStatus{}
+	var (
+		endpoints   []proxy.Endpoint
+		scheme      = ph.Spec.Backend.Protocol.Scheme
+		path        string
+		serverName  string
+		readyMsg    = "Service backend successfully registered"
+		readyReason = infrav1.ServiceBackendReadyReason
+		resolvedMsg = "Service backend resolved"
+	)
+
+	if ph.Spec.Backend.URL != "" {
+		u, reason, err := r.upstreamURL(ctx, ph.Spec.Backend.URL)
+		if err != nil {
+			// Name resolution may recover without any change to watched objects
+			if reason == infrav1.URLNotResolvableReason {
+				return r.backendNotResolved(ph, reason, err.Error()), ctrl.Result{RequeueAfter: urlResolveInterval}, nil
+			}
+
+			return r.backendNotResolved(ph, reason, err.Error()), ctrl.Result{}, nil
+		}
+
+		port, _ := strconv.Atoi(u.Port())
+		backend.Address = u.Hostname()
+		backend.Port = int32(port)
+		scheme = u.Scheme
+		path = u.Path
+		serverName = u.Hostname()
+		readyMsg = "URL backend successfully registered"
+		readyReason = infrav1.URLBackendReadyReason
+		resolvedMsg = "URL backend resolved"
+	} else {
+		if reason, err := r.servicePermitted(ctx, ph); err != nil {
+			if reason != infrav1.RefNotPermittedReason {
+				return infrav1.OAUTH2ProxyReconciling(ph, reason, err.Error()), ctrl.Result{}, err
+			}
+
+			return r.backendNotResolved(ph, reason, err.Error()), ctrl.Result{}, nil
+		}
+
+		// Lookup matching service
+		svc := v1.Service{}
+		err := r.Get(ctx, client.ObjectKey{
+			Namespace: serviceNamespace(&ph),
+			Name:      ph.Spec.Backend.Service.Name,
+		}, &svc)
+
+		if err != nil {
+			return r.backendNotResolved(ph, infrav1.ServiceNotFoundReason, "Service not found"), ctrl.Result{}, nil
+		}
+
+		port, ok := servicePort(svc, ph.Spec.Backend.Service.Port)
+		if !ok {
+			return r.backendNotResolved(ph, infrav1.ServicePortNotFoundReason, "Port not found in service"), ctrl.Result{}, nil
+		}
+
+		serverName = fmt.Sprintf("%s.%s.svc", ph.Spec.Backend.Service.Name, svc.GetNamespace())
+
+		switch {
+		case svc.Spec.Type == v1.ServiceTypeExternalName:
+			// ExternalName services are resolved by DNS, neither endpoints nor cluster IPs exist
+			backend.Address = svc.Spec.ExternalName
+			backend.Port = port.Port
+			serverName = svc.Spec.ExternalName
+		case ph.Spec.Backend.Service.Routing == infrav1.RoutingEndpoints:
+			endpoints, err = r.readyEndpoints(ctx, svc, port.Name, ipFamily(svc, ph.Spec.Backend.Service.IPFamily))
+			if err != nil {
+				return infrav1.OAUTH2ProxyReconciling(ph, infrav1.ProgressingWithRetryReason, err.Error()), ctrl.Result{}, err
+			}
+
+			if len(endpoints) == 0 {
+				return r.backendNotResolved(ph, infrav1.NoReadyEndpointsReason, "Service has no ready endpoints"), ctrl.Result{}, nil
+			}
+
+			for _, endpoint := range endpoints {
+				backend.Endpoints = append(backend.Endpoints, net.JoinHostPort(endpoint.Address, strconv.Itoa(int(endpoint.Port))))
+			}
+		default:
+			family := ipFamily(svc, ph.Spec.Backend.Service.IPFamily)
+			backend.Address = serviceClusterIP(svc, family)
+			backend.Port = port.Port
+
+			if backend.Address == "" {
+				msg := "Service has no cluster IP"
+				if family != "" {
+					msg = fmt.Sprintf("Service has no %s cluster IP", family)
+				}
+
+				return r.backendNotResolved(ph, infrav1.IPFamilyNotAvailableReason, msg), ctrl.Result{}, nil
+			}
+		}
+	}
+
+	ph = infrav1.OAUTH2ProxyBackendResolved(ph, true, readyReason, resolvedMsg)
+
+	var (
+		tlsConfig       *tls.Config
+		tlsCertificates proxy.TLSCertificates
+	)
+
+	if scheme == infrav1.SchemeHTTPS {
+		var (
+			reason string
+			err    error
+		)
+
+		tlsConfig, tlsCertificates, reason, err = r.backendTLSConfig(ctx, ph, serverName)
+		if err != nil {
+			return r.notRegistered(ph, reason, err.Error()), ctrl.Result{}, nil
+		}
+	}
+
+	if ph.Spec.TLS.SecretRef == nil {
+		r.Certificates.Delete(objectKey(&ph))
+	} else {
+		cert, reason, err := r.listenerCertificate(ctx, ph)
+		if err != nil {
+			return r.notRegistered(ph, reason, err.Error()), ctrl.Result{}, nil
+		}
+
+		hosts := []string{ph.Spec.Host}
+		if u, err := url.Parse(ph.Spec.RedirectURI); err == nil && u.Hostname() != "" {
+			hosts = append(hosts, u.Hostname())
+		}
+
+		r.Certificates.Set(objectKey(&ph), cert, hosts...)
+	}
+
+	_ = r.HttpProxy.RegisterOrUpdate(&proxy.OAUTH2Proxy{
+		Host:            ph.Spec.Host,
+		Service:         backend.Address,
+		Paths:           pathMatches(ph.Spec.Paths),
+		RedirectURI:     ph.Spec.RedirectURI,
+		Port:            backend.Port,
+		Endpoints:       endpoints,
+		Scheme:          scheme,
+		Path:            path,
+		TLS:             tlsConfig,
+		TLSCertificates: tlsCertificates,
+		Timeouts:        backendTimeouts(ph.Spec.Backend.Timeouts),
+		Retries:         retryPolicy(ph.Spec.Backend.Retries),
+		CircuitBreaker:  circuitBreakerPolicy(ph.Spec.Backend.CircuitBreaker),
+		Object: client.ObjectKey{
+			Namespace: ph.GetNamespace(),
+			Name:      ph.GetName(),
+		},
+	})
+
+	if state, ok := r.HttpProxy.CircuitBreakerState(objectKey(&ph)); ok {
+		switch state {
+		case proxy.CircuitOpen:
+			ph = infrav1.OAUTH2ProxyCircuitBreaker(ph, true, infrav1.CircuitBreakerOpenReason, "Requests are rejected after consecutive backend failures")
+		case proxy.CircuitHalfOpen:
+			ph = infrav1.OAUTH2ProxyCircuitBreaker(ph, true, infrav1.CircuitBreakerHalfOpenReason, "A trial request is forwarded to the backend")
+		default:
+			ph = infrav1.OAUTH2ProxyCircuitBreaker(ph, false, infrav1.CircuitBreakerClosedReason, "Requests are forwarded to the backend")
+		}
+	} else {
+		apimeta.RemoveStatusCondition(&ph.Status.Conditions, infrav1.CircuitBreakerOpenCondition)
+	}
+
+	ph.Status.Backend = backend
+	ph.Status.RedirectURI = ph.Spec.RedirectURI
+	ph = infrav1.OAUTH2ProxyRegistered(ph, true, infrav1.ProxyRegisteredReason, "Served by the proxy")
+
+	// Successful reconciles are only recorded if they changed the Ready condition
+	if ready := apimeta.FindStatusCondition(ph.Status.Conditions, infrav1.ReadyCondition); ready == nil ||
+		ready.Status != metav1.ConditionTrue || ready.Reason != readyReason || ready.Message != readyMsg {
+		r.Recorder.Event(&ph, v1.EventTypeNormal, readyReason, readyMsg)
+	}
+
+	return infrav1.OAUTH2ProxyReady(ph, readyReason, readyMsg), ctrl.Result{}, nil
+}
+
+// backendNotResolved reports a backend which could not be resolved, hence the OAUTH2Proxy could not be registered either
+func (r *OAUTH2ProxyReconciler) backendNotResolved(ph infrav1.OAUTH2Proxy, reason, msg string) infrav1.OAUTH2Proxy {
+	r.unregister(ph)
+	ph = infrav1.OAUTH2ProxyBackendResolved(ph, false, reason, msg)
+	ph = infrav1.OAUTH2ProxyRegistered(ph, false, infrav1.BackendNotResolvedReason, "Backend could not be resolved")
+	return r.notReady(ph, reason, msg)
+}
+
+// notRegistered reports an OAUTH2Proxy which could not be registered although its backend has been resolved
+func (r *OAUTH2ProxyReconciler) notRegistered(ph infrav1.OAUTH2Proxy, reason, msg string) infrav1.OAUTH2Proxy {
+	r.unregister(ph)
+	ph = infrav1.OAUTH2ProxyRegistered(ph, false, reason, msg)
+	return r.notReady(ph, reason, msg)
+}
+
+// unregister stops proxying and serving certificates for an OAUTH2Proxy which is reported as not registered.
+// A previous registration must not keep routing to a backend or serving a certificate which is gone.
+func (r *OAUTH2ProxyReconciler) unregister(ph infrav1.OAUTH2Proxy) {
+	_ = r.HttpProxy.Unregister(objectKey(&ph))
+	r.Certificates.Delete(objectKey(&ph))
+}
+
+// notReady records a Warning event and marks the OAUTH2Proxy as not ready.
+// It is stalled if it can not recover without a change, otherwise it is still reconciling.
+func (r *OAUTH2ProxyReconciler) notReady(ph infrav1.OAUTH2Proxy, reason, msg string) infrav1.OAUTH2Proxy {
+	r.Recorder.Event(&ph, v1.EventTypeWarning, reason, msg)
+
+	if stalled(reason) {
+		ph = infrav1.OAUTH2ProxyStalled(ph, reason, msg)
+	} else {
+		ph = infrav1.OAUTH2ProxyReconciling(ph, reason, msg)
+	}
+
+	return infrav1.OAUTH2ProxyNotReady(ph, reason, msg)
+}
+
+// stalled returns true for failures caused by the spec of the OAUTH2Proxy or the permissions of the namespace.
+// Other failures are expected to recover once the referenced objects exist or can be resolved.
+func stalled(reason string) bool {
+	switch reason {
+	case infrav1.InvalidURLReason, infrav1.InvalidTLSConfigReason, infrav1.RefNotPermittedReason:
+		return true
+	default:
+		return false
+	}
+}
+
+// backendTLSConfig builds the client TLS configuration used to connect to an https backend.
+// The PEM encoded certificates it was built from are returned as well.
+// On failure the condition reason is returned alongside the error.
+// serverName is used to verify the backend unless the OAUTH2Proxy overrides it.
+func (r *OAUTH2ProxyReconciler) backendTLSConfig(ctx context.Context, ph infrav1.OAUTH2Proxy, serverName string) (*tls.Config, proxy.TLSCertificates, string, error) {
+	var certs proxy.TLSCertificates
+	cfg := &tls.Config{
+		ServerName: ph.Spec.Backend.Protocol.TLS.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if cfg.ServerName == "" {
+		cfg.ServerName = serverName
+	}
+
+	if ref := ph.Spec.Backend.Protocol.TLS.CASecretRef; ref != nil {
+		secret := v1.Secret{}
+		if err := r.Get(ctx, client.ObjectKey{Namespace: ph.GetNamespace(), Name: ref.Name}, &secret); err != nil {
+			return nil, certs, infrav1.SecretNotFoundReason, fmt.Errorf("CA secret %s not found", ref.Name)
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(secret.Data[v1.ServiceAccountRootCAKey]) {
+			return nil, certs, infrav1.InvalidTLSConfigReason, fmt.Errorf("CA secret %s does not contain a valid PEM encoded %s", ref.Name, v1.ServiceAccountRootCAKey)
+		}
+
+		certs.CA = secret.Data[v1.ServiceAccountRootCAKey]
+	}
+
+	if ref := ph.Spec.Backend.Protocol.TLS.ClientCertSecretRef; ref != nil {
+		secret := v1.Secret{}
+		if err := r.Get(ctx, client.ObjectKey{Namespace: ph.GetNamespace(), Name: ref.Name}, &secret); err != nil {
+			return nil, certs, infrav1.SecretNotFoundReason, fmt.Errorf("client certificate secret %s not found", ref.Name)
+		}
+
+		cert, err := tls.X509KeyPair(secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey])
+		if err != nil {
+			return nil, certs, infrav1.InvalidTLSConfigReason, fmt.Errorf("client certificate secret %s is invalid: %w", ref.Name, err)
+		}
+
+		cfg.Certificates = []tls.Certificate{cert}
+		certs.Cert = secret.Data[v1.TLSCertKey]
+		certs.Key = secret.Data[v1.TLSPrivateKeyKey]
+	}
+
+	return cfg, certs, "", nil
+}
+
+// upstreamURL parses the URL of a backend outside the cluster and verifies its host can be resolved.
+// The port is set to the default port of the scheme if missing.
+// On failure the condition reason is returned alongside the error.
+func (r *OAUTH2ProxyReconciler) upstreamURL(ctx context.Context, rawURL string) (*url.URL, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, infrav1.InvalidURLReason, fmt.Errorf("invalid backend url: %w", err)
+	}
+
+	switch {
+	case u.Scheme != infrav1.SchemeHTTP && u.Scheme != infrav1.SchemeHTTPS:
+		return nil, infrav1.InvalidURLReason, fmt.Errorf("invalid backend url: scheme must be http or https")
+	case u.Hostname() == "":
+		return nil, infrav1.InvalidURLReason, fmt.Errorf("invalid backend url: missing host")
+	case u.User != nil || u.RawQuery != "" || u.Fragment != "":
+		return nil, infrav1.InvalidURLReason, fmt.Errorf("invalid backend url: user info, query and fragment are not supported")
+	}
+
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == infrav1.SchemeHTTPS {
+			port = "443"
+		}
+
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	} else if port, err := strconv.ParseUint(u.Port(), 10, 16); err != nil || port == 0 {
+		return nil, infrav1.InvalidURLReason, fmt.Errorf("invalid backend url: invalid port %s", u.Port())
+	}
+
+	if _, err := netip.ParseAddr(u.Hostname()); err == nil {
+		return u, "", nil
+	}
+
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	if _, err := resolver.LookupHost(ctx, u.Hostname()); err != nil {
+		return nil, infrav1.URLNotResolvableReason, fmt.Errorf("backend url host %s can not be resolved: %w", u.Hostname(), err)
+	}
+
+	return u, "", nil
+}
+
+// servicePort returns the port of the Service matching the port name or number.
+// ExternalName services do not need to declare their ports, a port number is used as is.
+func servicePort(svc v1.Service, port infrav1.ServiceBackendPort) (v1.ServicePort, bool) {
+	for _, p := range svc.Spec.Ports {
+		if port.Name != "" && p.Name == port.Name {
+			return p, true
+		}
+
+		if port.Name == "" && p.Port == port.Number {
+			return p, true
+		}
+	}
+
+	if svc.Spec.Type == v1.ServiceTypeExternalName && port.Name == "" && port.Number > 0 {
+		return v1.ServicePort{Port: port.Number}, true
+	}
+
+	return v1.ServicePort{}, false
+}
+
+// ipFamily returns the requested IP family or the primary IP family of the Service if none was requested.
+// An empty family is returned for services without IP families, for example services of type ExternalName.
+func ipFamily(svc v1.Service, requested string) v1.IPFamily {
+	if requested != "" {
+		return v1.IPFamily(requested)
+	}
+
+	if len(svc.Spec.IPFamilies) > 0 {
+		return svc.Spec.IPFamilies[0]
+	}
+
+	return ""
+}
+
+// serviceClusterIP returns the cluster IP of the Service for the given IP family
+func serviceClusterIP(svc v1.Service, family v1.IPFamily) string {
+	clusterIPs := svc.Spec.ClusterIPs
+	if len(clusterIPs) == 0 && svc.Spec.ClusterIP != "" {
+		clusterIPs = []string{svc.Spec.ClusterIP}
+	}
+
+	for _, ip := range clusterIPs {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case family == "":
+			return ip
+		case family == v1.IPv4Protocol && addr.Is4():
+			return ip
+		case family == v1.IPv6Protocol && addr.Is6():
+			return ip
+		}
+	}
+
+	return ""
+}
+
+// readyEndpoints returns the ready endpoints of the named port of a Service from its EndpointSlices.
+// Only slices of the given IP family are considered unless the family is empty.
+// The endpoints are sorted so an unchanged set does not change the registration.
+func (r *OAUTH2ProxyReconciler) readyEndpoints(ctx context.Context, svc v1.Service, portName string, family v1.IPFamily) ([]proxy.Endpoint, error) {
+	var slices discoveryv1.EndpointSliceList
+	if err := r.List(ctx, &slices, client.InNamespace(svc.GetNamespace()), client.MatchingLabels{
+		discoveryv1.LabelServiceName: svc.GetName(),
+	}); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[proxy.Endpoint]struct{})
+	var endpoints []proxy.Endpoint
+
+	for _, slice := range slices.Items {
+		if family != "" && string(slice.AddressType) != string(family) {
+			continue
+		}
+
+		var port int32
+		for _, p := range slice.Ports {
+			// The port of the slice is the target port of the service port with the same name
+			if ptr.Deref(p.Name, "") == portName && p.Port != nil {
+				port = *p.Port
+			}
+		}
+
+		if port == 0 {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			// A missing ready condition is to be interpreted as ready
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+
+			for _, address := range endpoint.Addresses {
+				e := proxy.Endpoint{Address: address, Port: port}
+				if _, ok := seen[e]; ok {
+					continue
+				}
+
+				seen[e] = struct{}{}
+				endpoints = append(endpoints, e)
+			}
+		}
+	}
+
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].Address != endpoints[j].Address {
+			return endpoints[i].Address < endpoints[j].Address
+		}
+
+		return endpoints[i].Port < endpoints[j].Port
+	})
+
+	return endpoints, nil
+}
+
+// pathMatches converts the paths of an OAUTH2Proxy, paths without a type are prefixes
+func pathMatches(paths []infrav1.HTTPPathMatch) []proxy.PathMatch {
+	var matches []proxy.PathMatch
+	for _, path := range paths {
+		matches = append(matches, proxy.PathMatch{
+			Path:  path.Value,
+			Exact: path.Type == infrav1.PathMatchExact,
+		})
+	}
+
+	return matches
+}
+
+// backendTimeouts converts the backend timeouts, unset timeouts are disabled
+func backendTimeouts(timeouts *infrav1.BackendTimeouts) proxy.Timeouts {
+	var t proxy.Timeouts
+	if timeouts == nil {
+		return t
+	}
+
+	if timeouts.Connect != nil {
+		t.Connect = timeouts.Connect.Duration
+	}
+
+	if timeouts.ResponseHeader != nil {
+		t.ResponseHeader = timeouts.ResponseHeader.Duration
+	}
+
+	if timeouts.Request != nil {
+		t.Request = timeouts.Request.Duration
+	}
+
+	return t
+}
+
+// retryPolicy converts the backend retry policy, requests are not retried if unset
+func retryPolicy(retries *infrav1.RetryPolicy) proxy.RetryPolicy {
+	var p proxy.RetryPolicy
+	if retries == nil {
+		return p
+	}
+
+	p.Attempts = int(retries.Attempts)
+	if retries.Backoff != nil {
+		p.Backoff = retries.Backoff.Duration
+	}
+
+	return p
+}
+
+// circuitBreakerPolicy converts the backend circuit breaker policy and applies the defaults
+func circuitBreakerPolicy(breaker *infrav1.CircuitBreakerPolicy) *proxy.CircuitBreakerPolicy {
+	if breaker == nil {
+		return nil
+	}
+
+	p := &proxy.CircuitBreakerPolicy{
+		ConsecutiveFailures: int(breaker.ConsecutiveFailures),
+		OpenDuration:        30 * time.Second,
+		StatusCode:          int(breaker.StatusCode),
+		Body:                breaker.Body,
+	}
+
+	if p.ConsecutiveFailures == 0 {
+		p.ConsecutiveFailures = 5
+	}
+
+	if p.StatusCode == 0 {
+		p.StatusCode = http.StatusServiceUnavailable
+	}
+
+	if breaker.OpenDuration != nil {
+		p.OpenDuration = breaker.OpenDuration.Duration
+	}
+
+	return p
+}
+
+// listenerCertificate loads the certificate served by the proxy listener for the OAUTH2Proxy.
+// On failure the condition reason is returned alongside the error.
+func (r *OAUTH2ProxyReconciler) listenerCertificate(ctx context.Context, ph infrav1.OAUTH2Proxy) (*tls.Certificate, string, error) {
+	ref := ph.Spec.TLS.SecretRef
+	secret := v1.Secret{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: ph.GetNamespace(), Name: ref.Name}, &secret); err != nil {
+		return nil, infrav1.SecretNotFoundReason, fmt.Errorf("TLS secret %s not found", ref.Name)
+	}
+
+	cert, err := tls.X509KeyPair(secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey])
+	if err != nil {
+		return nil, infrav1.InvalidTLSConfigReason, fmt.Errorf("TLS secret %s is invalid: %w", ref.Name, err)
+	}
+
+	return &cert, "", nil
+}
+
+func (r *OAUTH2ProxyReconciler) patchStatus(ctx context.Context, ph *infrav1.OAUTH2Proxy) error {
+	key := client.ObjectKeyFromObject(ph)
+	latest := &infrav1.OAUTH2Proxy{}
+	if err := r.Get(ctx, key, latest); err != nil {
+		return err
+	}
+
+	// The serving stats are owned by the StatusUpdater
+	ph.Status.LastRoutedTime = latest.Status.LastRoutedTime
+	ph.Status.Stats = latest.Status.Stats
+
+	return r.Status().Patch(ctx, ph, client.MergeFrom(latest))
+}
+
+// objectKey returns client.ObjectKey for the object.
+func objectKey(object metav1.Object) client.ObjectKey {
+	return client.ObjectKey{
+		Namespace: object.GetNamespace(),
+		Name:      object.GetName(),
+	}
+}
@@ -0,0 +1,561 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	infrav1 "github.com/DoodleScheduling/oauth2-redirect-controller/api/v1"
+	"github.com/DoodleScheduling/oauth2-redirect-controller/internal/proxy"
+)
+
+func TestReadyEndpoints(t *testing.T) {
+	g := NewWithT(t)
+
+	svc := v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "backend",
+			Namespace: "default",
+		},
+	}
+
+	slice := func(name, service string, addressType discoveryv1.AddressType, ports []discoveryv1.EndpointPort, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+		return &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Labels: map[string]string{
+					discoveryv1.LabelServiceName: service,
+				},
+			},
+			AddressType: addressType,
+			Ports:       ports,
+			Endpoints:   endpoints,
+		}
+	}
+
+	ports := []discoveryv1.EndpointPort{
+		{Name: ptr.To("metrics"), Port: ptr.To[int32](9090)},
+		{Name: ptr.To("http"), Port: ptr.To[int32](8080)},
+	}
+
+	r := &OAUTH2ProxyReconciler{
+		Client: fake.NewClientBuilder().WithObjects(
+			slice("backend-1", "backend", discoveryv1.AddressTypeIPv4, ports,
+				discoveryv1.Endpoint{Addresses: []string{"10.0.0.2"}, Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(true)}},
+				discoveryv1.Endpoint{Addresses: []string{"10.0.0.3"}, Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(false)}},
+				// A missing ready condition counts as ready
+				discoveryv1.Endpoint{Addresses: []string{"10.0.0.1"}},
+			),
+			// Endpoints may be listed by multiple slices while they are migrated
+			slice("backend-2", "backend", discoveryv1.AddressTypeIPv4, ports,
+				discoveryv1.Endpoint{Addresses: []string{"10.0.0.1"}, Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(true)}},
+			),
+			slice("backend-ipv6", "backend", discoveryv1.AddressTypeIPv6, ports,
+				discoveryv1.Endpoint{Addresses: []string{"fd00::2"}, Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(true)}},
+			),
+			slice("other", "other", discoveryv1.AddressTypeIPv4, ports,
+				discoveryv1.Endpoint{Addresses: []string{"10.0.1.1"}, Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(true)}},
+			),
+		).Build(),
+	}
+
+	endpoints, err := r.readyEndpoints(context.Background(), svc, "http", v1.IPv4Protocol)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(endpoints).To(Equal([]proxy.Endpoint{
+		{Address: "10.0.0.1", Port: 8080},
+		{Address: "10.0.0.2", Port: 8080},
+	}))
+
+	endpoints, err = r.readyEndpoints(context.Background(), svc, "http", v1.IPv6Protocol)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(endpoints).To(Equal([]proxy.Endpoint{
+		{Address: "fd00::2", Port: 8080},
+	}))
+
+	endpoints, err = r.readyEndpoints(context.Background(), svc, "http", "")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(endpoints).To(HaveLen(3))
+
+	endpoints, err = r.readyEndpoints(context.Background(), svc, "unknown", "")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(endpoints).To(BeEmpty())
+}
+
+func TestServiceClusterIP(t *testing.T) {
+	dualStack := v1.Service{
+		Spec: v1.ServiceSpec{
+			ClusterIP:  "fd00::1",
+			ClusterIPs: []string{"fd00::1", "10.96.0.1"},
+			IPFamilies: []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol},
+		},
+	}
+
+	singleStack := v1.Service{
+		Spec: v1.ServiceSpec{
+			ClusterIP:  "10.96.0.1",
+			ClusterIPs: []string{"10.96.0.1"},
+			IPFamilies: []v1.IPFamily{v1.IPv4Protocol},
+		},
+	}
+
+	headless := v1.Service{
+		Spec: v1.ServiceSpec{
+			ClusterIP:  v1.ClusterIPNone,
+			ClusterIPs: []string{v1.ClusterIPNone},
+			IPFamilies: []v1.IPFamily{v1.IPv4Protocol},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		svc       v1.Service
+		requested string
+		expectIP  string
+	}{
+		{
+			name:     "Primary IP family of a dual-stack service",
+			svc:      dualStack,
+			expectIP: "fd00::1",
+		},
+		{
+			name:      "Preferred IP family of a dual-stack service",
+			svc:       dualStack,
+			requested: "IPv4",
+			expectIP:  "10.96.0.1",
+		},
+		{
+			name:      "Preferred IP family is not available",
+			svc:       singleStack,
+			requested: "IPv6",
+			expectIP:  "",
+		},
+		{
+			name:     "Headless service has no cluster IP",
+			svc:      headless,
+			expectIP: "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(serviceClusterIP(test.svc, ipFamily(test.svc, test.requested))).To(Equal(test.expectIP))
+		})
+	}
+}
+
+func TestReconcileBackend(t *testing.T) {
+	services := []client.Object{
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster-ip", Namespace: "default"},
+			Spec: v1.ServiceSpec{
+				Type:       v1.ServiceTypeClusterIP,
+				ClusterIP:  "10.96.0.1",
+				ClusterIPs: []string{"10.96.0.1"},
+				IPFamilies: []v1.IPFamily{v1.IPv4Protocol},
+				Ports: []v1.ServicePort{
+					{Name: "http", Port: 80, TargetPort: intstr.FromInt32(8080)},
+				},
+			},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "external", Namespace: "default"},
+			Spec: v1.ServiceSpec{
+				Type:         v1.ServiceTypeExternalName,
+				ExternalName: "idp.example.com",
+			},
+		},
+		&discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "cluster-ip-1",
+				Namespace: "default",
+				Labels: map[string]string{
+					discoveryv1.LabelServiceName: "cluster-ip",
+				},
+			},
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Ports: []discoveryv1.EndpointPort{
+				{Name: ptr.To("http"), Port: ptr.To[int32](8080)},
+			},
+			Endpoints: []discoveryv1.Endpoint{
+				{Addresses: []string{"10.0.0.1"}},
+			},
+		},
+	}
+
+	tests := []struct {
+		name          string
+		backend       infrav1.BackendRef
+		expectReason  string
+		expectBackend *infrav1.BackendStatus
+	}{
+		{
+			name: "Named port of a ClusterIP service",
+			backend: infrav1.BackendRef{
+				Service: infrav1.ServiceBackendRef{
+					Name: "cluster-ip",
+					Port: infrav1.ServiceBackendPort{Name: "http"},
+				},
+			},
+			expectReason:  infrav1.ServiceBackendReadyReason,
+			expectBackend: &infrav1.BackendStatus{Address: "10.96.0.1", Port: 80},
+		},
+		{
+			name: "Numeric port of a ClusterIP service",
+			backend: infrav1.BackendRef{
+				Service: infrav1.ServiceBackendRef{
+					Name: "cluster-ip",
+					Port: infrav1.ServiceBackendPort{Number: 80},
+				},
+			},
+			expectReason:  infrav1.ServiceBackendReadyReason,
+			expectBackend: &infrav1.BackendStatus{Address: "10.96.0.1", Port: 80},
+		},
+		{
+			name: "Numeric port not declared by a ClusterIP service",
+			backend: infrav1.BackendRef{
+				Service: infrav1.ServiceBackendRef{
+					Name: "cluster-ip",
+					Port: infrav1.ServiceBackendPort{Number: 8080},
+				},
+			},
+			expectReason: infrav1.ServicePortNotFoundReason,
+		},
+		{
+			name: "Endpoints are addressed on the target port",
+			backend: infrav1.BackendRef{
+				Service: infrav1.ServiceBackendRef{
+					Name:    "cluster-ip",
+					Port:    infrav1.ServiceBackendPort{Number: 80},
+					Routing: infrav1.RoutingEndpoints,
+				},
+			},
+			expectReason:  infrav1.ServiceBackendReadyReason,
+			expectBackend: &infrav1.BackendStatus{Endpoints: []string{"10.0.0.1:8080"}},
+		},
+		{
+			name: "ExternalName service is addressed by its DNS name",
+			backend: infrav1.BackendRef{
+				Service: infrav1.ServiceBackendRef{
+					Name: "external",
+					Port: infrav1.ServiceBackendPort{Number: 443},
+				},
+			},
+			expectReason:  infrav1.ServiceBackendReadyReason,
+			expectBackend: &infrav1.BackendStatus{Address: "idp.example.com", Port: 443},
+		},
+		{
+			name: "ExternalName service requires a port number",
+			backend: infrav1.BackendRef{
+				Service: infrav1.ServiceBackendRef{
+					Name: "external",
+					Port: infrav1.ServiceBackendPort{Name: "https"},
+				},
+			},
+			expectReason: infrav1.ServicePortNotFoundReason,
+		},
+		{
+			name: "URL backend with default port",
+			backend: infrav1.BackendRef{
+				URL: "https://idp.example.com/auth",
+			},
+			expectReason:  infrav1.URLBackendReadyReason,
+			expectBackend: &infrav1.BackendStatus{Address: "idp.example.com", Port: 443},
+		},
+		{
+			name: "URL backend with IPv6 address",
+			backend: infrav1.BackendRef{
+				URL: "http://[fd00::1]:8080",
+			},
+			expectReason:  infrav1.URLBackendReadyReason,
+			expectBackend: &infrav1.BackendStatus{Address: "fd00::1", Port: 8080},
+		},
+		{
+			name: "URL backend with unsupported scheme",
+			backend: infrav1.BackendRef{
+				URL: "ftp://idp.example.com",
+			},
+			expectReason: infrav1.InvalidURLReason,
+		},
+		{
+			name: "URL backend with invalid port",
+			backend: infrav1.BackendRef{
+				URL: "http://idp.example.com:99999",
+			},
+			expectReason: infrav1.InvalidURLReason,
+		},
+		{
+			name: "URL backend which can not be resolved",
+			backend: infrav1.BackendRef{
+				URL: "https://unknown.example.com",
+			},
+			expectReason: infrav1.URLNotResolvableReason,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			certificates, err := proxy.NewCertificateStore(proxy.UnknownSNIReject, nil)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			r := &OAUTH2ProxyReconciler{
+				Client:       fake.NewClientBuilder().WithObjects(services...).Build(),
+				HttpProxy:    proxy.New(logr.Discard(), nil),
+				Certificates: certificates,
+				Recorder:     record.NewFakeRecorder(10),
+				Resolver: fakeResolver{
+					"idp.example.com": {"192.0.2.1"},
+				},
+			}
+
+			ph, _, err := r.reconcile(context.Background(), infrav1.OAUTH2Proxy{
+				ObjectMeta: metav1.ObjectMeta{Name: "idp", Namespace: "default"},
+				Spec: infrav1.OAUTH2ProxySpec{
+					Host:        "idp",
+					RedirectURI: "https://oauth2proxy",
+					Backend:     test.backend,
+				},
+			})
+			g.Expect(err).NotTo(HaveOccurred())
+
+			ready := apimeta.FindStatusCondition(ph.Status.Conditions, infrav1.ReadyCondition)
+			g.Expect(ready).NotTo(BeNil())
+			g.Expect(ready.Reason).To(Equal(test.expectReason))
+			g.Expect(ph.Status.Backend).To(Equal(test.expectBackend))
+
+			if test.expectBackend != nil {
+				g.Expect(ph.Status.RedirectURI).To(Equal("https://oauth2proxy"))
+			} else {
+				g.Expect(ph.Status.RedirectURI).To(BeEmpty())
+			}
+		})
+	}
+}
+
+func TestReconcileStatus(t *testing.T) {
+	g := NewWithT(t)
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = infrav1.AddToScheme(scheme)
+
+	lastRouted := metav1.NewTime(time.Unix(1700000000, 0))
+	ph := &infrav1.OAUTH2Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: "idp", Namespace: "default", Generation: 3},
+		Spec: infrav1.OAUTH2ProxySpec{
+			Host:        "idp",
+			RedirectURI: "https://oauth2proxy",
+			Backend: infrav1.BackendRef{
+				URL: "https://idp.example.com",
+			},
+		},
+		Status: infrav1.OAUTH2ProxyStatus{
+			LastRoutedTime: &lastRouted,
+			Stats:          &infrav1.RequestStats{Rewrites: 2, Callbacks: 1},
+		},
+	}
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(ph).WithStatusSubresource(ph).Build()
+	certificates, err := proxy.NewCertificateStore(proxy.UnknownSNIReject, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	r := &OAUTH2ProxyReconciler{
+		Client:       c,
+		Log:          logr.Discard(),
+		HttpProxy:    proxy.New(logr.Discard(), nil),
+		Certificates: certificates,
+		Recorder:     record.NewFakeRecorder(10),
+		Resolver: fakeResolver{
+			"idp.example.com": {"192.0.2.1"},
+		},
+	}
+
+	_, err = r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ph)})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	latest := &infrav1.OAUTH2Proxy{}
+	g.Expect(c.Get(context.Background(), client.ObjectKeyFromObject(ph), latest)).To(Succeed())
+	g.Expect(latest.Status.ObservedGeneration).To(Equal(latest.Generation))
+	g.Expect(latest.Status.RedirectURI).To(Equal("https://oauth2proxy"))
+	g.Expect(latest.Status.Backend).To(Equal(&infrav1.BackendStatus{Address: "idp.example.com", Port: 443}))
+
+	ready := apimeta.FindStatusCondition(latest.Status.Conditions, infrav1.ReadyCondition)
+	g.Expect(ready).NotTo(BeNil())
+	g.Expect(ready.ObservedGeneration).To(Equal(latest.Generation))
+
+	// The serving stats are left to the StatusUpdater
+	g.Expect(latest.Status.LastRoutedTime.Equal(&lastRouted)).To(BeTrue())
+	g.Expect(latest.Status.Stats).To(Equal(&infrav1.RequestStats{Rewrites: 2, Callbacks: 1}))
+}
+
+func TestReconcileConditions(t *testing.T) {
+	g := NewWithT(t)
+
+	certificates, err := proxy.NewCertificateStore(proxy.UnknownSNIReject, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	recorder := record.NewFakeRecorder(10)
+	r := &OAUTH2ProxyReconciler{
+		Client:       fake.NewClientBuilder().Build(),
+		HttpProxy:    proxy.New(logr.Discard(), nil),
+		Certificates: certificates,
+		Recorder:     recorder,
+		Resolver: fakeResolver{
+			"idp.example.com": {"192.0.2.1"},
+		},
+	}
+
+	ph := infrav1.OAUTH2Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: "idp", Namespace: "default", Generation: 1},
+		Spec: infrav1.OAUTH2ProxySpec{
+			Host:        "idp",
+			RedirectURI: "https://oauth2proxy",
+			Backend: infrav1.BackendRef{
+				Service: infrav1.ServiceBackendRef{
+					Name: "missing",
+					Port: infrav1.ServiceBackendPort{Number: 80},
+				},
+			},
+		},
+	}
+
+	condition := func(ph infrav1.OAUTH2Proxy, conditionType string) *metav1.Condition {
+		return apimeta.FindStatusCondition(ph.Status.Conditions, conditionType)
+	}
+
+	// A missing service may be created later
+	ph, _, err = r.reconcile(context.Background(), ph)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(condition(ph, infrav1.ReadyCondition).Status).To(Equal(metav1.ConditionFalse))
+	g.Expect(condition(ph, infrav1.BackendResolvedCondition).Reason).To(Equal(infrav1.ServiceNotFoundReason))
+	g.Expect(condition(ph, infrav1.RegisteredCondition).Reason).To(Equal(infrav1.BackendNotResolvedReason))
+	g.Expect(condition(ph, infrav1.ReconcilingCondition).Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(condition(ph, infrav1.StalledCondition)).To(BeNil())
+	g.Expect(<-recorder.Events).To(Equal("Warning ServiceNotFound Service not found"))
+
+	// An invalid URL can not recover without changing the OAUTH2Proxy
+	ph.Generation = 2
+	ph.Spec.Backend = infrav1.BackendRef{URL: "ftp://idp.example.com"}
+	ph, _, err = r.reconcile(context.Background(), ph)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(condition(ph, infrav1.BackendResolvedCondition).Reason).To(Equal(infrav1.InvalidURLReason))
+	g.Expect(condition(ph, infrav1.StalledCondition).Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(condition(ph, infrav1.StalledCondition).ObservedGeneration).To(Equal(int64(2)))
+	g.Expect(condition(ph, infrav1.ReconcilingCondition)).To(BeNil())
+	g.Expect(<-recorder.Events).To(HavePrefix("Warning InvalidURL "))
+
+	ph.Generation = 3
+	ph.Spec.Backend = infrav1.BackendRef{URL: "https://idp.example.com"}
+	ph, _, err = r.reconcile(context.Background(), ph)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(condition(ph, infrav1.ReadyCondition).Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(condition(ph, infrav1.BackendResolvedCondition).Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(condition(ph, infrav1.RegisteredCondition).Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(condition(ph, infrav1.StalledCondition)).To(BeNil())
+	g.Expect(condition(ph, infrav1.ReconcilingCondition)).To(BeNil())
+	g.Expect(<-recorder.Events).To(Equal("Normal URLBackendReady URL backend successfully registered"))
+
+	// Reconciling an unchanged OAUTH2Proxy does not record another event
+	ph, _, err = r.reconcile(context.Background(), ph)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(condition(ph, infrav1.ReadyCondition).Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(recorder.Events).To(BeEmpty())
+	g.Expect(r.HttpProxy.Registrations()).To(HaveLen(1))
+
+	// A registered OAUTH2Proxy is not proxied anymore once its backend is gone
+	ph.Generation = 4
+	ph.Spec.Backend = infrav1.BackendRef{
+		Service: infrav1.ServiceBackendRef{
+			Name: "missing",
+			Port: infrav1.ServiceBackendPort{Number: 80},
+		},
+	}
+	ph, _, err = r.reconcile(context.Background(), ph)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(condition(ph, infrav1.RegisteredCondition).Status).To(Equal(metav1.ConditionFalse))
+	g.Expect(r.HttpProxy.Registrations()).To(BeEmpty())
+	g.Expect(<-recorder.Events).To(Equal("Warning ServiceNotFound Service not found"))
+}
+
+func TestRequestsForSecretChange(t *testing.T) {
+	g := NewWithT(t)
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = infrav1.AddToScheme(scheme)
+
+	referencing := &infrav1.OAUTH2Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: "idp", Namespace: "default"},
+		Spec: infrav1.OAUTH2ProxySpec{
+			TLS: infrav1.ListenerTLS{SecretRef: &infrav1.LocalObjectReference{Name: "idp-tls"}},
+		},
+	}
+	other := &infrav1.OAUTH2Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "other"},
+		Spec: infrav1.OAUTH2ProxySpec{
+			TLS: infrav1.ListenerTLS{SecretRef: &infrav1.LocalObjectReference{Name: "idp-tls"}},
+		},
+	}
+
+	r := &OAUTH2ProxyReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(referencing, other).
+			WithIndex(&infrav1.OAUTH2Proxy{}, secretIndex, secretRefs).Build(),
+		Log: logr.Discard(),
+	}
+
+	// Secrets are watched by their metadata only
+	secret := &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "idp-tls", Namespace: "default"}}
+	g.Expect(r.requestsForSecretChange(context.Background(), secret)).To(Equal([]reconcile.Request{
+		{NamespacedName: client.ObjectKeyFromObject(referencing)},
+	}))
+
+	secret.Name = "unreferenced"
+	g.Expect(r.requestsForSecretChange(context.Background(), secret)).To(BeEmpty())
+}
+
+// fakeResolver resolves the hosts it contains
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := r[host]; ok {
+		return addrs, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
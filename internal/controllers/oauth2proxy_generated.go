@@ -0,0 +1,243 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// +kubebuilder:rbac:groups="",resources=services,verbs=create;update;patch;delete
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+
+	infrav1 "github.com/DoodleScheduling/oauth2-redirect-controller/api/v1"
+)
+
+const (
+	// generatedSuffix is appended to the name of the OAUTH2Proxy for the generated Ingress, HTTPRoute and Service
+	generatedSuffix = "-oauth2-proxy"
+	// proxyPortName is the name of the port of the generated Service
+	proxyPortName = "http"
+)
+
+// reconcileGenerated creates, updates or deletes the objects routing the OAUTH2Proxy to the proxy.
+// Ingress backends must be in the namespace of the Ingress, the Ingress routes to an ExternalName Service pointing at the proxy.
+// HTTPRoutes reference the proxy Service directly if possible, see proxyServiceRef, otherwise they route to the ExternalName Service as well.
+// The ExternalName Service is deleted once it is not needed anymore.
+// The outcome is reported in the RoutesGenerated condition, a missing proxy Service is only recorded as event once it is detected.
+func (r *OAUTH2ProxyReconciler) reconcileGenerated(ctx context.Context, ph infrav1.OAUTH2Proxy) (infrav1.OAUTH2Proxy, error) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ph.GetName() + generatedSuffix,
+			Namespace: ph.GetNamespace(),
+		},
+	}
+
+	if ph.Spec.Ingress == nil && ph.Spec.GatewayRef == nil {
+		return infrav1.OAUTH2ProxyNoRoutes(infrav1.OAUTH2ProxyNoHTTPRoutes(ph)), kerrors.NewAggregate([]error{
+			r.reconcileIngress(ctx, ph, svc),
+			r.deleteHTTPRoutes(ctx, ph),
+			r.deleteOwned(ctx, ph, svc),
+			r.reconcileProxyReferenceGrant(ctx),
+		})
+	}
+
+	if r.ProxyService == "" {
+		msg := "Routes can not be generated, the controller has no --ingress-proxy-service configured"
+		if generated := apimeta.FindStatusCondition(ph.Status.Conditions, infrav1.RoutesGeneratedCondition); generated == nil ||
+			generated.Status != metav1.ConditionFalse || generated.Reason != infrav1.ProxyServiceNotConfiguredReason {
+			r.Recorder.Event(&ph, v1.EventTypeWarning, infrav1.ProxyServiceNotConfiguredReason, msg)
+		}
+
+		return infrav1.OAUTH2ProxyRoutesGenerated(ph, false, infrav1.ProxyServiceNotConfiguredReason, msg), nil
+	}
+
+	proxySvc, direct := r.proxyServiceRef()
+	if ph.Spec.Ingress == nil && direct {
+		if err := r.deleteOwned(ctx, ph, svc); err != nil {
+			return ph, err
+		}
+	} else if err := r.createOrUpdateOwned(ctx, &ph, svc, func() {
+		svc.Spec.Type = v1.ServiceTypeExternalName
+		svc.Spec.ExternalName = r.ProxyService
+		svc.Spec.ClusterIP = ""
+		svc.Spec.Selector = nil
+		svc.Spec.Ports = []v1.ServicePort{
+			{
+				Name:       proxyPortName,
+				Port:       r.ProxyPort,
+				TargetPort: intstr.FromInt32(r.ProxyPort),
+				Protocol:   v1.ProtocolTCP,
+			},
+		}
+	}); err != nil {
+		return ph, err
+	}
+
+	backend := gatewayv1.BackendObjectReference{
+		Name: gatewayv1.ObjectName(svc.GetName()),
+	}
+
+	if direct {
+		backend.Name = gatewayv1.ObjectName(proxySvc.Name)
+		if proxySvc.Namespace != ph.GetNamespace() {
+			backend.Namespace = ptr.To(gatewayv1.Namespace(proxySvc.Namespace))
+		}
+	}
+
+	grantErr := r.reconcileProxyReferenceGrant(ctx)
+	ingressErr := r.reconcileIngress(ctx, ph, svc)
+	ph, routeErr := r.reconcileHTTPRoutes(ctx, ph, backend)
+	if err := kerrors.NewAggregate([]error{grantErr, ingressErr, routeErr}); err != nil {
+		return ph, err
+	}
+
+	return infrav1.OAUTH2ProxyRoutesGenerated(ph, true, infrav1.RoutesGeneratedReason, "Routes have been generated"), nil
+}
+
+// redirectURIHost returns the host name of the redirectURI or an empty string if it can not be parsed
+func redirectURIHost(ph infrav1.OAUTH2Proxy) string {
+	u, err := url.Parse(ph.Spec.RedirectURI)
+	if err != nil {
+		return ""
+	}
+
+	return u.Hostname()
+}
+
+// redirectHostRefs indexes OAUTH2Proxies by the host of their redirectURI
+func redirectHostRefs(o client.Object) []string {
+	ph := o.(*infrav1.OAUTH2Proxy)
+	if host := redirectURIHost(*ph); host != "" {
+		return []string{host}
+	}
+
+	return nil
+}
+
+// routesCallbacks returns true if the generated objects of the OAUTH2Proxy route the host of its redirectURI.
+// OAUTH2Proxies may share the host of their redirectURI while a host can only be routed once per Ingress class or Gateway.
+// The host is routed by the oldest OAUTH2Proxy for which sameRouting returns true.
+func (r *OAUTH2ProxyReconciler) routesCallbacks(ctx context.Context, ph infrav1.OAUTH2Proxy, sameRouting func(other infrav1.OAUTH2Proxy) bool) (bool, error) {
+	host := redirectURIHost(ph)
+	if host == "" || host == ph.Spec.Host {
+		return host != "", nil
+	}
+
+	var list infrav1.OAUTH2ProxyList
+	if err := r.List(ctx, &list, client.MatchingFields{
+		redirectHostIndex: host,
+	}); err != nil {
+		return false, err
+	}
+
+	for _, other := range list.Items {
+		if objectKey(&other) == objectKey(&ph) || !other.GetDeletionTimestamp().IsZero() || !sameRouting(other) {
+			continue
+		}
+
+		if olderThan(other, ph) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// olderThan returns true if a was created before b, OAUTH2Proxies created at the same time are ordered by namespace and name
+func olderThan(a, b infrav1.OAUTH2Proxy) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+
+	return objectKey(&a).String() < objectKey(&b).String()
+}
+
+// requestsForRedirectHostChange reconciles the OAUTH2Proxies sharing the host of the redirectURI with a changed OAUTH2Proxy,
+// another one of them might have to route the host now
+func (r *OAUTH2ProxyReconciler) requestsForRedirectHostChange(ctx context.Context, o client.Object) []reconcile.Request {
+	ph, ok := o.(*infrav1.OAUTH2Proxy)
+	if !ok {
+		panic(fmt.Sprintf("expected an OAUTH2Proxy, got %T", o))
+	}
+
+	host := redirectURIHost(*ph)
+	if host == "" {
+		return nil
+	}
+
+	var list infrav1.OAUTH2ProxyList
+	if err := r.List(ctx, &list, client.MatchingFields{
+		redirectHostIndex: host,
+	}); err != nil {
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for _, i := range list.Items {
+		if objectKey(&i) == objectKey(ph) {
+			continue
+		}
+
+		reqs = append(reqs, reconcile.Request{NamespacedName: objectKey(&i)})
+	}
+
+	return reqs
+}
+
+// createOrUpdateOwned creates or updates an object controlled by the OAUTH2Proxy.
+// Existing objects which are not controlled by the OAUTH2Proxy are left untouched.
+func (r *OAUTH2ProxyReconciler) createOrUpdateOwned(ctx context.Context, ph *infrav1.OAUTH2Proxy, obj client.Object, mutate func()) error {
+	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, obj, func() error {
+		if obj.GetResourceVersion() != "" && !metav1.IsControlledBy(obj, ph) {
+			return fmt.Errorf("%T %s already exists and is not owned by the OAUTH2Proxy", obj, obj.GetName())
+		}
+
+		mutate()
+		return controllerutil.SetControllerReference(ph, obj, r.Scheme)
+	})
+
+	return err
+}
+
+// deleteOwned deletes an object if it exists and is controlled by the OAUTH2Proxy
+func (r *OAUTH2ProxyReconciler) deleteOwned(ctx context.Context, ph infrav1.OAUTH2Proxy, obj client.Object) error {
+	if err := r.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	if !metav1.IsControlledBy(obj, &ph) {
+		return nil
+	}
+
+	if err := r.Delete(ctx, obj); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
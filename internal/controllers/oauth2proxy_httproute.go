@@ -0,0 +1,368 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// +kubebuilder:rbac:groups=gateway.networking.k8s.io,resources=httproutes,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=gateway.networking.k8s.io,resources=referencegrants,verbs=create;update;patch;delete,namespace=system
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+	gatewayv1beta1 "sigs.k8s.io/gateway-api/apis/v1beta1"
+
+	infrav1 "github.com/DoodleScheduling/oauth2-redirect-controller/api/v1"
+)
+
+const (
+	// callbackRouteSuffix is appended to the name of the generated HTTPRoute routing the host of the redirectURI
+	callbackRouteSuffix = "-callback"
+	// httpRoutesNotInstalledReason is recorded if a Gateway is referenced but the HTTPRoute API is not installed
+	httpRoutesNotInstalledReason = "HTTPRoutesNotInstalled"
+	// proxyReferenceGrantSuffix is appended to the name of the proxy Service for the ReferenceGrant permitting HTTPRoutes to reference it
+	proxyReferenceGrantSuffix = "-httproutes"
+)
+
+// httpRoutesInstalled returns true if the HTTPRoute API is served by the cluster
+func httpRoutesInstalled(mapper apimeta.RESTMapper) (bool, error) {
+	_, err := mapper.RESTMapping(schema.GroupKind{
+		Group: gatewayv1.GroupName,
+		Kind:  "HTTPRoute",
+	}, gatewayv1.GroupVersion.Version)
+
+	if apimeta.IsNoMatchError(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// proxyServiceRef returns the name and namespace of the proxy Service if HTTPRoutes can reference it directly.
+// This requires the ReferenceGrant API and ProxyService to be the cluster DNS name of a Service, <name>.<namespace>.svc[.<cluster domain>].
+func (r *OAUTH2ProxyReconciler) proxyServiceRef() (types.NamespacedName, bool) {
+	labels := strings.Split(r.ProxyService, ".")
+	if !r.referenceGrants || len(labels) < 3 || labels[2] != "svc" {
+		return types.NamespacedName{}, false
+	}
+
+	return types.NamespacedName{Namespace: labels[1], Name: labels[0]}, true
+}
+
+// reconcileProxyReferenceGrant permits HTTPRoutes to reference the proxy Service from the namespaces of all OAUTH2Proxies referencing a Gateway.
+// The namespaces are computed from the current OAUTH2Proxies on every reconcile, namespaces which do not need it anymore are removed.
+// The ReferenceGrant is shared by all OAUTH2Proxies, hence owned by none of them, and deleted once no namespace needs it.
+func (r *OAUTH2ProxyReconciler) reconcileProxyReferenceGrant(ctx context.Context) error {
+	proxySvc, direct := r.proxyServiceRef()
+	if !r.httpRoutes || !direct {
+		return nil
+	}
+
+	grant := &gatewayv1beta1.ReferenceGrant{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      proxySvc.Name + proxyReferenceGrantSuffix,
+			Namespace: proxySvc.Namespace,
+		},
+	}
+
+	var list infrav1.OAUTH2ProxyList
+	if err := r.List(ctx, &list); err != nil {
+		return err
+	}
+
+	var namespaces []string
+	for _, ph := range list.Items {
+		if ph.Spec.GatewayRef == nil || !ph.GetDeletionTimestamp().IsZero() || ph.GetNamespace() == proxySvc.Namespace {
+			continue
+		}
+
+		namespaces = append(namespaces, ph.GetNamespace())
+	}
+
+	if len(namespaces) == 0 {
+		return client.IgnoreNotFound(r.Delete(ctx, grant))
+	}
+
+	slices.Sort(namespaces)
+	namespaces = slices.Compact(namespaces)
+
+	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, grant, func() error {
+		grant.Spec.From = make([]gatewayv1beta1.ReferenceGrantFrom, 0, len(namespaces))
+		for _, namespace := range namespaces {
+			grant.Spec.From = append(grant.Spec.From, gatewayv1beta1.ReferenceGrantFrom{
+				Group:     gatewayv1.GroupName,
+				Kind:      "HTTPRoute",
+				Namespace: gatewayv1.Namespace(namespace),
+			})
+		}
+
+		grant.Spec.To = []gatewayv1beta1.ReferenceGrantTo{
+			{
+				Group: "",
+				Kind:  "Service",
+				Name:  ptr.To(gatewayv1.ObjectName(proxySvc.Name)),
+			},
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// reconcileHTTPRoutes creates or updates the HTTPRoutes generated for an OAUTH2Proxy referencing a Gateway
+// and mirrors their status into the HTTPRouteAccepted and HTTPRouteResolvedRefs conditions.
+// The HTTPRoutes route to the backend, a reference to another namespace is permitted by a ReferenceGrant, see reconcileProxyReferenceGrant.
+// The HTTPRoutes are deleted once the OAUTH2Proxy does not reference a Gateway anymore.
+func (r *OAUTH2ProxyReconciler) reconcileHTTPRoutes(ctx context.Context, ph infrav1.OAUTH2Proxy, backend gatewayv1.BackendObjectReference) (infrav1.OAUTH2Proxy, error) {
+	if ph.Spec.GatewayRef == nil {
+		return infrav1.OAUTH2ProxyNoHTTPRoutes(ph), r.deleteHTTPRoutes(ctx, ph)
+	}
+
+	if !r.httpRoutes {
+		r.Recorder.Event(&ph, v1.EventTypeWarning, httpRoutesNotInstalledReason, "HTTPRoutes can not be generated, the HTTPRoute API is not installed")
+		return infrav1.OAUTH2ProxyNoHTTPRoutes(ph), nil
+	}
+
+	// Only one of the HTTPRoutes attached to the same Gateway listener routes a shared redirectURI host
+	parentRef := gatewayParentRef(ph)
+	callbacks, err := r.routesCallbacks(ctx, ph, func(other infrav1.OAUTH2Proxy) bool {
+		return other.Spec.GatewayRef != nil && reflect.DeepEqual(gatewayParentRef(other), parentRef)
+	})
+	if err != nil {
+		return ph, err
+	}
+
+	backend.Port = ptr.To(gatewayv1.PortNumber(r.ProxyPort))
+	desired := httpRoutes(ph, backend, callbacks)
+	var routes []gatewayv1.HTTPRoute
+
+	for _, d := range desired {
+		route := &gatewayv1.HTTPRoute{ObjectMeta: d.ObjectMeta}
+		if err := r.createOrUpdateOwned(ctx, &ph, route, func() {
+			route.Spec = d.Spec
+		}); err != nil {
+			return ph, err
+		}
+
+		routes = append(routes, *route)
+	}
+
+	// The callback route is not needed if the redirectURI points at the host or another HTTPRoute routes the redirectURI host
+	if len(desired) == 1 {
+		if err := r.deleteOwned(ctx, ph, &gatewayv1.HTTPRoute{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      ph.GetName() + generatedSuffix + callbackRouteSuffix,
+				Namespace: ph.GetNamespace(),
+			},
+		}); err != nil {
+			return ph, err
+		}
+	}
+
+	return httpRouteConditions(ph, routes), nil
+}
+
+// deleteHTTPRoutes deletes the HTTPRoutes generated for an OAUTH2Proxy
+func (r *OAUTH2ProxyReconciler) deleteHTTPRoutes(ctx context.Context, ph infrav1.OAUTH2Proxy) error {
+	if !r.httpRoutes {
+		return nil
+	}
+
+	for _, name := range []string{ph.GetName() + generatedSuffix, ph.GetName() + generatedSuffix + callbackRouteSuffix} {
+		if err := r.deleteOwned(ctx, ph, &gatewayv1.HTTPRoute{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: ph.GetNamespace(),
+			},
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// gatewayParentRef returns the parentRef of the generated HTTPRoutes.
+// Fields defaulted by the API server are set explicitly to not update the HTTPRoutes on every reconcile.
+func gatewayParentRef(ph infrav1.OAUTH2Proxy) gatewayv1.ParentReference {
+	namespace := ph.Spec.GatewayRef.Namespace
+	if namespace == "" {
+		namespace = ph.GetNamespace()
+	}
+
+	ref := gatewayv1.ParentReference{
+		Group:     ptr.To(gatewayv1.Group(gatewayv1.GroupName)),
+		Kind:      ptr.To(gatewayv1.Kind("Gateway")),
+		Namespace: ptr.To(gatewayv1.Namespace(namespace)),
+		Name:      gatewayv1.ObjectName(ph.Spec.GatewayRef.Name),
+	}
+
+	if ph.Spec.GatewayRef.SectionName != "" {
+		ref.SectionName = ptr.To(gatewayv1.SectionName(ph.Spec.GatewayRef.SectionName))
+	}
+
+	return ref
+}
+
+// httpRoutes returns the HTTPRoutes routing the host and paths of the OAUTH2Proxy to the backend Service.
+// If callbacks is set all paths of the redirectURI host are routed by a second HTTPRoute if it differs from the host.
+func httpRoutes(ph infrav1.OAUTH2Proxy, backend gatewayv1.BackendObjectReference, callbacks bool) []gatewayv1.HTTPRoute {
+	backend.Group = ptr.To(gatewayv1.Group(""))
+	backend.Kind = ptr.To(gatewayv1.Kind("Service"))
+	backendRefs := []gatewayv1.HTTPBackendRef{
+		{
+			BackendRef: gatewayv1.BackendRef{
+				BackendObjectReference: backend,
+				Weight:                 ptr.To(int32(1)),
+			},
+		},
+	}
+
+	redirectHost := redirectURIHost(ph)
+
+	// Callbacks arrive at the original redirect_uri path, hence all paths of the redirectURI host are routed
+	paths := ph.Spec.Paths
+	if len(paths) == 0 || redirectHost == ph.Spec.Host {
+		paths = []infrav1.HTTPPathMatch{{Type: infrav1.PathMatchPrefix, Value: "/"}}
+	}
+
+	route := func(name, host string, paths []infrav1.HTTPPathMatch) gatewayv1.HTTPRoute {
+		var matches []gatewayv1.HTTPRouteMatch
+		for _, path := range paths {
+			pathType := gatewayv1.PathMatchPathPrefix
+			if path.Type == infrav1.PathMatchExact {
+				pathType = gatewayv1.PathMatchExact
+			}
+
+			matches = append(matches, gatewayv1.HTTPRouteMatch{
+				Path: &gatewayv1.HTTPPathMatch{
+					Type:  ptr.To(pathType),
+					Value: ptr.To(path.Value),
+				},
+			})
+		}
+
+		return gatewayv1.HTTPRoute{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: ph.GetNamespace(),
+			},
+			Spec: gatewayv1.HTTPRouteSpec{
+				CommonRouteSpec: gatewayv1.CommonRouteSpec{
+					ParentRefs: []gatewayv1.ParentReference{gatewayParentRef(ph)},
+				},
+				Hostnames: []gatewayv1.Hostname{gatewayv1.Hostname(host)},
+				Rules: []gatewayv1.HTTPRouteRule{
+					{
+						Matches:     matches,
+						BackendRefs: backendRefs,
+					},
+				},
+			},
+		}
+	}
+
+	routes := []gatewayv1.HTTPRoute{
+		route(ph.GetName()+generatedSuffix, ph.Spec.Host, paths),
+	}
+
+	if callbacks && redirectHost != "" && redirectHost != ph.Spec.Host {
+		routes = append(routes, route(ph.GetName()+generatedSuffix+callbackRouteSuffix, redirectHost, []infrav1.HTTPPathMatch{
+			{Type: infrav1.PathMatchPrefix, Value: "/"},
+		}))
+	}
+
+	return routes
+}
+
+// httpRouteConditions mirrors the Accepted and ResolvedRefs conditions the referenced Gateway reported for the HTTPRoutes.
+// A condition is False if it is False for any HTTPRoute, Unknown if any HTTPRoute has not been processed for its
+// current generation yet and True otherwise.
+func httpRouteConditions(ph infrav1.OAUTH2Proxy, routes []gatewayv1.HTTPRoute) infrav1.OAUTH2Proxy {
+	parentRef := gatewayParentRef(ph)
+
+	for _, mirror := range []struct {
+		routeCondition gatewayv1.RouteConditionType
+		proxyCondition string
+	}{
+		{gatewayv1.RouteConditionAccepted, infrav1.HTTPRouteAcceptedCondition},
+		{gatewayv1.RouteConditionResolvedRefs, infrav1.HTTPRouteResolvedRefsCondition},
+	} {
+		status := metav1.ConditionTrue
+		reason := string(mirror.routeCondition)
+		message := fmt.Sprintf("HTTPRoutes are %s by the Gateway", mirror.routeCondition)
+
+		for _, route := range routes {
+			condition := routeParentCondition(route, parentRef, mirror.routeCondition)
+
+			switch {
+			case condition == nil || condition.ObservedGeneration < route.GetGeneration():
+				if status == metav1.ConditionTrue {
+					status = metav1.ConditionUnknown
+					reason = infrav1.HTTPRoutePendingReason
+					message = fmt.Sprintf("HTTPRoute %s has not been processed by the Gateway yet", route.GetName())
+				}
+			case condition.Status == metav1.ConditionTrue:
+				if status == metav1.ConditionTrue {
+					reason = condition.Reason
+				}
+			default:
+				if status != metav1.ConditionFalse {
+					status = condition.Status
+					reason = condition.Reason
+					message = fmt.Sprintf("HTTPRoute %s: %s", route.GetName(), condition.Message)
+				}
+			}
+		}
+
+		ph = infrav1.OAUTH2ProxyHTTPRouteCondition(ph, mirror.proxyCondition, status, reason, message)
+	}
+
+	return ph
+}
+
+// routeParentCondition returns the condition the referenced Gateway reported for an HTTPRoute
+func routeParentCondition(route gatewayv1.HTTPRoute, parentRef gatewayv1.ParentReference, conditionType gatewayv1.RouteConditionType) *metav1.Condition {
+	for _, parent := range route.Status.Parents {
+		namespace := route.GetNamespace()
+		if parent.ParentRef.Namespace != nil {
+			namespace = string(*parent.ParentRef.Namespace)
+		}
+
+		if parent.ParentRef.Name != parentRef.Name ||
+			namespace != string(*parentRef.Namespace) ||
+			ptr.Deref(parent.ParentRef.SectionName, "") != ptr.Deref(parentRef.SectionName, "") {
+			continue
+		}
+
+		return apimeta.FindStatusCondition(parent.Conditions, string(conditionType))
+	}
+
+	return nil
+}
@@ -0,0 +1,387 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+	gatewayv1beta1 "sigs.k8s.io/gateway-api/apis/v1beta1"
+
+	infrav1 "github.com/DoodleScheduling/oauth2-redirect-controller/api/v1"
+)
+
+func TestHTTPRoutes(t *testing.T) {
+	g := NewWithT(t)
+
+	ph := infrav1.OAUTH2Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: "idp", Namespace: "default"},
+		Spec: infrav1.OAUTH2ProxySpec{
+			Host:        "idp.example.com",
+			RedirectURI: "https://oauth2proxy.example.com/callback",
+			Paths: []infrav1.HTTPPathMatch{
+				{Type: infrav1.PathMatchPrefix, Value: "/auth"},
+				{Type: infrav1.PathMatchExact, Value: "/login"},
+			},
+			GatewayRef: &infrav1.GatewayReference{
+				Name:        "public",
+				Namespace:   "gateways",
+				SectionName: "https",
+			},
+		},
+	}
+
+	backend := gatewayv1.BackendObjectReference{Name: "idp-oauth2-proxy", Port: ptr.To(gatewayv1.PortNumber(80))}
+	routes := httpRoutes(ph, backend, true)
+	g.Expect(routes).To(HaveLen(2))
+
+	g.Expect(routes[0].Name).To(Equal("idp-oauth2-proxy"))
+	g.Expect(routes[0].Spec.ParentRefs).To(Equal([]gatewayv1.ParentReference{
+		{
+			Group:       ptr.To(gatewayv1.Group("gateway.networking.k8s.io")),
+			Kind:        ptr.To(gatewayv1.Kind("Gateway")),
+			Namespace:   ptr.To(gatewayv1.Namespace("gateways")),
+			Name:        "public",
+			SectionName: ptr.To(gatewayv1.SectionName("https")),
+		},
+	}))
+	g.Expect(routes[0].Spec.Hostnames).To(Equal([]gatewayv1.Hostname{"idp.example.com"}))
+	g.Expect(routes[0].Spec.Rules).To(HaveLen(1))
+	g.Expect(routes[0].Spec.Rules[0].Matches).To(Equal([]gatewayv1.HTTPRouteMatch{
+		{Path: &gatewayv1.HTTPPathMatch{Type: ptr.To(gatewayv1.PathMatchPathPrefix), Value: ptr.To("/auth")}},
+		{Path: &gatewayv1.HTTPPathMatch{Type: ptr.To(gatewayv1.PathMatchExact), Value: ptr.To("/login")}},
+	}))
+	g.Expect(routes[0].Spec.Rules[0].BackendRefs).To(HaveLen(1))
+	g.Expect(routes[0].Spec.Rules[0].BackendRefs[0].Name).To(Equal(gatewayv1.ObjectName("idp-oauth2-proxy")))
+	g.Expect(routes[0].Spec.Rules[0].BackendRefs[0].Port).To(Equal(ptr.To(gatewayv1.PortNumber(80))))
+
+	g.Expect(routes[1].Name).To(Equal("idp-oauth2-proxy-callback"))
+	g.Expect(routes[1].Spec.Hostnames).To(Equal([]gatewayv1.Hostname{"oauth2proxy.example.com"}))
+	g.Expect(routes[1].Spec.Rules[0].Matches).To(Equal([]gatewayv1.HTTPRouteMatch{
+		{Path: &gatewayv1.HTTPPathMatch{Type: ptr.To(gatewayv1.PathMatchPathPrefix), Value: ptr.To("/")}},
+	}))
+
+	// No callback route if another HTTPRoute routes the redirectURI host
+	g.Expect(httpRoutes(ph, backend, false)).To(HaveLen(1))
+
+	// A single route for all paths if the redirectURI host is the host
+	ph.Spec.RedirectURI = "https://idp.example.com/oauth2"
+	ph.Spec.GatewayRef = &infrav1.GatewayReference{Name: "public"}
+	routes = httpRoutes(ph, backend, true)
+	g.Expect(routes).To(HaveLen(1))
+	g.Expect(routes[0].Spec.ParentRefs[0].Namespace).To(Equal(ptr.To(gatewayv1.Namespace("default"))))
+	g.Expect(routes[0].Spec.ParentRefs[0].SectionName).To(BeNil())
+	g.Expect(routes[0].Spec.Rules[0].Matches).To(Equal([]gatewayv1.HTTPRouteMatch{
+		{Path: &gatewayv1.HTTPPathMatch{Type: ptr.To(gatewayv1.PathMatchPathPrefix), Value: ptr.To("/")}},
+	}))
+}
+
+func TestHTTPRouteConditions(t *testing.T) {
+	ph := infrav1.OAUTH2Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: "idp", Namespace: "default"},
+		Spec: infrav1.OAUTH2ProxySpec{
+			GatewayRef: &infrav1.GatewayReference{Name: "public"},
+		},
+	}
+
+	parent := func(name string, conditions ...metav1.Condition) gatewayv1.RouteParentStatus {
+		return gatewayv1.RouteParentStatus{
+			ParentRef:  gatewayv1.ParentReference{Name: gatewayv1.ObjectName(name)},
+			Conditions: conditions,
+		}
+	}
+
+	route := func(name string, parents ...gatewayv1.RouteParentStatus) gatewayv1.HTTPRoute {
+		return gatewayv1.HTTPRoute{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Status: gatewayv1.HTTPRouteStatus{
+				RouteStatus: gatewayv1.RouteStatus{Parents: parents},
+			},
+		}
+	}
+
+	accepted := metav1.Condition{Type: "Accepted", Status: metav1.ConditionTrue, Reason: "Accepted"}
+	resolved := metav1.Condition{Type: "ResolvedRefs", Status: metav1.ConditionTrue, Reason: "ResolvedRefs"}
+	notAllowed := metav1.Condition{Type: "Accepted", Status: metav1.ConditionFalse, Reason: "NotAllowedByListeners", Message: "not allowed"}
+
+	tests := []struct {
+		name               string
+		routes             []gatewayv1.HTTPRoute
+		accepted           metav1.ConditionStatus
+		acceptedReason     string
+		acceptedMessage    string
+		resolvedRefs       metav1.ConditionStatus
+		resolvedRefsReason string
+	}{
+		{
+			name:               "All routes accepted",
+			routes:             []gatewayv1.HTTPRoute{route("a", parent("public", accepted, resolved)), route("b", parent("public", accepted, resolved))},
+			accepted:           metav1.ConditionTrue,
+			acceptedReason:     "Accepted",
+			acceptedMessage:    "HTTPRoutes are Accepted by the Gateway",
+			resolvedRefs:       metav1.ConditionTrue,
+			resolvedRefsReason: "ResolvedRefs",
+		},
+		{
+			name:               "Routes without status of the Gateway are pending",
+			routes:             []gatewayv1.HTTPRoute{route("a", parent("public", accepted, resolved)), route("b", parent("other", accepted, resolved))},
+			accepted:           metav1.ConditionUnknown,
+			acceptedReason:     "Pending",
+			acceptedMessage:    "HTTPRoute b has not been processed by the Gateway yet",
+			resolvedRefs:       metav1.ConditionUnknown,
+			resolvedRefsReason: "Pending",
+		},
+		{
+			name:               "Any route not accepted",
+			routes:             []gatewayv1.HTTPRoute{route("a"), route("b", parent("public", notAllowed, resolved))},
+			accepted:           metav1.ConditionFalse,
+			acceptedReason:     "NotAllowedByListeners",
+			acceptedMessage:    "HTTPRoute b: not allowed",
+			resolvedRefs:       metav1.ConditionUnknown,
+			resolvedRefsReason: "Pending",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+			result := httpRouteConditions(ph, test.routes)
+
+			condition := apimeta.FindStatusCondition(result.Status.Conditions, infrav1.HTTPRouteAcceptedCondition)
+			g.Expect(condition).NotTo(BeNil())
+			g.Expect(condition.Status).To(Equal(test.accepted))
+			g.Expect(condition.Reason).To(Equal(test.acceptedReason))
+			g.Expect(condition.Message).To(Equal(test.acceptedMessage))
+
+			condition = apimeta.FindStatusCondition(result.Status.Conditions, infrav1.HTTPRouteResolvedRefsCondition)
+			g.Expect(condition).NotTo(BeNil())
+			g.Expect(condition.Status).To(Equal(test.resolvedRefs))
+			g.Expect(condition.Reason).To(Equal(test.resolvedRefsReason))
+		})
+	}
+}
+
+func TestReconcileGeneratedHTTPRoutes(t *testing.T) {
+	g := NewWithT(t)
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = infrav1.AddToScheme(scheme)
+	_ = gatewayv1.AddToScheme(scheme)
+
+	ph := &infrav1.OAUTH2Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: "idp", Namespace: "default", UID: "uid"},
+		Spec: infrav1.OAUTH2ProxySpec{
+			Host:        "idp.example.com",
+			RedirectURI: "https://oauth2proxy.example.com",
+			GatewayRef:  &infrav1.GatewayReference{Name: "public"},
+		},
+	}
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(ph).WithStatusSubresource(&gatewayv1.HTTPRoute{}).
+		WithIndex(&infrav1.OAUTH2Proxy{}, redirectHostIndex, redirectHostRefs).Build()
+	r := &OAUTH2ProxyReconciler{
+		Client:       c,
+		Scheme:       scheme,
+		Recorder:     record.NewFakeRecorder(10),
+		ProxyService: "oauth2-redirect-controller.system.svc.cluster.local",
+		ProxyPort:    80,
+		httpRoutes:   true,
+	}
+
+	key := client.ObjectKey{Namespace: "default", Name: "idp-oauth2-proxy"}
+	callbackKey := client.ObjectKey{Namespace: "default", Name: "idp-oauth2-proxy-callback"}
+
+	result, err := r.reconcileGenerated(context.Background(), *ph)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(apimeta.FindStatusCondition(result.Status.Conditions, infrav1.HTTPRouteAcceptedCondition).Status).To(Equal(metav1.ConditionUnknown))
+
+	svc := &v1.Service{}
+	g.Expect(c.Get(context.Background(), key, svc)).To(Succeed())
+	g.Expect(metav1.IsControlledBy(svc, ph)).To(BeTrue())
+
+	route := &gatewayv1.HTTPRoute{}
+	g.Expect(c.Get(context.Background(), key, route)).To(Succeed())
+	g.Expect(metav1.IsControlledBy(route, ph)).To(BeTrue())
+
+	callback := &gatewayv1.HTTPRoute{}
+	g.Expect(c.Get(context.Background(), callbackKey, callback)).To(Succeed())
+	g.Expect(metav1.IsControlledBy(callback, ph)).To(BeTrue())
+
+	// The status reported by the Gateway is mirrored
+	for _, obj := range []*gatewayv1.HTTPRoute{route, callback} {
+		obj.Status.Parents = []gatewayv1.RouteParentStatus{
+			{
+				ParentRef:      gatewayv1.ParentReference{Name: "public"},
+				ControllerName: "example.com/gateway",
+				Conditions: []metav1.Condition{
+					{Type: "Accepted", Status: metav1.ConditionTrue, Reason: "Accepted", ObservedGeneration: obj.Generation},
+					{Type: "ResolvedRefs", Status: metav1.ConditionFalse, Reason: "BackendNotFound", Message: "service not found", ObservedGeneration: obj.Generation},
+				},
+			},
+		}
+		g.Expect(c.Status().Update(context.Background(), obj)).To(Succeed())
+	}
+
+	result, err = r.reconcileGenerated(context.Background(), *ph)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(apimeta.FindStatusCondition(result.Status.Conditions, infrav1.HTTPRouteAcceptedCondition).Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(apimeta.FindStatusCondition(result.Status.Conditions, infrav1.HTTPRouteResolvedRefsCondition).Reason).To(Equal("BackendNotFound"))
+
+	// The callback route is deleted once the redirectURI points at the host
+	ph.Spec.RedirectURI = "https://idp.example.com/oauth2"
+	_, err = r.reconcileGenerated(context.Background(), *ph)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(errors.IsNotFound(c.Get(context.Background(), callbackKey, callback))).To(BeTrue())
+
+	// All generated objects are deleted once no Gateway is referenced
+	ph.Spec.GatewayRef = nil
+	result, err = r.reconcileGenerated(context.Background(), *ph)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.Status.Conditions).To(BeEmpty())
+	g.Expect(errors.IsNotFound(c.Get(context.Background(), key, route))).To(BeTrue())
+	g.Expect(errors.IsNotFound(c.Get(context.Background(), key, svc))).To(BeTrue())
+}
+
+func TestReconcileGeneratedHTTPRoutesProxyService(t *testing.T) {
+	g := NewWithT(t)
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = infrav1.AddToScheme(scheme)
+	_ = gatewayv1.AddToScheme(scheme)
+	_ = gatewayv1beta1.AddToScheme(scheme)
+
+	proxy := func(namespace string, created time.Time) *infrav1.OAUTH2Proxy {
+		return &infrav1.OAUTH2Proxy{
+			ObjectMeta: metav1.ObjectMeta{Name: "idp", Namespace: namespace, UID: types.UID(namespace), CreationTimestamp: metav1.NewTime(created)},
+			Spec: infrav1.OAUTH2ProxySpec{
+				Host:        namespace + ".example.com",
+				RedirectURI: "https://oauth2proxy.example.com/callback",
+				GatewayRef:  &infrav1.GatewayReference{Name: "public", Namespace: "gateways"},
+			},
+		}
+	}
+
+	created := time.Unix(1700000000, 0)
+	first := proxy("first", created)
+	second := proxy("second", created.Add(time.Minute))
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(first, second).
+		WithIndex(&infrav1.OAUTH2Proxy{}, redirectHostIndex, redirectHostRefs).Build()
+	r := &OAUTH2ProxyReconciler{
+		Client:          c,
+		Scheme:          scheme,
+		Recorder:        record.NewFakeRecorder(10),
+		ProxyService:    "oauth2-redirect-controller.system.svc.cluster.local",
+		ProxyPort:       80,
+		httpRoutes:      true,
+		referenceGrants: true,
+	}
+
+	for _, ph := range []*infrav1.OAUTH2Proxy{first, second} {
+		_, err := r.reconcileGenerated(context.Background(), *ph)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		// No ExternalName Service is generated, the HTTPRoutes reference the proxy Service
+		g.Expect(errors.IsNotFound(c.Get(context.Background(), client.ObjectKey{Namespace: ph.GetNamespace(), Name: "idp-oauth2-proxy"}, &v1.Service{}))).To(BeTrue())
+
+		route := &gatewayv1.HTTPRoute{}
+		g.Expect(c.Get(context.Background(), client.ObjectKey{Namespace: ph.GetNamespace(), Name: "idp-oauth2-proxy"}, route)).To(Succeed())
+		g.Expect(route.Spec.Rules[0].BackendRefs[0].BackendObjectReference).To(Equal(gatewayv1.BackendObjectReference{
+			Group:     ptr.To(gatewayv1.Group("")),
+			Kind:      ptr.To(gatewayv1.Kind("Service")),
+			Name:      "oauth2-redirect-controller",
+			Namespace: ptr.To(gatewayv1.Namespace("system")),
+			Port:      ptr.To(gatewayv1.PortNumber(80)),
+		}))
+	}
+
+	// The reference is permitted for the namespaces of both OAUTH2Proxies
+	grant := &gatewayv1beta1.ReferenceGrant{}
+	g.Expect(c.Get(context.Background(), client.ObjectKey{Namespace: "system", Name: "oauth2-redirect-controller-httproutes"}, grant)).To(Succeed())
+	g.Expect(grant.Spec.From).To(Equal([]gatewayv1beta1.ReferenceGrantFrom{
+		{Group: "gateway.networking.k8s.io", Kind: "HTTPRoute", Namespace: "first"},
+		{Group: "gateway.networking.k8s.io", Kind: "HTTPRoute", Namespace: "second"},
+	}))
+	g.Expect(grant.Spec.To).To(Equal([]gatewayv1beta1.ReferenceGrantTo{
+		{Group: "", Kind: "Service", Name: ptr.To(gatewayv1.ObjectName("oauth2-redirect-controller"))},
+	}))
+
+	// The shared redirectURI host is routed by the HTTPRoutes of the oldest OAUTH2Proxy only
+	g.Expect(c.Get(context.Background(), client.ObjectKey{Namespace: "first", Name: "idp-oauth2-proxy-callback"}, &gatewayv1.HTTPRoute{})).To(Succeed())
+	g.Expect(errors.IsNotFound(c.Get(context.Background(), client.ObjectKey{Namespace: "second", Name: "idp-oauth2-proxy-callback"}, &gatewayv1.HTTPRoute{}))).To(BeTrue())
+
+	g.Expect(c.Delete(context.Background(), first)).To(Succeed())
+	_, err := r.reconcileGenerated(context.Background(), *second)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(c.Get(context.Background(), client.ObjectKey{Namespace: "second", Name: "idp-oauth2-proxy-callback"}, &gatewayv1.HTTPRoute{})).To(Succeed())
+
+	// Namespaces which do not reference the proxy Service anymore are removed
+	g.Expect(c.Get(context.Background(), client.ObjectKeyFromObject(grant), grant)).To(Succeed())
+	g.Expect(grant.Spec.From).To(Equal([]gatewayv1beta1.ReferenceGrantFrom{
+		{Group: "gateway.networking.k8s.io", Kind: "HTTPRoute", Namespace: "second"},
+	}))
+
+	// The ReferenceGrant is deleted once no OAUTH2Proxy references a Gateway
+	g.Expect(c.Get(context.Background(), client.ObjectKeyFromObject(second), second)).To(Succeed())
+	second.Spec.GatewayRef = nil
+	g.Expect(c.Update(context.Background(), second)).To(Succeed())
+	_, err = r.reconcileGenerated(context.Background(), *second)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(errors.IsNotFound(c.Get(context.Background(), client.ObjectKeyFromObject(grant), grant))).To(BeTrue())
+}
+
+func TestReconcileGeneratedHTTPRoutesNotInstalled(t *testing.T) {
+	g := NewWithT(t)
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = infrav1.AddToScheme(scheme)
+
+	recorder := record.NewFakeRecorder(10)
+	r := &OAUTH2ProxyReconciler{
+		Client:       fake.NewClientBuilder().WithScheme(scheme).Build(),
+		Scheme:       scheme,
+		Recorder:     recorder,
+		ProxyService: "oauth2-redirect-controller.system.svc.cluster.local",
+		ProxyPort:    80,
+	}
+
+	_, err := r.reconcileGenerated(context.Background(), infrav1.OAUTH2Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: "idp", Namespace: "default", UID: "uid"},
+		Spec: infrav1.OAUTH2ProxySpec{
+			GatewayRef: &infrav1.GatewayReference{Name: "public"},
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(<-recorder.Events).To(HavePrefix("Warning HTTPRoutesNotInstalled "))
+}
@@ -0,0 +1,166 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=create;update;patch;delete
+
+package controllers
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+
+	infrav1 "github.com/DoodleScheduling/oauth2-redirect-controller/api/v1"
+)
+
+// reconcileIngress creates or updates the Ingress generated for an OAUTH2Proxy.
+// The annotations of the template are merged into the annotations of the Ingress, annotations set by others are kept.
+// Annotations which were removed from the template are removed from the Ingress as well.
+// The Ingress is deleted once the OAUTH2Proxy does not request an Ingress anymore.
+func (r *OAUTH2ProxyReconciler) reconcileIngress(ctx context.Context, ph infrav1.OAUTH2Proxy, svc *v1.Service) error {
+	ing := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ph.GetName() + generatedSuffix,
+			Namespace: ph.GetNamespace(),
+		},
+	}
+
+	if ph.Spec.Ingress == nil {
+		return r.deleteOwned(ctx, ph, ing)
+	}
+
+	// Only one of the Ingresses of the same class routes a shared redirectURI host
+	callbacks, err := r.routesCallbacks(ctx, ph, func(other infrav1.OAUTH2Proxy) bool {
+		return other.Spec.Ingress != nil && ptr.Equal(other.Spec.Ingress.IngressClassName, ph.Spec.Ingress.IngressClassName)
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.createOrUpdateOwned(ctx, &ph, ing, func() {
+		ing.Annotations = mergeAnnotations(ing.Annotations, ph.Spec.Ingress.Annotations)
+		ing.Spec = ingressSpec(ph, svc.GetName(), callbacks)
+	})
+}
+
+// mergeAnnotations sets the annotations of a template on the annotations of a generated object.
+// The keys set from the template are recorded in ManagedAnnotationsAnnotation, keys which are not part of
+// the template anymore are removed while annotations set by others are kept.
+func mergeAnnotations(current, template map[string]string) map[string]string {
+	for _, key := range strings.Split(current[infrav1.ManagedAnnotationsAnnotation], ",") {
+		if _, ok := template[key]; !ok {
+			delete(current, key)
+		}
+	}
+
+	delete(current, infrav1.ManagedAnnotationsAnnotation)
+	if len(template) == 0 {
+		return current
+	}
+
+	if current == nil {
+		current = make(map[string]string, len(template)+1)
+	}
+
+	maps.Copy(current, template)
+	current[infrav1.ManagedAnnotationsAnnotation] = strings.Join(slices.Sorted(maps.Keys(template)), ",")
+
+	return current
+}
+
+// ingressSpec routes the host and paths of the OAUTH2Proxy to the service.
+// If callbacks is set all paths of the redirectURI host are routed as well.
+func ingressSpec(ph infrav1.OAUTH2Proxy, service string, callbacks bool) networkingv1.IngressSpec {
+	backend := networkingv1.IngressBackend{
+		Service: &networkingv1.IngressServiceBackend{
+			Name: service,
+			Port: networkingv1.ServiceBackendPort{Name: proxyPortName},
+		},
+	}
+
+	redirectHost := redirectURIHost(ph)
+
+	// Callbacks arrive at the original redirect_uri path, hence all paths of the redirectURI host are routed
+	paths := ph.Spec.Paths
+	if len(paths) == 0 || redirectHost == ph.Spec.Host {
+		paths = []infrav1.HTTPPathMatch{{Type: infrav1.PathMatchPrefix, Value: "/"}}
+	}
+
+	var hostPaths []networkingv1.HTTPIngressPath
+	for _, path := range paths {
+		pathType := networkingv1.PathTypePrefix
+		if path.Type == infrav1.PathMatchExact {
+			pathType = networkingv1.PathTypeExact
+		}
+
+		hostPaths = append(hostPaths, networkingv1.HTTPIngressPath{
+			Path:     path.Value,
+			PathType: &pathType,
+			Backend:  backend,
+		})
+	}
+
+	hosts := []string{ph.Spec.Host}
+	rules := []networkingv1.IngressRule{
+		{
+			Host: ph.Spec.Host,
+			IngressRuleValue: networkingv1.IngressRuleValue{
+				HTTP: &networkingv1.HTTPIngressRuleValue{Paths: hostPaths},
+			},
+		},
+	}
+
+	if callbacks && redirectHost != "" && redirectHost != ph.Spec.Host {
+		pathType := networkingv1.PathTypePrefix
+		hosts = append(hosts, redirectHost)
+		rules = append(rules, networkingv1.IngressRule{
+			Host: redirectHost,
+			IngressRuleValue: networkingv1.IngressRuleValue{
+				HTTP: &networkingv1.HTTPIngressRuleValue{
+					Paths: []networkingv1.HTTPIngressPath{
+						{
+							Path:     "/",
+							PathType: &pathType,
+							Backend:  backend,
+						},
+					},
+				},
+			},
+		})
+	}
+
+	spec := networkingv1.IngressSpec{
+		IngressClassName: ph.Spec.Ingress.IngressClassName,
+		Rules:            rules,
+	}
+
+	if ph.Spec.Ingress.TLS != nil {
+		spec.TLS = []networkingv1.IngressTLS{
+			{
+				Hosts:      hosts,
+				SecretName: ph.Spec.Ingress.TLS.SecretRef.Name,
+			},
+		}
+	}
+
+	return spec
+}
@@ -0,0 +1,382 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	infrav1 "github.com/DoodleScheduling/oauth2-redirect-controller/api/v1"
+)
+
+func TestIngressSpec(t *testing.T) {
+	backend := networkingv1.IngressBackend{
+		Service: &networkingv1.IngressServiceBackend{
+			Name: "idp-oauth2-proxy",
+			Port: networkingv1.ServiceBackendPort{Name: "http"},
+		},
+	}
+
+	path := func(value string, pathType networkingv1.PathType) networkingv1.HTTPIngressPath {
+		return networkingv1.HTTPIngressPath{
+			Path:     value,
+			PathType: &pathType,
+			Backend:  backend,
+		}
+	}
+
+	rule := func(host string, paths ...networkingv1.HTTPIngressPath) networkingv1.IngressRule {
+		return networkingv1.IngressRule{
+			Host: host,
+			IngressRuleValue: networkingv1.IngressRuleValue{
+				HTTP: &networkingv1.HTTPIngressRuleValue{Paths: paths},
+			},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		spec      infrav1.OAUTH2ProxySpec
+		callbacks bool
+		expect    networkingv1.IngressSpec
+	}{
+		{
+			name: "Paths of the host and all paths of the redirectURI host",
+			spec: infrav1.OAUTH2ProxySpec{
+				Host:        "idp.example.com",
+				RedirectURI: "https://oauth2proxy.example.com",
+				Paths: []infrav1.HTTPPathMatch{
+					{Type: infrav1.PathMatchPrefix, Value: "/auth"},
+					{Type: infrav1.PathMatchExact, Value: "/login"},
+				},
+				Ingress: &infrav1.IngressTemplate{
+					IngressClassName: ptr.To("nginx"),
+				},
+			},
+			callbacks: true,
+			expect: networkingv1.IngressSpec{
+				IngressClassName: ptr.To("nginx"),
+				Rules: []networkingv1.IngressRule{
+					rule("idp.example.com", path("/auth", networkingv1.PathTypePrefix), path("/login", networkingv1.PathTypeExact)),
+					rule("oauth2proxy.example.com", path("/", networkingv1.PathTypePrefix)),
+				},
+			},
+		},
+		{
+			name: "TLS for both hosts",
+			spec: infrav1.OAUTH2ProxySpec{
+				Host:        "idp.example.com",
+				RedirectURI: "https://oauth2proxy.example.com/callback",
+				Ingress: &infrav1.IngressTemplate{
+					TLS: &infrav1.IngressTLS{SecretRef: infrav1.LocalObjectReference{Name: "idp-tls"}},
+				},
+			},
+			callbacks: true,
+			expect: networkingv1.IngressSpec{
+				Rules: []networkingv1.IngressRule{
+					rule("idp.example.com", path("/", networkingv1.PathTypePrefix)),
+					rule("oauth2proxy.example.com", path("/", networkingv1.PathTypePrefix)),
+				},
+				TLS: []networkingv1.IngressTLS{
+					{Hosts: []string{"idp.example.com", "oauth2proxy.example.com"}, SecretName: "idp-tls"},
+				},
+			},
+		},
+		{
+			name: "RedirectURI host routed by another Ingress",
+			spec: infrav1.OAUTH2ProxySpec{
+				Host:        "idp.example.com",
+				RedirectURI: "https://oauth2proxy.example.com/callback",
+				Ingress: &infrav1.IngressTemplate{
+					TLS: &infrav1.IngressTLS{SecretRef: infrav1.LocalObjectReference{Name: "idp-tls"}},
+				},
+			},
+			expect: networkingv1.IngressSpec{
+				Rules: []networkingv1.IngressRule{
+					rule("idp.example.com", path("/", networkingv1.PathTypePrefix)),
+				},
+				TLS: []networkingv1.IngressTLS{
+					{Hosts: []string{"idp.example.com"}, SecretName: "idp-tls"},
+				},
+			},
+		},
+		{
+			name: "All paths if the redirectURI host is the host",
+			spec: infrav1.OAUTH2ProxySpec{
+				Host:        "idp.example.com",
+				RedirectURI: "https://idp.example.com/oauth2",
+				Paths: []infrav1.HTTPPathMatch{
+					{Type: infrav1.PathMatchPrefix, Value: "/auth"},
+				},
+				Ingress: &infrav1.IngressTemplate{},
+			},
+			callbacks: true,
+			expect: networkingv1.IngressSpec{
+				Rules: []networkingv1.IngressRule{
+					rule("idp.example.com", path("/", networkingv1.PathTypePrefix)),
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(ingressSpec(infrav1.OAUTH2Proxy{Spec: test.spec}, "idp-oauth2-proxy", test.callbacks)).To(Equal(test.expect))
+		})
+	}
+}
+
+func TestReconcileGeneratedIngress(t *testing.T) {
+	g := NewWithT(t)
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = infrav1.AddToScheme(scheme)
+
+	ph := &infrav1.OAUTH2Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: "idp", Namespace: "default", UID: "uid"},
+		Spec: infrav1.OAUTH2ProxySpec{
+			Host:        "idp.example.com",
+			RedirectURI: "https://oauth2proxy.example.com",
+			Ingress: &infrav1.IngressTemplate{
+				Annotations: map[string]string{"nginx.ingress.kubernetes.io/ssl-redirect": "true"},
+			},
+		},
+	}
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(ph).
+		WithIndex(&infrav1.OAUTH2Proxy{}, redirectHostIndex, redirectHostRefs).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &OAUTH2ProxyReconciler{
+		Client:       c,
+		Scheme:       scheme,
+		Recorder:     recorder,
+		ProxyService: "oauth2-redirect-controller.system.svc.cluster.local",
+		ProxyPort:    80,
+	}
+
+	key := client.ObjectKey{Namespace: "default", Name: "idp-oauth2-proxy"}
+	generated, err := r.reconcileGenerated(context.Background(), *ph)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(apimeta.IsStatusConditionTrue(generated.Status.Conditions, infrav1.RoutesGeneratedCondition)).To(BeTrue())
+
+	svc := &v1.Service{}
+	g.Expect(c.Get(context.Background(), key, svc)).To(Succeed())
+	g.Expect(metav1.IsControlledBy(svc, ph)).To(BeTrue())
+	g.Expect(svc.Spec.Type).To(Equal(v1.ServiceTypeExternalName))
+	g.Expect(svc.Spec.ExternalName).To(Equal("oauth2-redirect-controller.system.svc.cluster.local"))
+
+	ing := &networkingv1.Ingress{}
+	g.Expect(c.Get(context.Background(), key, ing)).To(Succeed())
+	g.Expect(metav1.IsControlledBy(ing, ph)).To(BeTrue())
+	g.Expect(ing.Annotations).To(Equal(map[string]string{
+		"nginx.ingress.kubernetes.io/ssl-redirect": "true",
+		infrav1.ManagedAnnotationsAnnotation:       "nginx.ingress.kubernetes.io/ssl-redirect",
+	}))
+	g.Expect(ing.Spec.Rules).To(HaveLen(2))
+
+	// Annotations set by others are kept
+	ing.Annotations["cert-manager.io/cluster-issuer"] = "letsencrypt"
+	g.Expect(c.Update(context.Background(), ing)).To(Succeed())
+
+	// Changes to the template are applied
+	ph.Spec.Ingress.IngressClassName = ptr.To("nginx")
+	ph.Spec.Ingress.Annotations["nginx.ingress.kubernetes.io/ssl-redirect"] = "false"
+	_, err = r.reconcileGenerated(context.Background(), *ph)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(c.Get(context.Background(), key, ing)).To(Succeed())
+	g.Expect(ing.Spec.IngressClassName).To(Equal(ptr.To("nginx")))
+	g.Expect(ing.Annotations).To(Equal(map[string]string{
+		"nginx.ingress.kubernetes.io/ssl-redirect": "false",
+		"cert-manager.io/cluster-issuer":           "letsencrypt",
+		infrav1.ManagedAnnotationsAnnotation:       "nginx.ingress.kubernetes.io/ssl-redirect",
+	}))
+
+	// Annotations removed from the template are removed from the Ingress
+	delete(ph.Spec.Ingress.Annotations, "nginx.ingress.kubernetes.io/ssl-redirect")
+	_, err = r.reconcileGenerated(context.Background(), *ph)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(c.Get(context.Background(), key, ing)).To(Succeed())
+	g.Expect(ing.Annotations).To(Equal(map[string]string{
+		"cert-manager.io/cluster-issuer": "letsencrypt",
+	}))
+
+	// The generated objects are deleted once no Ingress is requested
+	ph.Spec.Ingress = nil
+	_, err = r.reconcileGenerated(context.Background(), *ph)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(errors.IsNotFound(c.Get(context.Background(), key, ing))).To(BeTrue())
+	g.Expect(errors.IsNotFound(c.Get(context.Background(), key, svc))).To(BeTrue())
+}
+
+func TestReconcileGeneratedIngressSharedRedirectHost(t *testing.T) {
+	g := NewWithT(t)
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = infrav1.AddToScheme(scheme)
+
+	proxy := func(namespace string, created time.Time, ingressClassName *string) *infrav1.OAUTH2Proxy {
+		return &infrav1.OAUTH2Proxy{
+			ObjectMeta: metav1.ObjectMeta{Name: "idp", Namespace: namespace, UID: types.UID(namespace), CreationTimestamp: metav1.NewTime(created)},
+			Spec: infrav1.OAUTH2ProxySpec{
+				Host:        namespace + ".example.com",
+				RedirectURI: "https://oauth2proxy.example.com/callback",
+				Ingress:     &infrav1.IngressTemplate{IngressClassName: ingressClassName},
+			},
+		}
+	}
+
+	created := time.Unix(1700000000, 0)
+	first := proxy("first", created, nil)
+	second := proxy("second", created.Add(time.Minute), nil)
+	otherClass := proxy("other-class", created.Add(time.Minute), ptr.To("internal"))
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(first, second, otherClass).
+		WithIndex(&infrav1.OAUTH2Proxy{}, redirectHostIndex, redirectHostRefs).Build()
+	r := &OAUTH2ProxyReconciler{
+		Client:       c,
+		Scheme:       scheme,
+		Recorder:     record.NewFakeRecorder(10),
+		ProxyService: "oauth2-redirect-controller.system.svc.cluster.local",
+		ProxyPort:    80,
+	}
+
+	hosts := func(ph *infrav1.OAUTH2Proxy) []string {
+		_, err := r.reconcileGenerated(context.Background(), *ph)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		ing := &networkingv1.Ingress{}
+		g.Expect(c.Get(context.Background(), client.ObjectKey{Namespace: ph.GetNamespace(), Name: "idp-oauth2-proxy"}, ing)).To(Succeed())
+
+		var hosts []string
+		for _, rule := range ing.Spec.Rules {
+			hosts = append(hosts, rule.Host)
+		}
+
+		return hosts
+	}
+
+	// The redirectURI host is routed by the oldest OAUTH2Proxy of each Ingress class only
+	g.Expect(hosts(first)).To(Equal([]string{"first.example.com", "oauth2proxy.example.com"}))
+	g.Expect(hosts(second)).To(Equal([]string{"second.example.com"}))
+	g.Expect(hosts(otherClass)).To(Equal([]string{"other-class.example.com", "oauth2proxy.example.com"}))
+
+	// Another OAUTH2Proxy takes over once the oldest one is gone
+	g.Expect(r.requestsForRedirectHostChange(context.Background(), first)).To(ConsistOf(
+		reconcile.Request{NamespacedName: client.ObjectKeyFromObject(second)},
+		reconcile.Request{NamespacedName: client.ObjectKeyFromObject(otherClass)},
+	))
+
+	g.Expect(c.Delete(context.Background(), first)).To(Succeed())
+	g.Expect(hosts(second)).To(Equal([]string{"second.example.com", "oauth2proxy.example.com"}))
+}
+
+func TestReconcileGeneratedIngressNotOwned(t *testing.T) {
+	g := NewWithT(t)
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = infrav1.AddToScheme(scheme)
+
+	ph := &infrav1.OAUTH2Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: "idp", Namespace: "default", UID: "uid"},
+		Spec: infrav1.OAUTH2ProxySpec{
+			Host:        "idp.example.com",
+			RedirectURI: "https://oauth2proxy.example.com",
+			Ingress:     &infrav1.IngressTemplate{},
+		},
+	}
+
+	existing := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "idp-oauth2-proxy", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.1",
+		},
+	}
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(ph, existing).Build()
+	r := &OAUTH2ProxyReconciler{
+		Client:       c,
+		Scheme:       scheme,
+		Recorder:     record.NewFakeRecorder(10),
+		ProxyService: "oauth2-redirect-controller.system.svc.cluster.local",
+		ProxyPort:    80,
+	}
+
+	_, err := r.reconcileGenerated(context.Background(), *ph)
+	g.Expect(err).To(HaveOccurred())
+
+	// Objects which are not owned are not deleted either
+	ph.Spec.Ingress = nil
+	_, err = r.reconcileGenerated(context.Background(), *ph)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(c.Get(context.Background(), client.ObjectKeyFromObject(existing), existing)).To(Succeed())
+	g.Expect(existing.Spec.ClusterIP).To(Equal("10.96.0.1"))
+}
+
+func TestReconcileGeneratedProxyServiceNotConfigured(t *testing.T) {
+	g := NewWithT(t)
+
+	recorder := record.NewFakeRecorder(10)
+	r := &OAUTH2ProxyReconciler{
+		Client:   fake.NewClientBuilder().Build(),
+		Recorder: recorder,
+	}
+
+	ph, err := r.reconcileGenerated(context.Background(), infrav1.OAUTH2Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: "idp", Namespace: "default"},
+		Spec: infrav1.OAUTH2ProxySpec{
+			Ingress: &infrav1.IngressTemplate{},
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(<-recorder.Events).To(HavePrefix("Warning ProxyServiceNotConfigured "))
+
+	generated := apimeta.FindStatusCondition(ph.Status.Conditions, infrav1.RoutesGeneratedCondition)
+	g.Expect(generated).NotTo(BeNil())
+	g.Expect(generated.Status).To(Equal(metav1.ConditionFalse))
+	g.Expect(generated.Reason).To(Equal(infrav1.ProxyServiceNotConfiguredReason))
+
+	// The event is only recorded once the condition changes
+	_, err = r.reconcileGenerated(context.Background(), ph)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(recorder.Events).To(BeEmpty())
+
+	// The condition is removed once no routes are requested
+	ph.Spec.Ingress = nil
+	ph, err = r.reconcileGenerated(context.Background(), ph)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(apimeta.FindStatusCondition(ph.Status.Conditions, infrav1.RoutesGeneratedCondition)).To(BeNil())
+}
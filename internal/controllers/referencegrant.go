@@ -0,0 +1,131 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	gatewayv1beta1 "sigs.k8s.io/gateway-api/apis/v1beta1"
+
+	infrav1 "github.com/DoodleScheduling/oauth2-redirect-controller/api/v1"
+)
+
+// referenceGrantsInstalled returns true if the ReferenceGrant API is served by the cluster
+func referenceGrantsInstalled(mapper apimeta.RESTMapper) (bool, error) {
+	_, err := mapper.RESTMapping(schema.GroupKind{
+		Group: gatewayv1beta1.GroupName,
+		Kind:  "ReferenceGrant",
+	}, gatewayv1beta1.GroupVersion.Version)
+
+	if apimeta.IsNoMatchError(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// serviceNamespace returns the namespace of the backend service of an OAUTH2Proxy
+func serviceNamespace(ph *infrav1.OAUTH2Proxy) string {
+	if ph.Spec.Backend.Service.Namespace != "" {
+		return ph.Spec.Backend.Service.Namespace
+	}
+
+	return ph.GetNamespace()
+}
+
+// servicePermitted returns nil if the OAUTH2Proxy may reference the backend service.
+// Services in another namespace must be permitted by a ReferenceGrant in the namespace of the service and must be
+// in a cached namespace. On failure the condition reason is returned alongside the error, RefNotPermitted if the
+// reference is denied.
+func (r *OAUTH2ProxyReconciler) servicePermitted(ctx context.Context, ph infrav1.OAUTH2Proxy) (string, error) {
+	namespace := serviceNamespace(&ph)
+	if namespace == ph.GetNamespace() {
+		return "", nil
+	}
+
+	if !r.referenceGrants {
+		return infrav1.RefNotPermittedReason, fmt.Errorf("service %s/%s is in another namespace but ReferenceGrants are not installed", namespace, ph.Spec.Backend.Service.Name)
+	}
+
+	if len(r.CacheNamespaces) > 0 && !slices.Contains(r.CacheNamespaces, namespace) {
+		return infrav1.RefNotPermittedReason, fmt.Errorf("service %s/%s is in a namespace which is not watched, cross namespace references require --watch-all-namespaces", namespace, ph.Spec.Backend.Service.Name)
+	}
+
+	var grants gatewayv1beta1.ReferenceGrantList
+	if err := r.List(ctx, &grants, client.InNamespace(namespace)); err != nil {
+		return infrav1.ProgressingWithRetryReason, err
+	}
+
+	for _, grant := range grants.Items {
+		if referenceGrantPermits(grant, ph) {
+			return "", nil
+		}
+	}
+
+	return infrav1.RefNotPermittedReason, fmt.Errorf("service %s/%s is not permitted by any ReferenceGrant", namespace, ph.Spec.Backend.Service.Name)
+}
+
+// referenceGrantPermits returns true if the grant permits the reference from the OAUTH2Proxy to its backend service
+func referenceGrantPermits(grant gatewayv1beta1.ReferenceGrant, ph infrav1.OAUTH2Proxy) bool {
+	var from bool
+	for _, f := range grant.Spec.From {
+		if string(f.Group) == infrav1.GroupVersion.Group && string(f.Kind) == "OAUTH2Proxy" && string(f.Namespace) == ph.GetNamespace() {
+			from = true
+			break
+		}
+	}
+
+	if !from {
+		return false
+	}
+
+	for _, t := range grant.Spec.To {
+		if t.Group == "" && t.Kind == "Service" && (t.Name == nil || string(*t.Name) == ph.Spec.Backend.Service.Name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *OAUTH2ProxyReconciler) requestsForReferenceGrantChange(ctx context.Context, o client.Object) []reconcile.Request {
+	g, ok := o.(*gatewayv1beta1.ReferenceGrant)
+	if !ok {
+		panic(fmt.Sprintf("expected a ReferenceGrant, got %T", o))
+	}
+
+	var list infrav1.OAUTH2ProxyList
+	if err := r.List(ctx, &list, client.MatchingFields{
+		referenceGrantIndex: g.GetNamespace(),
+	}); err != nil {
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for _, i := range list.Items {
+		r.Log.Info("referencegrant for a oauth2proxy changed detected, reconcile oauth2proxy", "namespace", i.GetNamespace(), "name", i.GetName())
+		reqs = append(reqs, reconcile.Request{NamespacedName: objectKey(&i)})
+	}
+
+	return reqs
+}
@@ -0,0 +1,250 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	gatewayv1beta1 "sigs.k8s.io/gateway-api/apis/v1beta1"
+
+	infrav1 "github.com/DoodleScheduling/oauth2-redirect-controller/api/v1"
+	"github.com/DoodleScheduling/oauth2-redirect-controller/internal/proxy"
+)
+
+func TestReferenceGrantPermits(t *testing.T) {
+	ph := infrav1.OAUTH2Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: "idp", Namespace: "team"},
+		Spec: infrav1.OAUTH2ProxySpec{
+			Backend: infrav1.BackendRef{
+				Service: infrav1.ServiceBackendRef{
+					Name:      "keycloak",
+					Namespace: "identity",
+				},
+			},
+		},
+	}
+
+	from := gatewayv1beta1.ReferenceGrantFrom{
+		Group:     "oauth2.infra.doodle.com",
+		Kind:      "OAUTH2Proxy",
+		Namespace: "team",
+	}
+
+	tests := []struct {
+		name   string
+		from   []gatewayv1beta1.ReferenceGrantFrom
+		to     []gatewayv1beta1.ReferenceGrantTo
+		expect bool
+	}{
+		{
+			name:   "All services are permitted",
+			from:   []gatewayv1beta1.ReferenceGrantFrom{from},
+			to:     []gatewayv1beta1.ReferenceGrantTo{{Kind: "Service"}},
+			expect: true,
+		},
+		{
+			name:   "Named service is permitted",
+			from:   []gatewayv1beta1.ReferenceGrantFrom{from},
+			to:     []gatewayv1beta1.ReferenceGrantTo{{Kind: "Service", Name: ptr.To[gatewayv1beta1.ObjectName]("keycloak")}},
+			expect: true,
+		},
+		{
+			name:   "Another service is permitted",
+			from:   []gatewayv1beta1.ReferenceGrantFrom{from},
+			to:     []gatewayv1beta1.ReferenceGrantTo{{Kind: "Service", Name: ptr.To[gatewayv1beta1.ObjectName]("dex")}},
+			expect: false,
+		},
+		{
+			name: "Another namespace is permitted",
+			from: []gatewayv1beta1.ReferenceGrantFrom{{
+				Group:     "oauth2.infra.doodle.com",
+				Kind:      "OAUTH2Proxy",
+				Namespace: "other",
+			}},
+			to:     []gatewayv1beta1.ReferenceGrantTo{{Kind: "Service"}},
+			expect: false,
+		},
+		{
+			name: "Another kind is permitted",
+			from: []gatewayv1beta1.ReferenceGrantFrom{{
+				Group:     "gateway.networking.k8s.io",
+				Kind:      "HTTPRoute",
+				Namespace: "team",
+			}},
+			to:     []gatewayv1beta1.ReferenceGrantTo{{Kind: "Service"}},
+			expect: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+			grant := gatewayv1beta1.ReferenceGrant{
+				Spec: gatewayv1beta1.ReferenceGrantSpec{
+					From: test.from,
+					To:   test.to,
+				},
+			}
+
+			g.Expect(referenceGrantPermits(grant, ph)).To(Equal(test.expect))
+		})
+	}
+}
+
+func TestReconcileCrossNamespaceService(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = gatewayv1beta1.AddToScheme(scheme)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "keycloak", Namespace: "identity"},
+		Spec: v1.ServiceSpec{
+			ClusterIP:  "10.96.0.1",
+			ClusterIPs: []string{"10.96.0.1"},
+			IPFamilies: []v1.IPFamily{v1.IPv4Protocol},
+			Ports: []v1.ServicePort{
+				{Name: "http", Port: 80},
+			},
+		},
+	}
+
+	grant := &gatewayv1beta1.ReferenceGrant{
+		ObjectMeta: metav1.ObjectMeta{Name: "oauth2proxies", Namespace: "identity"},
+		Spec: gatewayv1beta1.ReferenceGrantSpec{
+			From: []gatewayv1beta1.ReferenceGrantFrom{{
+				Group:     "oauth2.infra.doodle.com",
+				Kind:      "OAUTH2Proxy",
+				Namespace: "team",
+			}},
+			To: []gatewayv1beta1.ReferenceGrantTo{{Kind: "Service"}},
+		},
+	}
+
+	tests := []struct {
+		name            string
+		referenceGrants bool
+		grant           bool
+		cacheNamespaces []string
+		listErr         error
+		expectReason    string
+		expectErr       bool
+	}{
+		{
+			name:            "Permitted by a ReferenceGrant",
+			referenceGrants: true,
+			grant:           true,
+			expectReason:    infrav1.ServiceBackendReadyReason,
+		},
+		{
+			name:            "Not permitted without a ReferenceGrant",
+			referenceGrants: true,
+			expectReason:    infrav1.RefNotPermittedReason,
+		},
+		{
+			name:         "Not permitted if ReferenceGrants are not installed",
+			grant:        true,
+			expectReason: infrav1.RefNotPermittedReason,
+		},
+		{
+			name:            "Not permitted if the namespace of the service is not cached",
+			referenceGrants: true,
+			grant:           true,
+			cacheNamespaces: []string{"team"},
+			expectReason:    infrav1.RefNotPermittedReason,
+		},
+		{
+			name:            "Failing to list the ReferenceGrants is retried",
+			referenceGrants: true,
+			grant:           true,
+			listErr:         errors.New("unavailable"),
+			expectReason:    infrav1.ProgressingWithRetryReason,
+			expectErr:       true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			builder := fake.NewClientBuilder().WithScheme(scheme).WithObjects(svc)
+			if test.grant {
+				builder = builder.WithObjects(grant)
+			}
+
+			if test.listErr != nil {
+				builder = builder.WithInterceptorFuncs(interceptor.Funcs{
+					List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+						return test.listErr
+					},
+				})
+			}
+
+			certificates, err := proxy.NewCertificateStore(proxy.UnknownSNIReject, nil)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			r := &OAUTH2ProxyReconciler{
+				Client:          builder.Build(),
+				HttpProxy:       proxy.New(logr.Discard(), nil),
+				Certificates:    certificates,
+				Recorder:        record.NewFakeRecorder(10),
+				referenceGrants: test.referenceGrants,
+				CacheNamespaces: test.cacheNamespaces,
+			}
+
+			ph, _, err := r.reconcile(context.Background(), infrav1.OAUTH2Proxy{
+				ObjectMeta: metav1.ObjectMeta{Name: "idp", Namespace: "team"},
+				Spec: infrav1.OAUTH2ProxySpec{
+					Host:        "idp",
+					RedirectURI: "https://oauth2proxy",
+					Backend: infrav1.BackendRef{
+						Service: infrav1.ServiceBackendRef{
+							Name:      "keycloak",
+							Namespace: "identity",
+							Port:      infrav1.ServiceBackendPort{Name: "http"},
+						},
+					},
+				},
+			})
+			if test.expectErr {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(apimeta.FindStatusCondition(ph.Status.Conditions, infrav1.ReconcilingCondition).Reason).To(Equal(test.expectReason))
+				g.Expect(apimeta.FindStatusCondition(ph.Status.Conditions, infrav1.StalledCondition)).To(BeNil())
+				return
+			}
+
+			g.Expect(err).NotTo(HaveOccurred())
+
+			ready := apimeta.FindStatusCondition(ph.Status.Conditions, infrav1.ReadyCondition)
+			g.Expect(ready).NotTo(BeNil())
+			g.Expect(ready.Reason).To(Equal(test.expectReason))
+		})
+	}
+}
@@ -0,0 +1,120 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1 "github.com/DoodleScheduling/oauth2-redirect-controller/api/v1"
+	"github.com/DoodleScheduling/oauth2-redirect-controller/internal/proxy"
+)
+
+// DefaultStatusUpdateInterval is the default interval in which the serving stats are patched
+const DefaultStatusUpdateInterval = 30 * time.Second
+
+// StatusUpdater patches the serving stats of the proxy into the status of the registered OAUTH2Proxies.
+// Registrations of annotated Ingresses are skipped.
+// Patches are throttled to at most one per OAUTH2Proxy and interval and are skipped if the stats did not change.
+type StatusUpdater struct {
+	client.Client
+	HttpProxy *proxy.HttpProxy
+	Log       logr.Logger
+	// Interval between status updates, defaults to DefaultStatusUpdateInterval
+	Interval time.Duration
+
+	// patched are the stats last patched for each OAUTH2Proxy
+	patched map[client.ObjectKey]proxy.Stats
+}
+
+// Start patches the stats until the context is canceled, it implements manager.Runnable
+func (u *StatusUpdater) Start(ctx context.Context) error {
+	interval := u.Interval
+	if interval <= 0 {
+		interval = DefaultStatusUpdateInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			u.update(ctx)
+		}
+	}
+}
+
+// update patches the status of all OAUTH2Proxies whose stats changed since the last update
+func (u *StatusUpdater) update(ctx context.Context) {
+	stats := u.HttpProxy.Stats()
+	window := u.HttpProxy.StatsWindow()
+	patched := make(map[client.ObjectKey]proxy.Stats, len(stats))
+
+	for obj, s := range stats {
+		// Hosts of annotated Ingresses have no status to patch
+		if isIngressRegistration(obj) {
+			continue
+		}
+
+		if last, ok := u.patched[obj]; ok && last == s {
+			patched[obj] = s
+			continue
+		}
+
+		if err := u.patchStats(ctx, obj, s, window); err != nil {
+			if !errors.IsNotFound(err) {
+				u.Log.Error(err, "unable to update serving stats", "Namespace", obj.Namespace, "Name", obj.Name)
+			}
+
+			continue
+		}
+
+		patched[obj] = s
+	}
+
+	// Stats of unregistered OAUTH2Proxies are forgotten
+	u.patched = patched
+}
+
+func (u *StatusUpdater) patchStats(ctx context.Context, obj client.ObjectKey, s proxy.Stats, window time.Duration) error {
+	ph := &infrav1.OAUTH2Proxy{}
+	if err := u.Get(ctx, obj, ph); err != nil {
+		return err
+	}
+
+	latest := ph.DeepCopy()
+
+	ph.Status.Stats = &infrav1.RequestStats{
+		Window:    metav1.Duration{Duration: window},
+		Rewrites:  s.Rewrites,
+		Callbacks: s.Callbacks,
+	}
+
+	if !s.LastRouted.IsZero() {
+		ph.Status.LastRoutedTime = &metav1.Time{Time: s.LastRouted}
+	}
+
+	return u.Status().Patch(ctx, ph, client.MergeFrom(latest))
+}
@@ -0,0 +1,115 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	infrav1 "github.com/DoodleScheduling/oauth2-redirect-controller/api/v1"
+	"github.com/DoodleScheduling/oauth2-redirect-controller/internal/proxy"
+)
+
+func TestStatusUpdater(t *testing.T) {
+	g := NewWithT(t)
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = infrav1.AddToScheme(scheme)
+
+	ph := &infrav1.OAUTH2Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: "idp", Namespace: "default"},
+	}
+
+	var patches int
+	var gets []client.ObjectKey
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(ph).WithStatusSubresource(ph).WithInterceptorFuncs(interceptor.Funcs{
+		Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+			gets = append(gets, key)
+			return c.Get(ctx, key, obj, opts...)
+		},
+		SubResourcePatch: func(ctx context.Context, c client.Client, subResourceName string, obj client.Object, patch client.Patch, opts ...client.SubResourcePatchOption) error {
+			patches++
+			return c.SubResource(subResourceName).Patch(ctx, obj, patch, opts...)
+		},
+	}).Build()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	p := proxy.New(logr.Discard(), nil, proxy.WithStatsWindow(5*time.Minute))
+	_ = p.RegisterOrUpdate(&proxy.OAUTH2Proxy{
+		Host:    "idp",
+		Service: "127.0.0.1",
+		Port:    int32(backend.Listener.Addr().(*net.TCPAddr).Port),
+		Object:  client.ObjectKeyFromObject(ph),
+	})
+
+	// Registered OAUTH2Proxies which do not exist anymore are skipped
+	_ = p.RegisterOrUpdate(&proxy.OAUTH2Proxy{
+		Host:   "gone",
+		Object: client.ObjectKey{Namespace: "default", Name: "gone"},
+	})
+
+	// Hosts of annotated Ingresses are not OAUTH2Proxies
+	ingressKey := ingressRegistrationKey(networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}}, "app")
+	_ = p.RegisterOrUpdate(&proxy.OAUTH2Proxy{
+		Host:   "app",
+		Object: ingressKey,
+	})
+
+	u := &StatusUpdater{
+		Client:    c,
+		HttpProxy: p,
+		Log:       logr.Discard(),
+	}
+
+	u.update(context.Background())
+	g.Expect(patches).To(Equal(1))
+	g.Expect(gets).NotTo(ContainElement(ingressKey))
+
+	latest := &infrav1.OAUTH2Proxy{}
+	g.Expect(c.Get(context.Background(), client.ObjectKeyFromObject(ph), latest)).To(Succeed())
+	g.Expect(latest.Status.Stats).To(Equal(&infrav1.RequestStats{Window: metav1.Duration{Duration: 5 * time.Minute}}))
+	g.Expect(latest.Status.LastRoutedTime).To(BeNil())
+
+	// Unchanged stats are not patched again
+	u.update(context.Background())
+	g.Expect(patches).To(Equal(1))
+
+	r, _ := http.NewRequest("GET", "http://idp/", nil)
+	p.ServeHTTP(httptest.NewRecorder(), r)
+
+	u.update(context.Background())
+	g.Expect(patches).To(Equal(2))
+	g.Expect(c.Get(context.Background(), client.ObjectKeyFromObject(ph), latest)).To(Succeed())
+	g.Expect(latest.Status.LastRoutedTime).NotTo(BeNil())
+}
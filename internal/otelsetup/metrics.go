@@ -0,0 +1,76 @@
+package otelsetup
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"google.golang.org/grpc/credentials"
+)
+
+// Metrics creates a meter provider periodically exporting metrics using the configured exporter
+func Metrics(ctx context.Context, opts Options, res *resource.Resource) (*metric.MeterProvider, error) {
+	exporter, err := metricExporter(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := metric.NewMeterProvider(
+		metric.WithReader(metric.NewPeriodicReader(exporter, metric.WithInterval(opts.MetricsInterval))),
+		metric.WithResource(res),
+	)
+
+	return provider, nil
+}
+
+func metricExporter(ctx context.Context, opts Options) (metric.Exporter, error) {
+	switch opts.Exporter {
+	case ExporterGRPC:
+		var grpcOptions []otlpmetricgrpc.Option
+
+		if opts.Endpoint != "" {
+			grpcOptions = append(grpcOptions, otlpmetricgrpc.WithEndpoint(opts.Endpoint))
+		}
+
+		if opts.Insecure {
+			grpcOptions = append(grpcOptions, otlpmetricgrpc.WithInsecure())
+		} else {
+			tlsOpts, err := opts.getTLSConfig()
+			if err != nil {
+				return nil, err
+			}
+
+			grpcOptions = append(grpcOptions, otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(tlsOpts)))
+		}
+
+		return otlpmetricgrpc.New(ctx, grpcOptions...)
+	case ExporterHTTP:
+		var httpOptions []otlpmetrichttp.Option
+
+		if opts.Endpoint != "" {
+			httpOptions = append(httpOptions, otlpmetrichttp.WithEndpoint(opts.Endpoint))
+		}
+
+		if opts.Insecure {
+			httpOptions = append(httpOptions, otlpmetrichttp.WithInsecure())
+		} else {
+			tlsOpts, err := opts.getTLSConfig()
+			if err != nil {
+				return nil, err
+			}
+
+			httpOptions = append(httpOptions, otlpmetrichttp.WithTLSClientConfig(tlsOpts))
+		}
+
+		return otlpmetrichttp.New(ctx, httpOptions...)
+	case ExporterStdout:
+		return stdoutmetric.New(stdoutmetric.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("unsupported exporter %q", opts.Exporter)
+	}
+}
@@ -4,18 +4,48 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"os"
+	"time"
 
 	"github.com/spf13/pflag"
 )
 
+const (
+	// ExporterGRPC exports using OTLP over gRPC
+	ExporterGRPC = "grpc"
+	// ExporterHTTP exports using OTLP over HTTP/protobuf
+	ExporterHTTP = "http"
+	// ExporterStdout writes telemetry to stdout, useful for debugging
+	ExporterStdout = "stdout"
+)
+
 type Options struct {
 	ServiceName       string
+	Exporter          string
 	Endpoint          string
 	Insecure          bool
-	TLSVerify         bool
 	TLSClientKeyPath  string
 	TLSClientCertPath string
 	TLSRootCAPath     string
+	SamplingRatio     float64
+	Propagators       []string
+	Metrics           bool
+	MetricsInterval   time.Duration
+}
+
+// enabled returns true if an exporter is configured.
+// OTLP exporters are configured either by flag or by the standard OTEL_EXPORTER_OTLP_* environment variables.
+func (o *Options) enabled() bool {
+	if o.Exporter == ExporterStdout || o.Endpoint != "" {
+		return true
+	}
+
+	for _, env := range []string{"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"} {
+		if os.Getenv(env) != "" {
+			return true
+		}
+	}
+
+	return false
 }
 
 // getTls returns a configuration that enables the use of mutual TLS.
@@ -47,10 +77,15 @@ func (o *Options) getTLSConfig() (*tls.Config, error) {
 
 // BindFlags will parse the given pflag.FlagSet
 func (o *Options) BindFlags(fs *pflag.FlagSet) {
-	fs.StringVar(&o.ServiceName, "otel-service-name", "k8skeycloak-controller", "Opentelemetry service name")
-	fs.StringVar(&o.Endpoint, "otel-endpoint", "", "Opentelemetry gRPC endpoint (without protocol)")
-	fs.BoolVar(&o.Insecure, "otel-insecure", false, "Opentelemetry gRPC disable tls")
-	fs.StringVar(&o.TLSClientKeyPath, "otel-tls-client-key-path", "", "Opentelemetry gRPC mTLS client key path")
-	fs.StringVar(&o.TLSClientCertPath, "otel-tls-client-cert-path", "", "Opentelemetry gRPC mTLS client cert path")
-	fs.StringVar(&o.TLSRootCAPath, "otel-tls-root-ca-path", "", "Opentelemetry gRPC mTLS root CA path")
+	fs.StringVar(&o.ServiceName, "otel-service-name", "oauth2-redirect-controller", "Opentelemetry service name")
+	fs.StringVar(&o.Exporter, "otel-exporter", ExporterGRPC, "Opentelemetry exporter. Can be one of 'grpc', 'http' or 'stdout'. Nothing is exported unless an endpoint is configured or 'stdout' is used")
+	fs.StringVar(&o.Endpoint, "otel-endpoint", "", "Opentelemetry OTLP endpoint (without protocol)")
+	fs.BoolVar(&o.Insecure, "otel-insecure", false, "Opentelemetry OTLP disable tls")
+	fs.StringVar(&o.TLSClientKeyPath, "otel-tls-client-key-path", "", "Opentelemetry OTLP mTLS client key path")
+	fs.StringVar(&o.TLSClientCertPath, "otel-tls-client-cert-path", "", "Opentelemetry OTLP mTLS client cert path")
+	fs.StringVar(&o.TLSRootCAPath, "otel-tls-root-ca-path", "", "Opentelemetry OTLP mTLS root CA path")
+	fs.Float64Var(&o.SamplingRatio, "otel-sampling-ratio", 1, "Opentelemetry ratio of root traces to sample, between 0 and 1. Sampling decisions of the parent span are respected")
+	fs.StringSliceVar(&o.Propagators, "otel-propagators", []string{PropagatorTraceContext, PropagatorBaggage}, "Opentelemetry propagators. Any of 'tracecontext', 'baggage', 'b3', 'b3multi' or 'none'")
+	fs.BoolVar(&o.Metrics, "otel-metrics", true, "Opentelemetry export metrics next to traces using the same exporter")
+	fs.DurationVar(&o.MetricsInterval, "otel-metrics-interval", time.Minute, "Opentelemetry interval between metric exports")
 }
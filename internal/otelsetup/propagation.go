@@ -0,0 +1,45 @@
+package otelsetup
+
+import (
+	"fmt"
+
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	// PropagatorTraceContext is the W3C Trace Context format; https://www.w3.org/TR/trace-context/
+	PropagatorTraceContext = "tracecontext"
+	// PropagatorBaggage is the W3C Baggage format; https://www.w3.org/TR/baggage/
+	PropagatorBaggage = "baggage"
+	// PropagatorB3 is the B3 single header format
+	PropagatorB3 = "b3"
+	// PropagatorB3Multi is the B3 multi header format
+	PropagatorB3Multi = "b3multi"
+	// PropagatorNone disables propagation
+	PropagatorNone = "none"
+)
+
+// Propagator builds a composite propagator from the given propagator names
+func Propagator(names []string) (propagation.TextMapPropagator, error) {
+	var propagators []propagation.TextMapPropagator
+
+	for _, name := range names {
+		switch name {
+		case PropagatorTraceContext:
+			propagators = append(propagators, propagation.TraceContext{})
+		case PropagatorBaggage:
+			propagators = append(propagators, propagation.Baggage{})
+		case PropagatorB3:
+			propagators = append(propagators, b3.New(b3.WithInjectEncoding(b3.B3SingleHeader)))
+		case PropagatorB3Multi:
+			propagators = append(propagators, b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader)))
+		case PropagatorNone:
+			return propagation.NewCompositeTextMapPropagator(), nil
+		default:
+			return nil, fmt.Errorf("unsupported propagator %q", name)
+		}
+	}
+
+	return propagation.NewCompositeTextMapPropagator(propagators...), nil
+}
@@ -0,0 +1,78 @@
+package otelsetup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+)
+
+// ShutdownFunc flushes and stops all telemetry providers
+type ShutdownFunc func(ctx context.Context) error
+
+// Setup configures the global propagator, tracer provider and meter provider.
+// Propagators are always configured, the providers only if an exporter is configured.
+// Otherwise the global no-op providers stay in place and nothing is exported.
+func Setup(ctx context.Context, opts Options, processors ...trace.SpanProcessor) (ShutdownFunc, error) {
+	propagator, err := Propagator(opts.Propagators)
+	if err != nil {
+		return nil, err
+	}
+
+	otel.SetTextMapPropagator(propagator)
+
+	if !opts.enabled() {
+		return func(ctx context.Context) error { return nil }, nil
+	}
+
+	if opts.SamplingRatio < 0 || opts.SamplingRatio > 1 {
+		return nil, fmt.Errorf("sampling ratio must be between 0 and 1, got %v", opts.SamplingRatio)
+	}
+
+	// labels/tags/resources that are common to all traces and metrics.
+	// Attributes from OTEL_RESOURCE_ATTRIBUTES and OTEL_SERVICE_NAME take precedence.
+	res, err := resource.New(ctx,
+		resource.WithSchemaURL(semconv.SchemaURL),
+		resource.WithAttributes(semconv.ServiceName(opts.ServiceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+		resource.WithProcess(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create resource: %w", err)
+	}
+
+	var shutdown []ShutdownFunc
+	shutdownAll := func(ctx context.Context) error {
+		var errs []error
+		for _, fn := range shutdown {
+			errs = append(errs, fn(ctx))
+		}
+
+		return errors.Join(errs...)
+	}
+
+	tp, err := Tracing(ctx, opts, res, processors...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup trace provider: %w", err)
+	}
+
+	otel.SetTracerProvider(tp)
+	shutdown = append(shutdown, tp.Shutdown)
+
+	if opts.Metrics {
+		mp, err := Metrics(ctx, opts, res)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("failed to setup meter provider: %w", err), shutdownAll(ctx))
+		}
+
+		otel.SetMeterProvider(mp)
+		shutdown = append(shutdown, mp.Shutdown)
+	}
+
+	return shutdownAll, nil
+}
@@ -0,0 +1,106 @@
+package otelsetup
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestSetupWithoutExporter(t *testing.T) {
+	g := NewWithT(t)
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+
+	shutdown, err := Setup(context.Background(), Options{
+		Exporter:    ExporterGRPC,
+		Propagators: []string{PropagatorTraceContext},
+	})
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(otel.GetTracerProvider()).NotTo(BeAssignableToTypeOf(&sdktrace.TracerProvider{}))
+	g.Expect(shutdown(context.Background())).To(Succeed())
+}
+
+func TestSetupStdoutExporter(t *testing.T) {
+	g := NewWithT(t)
+
+	shutdown, err := Setup(context.Background(), Options{
+		ServiceName:   "test",
+		Exporter:      ExporterStdout,
+		SamplingRatio: 1,
+		Propagators:   []string{PropagatorTraceContext},
+	})
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(otel.GetTracerProvider()).To(BeAssignableToTypeOf(&sdktrace.TracerProvider{}))
+	g.Expect(shutdown(context.Background())).To(Succeed())
+}
+
+func TestSetupInvalidSamplingRatio(t *testing.T) {
+	g := NewWithT(t)
+
+	_, err := Setup(context.Background(), Options{
+		Exporter:      ExporterStdout,
+		SamplingRatio: 2,
+	})
+
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestPropagator(t *testing.T) {
+	tests := []struct {
+		name          string
+		propagators   []string
+		expectFields  []string
+		expectFailure bool
+	}{
+		{
+			name:         "W3C trace context and baggage",
+			propagators:  []string{PropagatorTraceContext, PropagatorBaggage},
+			expectFields: []string{"traceparent", "tracestate", "baggage"},
+		},
+		{
+			name:         "B3 single and multi header",
+			propagators:  []string{PropagatorB3, PropagatorB3Multi},
+			expectFields: []string{"b3", "x-b3-traceid", "x-b3-spanid", "x-b3-sampled", "x-b3-flags"},
+		},
+		{
+			name:        "No propagation",
+			propagators: []string{PropagatorTraceContext, PropagatorNone},
+		},
+		{
+			name:          "Unsupported propagator",
+			propagators:   []string{"jaeger"},
+			expectFailure: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+			p, err := Propagator(test.propagators)
+
+			if test.expectFailure {
+				g.Expect(err).To(HaveOccurred())
+				return
+			}
+
+			g.Expect(err).NotTo(HaveOccurred())
+			for _, field := range test.expectFields {
+				g.Expect(p.Fields()).To(ContainElement(field))
+			}
+
+			if len(test.expectFields) == 0 {
+				carrier := propagation.HeaderCarrier(http.Header{})
+				p.Inject(context.Background(), carrier)
+				g.Expect(carrier.Keys()).To(BeEmpty())
+				g.Expect(p.Fields()).To(BeEmpty())
+			}
+		})
+	}
+}
@@ -2,63 +2,80 @@ package otelsetup
 
 import (
 	"context"
+	"fmt"
+	"os"
 
-	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
-	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
 	"go.opentelemetry.io/otel/sdk/resource"
 	"go.opentelemetry.io/otel/sdk/trace"
-	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
 	"google.golang.org/grpc/credentials"
 )
 
-func Tracing(ctx context.Context, opts Options) (*trace.TracerProvider, error) {
-	var grpcOptions []otlptracegrpc.Option
+// Tracing creates a tracer provider exporting spans using the configured exporter
+func Tracing(ctx context.Context, opts Options, res *resource.Resource, processors ...trace.SpanProcessor) (*trace.TracerProvider, error) {
+	exporter, err := traceExporter(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
 
-	if opts.Endpoint != "" {
-		grpcOptions = append(grpcOptions, otlptracegrpc.WithEndpoint(opts.Endpoint))
+	providerOpts := []trace.TracerProviderOption{
+		trace.WithBatcher(exporter),
+		trace.WithResource(res),
+		trace.WithSampler(trace.ParentBased(trace.TraceIDRatioBased(opts.SamplingRatio))),
 	}
 
-	if opts.Insecure {
-		grpcOptions = append(grpcOptions, otlptracegrpc.WithInsecure())
-	} else {
-		tlsOpts, err := opts.getTLSConfig()
-		if err != nil {
-			return nil, err
-		}
+	for _, processor := range processors {
+		providerOpts = append(providerOpts, trace.WithSpanProcessor(processor))
+	}
+
+	return trace.NewTracerProvider(providerOpts...), nil
+}
 
-		grpcOptions = append(grpcOptions, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(tlsOpts)))
+func traceExporter(ctx context.Context, opts Options) (trace.SpanExporter, error) {
+	switch opts.Exporter {
+	case ExporterGRPC:
+		var grpcOptions []otlptracegrpc.Option
 
-	}
+		if opts.Endpoint != "" {
+			grpcOptions = append(grpcOptions, otlptracegrpc.WithEndpoint(opts.Endpoint))
+		}
 
-	exporter, err := otlptracegrpc.New(
-		ctx,
-		grpcOptions...,
-	)
+		if opts.Insecure {
+			grpcOptions = append(grpcOptions, otlptracegrpc.WithInsecure())
+		} else {
+			tlsOpts, err := opts.getTLSConfig()
+			if err != nil {
+				return nil, err
+			}
 
-	if err != nil {
-		return nil, err
-	}
+			grpcOptions = append(grpcOptions, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(tlsOpts)))
+		}
 
-	// labels/tags/resources that are common to all traces.
-	resource := resource.NewWithAttributes(
-		semconv.SchemaURL,
-		semconv.ServiceNameKey.String(opts.ServiceName),
-	)
+		return otlptracegrpc.New(ctx, grpcOptions...)
+	case ExporterHTTP:
+		var httpOptions []otlptracehttp.Option
 
-	provider := trace.NewTracerProvider(
-		trace.WithBatcher(exporter),
-		trace.WithResource(resource),
-		trace.WithSampler(trace.ParentBased(trace.TraceIDRatioBased(1))),
-	)
+		if opts.Endpoint != "" {
+			httpOptions = append(httpOptions, otlptracehttp.WithEndpoint(opts.Endpoint))
+		}
 
-	otel.SetTextMapPropagator(
-		propagation.NewCompositeTextMapPropagator(
-			propagation.TraceContext{}, // W3C Trace Context format; https://www.w3.org/TR/trace-context/
-		),
-	)
+		if opts.Insecure {
+			httpOptions = append(httpOptions, otlptracehttp.WithInsecure())
+		} else {
+			tlsOpts, err := opts.getTLSConfig()
+			if err != nil {
+				return nil, err
+			}
 
-	otel.SetTracerProvider(provider)
+			httpOptions = append(httpOptions, otlptracehttp.WithTLSClientConfig(tlsOpts))
+		}
 
-	return provider, nil
+		return otlptracehttp.New(ctx, httpOptions...)
+	case ExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("unsupported exporter %q", opts.Exporter)
+	}
 }
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat is the output format of the access log
+type AccessLogFormat string
+
+const (
+	// AccessLogFormatJSON writes one json object per request
+	AccessLogFormatJSON AccessLogFormat = "json"
+	// AccessLogFormatCombined writes the Combined Log Format followed by the proxy specific fields
+	AccessLogFormatCombined AccessLogFormat = "combined"
+)
+
+// Action describes how the proxy handled a request
+type Action string
+
+const (
+	// ActionProxied is a request forwarded to a backend without modification
+	ActionProxied Action = "proxied"
+	// ActionRewritten is a request forwarded to a backend with a rewritten Location header in the response
+	ActionRewritten Action = "rewritten"
+	// ActionRecovered is a callback from the external IdP redirected back to the original redirect_uri
+	ActionRecovered Action = "recovered"
+	// ActionRejected is a callback from the external IdP which could not be recovered
+	ActionRejected Action = "rejected"
+	// ActionUnmatched is a request which did not match any OAUTH2Proxy
+	ActionUnmatched Action = "unmatched"
+	// ActionShortCircuited is a request which was not forwarded because the circuit breaker of the backend is open
+	ActionShortCircuited Action = "short-circuited"
+)
+
+// AccessLogger writes one entry per request handled by the proxy
+type AccessLogger struct {
+	out    io.Writer
+	format AccessLogFormat
+	mutex  sync.Mutex
+}
+
+// NewAccessLogger creates a new AccessLogger writing to out using the given format
+func NewAccessLogger(out io.Writer, format AccessLogFormat) (*AccessLogger, error) {
+	switch format {
+	case AccessLogFormatJSON, AccessLogFormatCombined:
+	default:
+		return nil, fmt.Errorf("unsupported access log format %q", format)
+	}
+
+	return &AccessLogger{
+		out:    out,
+		format: format,
+	}, nil
+}
+
+// accessLogEntry collects the attributes of a single request while it is handled
+type accessLogEntry struct {
+	RequestID       string    `json:"requestID"`
+	OriginRequestID string    `json:"originRequestID,omitempty"`
+	Time            time.Time `json:"time"`
+	RemoteAddr      string    `json:"remoteAddr"`
+	Method          string    `json:"method"`
+	Host            string    `json:"host"`
+	Path            string    `json:"path"`
+	Proto           string    `json:"proto"`
+	Referer         string    `json:"referer,omitempty"`
+	UserAgent       string    `json:"userAgent,omitempty"`
+	Object          string    `json:"object,omitempty"`
+	Action          Action    `json:"action"`
+	Status          int       `json:"status"`
+	UpstreamStatus  int       `json:"upstreamStatus,omitempty"`
+	Bytes           int64     `json:"bytes"`
+	Duration        float64   `json:"duration"`
+}
+
+type accessLogEntryKey struct{}
+
+// accessLogEntryFromContext returns the entry of the request currently handled.
+// A detached entry is returned if there is none so callers don't need to check.
+func accessLogEntryFromContext(ctx context.Context) *accessLogEntry {
+	if entry, ok := ctx.Value(accessLogEntryKey{}).(*accessLogEntry); ok {
+		return entry
+	}
+
+	return &accessLogEntry{}
+}
+
+// Log writes the entry using the configured format
+func (a *AccessLogger) Log(entry *accessLogEntry) {
+	var line []byte
+
+	switch a.format {
+	case AccessLogFormatJSON:
+		line, _ = json.Marshal(entry)
+	case AccessLogFormatCombined:
+		line = entry.combined()
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	_, _ = a.out.Write(append(line, '\n'))
+}
+
+// combined formats the entry as Combined Log Format with the host, object, action, upstream status and duration appended
+func (e *accessLogEntry) combined() []byte {
+	remoteHost, _, err := net.SplitHostPort(e.RemoteAddr)
+	if err != nil {
+		remoteHost = e.RemoteAddr
+	}
+
+	upstreamStatus := "-"
+	if e.UpstreamStatus != 0 {
+		upstreamStatus = strconv.Itoa(e.UpstreamStatus)
+	}
+
+	return fmt.Appendf(nil, `%s - - [%s] "%s %s %s" %d %d %q %q %q %s %s %s %.3f`,
+		orDash(remoteHost),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method,
+		e.Path,
+		e.Proto,
+		e.Status,
+		e.Bytes,
+		orDash(e.Referer),
+		orDash(e.UserAgent),
+		e.Host,
+		orDash(e.Object),
+		e.Action,
+		upstreamStatus,
+		e.Duration,
+	)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+// responseWriter records the status code and the number of bytes written to the client
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	// Informational responses except protocol switches are followed by the final response
+	if w.status == 0 && (code >= http.StatusOK || code == http.StatusSwitchingProtocols) {
+		w.status = code
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to access the underlying http.Flusher and http.Hijacker
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *responseWriter) Flush() {
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
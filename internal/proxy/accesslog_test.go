@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestAccessLog(t *testing.T) {
+	path := OAUTH2Proxy{
+		Host:        "foo",
+		Service:     "bar",
+		RedirectURI: "https://oauth2proxy",
+		Paths:       []PathMatch{{Path: "/auth"}},
+		Port:        8080,
+		Object: client.ObjectKey{
+			Name:      "foo",
+			Namespace: "bar",
+		},
+	}
+
+	transport := func(r *http.Request) (*http.Response, error) {
+		header := http.Header{}
+		header.Add("Location", "https://idp?redirect_uri=https://idp/auth&state=foobar")
+
+		return &http.Response{
+			StatusCode: http.StatusFound,
+			Header:     header,
+			Body:       io.NopCloser(strings.NewReader("body")),
+		}, nil
+	}
+
+	st := signState(state{
+		OrigRedirectURI: "https://my-original-uri",
+		ObjectID:        testObjectID(client.ObjectKey{Namespace: "bar", Name: "foo"}),
+	})
+
+	tests := []struct {
+		name        string
+		request     func() *http.Request
+		expectEntry map[string]any
+	}{
+		{
+			name: "Request without matching OAUTH2Proxy is unmatched",
+			request: func() *http.Request {
+				r, _ := http.NewRequest("GET", "http://unknown/", nil)
+				return r
+			},
+			expectEntry: map[string]any{
+				"method": "GET",
+				"host":   "unknown",
+				"path":   "/",
+				"action": "unmatched",
+				"status": float64(http.StatusServiceUnavailable),
+			},
+		},
+		{
+			name: "Request to a path which is not rewritten is proxied",
+			request: func() *http.Request {
+				r, _ := http.NewRequest("GET", "http://foo/other", nil)
+				return r
+			},
+			expectEntry: map[string]any{
+				"method":         "GET",
+				"host":           "foo",
+				"path":           "/other",
+				"object":         "bar/foo",
+				"action":         "proxied",
+				"status":         float64(http.StatusFound),
+				"upstreamStatus": float64(http.StatusFound),
+				"bytes":          float64(4),
+			},
+		},
+		{
+			name: "Request with a rewritten Location header is rewritten",
+			request: func() *http.Request {
+				r, _ := http.NewRequest("GET", "http://foo/auth?code=secret", nil)
+				return r
+			},
+			expectEntry: map[string]any{
+				"method":         "GET",
+				"host":           "foo",
+				"path":           "/auth?code=[REDACTED]",
+				"object":         "bar/foo",
+				"action":         "rewritten",
+				"status":         float64(http.StatusFound),
+				"upstreamStatus": float64(http.StatusFound),
+				"bytes":          float64(4),
+			},
+		},
+		{
+			name: "Callback with a valid state is recovered",
+			request: func() *http.Request {
+				r, _ := http.NewRequest("GET", fmt.Sprintf("https://oauth2proxy/cb?%s", url.Values{"state": []string{st}}.Encode()), nil)
+				return r
+			},
+			expectEntry: map[string]any{
+				"method": "GET",
+				"host":   "oauth2proxy",
+				"path":   "/cb?state=[REDACTED]",
+				"object": "bar/foo",
+				"action": "recovered",
+				"status": float64(http.StatusSeeOther),
+			},
+		},
+		{
+			name: "Callback with an invalid state is rejected",
+			request: func() *http.Request {
+				r, _ := http.NewRequest("GET", "https://oauth2proxy/cb?state=invalid", nil)
+				return r
+			},
+			expectEntry: map[string]any{
+				"method": "GET",
+				"host":   "oauth2proxy",
+				"path":   "/cb?state=[REDACTED]",
+				"action": "rejected",
+				"status": float64(http.StatusBadRequest),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+			out := &bytes.Buffer{}
+			accessLog, err := NewAccessLogger(out, AccessLogFormatJSON)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			proxy := New(logr.Discard(), &dummyTransport{
+				transport: transport,
+			}, WithAccessLogger(accessLog), WithStateKey(testStateKey))
+
+			p := path
+			_ = proxy.RegisterOrUpdate(&p)
+
+			proxy.ServeHTTP(httptest.NewRecorder(), test.request())
+
+			entry := make(map[string]any)
+			g.Expect(json.Unmarshal(out.Bytes(), &entry)).To(Succeed())
+
+			for k, v := range test.expectEntry {
+				g.Expect(entry).To(HaveKeyWithValue(k, v))
+			}
+
+			g.Expect(entry).To(HaveKey("time"))
+			g.Expect(entry).To(HaveKey("duration"))
+		})
+	}
+}
+
+func TestAccessLogCombinedFormat(t *testing.T) {
+	g := NewWithT(t)
+	out := &bytes.Buffer{}
+	accessLog, err := NewAccessLogger(out, AccessLogFormatCombined)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	accessLog.Log(&accessLogEntry{
+		Time:           time.Date(2023, time.November, 14, 22, 13, 20, 0, time.UTC),
+		RemoteAddr:     "10.0.0.1:52000",
+		Method:         "GET",
+		Host:           "foo",
+		Path:           "/auth?state=[REDACTED]",
+		Proto:          "HTTP/1.1",
+		UserAgent:      "curl/8.0",
+		Object:         "bar/foo",
+		Action:         ActionRewritten,
+		Status:         http.StatusFound,
+		UpstreamStatus: http.StatusFound,
+		Bytes:          4,
+		Duration:       0.0123,
+	})
+
+	g.Expect(out.String()).To(Equal(`10.0.0.1 - - [14/Nov/2023:22:13:20 +0000] "GET /auth?state=[REDACTED] HTTP/1.1" 302 4 "-" "curl/8.0" "foo" bar/foo rewritten 302 0.012` + "\n"))
+}
+
+func TestAccessLogUnsupportedFormat(t *testing.T) {
+	g := NewWithT(t)
+	_, err := NewAccessLogger(&bytes.Buffer{}, "xml")
+	g.Expect(err).To(HaveOccurred())
+}
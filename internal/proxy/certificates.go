@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// UnknownSNIPolicy defines how TLS handshakes for server names without a certificate are handled
+type UnknownSNIPolicy string
+
+const (
+	// UnknownSNIReject fails the handshake
+	UnknownSNIReject UnknownSNIPolicy = "reject"
+	// UnknownSNIDefault serves the default certificate
+	UnknownSNIDefault UnknownSNIPolicy = "default"
+)
+
+var (
+	ErrUnknownServerName = errors.New("no certificate for server name")
+)
+
+// CertificateStore holds the certificates served by the proxy listener, selected by SNI
+type CertificateStore struct {
+	mutex       sync.RWMutex
+	certs       map[client.ObjectKey]hostCertificate
+	policy      UnknownSNIPolicy
+	defaultCert *tls.Certificate
+}
+
+// hostCertificate is a certificate served for a set of hosts
+type hostCertificate struct {
+	hosts []string
+	cert  *tls.Certificate
+}
+
+// NewCertificateStore creates an empty CertificateStore.
+// defaultCert is required if unknown server names are answered with the default certificate.
+func NewCertificateStore(policy UnknownSNIPolicy, defaultCert *tls.Certificate) (*CertificateStore, error) {
+	switch policy {
+	case UnknownSNIReject:
+	case UnknownSNIDefault:
+		if defaultCert == nil {
+			return nil, fmt.Errorf("unknown SNI policy %q requires a default certificate", policy)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported unknown SNI policy %q", policy)
+	}
+
+	return &CertificateStore{
+		certs:       make(map[client.ObjectKey]hostCertificate),
+		policy:      policy,
+		defaultCert: defaultCert,
+	}, nil
+}
+
+// Set adds or replaces the certificate served by the OAUTH2Proxy obj for the given hosts
+func (s *CertificateStore) Set(obj client.ObjectKey, cert *tls.Certificate, hosts ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry := hostCertificate{
+		cert: cert,
+	}
+
+	for _, host := range hosts {
+		entry.hosts = append(entry.hosts, normalizeServerName(host))
+	}
+
+	s.certs[obj] = entry
+}
+
+// Delete removes the certificate of the OAUTH2Proxy obj
+func (s *CertificateStore) Delete(obj client.ObjectKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.certs, obj)
+}
+
+// GetCertificate returns the certificate for the requested server name, it is meant to be used as tls.Config.GetCertificate.
+// The redirectURI host is usually shared by many OAUTH2Proxies, a certificate which is valid for the server name is preferred.
+func (s *CertificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := normalizeServerName(hello.ServerName)
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var match *tls.Certificate
+	for _, v := range s.certs {
+		for _, host := range v.hosts {
+			if host != name {
+				continue
+			}
+
+			if v.cert.Leaf != nil && v.cert.Leaf.VerifyHostname(name) == nil {
+				return v.cert, nil
+			}
+
+			match = v.cert
+		}
+	}
+
+	if match != nil {
+		return match, nil
+	}
+
+	if s.policy == UnknownSNIDefault {
+		return s.defaultCert, nil
+	}
+
+	return nil, fmt.Errorf("%w %q", ErrUnknownServerName, hello.ServerName)
+}
+
+func normalizeServerName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// ServerTLSConfig returns the TLS configuration of a server serving the certificate loaded from certFile and keyFile.
+// If clientCAFile is set clients must present a certificate signed by one of its CAs.
+func ServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile == "" {
+		return config, nil
+	}
+
+	ca, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no PEM encoded certificates found in %s", clientCAFile)
+	}
+
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func newTestCertificate(t *testing.T, hosts ...string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+func TestCertificateStore(t *testing.T) {
+	idp := newTestCertificate(t, "idp", "oauth2proxy")
+	other := newTestCertificate(t, "other")
+	fallback := newTestCertificate(t, "default")
+
+	tests := []struct {
+		name          string
+		policy        UnknownSNIPolicy
+		serverName    string
+		expectCert    *tls.Certificate
+		expectFailure bool
+	}{
+		{
+			name:       "Certificate for the host",
+			policy:     UnknownSNIReject,
+			serverName: "idp",
+			expectCert: idp,
+		},
+		{
+			name:       "Server names are case insensitive",
+			policy:     UnknownSNIReject,
+			serverName: "IDP.",
+			expectCert: idp,
+		},
+		{
+			name:       "Certificate valid for the redirectURI host is preferred",
+			policy:     UnknownSNIReject,
+			serverName: "oauth2proxy",
+			expectCert: idp,
+		},
+		{
+			name:          "Unknown server name is rejected",
+			policy:        UnknownSNIReject,
+			serverName:    "unknown",
+			expectFailure: true,
+		},
+		{
+			name:          "Missing server name is rejected",
+			policy:        UnknownSNIReject,
+			expectFailure: true,
+		},
+		{
+			name:       "Unknown server name gets the default certificate",
+			policy:     UnknownSNIDefault,
+			serverName: "unknown",
+			expectCert: fallback,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			store, err := NewCertificateStore(test.policy, fallback)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			store.Set(client.ObjectKey{Namespace: "bar", Name: "idp"}, idp, "idp", "oauth2proxy")
+			store.Set(client.ObjectKey{Namespace: "bar", Name: "other"}, other, "other", "oauth2proxy")
+
+			cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: test.serverName})
+			if test.expectFailure {
+				g.Expect(err).To(MatchError(ErrUnknownServerName))
+				return
+			}
+
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(cert).To(BeIdenticalTo(test.expectCert))
+		})
+	}
+}
+
+func TestCertificateStoreDelete(t *testing.T) {
+	g := NewWithT(t)
+	store, err := NewCertificateStore(UnknownSNIReject, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	obj := client.ObjectKey{Namespace: "bar", Name: "idp"}
+	store.Set(obj, newTestCertificate(t, "idp"), "idp")
+	store.Delete(obj)
+
+	_, err = store.GetCertificate(&tls.ClientHelloInfo{ServerName: "idp"})
+	g.Expect(err).To(MatchError(ErrUnknownServerName))
+}
+
+func TestCertificateStoreInvalidPolicy(t *testing.T) {
+	g := NewWithT(t)
+
+	_, err := NewCertificateStore(UnknownSNIDefault, nil)
+	g.Expect(err).To(HaveOccurred())
+
+	_, err = NewCertificateStore("ignore", nil)
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	g := NewWithT(t)
+
+	cert := newTestCertificate(t, "ext-proc")
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	dir := t.TempDir()
+	write := func(name, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		g.Expect(os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600)).To(Succeed())
+		return path
+	}
+
+	certFile := write("tls.crt", "CERTIFICATE", cert.Certificate[0])
+	keyFile := write("tls.key", "PRIVATE KEY", key)
+	caFile := write("ca.crt", "CERTIFICATE", newTestCertificate(t, "ca").Certificate[0])
+
+	config, err := ServerTLSConfig(certFile, keyFile, "")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(config.Certificates).To(HaveLen(1))
+	g.Expect(config.ClientAuth).To(Equal(tls.NoClientCert))
+
+	// Clients must present a certificate if a client CA is configured
+	config, err = ServerTLSConfig(certFile, keyFile, caFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(config.ClientAuth).To(Equal(tls.RequireAndVerifyClientCert))
+	g.Expect(config.ClientCAs).NotTo(BeNil())
+
+	_, err = ServerTLSConfig(certFile, keyFile, keyFile)
+	g.Expect(err).To(MatchError(ContainSubstring("no PEM encoded certificates found")))
+
+	_, err = ServerTLSConfig(certFile, filepath.Join(dir, "missing.key"), "")
+	g.Expect(err).To(HaveOccurred())
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// CircuitState is the state of the circuit breaker of a backend
+type CircuitState int
+
+const (
+	// CircuitClosed forwards requests to the backend
+	CircuitClosed CircuitState = iota
+	// CircuitHalfOpen forwards a single trial request to the backend
+	CircuitHalfOpen
+	// CircuitOpen rejects requests without forwarding them
+	CircuitOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitHalfOpen:
+		return "half-open"
+	case CircuitOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreakerPolicy defines when the circuit breaker of a backend opens and how requests are answered while it is open
+type CircuitBreakerPolicy struct {
+	// ConsecutiveFailures is the number of consecutive failed requests which open the circuit breaker
+	ConsecutiveFailures int
+	// OpenDuration is the time the circuit breaker stays open before a trial request is forwarded
+	OpenDuration time.Duration
+	// StatusCode is the status code returned while the circuit breaker is open
+	StatusCode int
+	// Body is the response body returned while the circuit breaker is open
+	Body string
+}
+
+// CircuitBreakerListener is notified about state changes of a circuit breaker.
+// It is called from within the request path and must not block.
+type CircuitBreakerListener func(obj client.ObjectKey, state CircuitState)
+
+// WithCircuitBreakerListener sets a listener which is notified about circuit breaker state changes
+func WithCircuitBreakerListener(listener CircuitBreakerListener) Option {
+	return func(h *HttpProxy) {
+		h.circuitBreakerListener = listener
+	}
+}
+
+// circuitBreaker tracks consecutive failures of a backend.
+// Requests which failed to connect or timed out count as failure, any response from the backend as success.
+type circuitBreaker struct {
+	mutex    sync.Mutex
+	obj      client.ObjectKey
+	policy   CircuitBreakerPolicy
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	// trial is set while the trial request of the half-open state is in flight
+	trial    bool
+	now      func() time.Time
+	listener CircuitBreakerListener
+}
+
+func newCircuitBreaker(obj client.ObjectKey, policy CircuitBreakerPolicy, now func() time.Time, listener CircuitBreakerListener) *circuitBreaker {
+	b := &circuitBreaker{
+		obj:      obj,
+		policy:   policy,
+		now:      now,
+		listener: listener,
+	}
+
+	circuitBreakerState.WithLabelValues(obj.Namespace, obj.Name).Set(float64(CircuitClosed))
+	return b
+}
+
+// setPolicy updates the policy while keeping the current state
+func (b *circuitBreaker) setPolicy(policy CircuitBreakerPolicy) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.policy = policy
+}
+
+// State returns the current state
+func (b *circuitBreaker) State() CircuitState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.state
+}
+
+// allow returns whether a request may be forwarded to the backend.
+// Every allowed request must be finished using done.
+func (b *circuitBreaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		if b.now().Sub(b.openedAt) < b.policy.OpenDuration {
+			return false
+		}
+
+		b.setState(CircuitHalfOpen)
+		b.trial = true
+		return true
+	case CircuitHalfOpen:
+		if b.trial {
+			return false
+		}
+
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// done records the outcome of a forwarded request.
+// Requests canceled by the client do not count as failure.
+func (b *circuitBreaker) done(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.trial = false
+
+	switch {
+	case err == nil:
+		b.failures = 0
+		b.setState(CircuitClosed)
+	case errors.Is(err, context.Canceled):
+	default:
+		b.failures++
+		if b.state == CircuitHalfOpen || b.failures >= b.policy.ConsecutiveFailures {
+			b.openedAt = b.now()
+			b.setState(CircuitOpen)
+		}
+	}
+}
+
+// setState transitions to state and notifies the listener, the caller must hold the mutex
+func (b *circuitBreaker) setState(state CircuitState) {
+	if b.state == state {
+		return
+	}
+
+	b.state = state
+	circuitBreakerState.WithLabelValues(b.obj.Namespace, b.obj.Name).Set(float64(state))
+
+	if b.listener != nil {
+		b.listener(b.obj, state)
+	}
+}
+
+// remove deletes the metrics of the circuit breaker
+func (b *circuitBreaker) remove() {
+	circuitBreakerState.DeleteLabelValues(b.obj.Namespace, b.obj.Name)
+	circuitBreakerRejectedTotal.DeleteLabelValues(b.obj.Namespace, b.obj.Name)
+}
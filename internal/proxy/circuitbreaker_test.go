@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	g := NewWithT(t)
+
+	now := time.Unix(1700000000, 0)
+	var transitions []CircuitState
+
+	b := newCircuitBreaker(client.ObjectKey{Namespace: "bar", Name: "breaker"}, CircuitBreakerPolicy{
+		ConsecutiveFailures: 2,
+		OpenDuration:        time.Minute,
+	}, func() time.Time {
+		return now
+	}, func(obj client.ObjectKey, state CircuitState) {
+		transitions = append(transitions, state)
+	})
+
+	failure := errors.New("connection refused")
+
+	// A success resets the consecutive failures
+	g.Expect(b.allow()).To(BeTrue())
+	b.done(failure)
+	g.Expect(b.allow()).To(BeTrue())
+	b.done(nil)
+	g.Expect(b.allow()).To(BeTrue())
+	b.done(failure)
+	g.Expect(b.State()).To(Equal(CircuitClosed))
+
+	// Requests canceled by the client are not counted
+	g.Expect(b.allow()).To(BeTrue())
+	b.done(context.Canceled)
+	g.Expect(b.State()).To(Equal(CircuitClosed))
+
+	g.Expect(b.allow()).To(BeTrue())
+	b.done(failure)
+	g.Expect(b.State()).To(Equal(CircuitOpen))
+	g.Expect(b.allow()).To(BeFalse())
+
+	// A single trial request is forwarded once the open duration passed
+	now = now.Add(time.Minute)
+	g.Expect(b.allow()).To(BeTrue())
+	g.Expect(b.State()).To(Equal(CircuitHalfOpen))
+	g.Expect(b.allow()).To(BeFalse())
+
+	// A failed trial opens the circuit breaker again
+	b.done(failure)
+	g.Expect(b.State()).To(Equal(CircuitOpen))
+	g.Expect(b.allow()).To(BeFalse())
+
+	now = now.Add(time.Minute)
+	g.Expect(b.allow()).To(BeTrue())
+	b.done(nil)
+	g.Expect(b.State()).To(Equal(CircuitClosed))
+
+	g.Expect(transitions).To(Equal([]CircuitState{
+		CircuitOpen,
+		CircuitHalfOpen,
+		CircuitOpen,
+		CircuitHalfOpen,
+		CircuitClosed,
+	}))
+}
+
+func TestCircuitBreakerRejectsRequests(t *testing.T) {
+	g := NewWithT(t)
+
+	path := OAUTH2Proxy{
+		Host:        "breaker",
+		Service:     "bar",
+		RedirectURI: "https://oauth2proxy-breaker",
+		Paths:       []PathMatch{{Path: "/"}},
+		Port:        8080,
+		CircuitBreaker: &CircuitBreakerPolicy{
+			ConsecutiveFailures: 2,
+			OpenDuration:        time.Minute,
+			StatusCode:          http.StatusTooManyRequests,
+			Body:                "try again later",
+		},
+		Object: client.ObjectKey{
+			Name:      "breaker",
+			Namespace: "bar",
+		},
+	}
+
+	var calls int
+	var notified []CircuitState
+	proxy := New(logr.Discard(), &dummyTransport{
+		transport: func(r *http.Request) (*http.Response, error) {
+			calls++
+			return nil, errors.New("connection refused")
+		},
+	}, WithCircuitBreakerListener(func(obj client.ObjectKey, state CircuitState) {
+		notified = append(notified, state)
+	}))
+
+	p := path
+	_ = proxy.RegisterOrUpdate(&p)
+
+	serve := func() *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", "http://breaker/", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		return w
+	}
+
+	g.Expect(serve().Code).To(Equal(http.StatusBadGateway))
+	g.Expect(serve().Code).To(Equal(http.StatusBadGateway))
+
+	w := serve()
+	body, _ := io.ReadAll(w.Body)
+	g.Expect(w.Code).To(Equal(http.StatusTooManyRequests))
+	g.Expect(string(body)).To(Equal("try again later"))
+	g.Expect(calls).To(Equal(2))
+	g.Expect(notified).To(Equal([]CircuitState{CircuitOpen}))
+
+	state, ok := proxy.CircuitBreakerState(path.Object)
+	g.Expect(ok).To(BeTrue())
+	g.Expect(state).To(Equal(CircuitOpen))
+	g.Expect(testutil.ToFloat64(circuitBreakerState.WithLabelValues("bar", "breaker"))).To(Equal(float64(CircuitOpen)))
+	g.Expect(testutil.ToFloat64(circuitBreakerRejectedTotal.WithLabelValues("bar", "breaker"))).To(Equal(float64(1)))
+
+	// Updating the registration keeps the state
+	update := path
+	_ = proxy.RegisterOrUpdate(&update)
+	state, _ = proxy.CircuitBreakerState(path.Object)
+	g.Expect(state).To(Equal(CircuitOpen))
+
+	// Disabling the circuit breaker removes it
+	disable := path
+	disable.CircuitBreaker = nil
+	_ = proxy.RegisterOrUpdate(&disable)
+	_, ok = proxy.CircuitBreakerState(path.Object)
+	g.Expect(ok).To(BeFalse())
+	g.Expect(testutil.CollectAndCount(circuitBreakerState, "oauth2_redirect_proxy_circuit_breaker_state")).To(Equal(0))
+	g.Expect(serve().Code).To(Equal(http.StatusBadGateway))
+}
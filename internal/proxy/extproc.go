@@ -0,0 +1,367 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extprocfilterv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ExternalProcessor exposes the HttpProxy as Envoy external processor (ext_proc).
+// Envoy forwards requests to the backends itself, the processor rewrites the Location header of authorization redirects
+// and answers callbacks to the redirectURI directly, using the OAUTH2Proxies registered with the HttpProxy.
+// Form posted callbacks require the filter to allow mode overrides, the request body is only requested for those.
+type ExternalProcessor struct {
+	extprocv3.UnimplementedExternalProcessorServer
+	proxy *HttpProxy
+}
+
+// NewExternalProcessor creates an ExternalProcessor routing by the OAUTH2Proxies registered with h
+func NewExternalProcessor(h *HttpProxy) *ExternalProcessor {
+	return &ExternalProcessor{proxy: h}
+}
+
+// exchange is the state of the http request processed by a single ext_proc stream
+type exchange struct {
+	r      *http.Request
+	entry  *accessLogEntry
+	span   trace.Span
+	dst    *OAUTH2Proxy
+	status int
+	// callback is set while the body of a form posted callback is awaited
+	callback bool
+}
+
+// Process handles the processing requests Envoy sends for a single http request
+func (p *ExternalProcessor) Process(stream extprocv3.ExternalProcessor_ProcessServer) error {
+	ex := &exchange{}
+	defer p.finish(ex)
+
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		var res *extprocv3.ProcessingResponse
+		switch v := req.Request.(type) {
+		case *extprocv3.ProcessingRequest_RequestHeaders:
+			res = p.requestHeaders(stream.Context(), ex, v.RequestHeaders)
+		case *extprocv3.ProcessingRequest_RequestBody:
+			res = p.requestBody(ex, v.RequestBody)
+		case *extprocv3.ProcessingRequest_ResponseHeaders:
+			res = p.responseHeaders(ex, v.ResponseHeaders)
+		case *extprocv3.ProcessingRequest_ResponseBody:
+			res = &extprocv3.ProcessingResponse{
+				Response: &extprocv3.ProcessingResponse_ResponseBody{ResponseBody: &extprocv3.BodyResponse{}},
+			}
+		case *extprocv3.ProcessingRequest_RequestTrailers:
+			res = &extprocv3.ProcessingResponse{
+				Response: &extprocv3.ProcessingResponse_RequestTrailers{RequestTrailers: &extprocv3.TrailersResponse{}},
+			}
+		case *extprocv3.ProcessingRequest_ResponseTrailers:
+			res = &extprocv3.ProcessingResponse{
+				Response: &extprocv3.ProcessingResponse_ResponseTrailers{ResponseTrailers: &extprocv3.TrailersResponse{}},
+			}
+		default:
+			// Envoy waits for a response to every request, unknown requests are not silently dropped
+			return status.Errorf(codes.Unimplemented, "unsupported processing request %T", v)
+		}
+
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+	}
+}
+
+// requestHeaders looks up the OAUTH2Proxy matching the request.
+// Callbacks are answered immediately, form posted callbacks once the request body arrived.
+func (p *ExternalProcessor) requestHeaders(ctx context.Context, ex *exchange, headers *extprocv3.HttpHeaders) *extprocv3.ProcessingResponse {
+	h := p.proxy
+	r := httpRequest(headers.GetHeaders())
+
+	id := requestID(r)
+	r.Header.Set(RequestIDHeader, id)
+
+	ex.entry = &accessLogEntry{
+		RequestID:  id,
+		Time:       h.now(),
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       h.redactor.String(r.URL.RequestURI()),
+		Proto:      r.Proto,
+		Referer:    h.redactor.String(r.Referer()),
+		UserAgent:  r.UserAgent(),
+		RemoteAddr: r.Header.Get("X-Forwarded-For"),
+		Action:     ActionUnmatched,
+	}
+
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+	ctx, ex.span = h.tracer.Start(ctx, "extProc", trace.WithSpanKind(trace.SpanKindServer))
+	h.setAttributes(ex.span, attribute.String(requestIDAttribute, id))
+
+	ctx = context.WithValue(ctx, accessLogEntryKey{}, ex.entry)
+	ctx = logr.NewContext(ctx, h.log.WithValues("requestID", id))
+	ex.r = r.WithContext(ctx)
+
+	logger := h.logger(ctx)
+	logger.Info("attempt to process incoming http request", "request", r.RequestURI, "host", r.Host)
+
+	dst, callback := h.lookup(ex.r)
+	mutation := &extprocv3.HeaderMutation{
+		SetHeaders: []*corev3.HeaderValueOption{setHeader(RequestIDHeader, id)},
+	}
+
+	switch {
+	case dst == nil:
+	case callback && r.Method == http.MethodPost && !headers.GetEndOfStream():
+		// The state of form posted callbacks is carried in the body
+		ex.callback = true
+		return &extprocv3.ProcessingResponse{
+			Response: &extprocv3.ProcessingResponse_RequestHeaders{RequestHeaders: &extprocv3.HeadersResponse{}},
+			ModeOverride: &extprocfilterv3.ProcessingMode{
+				RequestBodyMode: extprocfilterv3.ProcessingMode_BUFFERED,
+			},
+		}
+	case callback:
+		return p.recover(ex)
+	default:
+		ex.dst = dst
+		ex.entry.Object = dst.Object.String()
+		ex.entry.Action = ActionProxied
+		h.setAttributes(ex.span, objectAttributes(ex.entry.Object)...)
+		dst.stats.routed(h.now())
+		logger.Info("found matching http backend for request", "request", r.RequestURI, "host", dst.Host, "service", dst.Service, "port", dst.Port)
+	}
+
+	return &extprocv3.ProcessingResponse{
+		Response: &extprocv3.ProcessingResponse_RequestHeaders{
+			RequestHeaders: &extprocv3.HeadersResponse{
+				Response: &extprocv3.CommonResponse{HeaderMutation: mutation},
+			},
+		},
+	}
+}
+
+// requestBody answers a form posted callback
+func (p *ExternalProcessor) requestBody(ex *exchange, body *extprocv3.HttpBody) *extprocv3.ProcessingResponse {
+	if !ex.callback {
+		return &extprocv3.ProcessingResponse{
+			Response: &extprocv3.ProcessingResponse_RequestBody{RequestBody: &extprocv3.BodyResponse{}},
+		}
+	}
+
+	ex.r.Body = io.NopCloser(bytes.NewReader(body.GetBody()))
+	ex.r.ContentLength = int64(len(body.GetBody()))
+	ex.callback = false
+
+	return p.recover(ex)
+}
+
+// recover answers a callback with a redirect to the original redirect_uri
+func (p *ExternalProcessor) recover(ex *exchange) *extprocv3.ProcessingResponse {
+	w := &bufferedResponse{header: http.Header{}}
+	_ = p.proxy.recoverIncomingState(w, ex.r)
+
+	return p.immediateResponse(ex, w.status, w.header)
+}
+
+// responseHeaders swaps redirect_uri and state of the Location header of responses for the matched paths
+func (p *ExternalProcessor) responseHeaders(ex *exchange, headers *extprocv3.HttpHeaders) *extprocv3.ProcessingResponse {
+	h := p.proxy
+	header := http.Header{}
+
+	for _, v := range headers.GetHeaders().GetHeaders() {
+		if v.GetKey() == ":status" {
+			ex.status, _ = strconv.Atoi(headerValue(v))
+			continue
+		}
+
+		header.Add(v.GetKey(), headerValue(v))
+	}
+
+	res := &extprocv3.HeadersResponse{}
+	if ex.dst == nil {
+		return &extprocv3.ProcessingResponse{
+			Response: &extprocv3.ProcessingResponse_ResponseHeaders{ResponseHeaders: res},
+		}
+	}
+
+	dst := ex.dst
+	ctx := ex.r.Context()
+	ex.entry.UpstreamStatus = ex.status
+	h.logger(ctx).Info("forwarding request to svc backend finished", "status", ex.status, "host", dst.Host, "service", dst.Service, "port", dst.Port)
+
+	// The backend may echo the request id, make sure it is only sent once
+	mutation := &extprocv3.HeaderMutation{
+		SetHeaders: []*corev3.HeaderValueOption{setHeader(RequestIDHeader, ex.entry.RequestID)},
+	}
+
+	rewritten, err := h.rewriteLocation(ctx, ex.r, dst, header)
+	if err != nil {
+		var statusErr *statusError
+		if errors.As(err, &statusErr) {
+			h.fail(ex.span, statusErr.reason, err)
+			return p.immediateResponse(ex, statusErr.code, http.Header{})
+		}
+
+		return p.immediateResponse(ex, http.StatusInternalServerError, http.Header{})
+	}
+
+	if rewritten {
+		ex.entry.Action = ActionRewritten
+		h.observeRewrite(dst)
+		mutation.SetHeaders = append(mutation.SetHeaders, setHeader("Location", header.Get("Location")))
+	}
+
+	res.Response = &extprocv3.CommonResponse{HeaderMutation: mutation}
+	return &extprocv3.ProcessingResponse{
+		Response: &extprocv3.ProcessingResponse_ResponseHeaders{ResponseHeaders: res},
+	}
+}
+
+// immediateResponse answers the request without forwarding it
+func (p *ExternalProcessor) immediateResponse(ex *exchange, code int, header http.Header) *extprocv3.ProcessingResponse {
+	ex.status = code
+	mutation := &extprocv3.HeaderMutation{
+		SetHeaders: []*corev3.HeaderValueOption{setHeader(RequestIDHeader, ex.entry.RequestID)},
+	}
+
+	for key, values := range header {
+		for _, v := range values {
+			mutation.SetHeaders = append(mutation.SetHeaders, setHeader(key, v))
+		}
+	}
+
+	return &extprocv3.ProcessingResponse{
+		Response: &extprocv3.ProcessingResponse_ImmediateResponse{
+			ImmediateResponse: &extprocv3.ImmediateResponse{
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode(code)},
+				Headers: mutation,
+			},
+		},
+	}
+}
+
+// finish records the processed request once the stream ended
+func (p *ExternalProcessor) finish(ex *exchange) {
+	if ex.entry == nil {
+		return
+	}
+
+	h := p.proxy
+	h.setAttributes(ex.span, ex.entry.attributes()...)
+	ex.span.End()
+
+	if h.accessLog != nil {
+		ex.entry.Status = ex.status
+		ex.entry.Duration = h.now().Sub(ex.entry.Time).Seconds()
+		h.accessLog.Log(ex.entry)
+	}
+}
+
+// httpRequest builds the request described by the headers Envoy sent, including the pseudo headers
+func httpRequest(headers *corev3.HeaderMap) *http.Request {
+	r := &http.Request{
+		Method:     http.MethodGet,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		URL:        &url.URL{},
+		Body:       http.NoBody,
+	}
+
+	scheme := "http"
+	for _, v := range headers.GetHeaders() {
+		value := headerValue(v)
+
+		switch v.GetKey() {
+		case ":method":
+			r.Method = value
+		case ":authority":
+			r.Host = value
+		case ":scheme":
+			scheme = value
+		case ":path":
+			r.RequestURI = value
+		default:
+			if !strings.HasPrefix(v.GetKey(), ":") {
+				r.Header.Add(v.GetKey(), value)
+			}
+		}
+	}
+
+	if u, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		r.URL = u
+	}
+
+	r.URL.Scheme = scheme
+	r.URL.Host = r.Host
+
+	return r
+}
+
+// headerValue returns the value of an Envoy header, which is either sent as string or raw bytes
+func headerValue(v *corev3.HeaderValue) string {
+	if len(v.GetRawValue()) > 0 {
+		return string(v.GetRawValue())
+	}
+
+	return v.GetValue()
+}
+
+// setHeader replaces the value of a header
+func setHeader(key, value string) *corev3.HeaderValueOption {
+	return &corev3.HeaderValueOption{
+		Header: &corev3.HeaderValue{
+			Key:      strings.ToLower(key),
+			RawValue: []byte(value),
+		},
+		AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+	}
+}
+
+// bufferedResponse captures the response of the HttpProxy so it can be sent as immediate response
+type bufferedResponse struct {
+	header http.Header
+	status int
+}
+
+func (w *bufferedResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponse) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return len(b), nil
+}
+
+func (w *bufferedResponse) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
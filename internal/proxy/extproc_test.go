@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extprocfilterv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// newExtProcClient serves an ExternalProcessor for h in-process and returns a client connected to it
+func newExtProcClient(t *testing.T, h *HttpProxy) extprocv3.ExternalProcessorClient {
+	lis := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	extprocv3.RegisterExternalProcessorServer(server, NewExternalProcessor(h))
+
+	go func() {
+		_ = server.Serve(lis)
+	}()
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = conn.Close()
+		server.Stop()
+	})
+
+	return extprocv3.NewExternalProcessorClient(conn)
+}
+
+func envoyHeaders(endOfStream bool, kv ...string) *extprocv3.HttpHeaders {
+	headers := &corev3.HeaderMap{}
+	for i := 0; i < len(kv); i += 2 {
+		headers.Headers = append(headers.Headers, &corev3.HeaderValue{Key: kv[i], RawValue: []byte(kv[i+1])})
+	}
+
+	return &extprocv3.HttpHeaders{Headers: headers, EndOfStream: endOfStream}
+}
+
+func requestHeaders(headers *extprocv3.HttpHeaders) *extprocv3.ProcessingRequest {
+	return &extprocv3.ProcessingRequest{
+		Request: &extprocv3.ProcessingRequest_RequestHeaders{RequestHeaders: headers},
+	}
+}
+
+func responseHeaders(headers *extprocv3.HttpHeaders) *extprocv3.ProcessingRequest {
+	return &extprocv3.ProcessingRequest{
+		Request: &extprocv3.ProcessingRequest_ResponseHeaders{ResponseHeaders: headers},
+	}
+}
+
+// mutatedHeaders returns the headers set by a header mutation
+func mutatedHeaders(mutation *extprocv3.HeaderMutation) map[string]string {
+	headers := map[string]string{}
+	for _, v := range mutation.GetSetHeaders() {
+		headers[v.GetHeader().GetKey()] = headerValue(v.GetHeader())
+	}
+
+	return headers
+}
+
+func TestExternalProcessorRewritesLocation(t *testing.T) {
+	g := NewWithT(t)
+
+	h := New(logr.Discard(), nil)
+	_ = h.RegisterOrUpdate(&OAUTH2Proxy{
+		Host:        "idp",
+		RedirectURI: "https://oauth2proxy",
+		Paths:       []PathMatch{{Path: "/auth"}},
+		Object:      client.ObjectKey{Namespace: "bar", Name: "foo"},
+	})
+
+	stream, err := newExtProcClient(t, h).Process(context.Background())
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(stream.Send(requestHeaders(envoyHeaders(true,
+		":method", "GET",
+		":scheme", "https",
+		":authority", "idp",
+		":path", "/auth?client_id=app",
+		"x-request-id", "my-request",
+	)))).To(Succeed())
+
+	res, err := stream.Recv()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(res.GetRequestHeaders()).NotTo(BeNil())
+	g.Expect(mutatedHeaders(res.GetRequestHeaders().GetResponse().GetHeaderMutation())).To(HaveKeyWithValue("x-request-id", "my-request"))
+
+	g.Expect(stream.Send(responseHeaders(envoyHeaders(false,
+		":status", "302",
+		"location", "https://idp/login?redirect_uri=https://idp/auth/callback&state=foobar",
+	)))).To(Succeed())
+
+	res, err = stream.Recv()
+	g.Expect(err).NotTo(HaveOccurred())
+
+	headers := mutatedHeaders(res.GetResponseHeaders().GetResponse().GetHeaderMutation())
+	g.Expect(headers).To(HaveKey("location"))
+
+	u, err := url.Parse(headers["location"])
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(u.Query().Get("redirect_uri")).To(Equal("https://oauth2proxy/auth/callback"))
+
+	st := state{}
+	g.Expect(h.parseState(u.Query().Get("state"), &st)).To(Succeed())
+	g.Expect(st.OrigState).To(Equal("foobar"))
+	g.Expect(st.OrigRedirectURI).To(Equal("https://idp/auth/callback"))
+	g.Expect(st.ObjectID).To(Equal(h.objectID(client.ObjectKey{Namespace: "bar", Name: "foo"})))
+	g.Expect(st.RequestID).To(Equal("my-request"))
+
+	g.Expect(stream.CloseSend()).To(Succeed())
+	g.Expect(h.Stats()).To(HaveKeyWithValue(client.ObjectKey{Namespace: "bar", Name: "foo"}, HaveField("Rewrites", int64(1))))
+}
+
+func TestExternalProcessorKeepsLocation(t *testing.T) {
+	h := New(logr.Discard(), nil)
+	_ = h.RegisterOrUpdate(&OAUTH2Proxy{
+		Host:        "idp",
+		RedirectURI: "https://oauth2proxy",
+		Paths:       []PathMatch{{Path: "/auth"}},
+		Object:      client.ObjectKey{Namespace: "bar", Name: "foo"},
+	})
+
+	c := newExtProcClient(t, h)
+
+	for _, authority := range []string{"idp", "unknown"} {
+		t.Run(authority, func(t *testing.T) {
+			g := NewWithT(t)
+
+			stream, err := c.Process(context.Background())
+			g.Expect(err).NotTo(HaveOccurred())
+
+			// Only the paths of the OAUTH2Proxy are rewritten and unknown hosts are passed through
+			g.Expect(stream.Send(requestHeaders(envoyHeaders(true, ":method", "GET", ":authority", authority, ":path", "/login")))).To(Succeed())
+			res, err := stream.Recv()
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(res.GetRequestHeaders()).NotTo(BeNil())
+
+			g.Expect(stream.Send(responseHeaders(envoyHeaders(false,
+				":status", "302",
+				"location", "https://idp/login?redirect_uri=https://idp/auth/callback",
+			)))).To(Succeed())
+
+			res, err = stream.Recv()
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(res.GetResponseHeaders()).NotTo(BeNil())
+			g.Expect(mutatedHeaders(res.GetResponseHeaders().GetResponse().GetHeaderMutation())).NotTo(HaveKey("location"))
+		})
+	}
+}
+
+func TestExternalProcessorUnsupportedRequest(t *testing.T) {
+	g := NewWithT(t)
+	c := newExtProcClient(t, New(logr.Discard(), nil))
+
+	stream, err := c.Process(context.Background())
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// Requests without a known type are answered with an error instead of leaving Envoy waiting
+	g.Expect(stream.Send(&extprocv3.ProcessingRequest{})).To(Succeed())
+	_, err = stream.Recv()
+	g.Expect(status.Code(err)).To(Equal(codes.Unimplemented))
+}
+
+func TestExternalProcessorRecoversState(t *testing.T) {
+	h := New(logr.Discard(), nil)
+	_ = h.RegisterOrUpdate(&OAUTH2Proxy{
+		Host:        "idp",
+		RedirectURI: "https://oauth2proxy",
+		Object:      client.ObjectKey{Namespace: "bar", Name: "foo"},
+	})
+
+	c := newExtProcClient(t, h)
+
+	b := h.encodeState(state{
+		OrigRedirectURI: "https://my-original-uri",
+		OrigState:       "my-state",
+		ObjectID:        h.objectID(client.ObjectKey{Namespace: "bar", Name: "foo"}),
+	})
+
+	tests := []struct {
+		name           string
+		requests       []*extprocv3.ProcessingRequest
+		expectCode     int32
+		expectLocation string
+	}{
+		{
+			name: "Undecodable state ends in 400",
+			requests: []*extprocv3.ProcessingRequest{
+				requestHeaders(envoyHeaders(true, ":method", "GET", ":scheme", "https", ":authority", "oauth2proxy", ":path", "/?state=invalid")),
+			},
+			expectCode: 400,
+		},
+		{
+			name: "Recover origin redirect uri and redirect client ends in 303",
+			requests: []*extprocv3.ProcessingRequest{
+				requestHeaders(envoyHeaders(true, ":method", "GET", ":scheme", "https", ":authority", "oauth2proxy", ":path", "/?"+url.Values{"state": []string{b}}.Encode())),
+			},
+			expectCode:     303,
+			expectLocation: "https://my-original-uri?state=my-state",
+		},
+		{
+			name: "POST redirect extracts origin state and code from the post form body",
+			requests: []*extprocv3.ProcessingRequest{
+				requestHeaders(envoyHeaders(false, ":method", "POST", ":scheme", "https", ":authority", "oauth2proxy", ":path", "/", "content-type", "application/x-www-form-urlencoded")),
+				{
+					Request: &extprocv3.ProcessingRequest_RequestBody{RequestBody: &extprocv3.HttpBody{
+						Body:        []byte(url.Values{"state": []string{b}, "code": []string{"foobar"}}.Encode()),
+						EndOfStream: true,
+					}},
+				},
+			},
+			expectCode:     303,
+			expectLocation: "https://my-original-uri?code=foobar&state=my-state",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			stream, err := c.Process(context.Background())
+			g.Expect(err).NotTo(HaveOccurred())
+
+			var res *extprocv3.ProcessingResponse
+			for i, req := range test.requests {
+				g.Expect(stream.Send(req)).To(Succeed())
+				res, err = stream.Recv()
+				g.Expect(err).NotTo(HaveOccurred())
+
+				// The body of form posted callbacks is requested
+				if i < len(test.requests)-1 {
+					g.Expect(res.GetModeOverride().GetRequestBodyMode()).To(Equal(extprocfilterv3.ProcessingMode_BUFFERED))
+				}
+			}
+
+			g.Expect(res.GetImmediateResponse()).NotTo(BeNil())
+			g.Expect(int32(res.GetImmediateResponse().GetStatus().GetCode())).To(Equal(test.expectCode))
+
+			headers := mutatedHeaders(res.GetImmediateResponse().GetHeaders())
+			if test.expectLocation != "" {
+				g.Expect(headers).To(HaveKeyWithValue("location", test.expectLocation))
+			} else {
+				g.Expect(headers).NotTo(HaveKey("location"))
+			}
+		})
+	}
+
+	g := NewWithT(t)
+	g.Expect(h.Stats()).To(HaveKeyWithValue(client.ObjectKey{Namespace: "bar", Name: "foo"}, HaveField("Callbacks", int64(2))))
+}
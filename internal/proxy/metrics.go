@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	// unknownObject is the namespace and name label of callbacks whose state was not issued by a registered OAUTH2Proxy.
+	// The state is sent back by the client, using its object as label would allow anyone to create label series.
+	unknownObject = "unknown"
+	// maxLoginDuration is the maximum age of a state whose login duration is observed
+	maxLoginDuration = 24 * time.Hour
+	// maxClockSkew is the tolerated clock difference between the replica which issued a state and the one receiving the callback
+	maxClockSkew = time.Minute
+)
+
+var (
+	// loginsStartedTotal counts the authorization redirects which have been rewritten to point to the proxy redirectURI
+	loginsStartedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "oauth2_redirect_proxy_logins_started_total",
+			Help: "Total number of logins redirected to the external IdP.",
+		},
+		[]string{"namespace", "name"},
+	)
+
+	// loginsCompletedTotal counts the callbacks which have been recovered and redirected back to the originating IdP
+	loginsCompletedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "oauth2_redirect_proxy_logins_completed_total",
+			Help: "Total number of logins returned from the external IdP.",
+		},
+		[]string{"namespace", "name"},
+	)
+
+	// loginDurationSeconds observes the time a user spent at the external IdP
+	loginDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "oauth2_redirect_proxy_login_duration_seconds",
+			Help:    "Round trip duration between the outbound redirect and the callback from the external IdP.",
+			Buckets: []float64{1, 2.5, 5, 10, 20, 30, 60, 120, 300, 600, 1800},
+		},
+		[]string{"namespace", "name"},
+	)
+
+	// circuitBreakerState is the state of the circuit breaker of an OAUTH2Proxy backend
+	circuitBreakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "oauth2_redirect_proxy_circuit_breaker_state",
+			Help: "State of the backend circuit breaker, 0 is closed, 1 is half-open and 2 is open.",
+		},
+		[]string{"namespace", "name"},
+	)
+
+	// circuitBreakerRejectedTotal counts the requests rejected by an open circuit breaker
+	circuitBreakerRejectedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "oauth2_redirect_proxy_circuit_breaker_rejected_total",
+			Help: "Total number of requests rejected without forwarding them to the backend.",
+		},
+		[]string{"namespace", "name"},
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		loginsStartedTotal,
+		loginsCompletedTotal,
+		loginDurationSeconds,
+		circuitBreakerState,
+		circuitBreakerRejectedTotal,
+	)
+}
@@ -2,16 +2,25 @@ package proxy
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -21,10 +30,48 @@ var (
 
 // HttpProxy is the main proxy server
 type HttpProxy struct {
-	dst    []*OAUTH2Proxy
-	client *http.Client
-	mutex  sync.Mutex
-	log    logr.Logger
+	dst                    []*OAUTH2Proxy
+	transport              http.RoundTripper
+	wrap                   func(http.RoundTripper) http.RoundTripper
+	circuitBreakerListener CircuitBreakerListener
+	registrationListener   RegistrationListener
+	mutex                  sync.Mutex
+	log                    logr.Logger
+	redactor               *Redactor
+	accessLog              *AccessLogger
+	tracer                 trace.Tracer
+	statsWindow            time.Duration
+	stateKey               []byte
+	now                    func() time.Time
+}
+
+// Option configures optional HttpProxy settings
+type Option func(h *HttpProxy)
+
+// WithRedactor sets the Redactor used to mask sensitive parameters in logs and traces.
+// Passing nil disables redaction.
+func WithRedactor(r *Redactor) Option {
+	return func(h *HttpProxy) {
+		h.redactor = r
+	}
+}
+
+// RegistrationListener is notified once an OAUTH2Proxy has been registered, updated or unregistered.
+// It is called while the registrations are locked and must not block.
+type RegistrationListener func()
+
+// WithRegistrationListener sets a listener which is notified about changes of the registered OAUTH2Proxies
+func WithRegistrationListener(listener RegistrationListener) Option {
+	return func(h *HttpProxy) {
+		h.registrationListener = listener
+	}
+}
+
+// PathMatch matches the path of a request
+type PathMatch struct {
+	Path string
+	// Exact only matches the path itself instead of all paths with the prefix
+	Exact bool
 }
 
 // OAUTH2Proxy defines the serivce which is proxied
@@ -32,30 +79,168 @@ type OAUTH2Proxy struct {
 	Host        string
 	Service     string
 	RedirectURI string
-	Paths       []string
+	Paths       []PathMatch
 	Port        int32
 	Object      client.ObjectKey
+	// Endpoints are the ready endpoints of the service, if set requests are balanced across them instead of
+	// being forwarded to the service address
+	Endpoints []Endpoint
+	// Scheme used to connect to the service, defaults to http
+	Scheme string
+	// Path is prepended to the path of forwarded requests
+	Path string
+	// TLS is the client configuration used to connect to the service if the scheme is https
+	TLS *tls.Config
+	// TLSCertificates are the PEM encoded certificates TLS was built from, the xDS server publishes them to Envoy
+	TLSCertificates TLSCertificates
+	// Timeouts for requests forwarded to the service
+	Timeouts Timeouts
+	// Retries of requests which failed to connect to the service
+	Retries RetryPolicy
+	// CircuitBreaker rejects requests while the service is failing, disabled if nil
+	CircuitBreaker *CircuitBreakerPolicy
+
+	// transport forwards the requests to the service
+	transport http.RoundTripper
+	// backendTransport is the transport dedicated to this service, if any
+	backendTransport *http.Transport
+	// breaker is the circuit breaker of the service, if any
+	breaker *circuitBreaker
+	// stats counts the requests routed for the service
+	stats *routeStats
+	// next is the round robin counter used to choose an endpoint
+	next *atomic.Uint64
+}
+
+// TLSCertificates are the PEM encoded certificates used to connect to a service
+type TLSCertificates struct {
+	// CA verifies the certificate of the service, the system roots are used if empty
+	CA []byte
+	// Cert and Key are the client certificate presented to the service, if any
+	Cert []byte
+	Key  []byte
+}
+
+// Endpoint is a ready endpoint of a service
+type Endpoint struct {
+	Address string
+	Port    int32
+}
+
+// upstream returns the address and port a request is forwarded to.
+// Endpoints are chosen round robin, the service address is used if there are none.
+func (dst *OAUTH2Proxy) upstream() (string, int32) {
+	if len(dst.Endpoints) == 0 || dst.next == nil {
+		return dst.Service, dst.Port
+	}
+
+	i := dst.next.Add(1) - 1
+	endpoint := dst.Endpoints[i%uint64(len(dst.Endpoints))]
+	return endpoint.Address, endpoint.Port
+}
+
+// Timeouts for requests forwarded to a service, zero means no timeout
+type Timeouts struct {
+	// Connect is the maximum time to establish a connection
+	Connect time.Duration
+	// ResponseHeader is the maximum time to wait for the response headers once the request has been sent
+	ResponseHeader time.Duration
+	// Request is the maximum time for the whole request including reading the response body
+	Request time.Duration
 }
 
 // state is the proxied OAUTH2 state
 type state struct {
 	OrigState       string `json:"origState,omitempty"`
 	OrigRedirectURI string `json:"origRedirectURI,omitempty"`
+	IssuedAt        int64  `json:"issuedAt,omitempty"`
+	ObjectID        string `json:"objectID,omitempty"`
+	RequestID       string `json:"requestID,omitempty"`
+	TraceParent     string `json:"traceParent,omitempty"`
+}
+
+// WithAccessLogger enables the access log
+func WithAccessLogger(a *AccessLogger) Option {
+	return func(h *HttpProxy) {
+		h.accessLog = a
+	}
+}
+
+// WithStateKey sets the key the proxied state is signed with.
+// Callbacks are only accepted with a state signed by the same key, hence all replicas must share it.
+// A random key is generated by default.
+func WithStateKey(key []byte) Option {
+	return func(h *HttpProxy) {
+		h.stateKey = key
+	}
+}
+
+// WithTracerProvider sets the provider used to create spans, by default the global provider is used
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(h *HttpProxy) {
+		h.tracer = tp.Tracer(tracerName)
+	}
+}
+
+// WithTransportWrapper wraps the transports used to forward requests to the backends, for example to instrument them
+func WithTransportWrapper(wrap func(http.RoundTripper) http.RoundTripper) Option {
+	return func(h *HttpProxy) {
+		h.wrap = wrap
+	}
 }
 
 // New creates a new instance of HttpProxy
-func New(logger logr.Logger, client *http.Client) *HttpProxy {
-	return &HttpProxy{
-		log:    logger,
-		client: client,
+// Requests are forwarded to the backends using transport, if nil http.DefaultTransport is used.
+// Backends using https get a dedicated transport.
+// Sensitive parameters are redacted from logs by default.
+func New(logger logr.Logger, transport http.RoundTripper, opts ...Option) *HttpProxy {
+	h := &HttpProxy{
+		transport:   transport,
+		redactor:    NewRedactor(),
+		tracer:      otel.Tracer(tracerName),
+		statsWindow: DefaultStatsWindow,
+		now:         time.Now,
+		wrap: func(rt http.RoundTripper) http.RoundTripper {
+			return rt
+		},
+	}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	if h.transport == nil {
+		h.transport = http.DefaultTransport
 	}
+
+	if len(h.stateKey) == 0 {
+		h.stateKey = make([]byte, stateKeySize)
+		_, _ = rand.Read(h.stateKey)
+	}
+
+	h.transport = h.wrap(h.transport)
+
+	h.log = h.redactor.Logger(logger)
+	return h
 }
 
 // Unregister removes a service from the proxy
 func (h *HttpProxy) Unregister(obj client.ObjectKey) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
 	for k, v := range h.dst {
 		if v.Object == obj {
+			if v.backendTransport != nil {
+				v.backendTransport.CloseIdleConnections()
+			}
+
+			if v.breaker != nil {
+				v.breaker.remove()
+			}
+
 			h.dst = append(h.dst[:k], h.dst[k+1:]...)
+			h.notifyRegistration()
 			return nil
 		}
 	}
@@ -70,124 +255,493 @@ func (h *HttpProxy) RegisterOrUpdate(dst *OAUTH2Proxy) error {
 
 	for _, v := range h.dst {
 		if v.Object == dst.Object {
-			h.log.Info("update http backend", "host", dst.Host, "service", dst.Service, "port", dst.Port)
+			h.log.Info("update http backend", "host", dst.Host, "service", dst.Service, "port", dst.Port, "scheme", dst.Scheme, "endpoints", len(dst.Endpoints))
 			v.Host = dst.Host
 			v.Port = dst.Port
 			v.Service = dst.Service
 			v.RedirectURI = dst.RedirectURI
 			v.Paths = dst.Paths
+			v.Endpoints = dst.Endpoints
+			v.Scheme = dst.Scheme
+			v.Path = dst.Path
+			v.TLS = dst.TLS
+			v.TLSCertificates = dst.TLSCertificates
+			v.Timeouts = dst.Timeouts
+			v.Retries = dst.Retries
+			v.CircuitBreaker = dst.CircuitBreaker
+			h.setTransport(v)
+			h.setCircuitBreaker(v)
+			h.notifyRegistration()
 
 			return nil
 		}
 	}
 
-	h.log.Info("register http backend", "host", dst.Host, "service", dst.Service, "port", dst.Port)
+	h.log.Info("register http backend", "host", dst.Host, "service", dst.Service, "port", dst.Port, "scheme", dst.Scheme, "endpoints", len(dst.Endpoints))
+	dst.next = &atomic.Uint64{}
+	dst.stats = newRouteStats(h.statsWindow)
+	h.setTransport(dst)
+	h.setCircuitBreaker(dst)
 	h.dst = append(h.dst, dst)
+	h.notifyRegistration()
 
 	return nil
 }
 
+// Registrations returns a copy of each registered OAUTH2Proxy
+func (h *HttpProxy) Registrations() []OAUTH2Proxy {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	registrations := make([]OAUTH2Proxy, 0, len(h.dst))
+	for _, v := range h.dst {
+		registrations = append(registrations, *v)
+	}
+
+	return registrations
+}
+
+// notifyRegistration notifies the RegistrationListener, if any
+func (h *HttpProxy) notifyRegistration() {
+	if h.registrationListener != nil {
+		h.registrationListener()
+	}
+}
+
+// CircuitBreakerState returns the state of the circuit breaker of a registered OAUTH2Proxy.
+// ok is false if the OAUTH2Proxy is not registered or has no circuit breaker.
+func (h *HttpProxy) CircuitBreakerState(obj client.ObjectKey) (state CircuitState, ok bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, v := range h.dst {
+		if v.Object == obj && v.breaker != nil {
+			return v.breaker.State(), true
+		}
+	}
+
+	return CircuitClosed, false
+}
+
+// setTransport (re)creates the transport of a backend.
+// Backends with a TLS configuration or connection timeouts get a dedicated transport, which also separates their connection pool.
+// Certificate changes are picked up for new connections.
+// Idle connections of the previous transport are closed, in-flight requests finish using it.
+func (h *HttpProxy) setTransport(dst *OAUTH2Proxy) {
+	if dst.backendTransport != nil {
+		dst.backendTransport.CloseIdleConnections()
+	}
+
+	dst.backendTransport = nil
+	dst.transport = h.transport
+
+	if dst.TLS != nil || dst.Timeouts.Connect > 0 || dst.Timeouts.ResponseHeader > 0 {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = dst.TLS
+		t.ResponseHeaderTimeout = dst.Timeouts.ResponseHeader
+
+		if dst.Timeouts.Connect > 0 {
+			dialer := &net.Dialer{
+				Timeout:   dst.Timeouts.Connect,
+				KeepAlive: 30 * time.Second,
+			}
+			t.DialContext = dialer.DialContext
+		}
+
+		dst.backendTransport = t
+		dst.transport = h.wrap(t)
+	}
+
+	if dst.Retries.Attempts > 0 {
+		dst.transport = &retryTransport{
+			next:   dst.transport,
+			policy: dst.Retries,
+		}
+	}
+}
+
+// setCircuitBreaker creates, updates or removes the circuit breaker of a backend.
+// The state of an existing circuit breaker is kept.
+func (h *HttpProxy) setCircuitBreaker(dst *OAUTH2Proxy) {
+	switch {
+	case dst.CircuitBreaker == nil && dst.breaker != nil:
+		dst.breaker.remove()
+		dst.breaker = nil
+	case dst.CircuitBreaker != nil && dst.breaker != nil:
+		dst.breaker.setPolicy(*dst.CircuitBreaker)
+	case dst.CircuitBreaker != nil:
+		dst.breaker = newCircuitBreaker(dst.Object, *dst.CircuitBreaker, func() time.Time {
+			return h.now()
+		}, h.circuitBreakerListener)
+	}
+}
+
 func (h *HttpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	h.log.Info("attempt to proxy incoming http request", "request", r.RequestURI, "host", r.Host)
+	id := requestID(r)
+	r.Header.Set(RequestIDHeader, id)
+	w.Header().Set(RequestIDHeader, id)
+
+	span := trace.SpanFromContext(r.Context())
+	h.setAttributes(span, attribute.String(requestIDAttribute, id))
+
+	entry := &accessLogEntry{
+		RequestID:  id,
+		Time:       h.now(),
+		RemoteAddr: r.RemoteAddr,
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       h.redactor.String(r.URL.RequestURI()),
+		Proto:      r.Proto,
+		Referer:    h.redactor.String(r.Referer()),
+		UserAgent:  r.UserAgent(),
+		Action:     ActionUnmatched,
+	}
 
-	for _, dst := range h.dst {
-		u, err := url.Parse(dst.RedirectURI)
-		if err != nil {
-			h.log.Info("could not parse proxy redirectURI", "request", r.RequestURI, "host", dst.Host, "err", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+	ctx := context.WithValue(r.Context(), accessLogEntryKey{}, entry)
+	ctx = logr.NewContext(ctx, h.log.WithValues("requestID", id))
+
+	rw := &responseWriter{ResponseWriter: w}
+
+	// The reverse proxy aborts the handler with a panic if the response could not be copied, the request is recorded anyway
+	defer func() {
+		h.setAttributes(span, entry.attributes()...)
+
+		if h.accessLog != nil {
+			entry.Status = rw.status
+			entry.Bytes = rw.bytes
+			entry.Duration = h.now().Sub(entry.Time).Seconds()
+			h.accessLog.Log(entry)
 		}
+	}()
+
+	h.route(rw, r.WithContext(ctx))
+}
+
+// logger returns the request scoped logger
+func (h *HttpProxy) logger(ctx context.Context) logr.Logger {
+	if logger, err := logr.FromContext(ctx); err == nil {
+		return logger
+	}
 
+	return h.log
+}
+
+// route dispatches the request to the matching OAUTH2Proxy
+func (h *HttpProxy) route(w http.ResponseWriter, r *http.Request) {
+	logger := h.logger(r.Context())
+	logger.Info("attempt to proxy incoming http request", "request", r.RequestURI, "host", r.Host)
+
+	dst, callback := h.lookup(r)
+
+	switch {
+	case dst == nil:
+		// We don't have any matching OAUTH2Proxy resources matching the host
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case callback:
+		//request targets redirectURI, attempt to parse state and redirect to original URL
+		_ = h.recoverIncomingState(w, r)
+	default:
 		//request targets service, check if response has a redirect uri and state and attempt to change it to the proxy redirectURI
-		if dst.Host == r.Host {
-			_ = h.changeRedirectURI(w, r, dst)
-			return
+		h.changeRedirectURI(w, r, dst)
+	}
+}
+
+// lookup finds the OAUTH2Proxy matching the request host.
+// callback is true if the request targets the redirectURI host rather than the host of the OAUTH2Proxy.
+// A copy of the OAUTH2Proxy is returned so it can be used while the registration gets updated.
+func (h *HttpProxy) lookup(r *http.Request) (dst *OAUTH2Proxy, callback bool) {
+	_, span := h.tracer.Start(r.Context(), "lookup")
+	defer span.End()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, v := range h.dst {
+		if v.Host == r.Host {
+			h.setAttributes(span, objectAttributes(v.Object.String())...)
+			d := *v
+			return &d, false
 		}
 
-		//request targets redirectURI, attempt to parse state and redirect to original URL
+		// An OAUTH2Proxy with an invalid redirectURI must not affect requests for other hosts
+		u, err := url.Parse(v.RedirectURI)
+		if err != nil {
+			h.logger(r.Context()).Info("could not parse proxy redirectURI", "request", r.RequestURI, "host", v.Host, "err", err)
+			continue
+		}
+
+		// The originating OAUTH2Proxy of a callback is only known once the state has been decoded
 		if u.Host == r.Host {
-			_ = h.recoverIncomingState(w, r)
-			return
+			span.SetAttributes(attribute.Bool(callbackAttribute, true))
+			d := *v
+			return &d, true
 		}
 	}
 
-	// We don't have any matching OAUTH2Proxy resources matching the host
-	w.WriteHeader(http.StatusServiceUnavailable)
+	h.fail(span, reasonNoMatchingOAUTH2Proxy, nil)
+	return nil, false
 }
 
 // proxy request to target
 // if the request matches a path and the response contains a location header, the proxy
 // attempts to change the redirect_url in the location uri to the configured proxy target
-func (h *HttpProxy) changeRedirectURI(w http.ResponseWriter, r *http.Request, dst *OAUTH2Proxy) error {
-	h.log.Info("found matching http backend for request", "request", r.RequestURI, "host", dst.Host, "service", dst.Service, "port", dst.Port)
-
-	clone := r.Clone(context.TODO())
-	clone.URL.Scheme = "http"
-	clone.URL.Host = fmt.Sprintf("%s:%d", dst.Service, dst.Port)
-	clone.RequestURI = ""
+func (h *HttpProxy) changeRedirectURI(w http.ResponseWriter, r *http.Request, dst *OAUTH2Proxy) {
+	entry := accessLogEntryFromContext(r.Context())
+	entry.Object = dst.Object.String()
+	entry.Action = ActionProxied
+
+	ctx, span := h.tracer.Start(r.Context(), "changeRedirectURI", trace.WithAttributes(
+		h.redactor.Attributes(objectAttributes(entry.Object)...)...,
+	))
+	defer func() {
+		h.setAttributes(span, attribute.String(actionAttribute, string(entry.Action)))
+		span.End()
+	}()
+
+	dst.stats.routed(h.now())
+
+	logger := h.logger(ctx)
+	logger.Info("found matching http backend for request", "request", r.RequestURI, "host", dst.Host, "service", dst.Service, "port", dst.Port)
+
+	if dst.breaker != nil && !dst.breaker.allow() {
+		logger.Info("circuit breaker is open, reject request", "request", r.RequestURI, "host", dst.Host, "service", dst.Service, "port", dst.Port)
+		h.fail(span, reasonCircuitOpen, nil)
+		entry.Action = ActionShortCircuited
+		circuitBreakerRejectedTotal.WithLabelValues(dst.Object.Namespace, dst.Object.Name).Inc()
+
+		code := dst.CircuitBreaker.StatusCode
+		if code == 0 {
+			code = http.StatusServiceUnavailable
+		}
 
-	// send request to proxy target
-	res, err := h.client.Do(clone)
+		w.WriteHeader(code)
+		_, _ = io.WriteString(w, dst.CircuitBreaker.Body)
+		return
+	}
 
-	if err != nil {
-		h.log.Info("forwarding request to svc backend failed", "err", err, "request", r.RequestURI, "host", dst.Host, "service", dst.Service, "port", dst.Port)
-		w.WriteHeader(http.StatusBadRequest)
-		return err
+	if dst.Timeouts.Request > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dst.Timeouts.Request)
+		defer cancel()
 	}
 
-	h.log.Info("forwarding request to svc backend finished", "status", res.StatusCode, "host", dst.Host, "service", dst.Service, "port", dst.Port)
+	var upstreamSpan trace.Span
+	address, port := dst.upstream()
+	target := &url.URL{
+		Scheme: dst.Scheme,
+		Host:   net.JoinHostPort(address, strconv.Itoa(int(port))),
+		Path:   dst.Path,
+	}
 
-	if location, ok := res.Header["Location"]; ok && matchPath(r.URL.Path, dst.Paths) {
-		u, err := url.Parse(location[0])
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return err
-		}
+	if target.Scheme == "" {
+		target.Scheme = "http"
+	}
 
-		vals := u.Query()
-		if vals.Get("redirect_uri") != "" {
-			st := state{
-				OrigState:       vals.Get("state"),
-				OrigRedirectURI: vals.Get("redirect_uri"),
+	rp := &httputil.ReverseProxy{
+		Transport: dst.transport,
+		// Flush immediately so streamed responses are not buffered by the proxy
+		FlushInterval: -1,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			var upstreamCtx context.Context
+			upstreamCtx, upstreamSpan = h.tracer.Start(ctx, "upstream", trace.WithAttributes(h.redactor.Attributes(
+				attribute.String("server.address", address),
+				attribute.Int("server.port", int(port)),
+				attribute.String("url.scheme", target.Scheme),
+			)...))
+
+			pr.Out = pr.Out.WithContext(withNextUpstream(upstreamCtx, dst))
+			pr.SetURL(target)
+			// The backend expects the host it is published as
+			pr.Out.Host = pr.In.Host
+			setXForwarded(pr)
+		},
+		ModifyResponse: func(res *http.Response) error {
+			upstreamSpan.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
+			upstreamSpan.End()
+
+			if dst.breaker != nil {
+				dst.breaker.done(nil)
 			}
-			b, _ := json.Marshal(st)
 
-			origRedirectUri, err := url.Parse(vals.Get("redirect_uri"))
+			logger.Info("forwarding request to svc backend finished", "status", res.StatusCode, "host", dst.Host, "service", dst.Service, "port", dst.Port)
+			entry.UpstreamStatus = res.StatusCode
+
+			// The backend may echo the request id, make sure it is only sent once
+			res.Header.Del(RequestIDHeader)
+
+			rewritten, err := h.rewriteLocation(ctx, r, dst, res.Header)
 			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
 				return err
 			}
 
-			redirectUri, err := url.Parse(dst.RedirectURI)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return err
+			if rewritten {
+				entry.Action = ActionRewritten
+				h.observeRewrite(dst)
+			}
+
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, err error) {
+			var statusErr *statusError
+			if errors.As(err, &statusErr) {
+				h.fail(span, statusErr.reason, err)
+				w.WriteHeader(statusErr.code)
+				return
+			}
+
+			logger.Info("forwarding request to svc backend failed", "err", err, "request", r.RequestURI, "host", dst.Host, "service", dst.Service, "port", dst.Port)
+
+			if dst.breaker != nil {
+				dst.breaker.done(err)
+			}
+
+			code, reason := http.StatusBadGateway, reasonUpstreamUnavailable
+			if isTimeout(err) {
+				code, reason = http.StatusGatewayTimeout, reasonUpstreamTimeout
 			}
-			redirectUri.Path = origRedirectUri.Path
 
-			vals.Set("state", string(b))
-			vals.Set("redirect_uri", redirectUri.String())
-			u.RawQuery = vals.Encode()
+			h.fail(upstreamSpan, reason, err)
+			upstreamSpan.End()
+			h.fail(span, reason, err)
+			w.WriteHeader(code)
+		},
+	}
+
+	rp.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// setXForwarded sets the X-Forwarded-* headers of the outgoing request.
+// The proxy is expected to run behind an ingress controller, hence the forwarded chain of the incoming request is extended
+// and the original host and protocol are kept if the incoming request carries them.
+func setXForwarded(pr *httputil.ProxyRequest) {
+	pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+	pr.SetXForwarded()
 
-			res.Header["Location"] = []string{u.String()}
+	for _, header := range []string{"X-Forwarded-Host", "X-Forwarded-Proto"} {
+		if v := pr.In.Header.Get(header); v != "" {
+			pr.Out.Header.Set(header, v)
 		}
 	}
+}
+
+// isTimeout returns true if err is caused by the backend not responding in time
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// rewriteLocation swaps redirect_uri and state of the Location header for the redirectURI of the OAUTH2Proxy.
+// The original redirect_uri and state are carried within the proxied state, which is signed, see encodeState.
+// ctx must carry the span of the changeRedirectURI step as it is referenced by the proxied state.
+func (h *HttpProxy) rewriteLocation(ctx context.Context, r *http.Request, dst *OAUTH2Proxy, header http.Header) (bool, error) {
+	location, ok := header["Location"]
+	if !ok || !matchPath(r.URL.Path, dst.Paths) {
+		return false, nil
+	}
+
+	issuer := traceParent(ctx)
+	_, span := h.tracer.Start(ctx, "rewriteLocation")
+	defer span.End()
+
+	u, err := url.Parse(location[0])
+	if err != nil {
+		h.fail(span, reasonInvalidLocation, err)
+		return false, &statusError{code: http.StatusBadRequest, reason: reasonInvalidLocation, err: err}
+	}
+
+	vals := u.Query()
+	if vals.Get("redirect_uri") == "" {
+		span.SetAttributes(attribute.Bool(rewrittenAttribute, false))
+		return false, nil
+	}
+
+	st := state{
+		OrigState:       vals.Get("state"),
+		OrigRedirectURI: vals.Get("redirect_uri"),
+		IssuedAt:        h.now().Unix(),
+		ObjectID:        h.objectID(dst.Object),
+		RequestID:       accessLogEntryFromContext(ctx).RequestID,
+		TraceParent:     issuer,
+	}
+
+	origRedirectUri, err := url.Parse(vals.Get("redirect_uri"))
+	if err != nil {
+		h.fail(span, reasonInvalidOrigRedirectURI, err)
+		return false, &statusError{code: http.StatusBadRequest, reason: reasonInvalidOrigRedirectURI, err: err}
+	}
+
+	redirectUri, err := url.Parse(dst.RedirectURI)
+	if err != nil {
+		h.fail(span, reasonInvalidRedirectURI, err)
+		return false, &statusError{code: http.StatusInternalServerError, reason: reasonInvalidRedirectURI, err: err}
+	}
+	redirectUri.Path = origRedirectUri.Path
+
+	vals.Set("state", h.encodeState(st))
+	vals.Set("redirect_uri", redirectUri.String())
+	u.RawQuery = vals.Encode()
+
+	header["Location"] = []string{u.String()}
+	span.SetAttributes(attribute.Bool(rewrittenAttribute, true))
+
+	return true, nil
+}
+
+// observeRewrite records the start of a login round trip for the OAUTH2Proxy
+func (h *HttpProxy) observeRewrite(dst *OAUTH2Proxy) {
+	loginsStartedTotal.WithLabelValues(dst.Object.Namespace, dst.Object.Name).Inc()
+	dst.stats.rewrite(h.now())
+}
 
-	for k, v := range res.Header {
-		for _, h := range v {
-			w.Header().Add(k, h)
+// stateObject returns the OAUTH2Proxy which issued the state.
+// The OAUTH2Proxy is only trusted if it is still registered and the callback arrived at the host of its redirectURI.
+func (h *HttpProxy) stateObject(host string, st *state) (client.ObjectKey, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, v := range h.dst {
+		if st.ObjectID == "" || h.objectID(v.Object) != st.ObjectID {
+			continue
 		}
+
+		u, err := url.Parse(v.RedirectURI)
+		return v.Object, err == nil && u.Host == host
+	}
+
+	return client.ObjectKey{}, false
+}
+
+// observeLogin records the completion of a login round trip for the OAUTH2Proxy which issued the state.
+// Callbacks whose state was not issued by a registered OAUTH2Proxy are recorded as unknown and the duration
+// is only observed if the state was issued within maxLoginDuration.
+func (h *HttpProxy) observeLogin(obj client.ObjectKey, ok bool, st *state) {
+	if !ok {
+		loginsCompletedTotal.WithLabelValues(unknownObject, unknownObject).Inc()
+		return
 	}
 
-	w.WriteHeader(res.StatusCode)
+	loginsCompletedTotal.WithLabelValues(obj.Namespace, obj.Name).Inc()
+	h.recordCallback(obj)
+
+	if st.IssuedAt <= 0 {
+		return
+	}
 
-	_, _ = io.Copy(w, res.Body)
-	return res.Body.Close()
+	d := h.now().Sub(time.Unix(st.IssuedAt, 0))
+	if d < -maxClockSkew || d > maxLoginDuration {
+		return
+	}
+
+	loginDurationSeconds.WithLabelValues(obj.Namespace, obj.Name).Observe(max(d, 0).Seconds())
 }
 
-func matchPath(p string, list []string) bool {
+func matchPath(p string, list []PathMatch) bool {
 	for _, v := range list {
-		if strings.HasPrefix(p, v) {
+		if v.Exact && p == v.Path || !v.Exact && strings.HasPrefix(p, v.Path) {
 			return true
 		}
 	}
@@ -198,42 +752,52 @@ func matchPath(p string, list []string) bool {
 // recoverIncomingState attempts to parse the incoming state (if there is any) and redirect the request back to the original redirect_uri
 func (h *HttpProxy) recoverIncomingState(w http.ResponseWriter, r *http.Request) error {
 	vals := r.URL.Query()
-	var str string
-	var code string
 
-	if r.Method == "POST" {
-		err := r.ParseForm()
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return err
-		}
-
-		str = r.PostFormValue("state")
-		code = r.PostFormValue("code")
-	} else {
-		str = vals.Get("state")
-	}
+	entry := accessLogEntryFromContext(r.Context())
+	entry.Action = ActionRejected
+	logger := h.logger(r.Context())
 
-	state := &state{}
+	// The state is decoded before the span is started so it can link to the span which issued the state.
+	// Both spans are started at the time decoding started.
+	start := h.now()
+	state, origRedirectURI, code, err := h.decodeState(r)
 
-	h.log.Info("request matches redirectURL, attempt to recover state", "host", r.Host, "state", str)
+	ctx, span := h.tracer.Start(r.Context(), "recoverIncomingState", trace.WithTimestamp(start), trace.WithLinks(state.spanLinks()...))
+	defer func() {
+		h.setAttributes(span, attribute.String(actionAttribute, string(entry.Action)))
+		span.End()
+	}()
 
-	err := json.Unmarshal([]byte(str), state)
+	_, decodeSpan := h.tracer.Start(ctx, "decodeState", trace.WithTimestamp(start))
 	if err != nil {
-		h.log.Info("contains undecodable state", "request", r.RequestURI, "err", err)
+		var statusErr *statusError
+		if errors.As(err, &statusErr) {
+			h.fail(decodeSpan, statusErr.reason, err)
+			h.fail(span, statusErr.reason, err)
+		}
+
+		decodeSpan.End()
 		w.WriteHeader(http.StatusBadRequest)
 		return err
 	}
 
-	u, err := url.Parse(state.OrigRedirectURI)
-	if err != nil {
-		h.log.Info("could not decode original redirect uri", "request", r.RequestURI, "origRedirectURI", state.OrigRedirectURI, "err", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return err
+	decodeSpan.End()
+
+	obj, verified := h.stateObject(r.Host, state)
+	if verified {
+		entry.Object = obj.String()
+		h.setAttributes(span, objectAttributes(entry.Object)...)
 	}
 
-	r.URL.Path = u.Path
-	r.URL.Host = u.Host
+	entry.OriginRequestID = state.RequestID
+	entry.Action = ActionRecovered
+
+	if state.RequestID != "" {
+		h.setAttributes(span, attribute.String(originRequestIDAttribute, state.RequestID))
+	}
+
+	r.URL.Path = origRedirectURI.Path
+	r.URL.Host = origRedirectURI.Host
 
 	if state.OrigState != "" {
 		vals.Set("state", state.OrigState)
@@ -247,10 +811,69 @@ func (h *HttpProxy) recoverIncomingState(w http.ResponseWriter, r *http.Request)
 
 	r.URL.RawQuery = vals.Encode()
 
-	h.log.Info("recovered original state and modified path", "url", r.URL.String(), "path", u.Path, "state", state.OrigState)
+	logger.Info("recovered original state and modified path", "url", r.URL.String(), "path", origRedirectURI.Path, "state", state.OrigState, "originRequestID", state.RequestID)
+	h.observeLogin(obj, verified, state)
 
 	w.Header().Set("Location", r.URL.String())
 	w.WriteHeader(http.StatusSeeOther)
 
 	return nil
 }
+
+// decodeState extracts the proxied state from a callback request.
+// It returns the decoded state, the original redirect_uri and the authorization code in case of a form post.
+// The returned state is never nil, it holds whatever could be decoded.
+func (h *HttpProxy) decodeState(r *http.Request) (*state, *url.URL, string, error) {
+	logger := h.logger(r.Context())
+	st := &state{}
+	var str string
+	var code string
+
+	if r.Method == "POST" {
+		err := r.ParseForm()
+		if err != nil {
+			return st, nil, "", &statusError{code: http.StatusBadRequest, reason: reasonInvalidForm, err: err}
+		}
+
+		str = r.PostFormValue("state")
+		code = r.PostFormValue("code")
+	} else {
+		str = r.URL.Query().Get("state")
+	}
+
+	logger.Info("request matches redirectURL, attempt to recover state", "host", r.Host, "state", str)
+
+	err := h.parseState(str, st)
+	if errors.Is(err, errInvalidStateSignature) {
+		logger.Info("contains state with an invalid signature", "request", r.RequestURI)
+		return st, nil, "", &statusError{code: http.StatusBadRequest, reason: reasonInvalidStateSignature, err: err}
+	}
+
+	if err != nil {
+		logger.Info("contains undecodable state", "request", r.RequestURI, "err", err)
+		return st, nil, "", &statusError{code: http.StatusBadRequest, reason: reasonUndecodableState, err: err}
+	}
+
+	u, err := url.Parse(st.OrigRedirectURI)
+	if err != nil {
+		logger.Info("could not decode original redirect uri", "request", r.RequestURI, "origRedirectURI", st.OrigRedirectURI, "err", err)
+		return st, nil, "", &statusError{code: http.StatusBadRequest, reason: reasonInvalidOrigRedirectURI, err: err}
+	}
+
+	return st, u, code, nil
+}
+
+// statusError is a failure which results in a specific http status code
+type statusError struct {
+	code   int
+	reason string
+	err    error
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.reason, e.err)
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
@@ -1,30 +1,41 @@
 package proxy
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-logr/logr"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 func TestRegisterOrUpdateBackend(t *testing.T) {
 	g := NewWithT(t)
-	proxy := New(logr.Discard(), &http.Client{})
+	proxy := New(logr.Discard(), nil)
 
 	path := OAUTH2Proxy{
 		Host:        "foo",
 		Service:     "bar",
 		RedirectURI: "https://oauth2proxy",
-		Paths:       []string{"/"},
+		Paths:       []PathMatch{{Path: "/"}},
 		Port:        8080,
 		Object: client.ObjectKey{
 			Name:      "foo",
@@ -41,7 +52,7 @@ func TestRegisterOrUpdateBackend(t *testing.T) {
 		Host:        "foo2",
 		Service:     "bar2",
 		RedirectURI: "https://oauth2proxy2",
-		Paths:       []string{"/"},
+		Paths:       []PathMatch{{Path: "/"}},
 		Port:        8080,
 		Object: client.ObjectKey{
 			Name:      "foo",
@@ -55,9 +66,36 @@ func TestRegisterOrUpdateBackend(t *testing.T) {
 	g.Expect(path).To(Equal(*proxy.dst[0]))
 }
 
+func TestRegistrationListener(t *testing.T) {
+	g := NewWithT(t)
+
+	var notified int
+	proxy := New(logr.Discard(), nil, WithRegistrationListener(func() {
+		notified++
+	}))
+
+	dst := OAUTH2Proxy{
+		Host:   "foo",
+		Object: client.ObjectKey{Namespace: "bar", Name: "foo"},
+	}
+
+	g.Expect(proxy.RegisterOrUpdate(&dst)).To(Succeed())
+	g.Expect(proxy.RegisterOrUpdate(&OAUTH2Proxy{Host: "foo2", Object: dst.Object})).To(Succeed())
+	g.Expect(notified).To(Equal(2))
+
+	registrations := proxy.Registrations()
+	g.Expect(registrations).To(HaveLen(1))
+	g.Expect(registrations[0].Host).To(Equal("foo2"))
+
+	g.Expect(proxy.Unregister(dst.Object)).To(Succeed())
+	g.Expect(proxy.Unregister(dst.Object)).NotTo(Succeed())
+	g.Expect(notified).To(Equal(3))
+	g.Expect(proxy.Registrations()).To(BeEmpty())
+}
+
 func TestRemoveBackend(t *testing.T) {
 	g := NewWithT(t)
-	proxy := New(logr.Discard(), &http.Client{})
+	proxy := New(logr.Discard(), nil)
 	err := proxy.Unregister(client.ObjectKey{
 		Name: "does-not-exist",
 	})
@@ -67,7 +105,7 @@ func TestRemoveBackend(t *testing.T) {
 		Host:        "foo",
 		Service:     "bar",
 		RedirectURI: "https://oauth2proxy",
-		Paths:       []string{"/"},
+		Paths:       []PathMatch{{Path: "/"}},
 		Port:        8080,
 		Object: client.ObjectKey{
 			Name:      "foo",
@@ -82,13 +120,13 @@ func TestRemoveBackend(t *testing.T) {
 
 func TestRouteRecoverOriginRedirectURI(t *testing.T) {
 	g := NewWithT(t)
-	proxy := New(logr.Discard(), &http.Client{})
+	proxy := New(logr.Discard(), nil, WithStateKey(testStateKey))
 
 	path := OAUTH2Proxy{
 		Host:        "foo",
 		Service:     "bar",
 		RedirectURI: "https://oauth2proxy",
-		Paths:       []string{"/"},
+		Paths:       []PathMatch{{Path: "/"}},
 		Port:        8080,
 		Object: client.ObjectKey{
 			Name:      "foo",
@@ -121,6 +159,18 @@ func TestRouteRecoverOriginRedirectURI(t *testing.T) {
 			},
 			expectHTTPCode: http.StatusBadRequest,
 		},
+		{
+			name: "Recovered state signed by another key ends in 400",
+			request: func() *http.Request {
+				b := New(logr.Discard(), nil).encodeState(state{
+					OrigRedirectURI: "https://attacker",
+				})
+
+				r, _ := http.NewRequest("GET", fmt.Sprintf("https://oauth2proxy?state=%s", url.QueryEscape(b)), nil)
+				return r
+			},
+			expectHTTPCode: http.StatusBadRequest,
+		},
 		{
 			name: "Recovered origin redirectURL is undecodable and ends in 400",
 			request: func() *http.Request {
@@ -128,9 +178,9 @@ func TestRouteRecoverOriginRedirectURI(t *testing.T) {
 					OrigRedirectURI: ":):((#///`",
 				}
 
-				b, _ := json.Marshal(st)
+				b := signState(st)
 
-				r, _ := http.NewRequest("GET", fmt.Sprintf("https://oauth2proxy?state=%s", b), nil)
+				r, _ := http.NewRequest("GET", fmt.Sprintf("https://oauth2proxy?state=%s", url.QueryEscape(b)), nil)
 				return r
 			},
 			expectHTTPCode: http.StatusBadRequest,
@@ -142,8 +192,8 @@ func TestRouteRecoverOriginRedirectURI(t *testing.T) {
 					OrigRedirectURI: "https://my-original-uri",
 				}
 
-				b, _ := json.Marshal(st)
-				r, _ := http.NewRequest("GET", fmt.Sprintf("https://oauth2proxy?state=%s", b), nil)
+				b := signState(st)
+				r, _ := http.NewRequest("GET", fmt.Sprintf("https://oauth2proxy?state=%s", url.QueryEscape(b)), nil)
 				return r
 			},
 			expectHTTPCode: http.StatusSeeOther,
@@ -159,8 +209,8 @@ func TestRouteRecoverOriginRedirectURI(t *testing.T) {
 					OrigState:       "my-state",
 				}
 
-				b, _ := json.Marshal(st)
-				r, _ := http.NewRequest("GET", fmt.Sprintf("https://oauth2proxy?state=%s", b), nil)
+				b := signState(st)
+				r, _ := http.NewRequest("GET", fmt.Sprintf("https://oauth2proxy?state=%s", url.QueryEscape(b)), nil)
 				return r
 			},
 			expectHTTPCode: http.StatusSeeOther,
@@ -176,8 +226,8 @@ func TestRouteRecoverOriginRedirectURI(t *testing.T) {
 					OrigState:       "my-state",
 				}
 
-				b, _ := json.Marshal(st)
-				r, _ := http.NewRequest("POST", fmt.Sprintf("https://oauth2proxy?state=%s", b), nil)
+				b := signState(st)
+				r, _ := http.NewRequest("POST", fmt.Sprintf("https://oauth2proxy?state=%s", url.QueryEscape(b)), nil)
 				return r
 			},
 			expectHTTPCode: http.StatusBadRequest,
@@ -190,9 +240,9 @@ func TestRouteRecoverOriginRedirectURI(t *testing.T) {
 					OrigState:       "my-state",
 				}
 
-				b, _ := json.Marshal(st)
+				b := signState(st)
 				vals := url.Values{
-					"state": []string{string(b)},
+					"state": []string{b},
 					"code":  []string{"foobar"},
 				}.Encode()
 
@@ -228,7 +278,17 @@ type dummyTransport struct {
 }
 
 func (t *dummyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
-	return t.transport(r)
+	res, err := t.transport(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like http.Transport, always return a body
+	if res.Body == nil {
+		res.Body = http.NoBody
+	}
+
+	return res, nil
 }
 
 func TestChangeRedirectURI(t *testing.T) {
@@ -238,7 +298,7 @@ func TestChangeRedirectURI(t *testing.T) {
 		Host:        "foo",
 		Service:     "bar",
 		RedirectURI: "https://oauth2proxy",
-		Paths:       []string{"/"},
+		Paths:       []PathMatch{{Path: "/"}},
 		Port:        8080,
 		Object: client.ObjectKey{
 			Name:      "foo",
@@ -270,7 +330,7 @@ func TestChangeRedirectURI(t *testing.T) {
 			expectHTTPCode: http.StatusOK,
 		},
 		{
-			name: "Proxy request failed with error ends in bad request",
+			name: "Proxy request failed with error ends in bad gateway",
 			path: func() OAUTH2Proxy { return path },
 			transport: func(r *http.Request) (*http.Response, error) {
 				return &http.Response{
@@ -281,7 +341,19 @@ func TestChangeRedirectURI(t *testing.T) {
 				r, _ := http.NewRequest("GET", "http://foo/bar", nil)
 				return r
 			},
-			expectHTTPCode: http.StatusBadRequest,
+			expectHTTPCode: http.StatusBadGateway,
+		},
+		{
+			name: "Proxy request timed out ends in gateway timeout",
+			path: func() OAUTH2Proxy { return path },
+			transport: func(r *http.Request) (*http.Response, error) {
+				return nil, context.DeadlineExceeded
+			},
+			request: func() *http.Request {
+				r, _ := http.NewRequest("GET", "http://foo/bar", nil)
+				return r
+			},
+			expectHTTPCode: http.StatusGatewayTimeout,
 		},
 		{
 			name: "Parsing of invalid backend response Location header ends in bad request",
@@ -328,7 +400,7 @@ func TestChangeRedirectURI(t *testing.T) {
 			},
 			transport: func(r *http.Request) (*http.Response, error) {
 				header := http.Header{}
-				header.Add("Location", "https://idp")
+				header.Add("Location", "https://idp?redirect_uri=https://foo/callback")
 
 				return &http.Response{
 					StatusCode: http.StatusOK,
@@ -360,24 +432,36 @@ func TestChangeRedirectURI(t *testing.T) {
 			},
 			request: func() *http.Request {
 				r, _ := http.NewRequest("GET", "http://foo/bar", nil)
+				r.Header.Set("X-Request-ID", "my-request")
 				return r
 			},
 			expectHTTPCode: http.StatusOK,
 			expectBody:     "foo",
 			expectHeaders: http.Header{
-				"Location": []string{"https://idp?redirect_uri=https%3A%2F%2Foauth2proxy%2Fauth&state=%7B%22origState%22%3A%22foobar%22%2C%22origRedirectURI%22%3A%22https%3A%2F%2Fidp%2Fauth%22%7D"},
-				"X-1":      []string{"foo", "bar"},
+				"Location": []string{"https://idp?" + url.Values{
+					"redirect_uri": []string{"https://oauth2proxy/auth"},
+					"state": []string{signState(state{
+						OrigState:       "foobar",
+						OrigRedirectURI: "https://idp/auth",
+						IssuedAt:        1700000000,
+						ObjectID:        testObjectID(client.ObjectKey{Namespace: "bar", Name: "foo"}),
+						RequestID:       "my-request",
+					})},
+				}.Encode()},
+				"X-1":          []string{"foo", "bar"},
+				"X-Request-Id": []string{"my-request"},
 			},
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			proxy := New(logr.Discard(), &http.Client{
-				Transport: &dummyTransport{
-					transport: test.transport,
-				},
-			})
+			proxy := New(logr.Discard(), &dummyTransport{
+				transport: test.transport,
+			}, WithStateKey(testStateKey))
+			proxy.now = func() time.Time {
+				return time.Unix(1700000000, 0)
+			}
 
 			p := test.path()
 			_ = proxy.RegisterOrUpdate(&p)
@@ -398,3 +482,989 @@ func TestChangeRedirectURI(t *testing.T) {
 		})
 	}
 }
+
+func TestInvalidRedirectURIDoesNotAffectOtherHosts(t *testing.T) {
+	g := NewWithT(t)
+
+	proxy := New(logr.Discard(), &dummyTransport{
+		transport: func(r *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+			}, nil
+		},
+	})
+
+	_ = proxy.RegisterOrUpdate(&OAUTH2Proxy{
+		Host:        "broken",
+		Service:     "bar",
+		RedirectURI: ":):((#///`",
+		Paths:       []PathMatch{{Path: "/"}},
+		Port:        8080,
+		Object: client.ObjectKey{
+			Name:      "broken",
+			Namespace: "bar",
+		},
+	})
+
+	_ = proxy.RegisterOrUpdate(&OAUTH2Proxy{
+		Host:        "foo",
+		Service:     "bar",
+		RedirectURI: "https://oauth2proxy",
+		Paths:       []PathMatch{{Path: "/"}},
+		Port:        8080,
+		Object: client.ObjectKey{
+			Name:      "foo",
+			Namespace: "bar",
+		},
+	})
+
+	r, _ := http.NewRequest("GET", "http://foo/bar", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	g.Expect(w.Code).To(Equal(http.StatusOK))
+
+	r, _ = http.NewRequest("GET", "http://unknown/bar", nil)
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	g.Expect(w.Code).To(Equal(http.StatusServiceUnavailable))
+}
+
+func TestReverseProxy(t *testing.T) {
+	g := NewWithT(t)
+	flushed := make(chan struct{})
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Host", r.Host)
+		w.Header().Set("X-Connection-Token", r.Header.Get("X-Connection-Token"))
+		w.Header().Set("X-Forwarded-For", r.Header.Get("X-Forwarded-For"))
+		w.Header().Set("X-Forwarded-Host", r.Header.Get("X-Forwarded-Host"))
+		w.Header().Set("X-Forwarded-Proto", r.Header.Get("X-Forwarded-Proto"))
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Trailer", "X-Checksum")
+
+		_, _ = w.Write([]byte("foo"))
+		w.(http.Flusher).Flush()
+		<-flushed
+
+		_, _ = w.Write([]byte("bar"))
+		w.Header().Set("X-Checksum", "123")
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	proxy := New(logr.Discard(), nil)
+	_ = proxy.RegisterOrUpdate(&OAUTH2Proxy{
+		Host:        "foo",
+		Service:     u.Hostname(),
+		RedirectURI: "https://oauth2proxy",
+		Paths:       []PathMatch{{Path: "/"}},
+		Port:        int32(port),
+		Object: client.ObjectKey{
+			Name:      "foo",
+			Namespace: "bar",
+		},
+	})
+
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	r, _ := http.NewRequest("GET", server.URL+"/bar", nil)
+	r.Host = "foo"
+	r.Header.Set("Connection", "X-Connection-Token")
+	r.Header.Set("X-Connection-Token", "hop-by-hop")
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+	r.Header.Set("X-Forwarded-Proto", "https")
+
+	res, err := http.DefaultClient.Do(r)
+	g.Expect(err).NotTo(HaveOccurred())
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	g.Expect(res.StatusCode).To(Equal(http.StatusOK))
+	g.Expect(res.Header.Get("X-Host")).To(Equal("foo"))
+	g.Expect(res.Header.Get("X-Connection-Token")).To(BeEmpty())
+	g.Expect(res.Header.Get("X-Forwarded-For")).To(Equal("10.0.0.1, 127.0.0.1"))
+	g.Expect(res.Header.Get("X-Forwarded-Host")).To(Equal("foo"))
+	g.Expect(res.Header.Get("X-Forwarded-Proto")).To(Equal("https"))
+	g.Expect(res.Header.Get("Keep-Alive")).To(BeEmpty())
+
+	// The first chunk must arrive before the backend finished the response
+	chunk := make([]byte, 3)
+	_, err = io.ReadFull(res.Body, chunk)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(chunk)).To(Equal("foo"))
+	close(flushed)
+
+	rest, err := io.ReadAll(res.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(rest)).To(Equal("bar"))
+	g.Expect(res.Trailer.Get("X-Checksum")).To(Equal("123"))
+}
+
+func TestTLSBackend(t *testing.T) {
+	g := NewWithT(t)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Client-Certificates", strconv.Itoa(len(r.TLS.PeerCertificates)))
+	}))
+	backend.TLS = &tls.Config{
+		ClientAuth: tls.RequireAnyClientCert,
+	}
+	backend.Config.ErrorLog = log.New(io.Discard, "", 0)
+	backend.StartTLS()
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(backend.Certificate())
+
+	path := OAUTH2Proxy{
+		Host:        "foo",
+		Service:     u.Hostname(),
+		RedirectURI: "https://oauth2proxy",
+		Paths:       []PathMatch{{Path: "/"}},
+		Port:        int32(port),
+		Scheme:      "https",
+		TLS: &tls.Config{
+			ServerName: "backend.invalid",
+			RootCAs:    rootCAs,
+		},
+		Object: client.ObjectKey{
+			Name:      "foo",
+			Namespace: "bar",
+		},
+	}
+
+	proxy := New(logr.Discard(), nil)
+	p := path
+	p.TLS.Certificates = backend.TLS.Certificates
+	_ = proxy.RegisterOrUpdate(&p)
+
+	serve := func() *http.Response {
+		r, _ := http.NewRequest("GET", "http://foo/bar", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	// The backend certificate is not valid for the server name
+	g.Expect(serve().StatusCode).To(Equal(http.StatusBadGateway))
+
+	// Updating the backend replaces the transport without a restart
+	update := path
+	update.TLS = &tls.Config{
+		ServerName:   "example.com",
+		RootCAs:      rootCAs,
+		Certificates: backend.TLS.Certificates,
+	}
+	_ = proxy.RegisterOrUpdate(&update)
+
+	res := serve()
+	g.Expect(res.StatusCode).To(Equal(http.StatusOK))
+	g.Expect(res.Header.Get("X-Client-Certificates")).To(Equal("1"))
+}
+
+func TestBackendTimeouts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-body" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+		}
+
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	tests := []struct {
+		name           string
+		path           string
+		timeouts       Timeouts
+		expectHTTPCode int
+	}{
+		{
+			name: "Response header timeout ends in gateway timeout",
+			path: "/",
+			timeouts: Timeouts{
+				ResponseHeader: 50 * time.Millisecond,
+			},
+			expectHTTPCode: http.StatusGatewayTimeout,
+		},
+		{
+			name: "Request timeout ends in gateway timeout",
+			path: "/",
+			timeouts: Timeouts{
+				Request: 50 * time.Millisecond,
+			},
+			expectHTTPCode: http.StatusGatewayTimeout,
+		},
+		{
+			name: "Request timeout aborts reading the response body",
+			path: "/slow-body",
+			timeouts: Timeouts{
+				Request: 50 * time.Millisecond,
+			},
+			expectHTTPCode: http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			proxy := New(logr.Discard(), nil)
+			_ = proxy.RegisterOrUpdate(&OAUTH2Proxy{
+				Host:        "foo",
+				Service:     u.Hostname(),
+				RedirectURI: "https://oauth2proxy",
+				Paths:       []PathMatch{{Path: "/"}},
+				Port:        int32(port),
+				Timeouts:    test.timeouts,
+				Object: client.ObjectKey{
+					Name:      "foo",
+					Namespace: "bar",
+				},
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo"+test.path, nil)
+			w := httptest.NewRecorder()
+
+			start := time.Now()
+			proxy.ServeHTTP(w, r)
+			g.Expect(w.Code).To(Equal(test.expectHTTPCode))
+			g.Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+		})
+	}
+}
+
+func TestEndpointsRoundRobin(t *testing.T) {
+	g := NewWithT(t)
+
+	var endpoints []Endpoint
+	for _, name := range []string{"a", "b"} {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Endpoint", name)
+		}))
+		defer backend.Close()
+
+		u, _ := url.Parse(backend.URL)
+		port, _ := strconv.Atoi(u.Port())
+		endpoints = append(endpoints, Endpoint{Address: u.Hostname(), Port: int32(port)})
+	}
+
+	proxy := New(logr.Discard(), nil)
+	_ = proxy.RegisterOrUpdate(&OAUTH2Proxy{
+		Host:        "foo",
+		Service:     "unreachable.invalid",
+		RedirectURI: "https://oauth2proxy",
+		Paths:       []PathMatch{{Path: "/"}},
+		Port:        8080,
+		Endpoints:   endpoints,
+		Object: client.ObjectKey{
+			Name:      "foo",
+			Namespace: "bar",
+		},
+	})
+
+	var served []string
+	for range 4 {
+		r, _ := http.NewRequest("GET", "http://foo/", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		g.Expect(w.Code).To(Equal(http.StatusOK))
+		served = append(served, w.Header().Get("X-Endpoint"))
+	}
+
+	g.Expect(served).To(Equal([]string{"a", "b", "a", "b"}))
+}
+
+func TestIPv6Backend(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Host", r.Host)
+	}))
+	backend.Listener.Close()
+	backend.Listener = l
+	backend.Start()
+	defer backend.Close()
+
+	port := int32(l.Addr().(*net.TCPAddr).Port)
+
+	tests := []struct {
+		name      string
+		service   string
+		endpoints []Endpoint
+	}{
+		{
+			name:    "Forward to IPv6 cluster IP",
+			service: "::1",
+		},
+		{
+			name:      "Forward to IPv6 endpoint",
+			service:   "unreachable.invalid",
+			endpoints: []Endpoint{{Address: "::1", Port: port}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			proxy := New(logr.Discard(), nil)
+			_ = proxy.RegisterOrUpdate(&OAUTH2Proxy{
+				Host:        "foo",
+				Service:     test.service,
+				RedirectURI: "https://oauth2proxy",
+				Paths:       []PathMatch{{Path: "/"}},
+				Port:        port,
+				Endpoints:   test.endpoints,
+				Object: client.ObjectKey{
+					Name:      "foo",
+					Namespace: "bar",
+				},
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo/", nil)
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, r)
+			g.Expect(w.Code).To(Equal(http.StatusOK))
+			g.Expect(w.Header().Get("X-Host")).To(Equal("foo"))
+		})
+	}
+}
+
+func TestBackendPath(t *testing.T) {
+	g := NewWithT(t)
+
+	var path string
+	proxy := New(logr.Discard(), &dummyTransport{
+		transport: func(r *http.Request) (*http.Response, error) {
+			path = r.URL.Path
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		},
+	})
+
+	_ = proxy.RegisterOrUpdate(&OAUTH2Proxy{
+		Host:        "foo",
+		Service:     "idp.example.com",
+		RedirectURI: "https://oauth2proxy",
+		Paths:       []PathMatch{{Path: "/"}},
+		Port:        443,
+		Scheme:      "https",
+		Path:        "/auth/",
+		Object: client.ObjectKey{
+			Name:      "foo",
+			Namespace: "bar",
+		},
+	})
+
+	r, _ := http.NewRequest("GET", "http://foo/login", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	g.Expect(w.Code).To(Equal(http.StatusOK))
+	g.Expect(path).To(Equal("/auth/login"))
+}
+
+func TestExactPath(t *testing.T) {
+	g := NewWithT(t)
+
+	proxy := New(logr.Discard(), &dummyTransport{
+		transport: func(r *http.Request) (*http.Response, error) {
+			header := http.Header{}
+			header.Add("Location", "https://idp?redirect_uri=https://foo/callback&state=foobar")
+
+			return &http.Response{
+				StatusCode: http.StatusFound,
+				Header:     header,
+				Body:       io.NopCloser(strings.NewReader("")),
+			}, nil
+		},
+	})
+
+	_ = proxy.RegisterOrUpdate(&OAUTH2Proxy{
+		Host:        "foo",
+		Service:     "bar",
+		RedirectURI: "https://oauth2proxy",
+		Paths:       []PathMatch{{Path: "/auth", Exact: true}},
+		Port:        8080,
+		Object: client.ObjectKey{
+			Name:      "foo",
+			Namespace: "bar",
+		},
+	})
+
+	r, _ := http.NewRequest("GET", "http://foo/auth", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	g.Expect(w.Code).To(Equal(http.StatusFound))
+	g.Expect(w.Header().Get("Location")).To(ContainSubstring("redirect_uri=https%3A%2F%2Foauth2proxy"))
+
+	r, _ = http.NewRequest("GET", "http://foo/auth/login", nil)
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	g.Expect(w.Code).To(Equal(http.StatusFound))
+	g.Expect(w.Header().Get("Location")).To(Equal("https://idp?redirect_uri=https://foo/callback&state=foobar"))
+}
+
+func TestLoginFunnelMetrics(t *testing.T) {
+	g := NewWithT(t)
+
+	path := OAUTH2Proxy{
+		Host:        "funnel",
+		Service:     "bar",
+		RedirectURI: "https://oauth2proxy-funnel",
+		Paths:       []PathMatch{{Path: "/"}},
+		Port:        8080,
+		Object: client.ObjectKey{
+			Name:      "funnel",
+			Namespace: "metrics",
+		},
+	}
+
+	proxy := New(logr.Discard(), &dummyTransport{
+		transport: func(r *http.Request) (*http.Response, error) {
+			header := http.Header{}
+			header.Add("Location", "https://idp?redirect_uri=https://idp/auth&state=foobar")
+
+			return &http.Response{
+				StatusCode: http.StatusFound,
+				Header:     header,
+				Body:       io.NopCloser(strings.NewReader("")),
+			}, nil
+		},
+	})
+
+	issuedAt := time.Unix(1700000000, 0)
+	proxy.now = func() time.Time {
+		return issuedAt
+	}
+
+	_ = proxy.RegisterOrUpdate(&path)
+
+	r, _ := http.NewRequest("GET", "http://funnel/auth", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	g.Expect(w.Code).To(Equal(http.StatusFound))
+	g.Expect(testutil.ToFloat64(loginsStartedTotal.WithLabelValues("metrics", "funnel"))).To(Equal(float64(1)))
+
+	location, err := url.Parse(w.Result().Header.Get("Location"))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	proxy.now = func() time.Time {
+		return issuedAt.Add(42 * time.Second)
+	}
+
+	r, _ = http.NewRequest("GET", fmt.Sprintf("https://oauth2proxy-funnel/auth?%s", url.Values{
+		"state": []string{location.Query().Get("state")},
+	}.Encode()), nil)
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	g.Expect(w.Code).To(Equal(http.StatusSeeOther))
+	g.Expect(testutil.ToFloat64(loginsCompletedTotal.WithLabelValues("metrics", "funnel"))).To(Equal(float64(1)))
+
+	expected := `
+# HELP oauth2_redirect_proxy_login_duration_seconds Round trip duration between the outbound redirect and the callback from the external IdP.
+# TYPE oauth2_redirect_proxy_login_duration_seconds histogram
+oauth2_redirect_proxy_login_duration_seconds_bucket{name="funnel",namespace="metrics",le="1"} 0
+oauth2_redirect_proxy_login_duration_seconds_bucket{name="funnel",namespace="metrics",le="2.5"} 0
+oauth2_redirect_proxy_login_duration_seconds_bucket{name="funnel",namespace="metrics",le="5"} 0
+oauth2_redirect_proxy_login_duration_seconds_bucket{name="funnel",namespace="metrics",le="10"} 0
+oauth2_redirect_proxy_login_duration_seconds_bucket{name="funnel",namespace="metrics",le="20"} 0
+oauth2_redirect_proxy_login_duration_seconds_bucket{name="funnel",namespace="metrics",le="30"} 0
+oauth2_redirect_proxy_login_duration_seconds_bucket{name="funnel",namespace="metrics",le="60"} 1
+oauth2_redirect_proxy_login_duration_seconds_bucket{name="funnel",namespace="metrics",le="120"} 1
+oauth2_redirect_proxy_login_duration_seconds_bucket{name="funnel",namespace="metrics",le="300"} 1
+oauth2_redirect_proxy_login_duration_seconds_bucket{name="funnel",namespace="metrics",le="600"} 1
+oauth2_redirect_proxy_login_duration_seconds_bucket{name="funnel",namespace="metrics",le="1800"} 1
+oauth2_redirect_proxy_login_duration_seconds_bucket{name="funnel",namespace="metrics",le="+Inf"} 1
+oauth2_redirect_proxy_login_duration_seconds_sum{name="funnel",namespace="metrics"} 42
+oauth2_redirect_proxy_login_duration_seconds_count{name="funnel",namespace="metrics"} 1
+`
+	g.Expect(testutil.CollectAndCompare(loginDurationSeconds, strings.NewReader(expected))).To(Succeed())
+}
+
+func TestLoginFunnelMetricsForgedState(t *testing.T) {
+	proxy := New(logr.Discard(), nil, WithStateKey(testStateKey))
+	_ = proxy.RegisterOrUpdate(&OAUTH2Proxy{
+		Host:        "forged",
+		RedirectURI: "https://oauth2proxy-forged",
+		Object:      client.ObjectKey{Namespace: "forged", Name: "idp"},
+	})
+	_ = proxy.RegisterOrUpdate(&OAUTH2Proxy{
+		Host:        "other",
+		RedirectURI: "https://oauth2proxy-other",
+		Object:      client.ObjectKey{Namespace: "forged", Name: "other"},
+	})
+
+	now := time.Unix(1700000000, 0)
+	proxy.now = func() time.Time {
+		return now
+	}
+
+	tests := []struct {
+		name            string
+		host            string
+		state           state
+		expectCompleted []string
+		expectCallbacks int64
+	}{
+		{
+			name:            "Object which is not registered is recorded as unknown",
+			host:            "oauth2proxy-forged",
+			state:           state{OrigRedirectURI: "https://forged/callback", ObjectID: testObjectID(client.ObjectKey{Namespace: "attacker", Name: "does-not-exist"})},
+			expectCompleted: []string{unknownObject, unknownObject},
+		},
+		{
+			name:            "Object whose redirectURI host differs is recorded as unknown",
+			host:            "oauth2proxy-other",
+			state:           state{OrigRedirectURI: "https://forged/callback", ObjectID: testObjectID(client.ObjectKey{Namespace: "forged", Name: "idp"})},
+			expectCompleted: []string{unknownObject, unknownObject},
+		},
+		{
+			name:            "Duration of a state issued in the future is not observed",
+			host:            "oauth2proxy-forged",
+			state:           state{OrigRedirectURI: "https://forged/callback", ObjectID: testObjectID(client.ObjectKey{Namespace: "forged", Name: "idp"}), IssuedAt: now.Add(time.Hour).Unix()},
+			expectCompleted: []string{"forged", "idp"},
+			expectCallbacks: 1,
+		},
+		{
+			name:            "Duration of a state issued too long ago is not observed",
+			host:            "oauth2proxy-forged",
+			state:           state{OrigRedirectURI: "https://forged/callback", ObjectID: testObjectID(client.ObjectKey{Namespace: "forged", Name: "idp"}), IssuedAt: 1},
+			expectCompleted: []string{"forged", "idp"},
+			expectCallbacks: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			completed := loginsCompletedTotal.WithLabelValues(test.expectCompleted...)
+			before := testutil.ToFloat64(completed)
+			series := testutil.CollectAndCount(loginsCompletedTotal)
+			durations := testutil.CollectAndCount(loginDurationSeconds)
+			callbacks := proxy.Stats()
+
+			r, _ := http.NewRequest("GET", fmt.Sprintf("https://%s/callback?%s", test.host, url.Values{
+				"state": []string{signState(test.state)},
+			}.Encode()), nil)
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, r)
+
+			g.Expect(w.Code).To(Equal(http.StatusSeeOther))
+			g.Expect(testutil.ToFloat64(completed)).To(Equal(before + 1))
+			g.Expect(testutil.CollectAndCount(loginsCompletedTotal)).To(Equal(series))
+			g.Expect(testutil.CollectAndCount(loginDurationSeconds)).To(Equal(durations))
+
+			// Only callbacks attributed to the OAUTH2Proxy are counted in its stats
+			stats := proxy.Stats()
+			idp := client.ObjectKey{Namespace: "forged", Name: "idp"}
+			other := client.ObjectKey{Namespace: "forged", Name: "other"}
+			g.Expect(stats[idp].Callbacks).To(Equal(callbacks[idp].Callbacks + test.expectCallbacks))
+			g.Expect(stats[other].Callbacks).To(Equal(callbacks[other].Callbacks))
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	path := OAUTH2Proxy{
+		Host:        "foo",
+		Service:     "bar",
+		RedirectURI: "https://oauth2proxy",
+		Paths:       []PathMatch{{Path: "/"}},
+		Port:        8080,
+		Object: client.ObjectKey{
+			Name:      "foo",
+			Namespace: "bar",
+		},
+	}
+
+	tests := []struct {
+		name            string
+		requestID       string
+		expectRequestID func(g *WithT, id string)
+	}{
+		{
+			name:      "Request id from the client is kept",
+			requestID: "my-request",
+			expectRequestID: func(g *WithT, id string) {
+				g.Expect(id).To(Equal("my-request"))
+			},
+		},
+		{
+			name: "Request id is generated if the client did not send one",
+			expectRequestID: func(g *WithT, id string) {
+				g.Expect(id).To(HaveLen(36))
+			},
+		},
+		{
+			name:      "Request id is replaced if it contains invalid characters",
+			requestID: "my request",
+			expectRequestID: func(g *WithT, id string) {
+				g.Expect(id).To(HaveLen(36))
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+			var backendRequestID string
+
+			proxy := New(logr.Discard(), &dummyTransport{
+				transport: func(r *http.Request) (*http.Response, error) {
+					backendRequestID = r.Header.Get("X-Request-ID")
+					header := http.Header{}
+					header.Add("Location", "https://idp?redirect_uri=https://idp/auth&state=foobar")
+					header.Add("X-Request-ID", backendRequestID)
+
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Header:     header,
+						Body:       io.NopCloser(strings.NewReader("")),
+					}, nil
+				},
+			})
+
+			p := path
+			_ = proxy.RegisterOrUpdate(&p)
+
+			r, _ := http.NewRequest("GET", "http://foo/auth", nil)
+			if test.requestID != "" {
+				r.Header.Set("X-Request-ID", test.requestID)
+			}
+
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, r)
+
+			res := w.Result()
+			g.Expect(res.Header.Values("X-Request-ID")).To(HaveLen(1))
+			id := res.Header.Get("X-Request-ID")
+			test.expectRequestID(g, id)
+			g.Expect(backendRequestID).To(Equal(id))
+
+			location, _ := url.Parse(res.Header.Get("Location"))
+			st := state{}
+			g.Expect(proxy.parseState(location.Query().Get("state"), &st)).To(Succeed())
+			g.Expect(st.RequestID).To(Equal(id))
+		})
+	}
+}
+
+func TestCallbackSpanLinksToAuthorizationSpan(t *testing.T) {
+	g := NewWithT(t)
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	path := OAUTH2Proxy{
+		Host:        "foo",
+		Service:     "bar",
+		RedirectURI: "https://oauth2proxy",
+		Paths:       []PathMatch{{Path: "/"}},
+		Port:        8080,
+		Object: client.ObjectKey{
+			Name:      "foo",
+			Namespace: "bar",
+		},
+	}
+
+	proxy := New(logr.Discard(), &dummyTransport{
+		transport: func(r *http.Request) (*http.Response, error) {
+			header := http.Header{}
+			header.Add("Location", "https://idp?redirect_uri=https://idp/auth&state=foobar")
+
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     header,
+				Body:       io.NopCloser(strings.NewReader("")),
+			}, nil
+		},
+	}, WithTracerProvider(provider))
+
+	_ = proxy.RegisterOrUpdate(&path)
+
+	r, _ := http.NewRequest("GET", "http://foo/auth", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+
+	location, err := url.Parse(w.Result().Header.Get("Location"))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// The callback spans are started at the time decoding started
+	callbackAt := time.Unix(1700000000, 0)
+	proxy.now = func() time.Time {
+		return callbackAt
+	}
+
+	r, _ = http.NewRequest("GET", fmt.Sprintf("https://oauth2proxy/auth?%s", url.Values{
+		"state": []string{location.Query().Get("state")},
+	}.Encode()), nil)
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	g.Expect(w.Code).To(Equal(http.StatusSeeOther))
+
+	spans := spansByName(recorder.Ended())
+	g.Expect(spans).To(HaveKey("changeRedirectURI"))
+	g.Expect(spans).To(HaveKey("recoverIncomingState"))
+	g.Expect(spans).To(HaveKey("decodeState"))
+
+	issuer := spans["changeRedirectURI"]
+	callback := spans["recoverIncomingState"]
+	g.Expect(callback.StartTime()).To(BeTemporally("==", callbackAt))
+	g.Expect(spans["decodeState"].StartTime()).To(BeTemporally("==", callbackAt))
+	g.Expect(callback.Parent().IsValid()).To(BeFalse())
+	g.Expect(callback.Links()).To(HaveLen(1))
+	g.Expect(callback.Links()[0].SpanContext.TraceID()).To(Equal(issuer.SpanContext().TraceID()))
+	g.Expect(callback.Links()[0].SpanContext.SpanID()).To(Equal(issuer.SpanContext().SpanID()))
+}
+
+func spansByName(spans []sdktrace.ReadOnlySpan) map[string]sdktrace.ReadOnlySpan {
+	m := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range spans {
+		m[span.Name()] = span
+	}
+
+	return m
+}
+
+func spanAttributes(span sdktrace.ReadOnlySpan) map[string]string {
+	m := make(map[string]string)
+	for _, attr := range span.Attributes() {
+		m[string(attr.Key)] = attr.Value.Emit()
+	}
+
+	return m
+}
+
+func TestDetailedSpans(t *testing.T) {
+	path := OAUTH2Proxy{
+		Host:        "foo",
+		Service:     "bar",
+		RedirectURI: "https://oauth2proxy",
+		Paths:       []PathMatch{{Path: "/"}},
+		Port:        8080,
+		Object: client.ObjectKey{
+			Name:      "foo",
+			Namespace: "bar",
+		},
+	}
+
+	tests := []struct {
+		name        string
+		request     func() *http.Request
+		transport   func(r *http.Request) (*http.Response, error)
+		expectSpans map[string]map[string]string
+	}{
+		{
+			name: "Rewritten authorization redirect",
+			request: func() *http.Request {
+				r, _ := http.NewRequest("GET", "http://foo/auth?code=secret", nil)
+				return r
+			},
+			transport: func(r *http.Request) (*http.Response, error) {
+				header := http.Header{}
+				header.Add("Location", "https://idp?redirect_uri=https://idp/auth&state=foobar")
+
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     header,
+					Body:       io.NopCloser(strings.NewReader("")),
+				}, nil
+			},
+			expectSpans: map[string]map[string]string{
+				"lookup": {
+					"oauth2proxy.namespace": "bar",
+					"oauth2proxy.name":      "foo",
+				},
+				"changeRedirectURI": {
+					"oauth2proxy.namespace": "bar",
+					"oauth2proxy.name":      "foo",
+					"oauth2proxy.action":    "rewritten",
+				},
+				"upstream": {
+					"server.address":            "bar",
+					"server.port":               "8080",
+					"http.response.status_code": "200",
+				},
+				"rewriteLocation": {
+					"oauth2proxy.rewritten": "true",
+				},
+			},
+		},
+		{
+			name: "Failing upstream",
+			request: func() *http.Request {
+				r, _ := http.NewRequest("GET", "http://foo/auth", nil)
+				return r
+			},
+			transport: func(r *http.Request) (*http.Response, error) {
+				return nil, errors.New("connection refused")
+			},
+			expectSpans: map[string]map[string]string{
+				"changeRedirectURI": {
+					"oauth2proxy.action":         "proxied",
+					"oauth2proxy.failure.reason": "UpstreamUnavailable",
+				},
+				"upstream": {
+					"oauth2proxy.failure.reason": "UpstreamUnavailable",
+				},
+			},
+		},
+		{
+			name: "Invalid Location header",
+			request: func() *http.Request {
+				r, _ := http.NewRequest("GET", "http://foo/auth", nil)
+				return r
+			},
+			transport: func(r *http.Request) (*http.Response, error) {
+				header := http.Header{}
+				header.Add("Location", ":):((#///`")
+
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     header,
+					Body:       io.NopCloser(strings.NewReader("")),
+				}, nil
+			},
+			expectSpans: map[string]map[string]string{
+				"changeRedirectURI": {
+					"oauth2proxy.failure.reason": "InvalidLocation",
+				},
+				"rewriteLocation": {
+					"oauth2proxy.failure.reason": "InvalidLocation",
+				},
+			},
+		},
+		{
+			name: "Recovered callback",
+			request: func() *http.Request {
+				b := signState(state{
+					OrigRedirectURI: "https://my-original-uri",
+					ObjectID:        testObjectID(client.ObjectKey{Namespace: "bar", Name: "foo"}),
+					RequestID:       "my-request",
+				})
+
+				r, _ := http.NewRequest("GET", fmt.Sprintf("https://oauth2proxy/cb?%s", url.Values{"state": []string{b}}.Encode()), nil)
+				return r
+			},
+			expectSpans: map[string]map[string]string{
+				"lookup": {
+					"oauth2proxy.callback": "true",
+				},
+				"recoverIncomingState": {
+					"oauth2proxy.namespace":         "bar",
+					"oauth2proxy.name":              "foo",
+					"oauth2proxy.action":            "recovered",
+					"oauth2proxy.origin_request.id": "my-request",
+				},
+				"decodeState": {},
+			},
+		},
+		{
+			name: "Undecodable callback state",
+			request: func() *http.Request {
+				// The signature is valid but the payload is not JSON
+				payload := base64.RawURLEncoding.EncodeToString([]byte("invalid"))
+				signature := base64.RawURLEncoding.EncodeToString((&HttpProxy{stateKey: testStateKey}).sign(payload))
+				r, _ := http.NewRequest("GET", "https://oauth2proxy/cb?state="+payload+"."+signature, nil)
+				return r
+			},
+			expectSpans: map[string]map[string]string{
+				"recoverIncomingState": {
+					"oauth2proxy.action":         "rejected",
+					"oauth2proxy.failure.reason": "UndecodableState",
+				},
+				"decodeState": {
+					"oauth2proxy.failure.reason": "UndecodableState",
+				},
+			},
+		},
+		{
+			name: "Callback state with an invalid signature",
+			request: func() *http.Request {
+				r, _ := http.NewRequest("GET", "https://oauth2proxy/cb?state=invalid", nil)
+				return r
+			},
+			expectSpans: map[string]map[string]string{
+				"recoverIncomingState": {
+					"oauth2proxy.action":         "rejected",
+					"oauth2proxy.failure.reason": "InvalidStateSignature",
+				},
+				"decodeState": {
+					"oauth2proxy.failure.reason": "InvalidStateSignature",
+				},
+			},
+		},
+		{
+			name: "No matching OAUTH2Proxy",
+			request: func() *http.Request {
+				r, _ := http.NewRequest("GET", "http://unknown/", nil)
+				return r
+			},
+			expectSpans: map[string]map[string]string{
+				"lookup": {
+					"oauth2proxy.failure.reason": "NoMatchingOAUTH2Proxy",
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+			recorder := tracetest.NewSpanRecorder()
+			provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+			proxy := New(logr.Discard(), &dummyTransport{
+				transport: test.transport,
+			}, WithTracerProvider(provider), WithStateKey(testStateKey))
+
+			p := path
+			_ = proxy.RegisterOrUpdate(&p)
+			proxy.ServeHTTP(httptest.NewRecorder(), test.request())
+
+			spans := spansByName(recorder.Ended())
+			for name, attrs := range test.expectSpans {
+				g.Expect(spans).To(HaveKey(name))
+				for k, v := range attrs {
+					g.Expect(spanAttributes(spans[name])).To(HaveKeyWithValue(k, v), "span %s", name)
+				}
+
+				if _, ok := attrs[failureReasonAttribute]; ok {
+					g.Expect(spans[name].Status().Code).To(Equal(codes.Error))
+				}
+
+				for _, v := range spanAttributes(spans[name]) {
+					g.Expect(v).NotTo(ContainSubstring("secret"))
+				}
+			}
+
+			if parent, ok := spans["changeRedirectURI"]; ok {
+				for _, name := range []string{"upstream", "rewriteLocation"} {
+					if child, ok := spans[name]; ok {
+						g.Expect(child.Parent().SpanID()).To(Equal(parent.SpanContext().SpanID()))
+					}
+				}
+			}
+
+			if parent, ok := spans["recoverIncomingState"]; ok {
+				g.Expect(spans["decodeState"].Parent().SpanID()).To(Equal(parent.SpanContext().SpanID()))
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const redactedValue = "[REDACTED]"
+
+// DefaultRedactedParams are the OAUTH2/OIDC and SAML parameters which are always masked
+var DefaultRedactedParams = []string{"code", "state", "id_token", "access_token", "SAMLResponse"}
+
+// Redactor masks sensitive parameters in log values and trace attributes.
+// A nil Redactor is valid and leaves all values untouched.
+type Redactor struct {
+	params  map[string]struct{}
+	pattern *regexp.Regexp
+}
+
+// NewRedactor creates a new Redactor masking DefaultRedactedParams plus the given extra parameters
+func NewRedactor(extraParams ...string) *Redactor {
+	r := &Redactor{
+		params: make(map[string]struct{}),
+	}
+
+	var names []string
+	params := append(append([]string{}, DefaultRedactedParams...), extraParams...)
+	for _, p := range params {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if _, ok := r.params[p]; ok || p == "" {
+			continue
+		}
+
+		r.params[p] = struct{}{}
+		names = append(names, regexp.QuoteMeta(p))
+	}
+
+	// Matches name=value pairs as found in query strings, form bodies, fragments and error messages
+	r.pattern = regexp.MustCompile(`(?i)(^|[?&#;\s"'])(` + strings.Join(names, "|") + `)=([^&#;\s"']*)`)
+	return r
+}
+
+// IsSensitive returns true if the given parameter name is masked
+func (r *Redactor) IsSensitive(name string) bool {
+	if r == nil {
+		return false
+	}
+
+	_, ok := r.params[strings.ToLower(name)]
+	return ok
+}
+
+// String masks the values of all sensitive parameters found in s
+func (r *Redactor) String(s string) string {
+	if r == nil {
+		return s
+	}
+
+	return r.pattern.ReplaceAllString(s, "${1}${2}="+redactedValue)
+}
+
+// URL returns the string representation of u with all sensitive query and fragment parameters masked
+func (r *Redactor) URL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+
+	return r.String(u.String())
+}
+
+// Value masks a single log value or trace attribute value.
+// The value is masked completely if key itself is a sensitive parameter.
+func (r *Redactor) Value(key string, value any) any {
+	if r == nil {
+		return value
+	}
+
+	if r.IsSensitive(key) {
+		return redactedValue
+	}
+
+	switch v := value.(type) {
+	case string:
+		return r.String(v)
+	case *url.URL:
+		return r.URL(v)
+	case url.Values:
+		return r.String(v.Encode())
+	case error:
+		return redactedError{err: v, msg: r.String(v.Error())}
+	case fmt.Stringer:
+		// Other values keep their type, only Stringers containing sensitive parameters are replaced
+		s := v.String()
+		if redacted := r.String(s); redacted != s {
+			return redacted
+		}
+
+		return value
+	default:
+		return value
+	}
+}
+
+// KeysAndValues masks a logr key/value list
+func (r *Redactor) KeysAndValues(keysAndValues []any) []any {
+	if r == nil {
+		return keysAndValues
+	}
+
+	out := make([]any, len(keysAndValues))
+	for i := 0; i < len(keysAndValues); i++ {
+		if i%2 == 0 {
+			out[i] = keysAndValues[i]
+			continue
+		}
+
+		key, _ := keysAndValues[i-1].(string)
+		out[i] = r.Value(key, keysAndValues[i])
+	}
+
+	return out
+}
+
+// Attributes masks trace attributes of type string
+func (r *Redactor) Attributes(attrs ...attribute.KeyValue) []attribute.KeyValue {
+	if r == nil {
+		return attrs
+	}
+
+	out := make([]attribute.KeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		if attr.Value.Type() == attribute.STRING {
+			if r.IsSensitive(string(attr.Key)) {
+				attr = attribute.String(string(attr.Key), redactedValue)
+			} else {
+				attr = attribute.String(string(attr.Key), r.String(attr.Value.AsString()))
+			}
+		}
+
+		out = append(out, attr)
+	}
+
+	return out
+}
+
+// Logger wraps the sink of the given logger so that every log line passes through the Redactor
+func (r *Redactor) Logger(logger logr.Logger) logr.Logger {
+	sink := logger.GetSink()
+	if r == nil || sink == nil {
+		return logger
+	}
+
+	if s, ok := sink.(logr.CallDepthLogSink); ok {
+		sink = s.WithCallDepth(1)
+	}
+
+	return logger.WithSink(&redactingSink{sink: sink, redactor: r})
+}
+
+// SpanProcessor returns a span processor which masks the attributes spans are started with.
+// This covers the attributes of instrumentation libraries like otelhttp which include the request URL.
+func (r *Redactor) SpanProcessor() sdktrace.SpanProcessor {
+	return &redactingSpanProcessor{redactor: r}
+}
+
+// redactedError keeps the original error for unwrapping but returns a masked message
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (e redactedError) Error() string {
+	return e.msg
+}
+
+func (e redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactingSink is a logr.LogSink which masks all key/value pairs before passing them to the underlying sink
+type redactingSink struct {
+	sink     logr.LogSink
+	redactor *Redactor
+}
+
+// Init initializes the underlying sink, the redactingSink adds a frame between the caller and the underlying sink
+func (s *redactingSink) Init(info logr.RuntimeInfo) {
+	info.CallDepth++
+	s.sink.Init(info)
+}
+
+func (s *redactingSink) Enabled(level int) bool {
+	return s.sink.Enabled(level)
+}
+
+func (s *redactingSink) Info(level int, msg string, keysAndValues ...any) {
+	s.sink.Info(level, s.redactor.String(msg), s.redactor.KeysAndValues(keysAndValues)...)
+}
+
+func (s *redactingSink) Error(err error, msg string, keysAndValues ...any) {
+	if err != nil {
+		err = redactedError{err: err, msg: s.redactor.String(err.Error())}
+	}
+
+	s.sink.Error(err, s.redactor.String(msg), s.redactor.KeysAndValues(keysAndValues)...)
+}
+
+func (s *redactingSink) WithValues(keysAndValues ...any) logr.LogSink {
+	return &redactingSink{
+		sink:     s.sink.WithValues(s.redactor.KeysAndValues(keysAndValues)...),
+		redactor: s.redactor,
+	}
+}
+
+func (s *redactingSink) WithName(name string) logr.LogSink {
+	return &redactingSink{
+		sink:     s.sink.WithName(name),
+		redactor: s.redactor,
+	}
+}
+
+// WithCallDepth implements logr.CallDepthLogSink so helpers logging on behalf of their caller report the right caller
+func (s *redactingSink) WithCallDepth(depth int) logr.LogSink {
+	sink, ok := s.sink.(logr.CallDepthLogSink)
+	if !ok {
+		return s
+	}
+
+	return &redactingSink{
+		sink:     sink.WithCallDepth(depth),
+		redactor: s.redactor,
+	}
+}
+
+// redactingSpanProcessor masks the start attributes of every span
+type redactingSpanProcessor struct {
+	redactor *Redactor
+}
+
+func (p *redactingSpanProcessor) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {
+	s.SetAttributes(p.redactor.Attributes(s.Attributes()...)...)
+}
+
+func (p *redactingSpanProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+}
+
+func (p *redactingSpanProcessor) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func (p *redactingSpanProcessor) ForceFlush(ctx context.Context) error {
+	return nil
+}
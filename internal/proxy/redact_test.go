@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestRedactString(t *testing.T) {
+	redactor := NewRedactor("session")
+
+	tests := []struct {
+		name   string
+		in     string
+		expect string
+	}{
+		{
+			name:   "Redacts code and state in a request uri",
+			in:     "/auth?code=secret&state=%7B%22origState%22%7D&foo=bar",
+			expect: "/auth?code=[REDACTED]&state=[REDACTED]&foo=bar",
+		},
+		{
+			name:   "Redacts tokens in a url fragment",
+			in:     "https://idp/cb#id_token=abc&access_token=def&token_type=Bearer",
+			expect: "https://idp/cb#id_token=[REDACTED]&access_token=[REDACTED]&token_type=Bearer",
+		},
+		{
+			name:   "Redacts a raw form body",
+			in:     "SAMLResponse=PHNhbWw%2B&RelayState=foo",
+			expect: "SAMLResponse=[REDACTED]&RelayState=foo",
+		},
+		{
+			name:   "Redacts urls embedded in error messages",
+			in:     `Get "http://10.0.0.1:8080/cb?code=secret": dial tcp: connection refused`,
+			expect: `Get "http://10.0.0.1:8080/cb?code=[REDACTED]": dial tcp: connection refused`,
+		},
+		{
+			name:   "Redacts configured extra parameters",
+			in:     "/auth?session=123",
+			expect: "/auth?session=[REDACTED]",
+		},
+		{
+			name:   "Does not redact parameters which only share a suffix",
+			in:     "/auth?zipcode=1234&response_code=foo",
+			expect: "/auth?zipcode=1234&response_code=foo",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(redactor.String(test.in)).To(Equal(test.expect))
+		})
+	}
+}
+
+func TestRedactValue(t *testing.T) {
+	g := NewWithT(t)
+	redactor := NewRedactor()
+
+	g.Expect(redactor.Value("duration", time.Second)).To(Equal(time.Second))
+	g.Expect(redactor.Value("object", types.NamespacedName{Namespace: "default", Name: "idp"})).To(Equal(types.NamespacedName{Namespace: "default", Name: "idp"}))
+	g.Expect(redactor.Value("url", stringer("/auth?code=secret"))).To(Equal("/auth?code=[REDACTED]"))
+	g.Expect(redactor.Value("code", "secret")).To(Equal("[REDACTED]"))
+}
+
+type stringer string
+
+func (s stringer) String() string {
+	return string(s)
+}
+
+func TestRedactNilRedactor(t *testing.T) {
+	g := NewWithT(t)
+	var redactor *Redactor
+
+	g.Expect(redactor.String("/auth?code=secret")).To(Equal("/auth?code=secret"))
+	g.Expect(redactor.KeysAndValues([]any{"state", "foo"})).To(Equal([]any{"state", "foo"}))
+}
+
+func TestRedactLogger(t *testing.T) {
+	g := NewWithT(t)
+	redactor := NewRedactor()
+
+	var lines []string
+	logger := redactor.Logger(funcr.New(func(prefix, args string) {
+		lines = append(lines, args)
+	}, funcr.Options{}))
+
+	u, _ := url.Parse("https://oauth2proxy/auth?code=secret&foo=bar")
+	logger.WithValues("request", "/auth?state=secret").Info("recovered state", "state", "{}", "url", u)
+	logger.Error(errors.New(`Get "http://backend/cb?code=secret": EOF`), "forwarding failed")
+
+	g.Expect(lines).To(HaveLen(2))
+	g.Expect(lines[0]).To(Equal(`"level"=0 "msg"="recovered state" "request"="/auth?state=[REDACTED]" "state"="[REDACTED]" "url"="https://oauth2proxy/auth?code=[REDACTED]&foo=bar"`))
+	g.Expect(lines[1]).To(Equal(`"msg"="forwarding failed" "error"="Get \"http://backend/cb?code=[REDACTED]\": EOF"`))
+}
+
+// initSink records the runtime info it has been initialized with
+type initSink struct {
+	logr.LogSink
+	info logr.RuntimeInfo
+}
+
+func (s *initSink) Init(info logr.RuntimeInfo) {
+	s.info = info
+}
+
+func TestRedactLoggerCaller(t *testing.T) {
+	g := NewWithT(t)
+
+	var lines []string
+	logger := NewRedactor().Logger(funcr.New(func(prefix, args string) {
+		lines = append(lines, args)
+	}, funcr.Options{LogCaller: funcr.Info}))
+
+	// logHelper logs on behalf of its caller
+	logHelper := func(logger logr.Logger) {
+		logger.WithCallDepth(1).Info("helper")
+	}
+
+	_, _, line, _ := runtime.Caller(0)
+	logger.Info("direct")
+	logHelper(logger)
+
+	g.Expect(lines).To(HaveLen(2))
+	g.Expect(lines[0]).To(ContainSubstring(fmt.Sprintf(`"caller"={"file"="redact_test.go" "line"=%d}`, line+1)))
+	g.Expect(lines[1]).To(ContainSubstring(fmt.Sprintf(`"caller"={"file"="redact_test.go" "line"=%d}`, line+2)))
+
+	// The redactingSink adds a frame if the underlying sink is initialized through it
+	sink := &initSink{}
+	_ = logr.New(&redactingSink{sink: sink, redactor: NewRedactor()})
+	g.Expect(sink.info.CallDepth).To(Equal(2))
+}
+
+func TestRedactSpanProcessor(t *testing.T) {
+	g := NewWithT(t)
+	redactor := NewRedactor()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(redactor.SpanProcessor()),
+		sdktrace.WithSpanProcessor(recorder),
+	)
+
+	_, span := provider.Tracer("test").Start(context.Background(), "request", trace.WithAttributes(
+		attribute.String("url.full", "https://oauth2proxy/auth?code=secret&foo=bar"),
+		attribute.String("state", "secret"),
+		attribute.Int("http.response.status_code", 303),
+	))
+	span.End()
+
+	spans := recorder.Ended()
+	g.Expect(spans).To(HaveLen(1))
+
+	attrs := make(map[string]string)
+	for _, attr := range spans[0].Attributes() {
+		attrs[string(attr.Key)] = attr.Value.Emit()
+	}
+
+	g.Expect(attrs).To(Equal(map[string]string{
+		"url.full":                  "https://oauth2proxy/auth?code=[REDACTED]&foo=bar",
+		"state":                     "[REDACTED]",
+		"http.response.status_code": "303",
+	}))
+}
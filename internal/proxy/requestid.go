@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader is the header used to correlate requests between the client, the proxy and the backend
+const RequestIDHeader = "X-Request-ID"
+
+const (
+	// requestIDAttribute is the span attribute holding the id of the request
+	requestIDAttribute = "http.request.id"
+	// originRequestIDAttribute is the span attribute holding the id of the request which started the login on callbacks
+	originRequestIDAttribute = "oauth2proxy.origin_request.id"
+)
+
+// maxRequestIDLength limits the size of request ids accepted from clients
+const maxRequestIDLength = 128
+
+// requestID returns the request id sent by the client or generates a new one if there is none or it is not acceptable
+func requestID(r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if validRequestID(id) {
+		return id
+	}
+
+	return uuid.NewString()
+}
+
+// validRequestID accepts printable ASCII characters without whitespace only, as the id ends up in headers and logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
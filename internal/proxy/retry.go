@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RetryPolicy defines how requests which failed to connect to a backend are retried
+type RetryPolicy struct {
+	// Attempts is the number of retries after the first attempt
+	Attempts int
+	// Backoff is the time to wait before each retry
+	Backoff time.Duration
+}
+
+// retryTransport retries idempotent requests without a body which failed to connect to the backend.
+// Such requests never reached the backend and can be sent again safely.
+type retryTransport struct {
+	next   http.RoundTripper
+	policy RetryPolicy
+}
+
+func (t *retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(r)
+
+	for attempt := 1; attempt <= t.policy.Attempts && err != nil && isRetryable(r, err); attempt++ {
+		timer := time.NewTimer(t.policy.Backoff)
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+
+		retry := r
+		attributes := []attribute.KeyValue{attribute.Int("http.request.resend_count", attempt)}
+
+		// The endpoint which failed to connect is skipped
+		if next, ok := r.Context().Value(nextUpstreamKey{}).(func() (string, int32)); ok {
+			address, port := next()
+			retry = r.Clone(r.Context())
+			retry.URL.Host = net.JoinHostPort(address, strconv.Itoa(int(port)))
+			attributes = append(attributes, attribute.String("server.address", address), attribute.Int("server.port", int(port)))
+		}
+
+		trace.SpanFromContext(r.Context()).AddEvent("retry", trace.WithAttributes(attributes...))
+
+		res, err = t.next.RoundTrip(retry)
+	}
+
+	return res, err
+}
+
+// nextUpstreamKey is the context key of the function choosing the endpoint a retry is sent to
+type nextUpstreamKey struct{}
+
+// withNextUpstream lets retries of requests to dst choose the next of its endpoints
+func withNextUpstream(ctx context.Context, dst *OAUTH2Proxy) context.Context {
+	if len(dst.Endpoints) < 2 {
+		return ctx
+	}
+
+	return context.WithValue(ctx, nextUpstreamKey{}, dst.upstream)
+}
+
+// isRetryable returns true if r is idempotent and failed to connect
+func isRetryable(r *http.Request, err error) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+	default:
+		return false
+	}
+
+	if r.Body != nil && r.Body != http.NoBody {
+		return false
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestRetries(t *testing.T) {
+	path := OAUTH2Proxy{
+		Host:        "retry",
+		Service:     "bar",
+		RedirectURI: "https://oauth2proxy-retry",
+		Paths:       []PathMatch{{Path: "/"}},
+		Port:        8080,
+		Retries: RetryPolicy{
+			Attempts: 2,
+			Backoff:  time.Millisecond,
+		},
+		Object: client.ObjectKey{
+			Name:      "retry",
+			Namespace: "bar",
+		},
+	}
+
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+	tests := []struct {
+		name           string
+		request        func() *http.Request
+		failures       []error
+		expectCalls    int
+		expectHTTPCode int
+	}{
+		{
+			name: "Idempotent request is retried after failing to connect",
+			request: func() *http.Request {
+				r, _ := http.NewRequest("GET", "http://retry/", nil)
+				return r
+			},
+			failures:       []error{dialErr, dialErr},
+			expectCalls:    3,
+			expectHTTPCode: http.StatusOK,
+		},
+		{
+			name: "Retries are limited",
+			request: func() *http.Request {
+				r, _ := http.NewRequest("GET", "http://retry/", nil)
+				return r
+			},
+			failures:       []error{dialErr, dialErr, dialErr},
+			expectCalls:    3,
+			expectHTTPCode: http.StatusBadGateway,
+		},
+		{
+			name: "Request with a body is not retried",
+			request: func() *http.Request {
+				r, _ := http.NewRequest("POST", "http://retry/", strings.NewReader("foo"))
+				return r
+			},
+			failures:       []error{dialErr},
+			expectCalls:    1,
+			expectHTTPCode: http.StatusBadGateway,
+		},
+		{
+			name: "Request which reached the backend is not retried",
+			request: func() *http.Request {
+				r, _ := http.NewRequest("GET", "http://retry/", nil)
+				return r
+			},
+			failures:       []error{errors.New("connection reset by peer")},
+			expectCalls:    1,
+			expectHTTPCode: http.StatusBadGateway,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var calls int
+			proxy := New(logr.Discard(), &dummyTransport{
+				transport: func(r *http.Request) (*http.Response, error) {
+					calls++
+					if calls <= len(test.failures) {
+						return nil, test.failures[calls-1]
+					}
+
+					return &http.Response{
+						StatusCode: http.StatusOK,
+					}, nil
+				},
+			})
+
+			p := path
+			_ = proxy.RegisterOrUpdate(&p)
+
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, test.request())
+			g.Expect(w.Code).To(Equal(test.expectHTTPCode))
+			g.Expect(calls).To(Equal(test.expectCalls))
+		})
+	}
+}
+
+func TestRetriesNextEndpoint(t *testing.T) {
+	g := NewWithT(t)
+
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+	var hosts []string
+	proxy := New(logr.Discard(), &dummyTransport{
+		transport: func(r *http.Request) (*http.Response, error) {
+			hosts = append(hosts, r.URL.Host)
+			if len(hosts) == 1 {
+				return nil, dialErr
+			}
+
+			return &http.Response{
+				StatusCode: http.StatusOK,
+			}, nil
+		},
+	})
+
+	_ = proxy.RegisterOrUpdate(&OAUTH2Proxy{
+		Host:        "retry",
+		Service:     "bar",
+		RedirectURI: "https://oauth2proxy-retry",
+		Port:        8080,
+		Endpoints:   []Endpoint{{Address: "10.0.0.1", Port: 8080}, {Address: "10.0.0.2", Port: 8080}},
+		Retries: RetryPolicy{
+			Attempts: 1,
+			Backoff:  time.Millisecond,
+		},
+		Object: client.ObjectKey{
+			Name:      "retry",
+			Namespace: "bar",
+		},
+	})
+
+	r, _ := http.NewRequest("GET", "http://retry/", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	g.Expect(w.Code).To(Equal(http.StatusOK))
+	g.Expect(hosts).To(Equal([]string{"10.0.0.1:8080", "10.0.0.2:8080"}))
+}
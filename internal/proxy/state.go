@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	errInvalidStateSignature = errors.New("state signature is invalid")
+)
+
+// stateKeySize is the size of the key generated if none is configured
+const stateKeySize = 32
+
+// encodeState encodes the proxied state as base64url encoded JSON and its HMAC-SHA256 signature separated by a dot.
+// The state passes through the client and the IdP, the signature ensures it has been issued by the proxy.
+func (h *HttpProxy) encodeState(st state) string {
+	b, _ := json.Marshal(st)
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(h.sign(payload))
+}
+
+// parseState verifies the signature of a proxied state and decodes it into st
+func (h *HttpProxy) parseState(s string, st *state) error {
+	payload, signature, ok := strings.Cut(s, ".")
+	if !ok {
+		return errInvalidStateSignature
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, h.sign(payload)) {
+		return errInvalidStateSignature
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, st)
+}
+
+// objectID returns the opaque id of an OAUTH2Proxy carried in the proxied state instead of its namespace and name
+func (h *HttpProxy) objectID(obj client.ObjectKey) string {
+	// The prefix can not collide with a payload as it is not part of the base64url alphabet
+	return base64.RawURLEncoding.EncodeToString(h.sign("object:" + obj.String())[:12])
+}
+
+func (h *HttpProxy) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, h.stateKey)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// testStateKey signs the states crafted by tests, proxies receiving them are created WithStateKey(testStateKey)
+var testStateKey = []byte("test-state-key")
+
+// signState encodes a state like a proxy using testStateKey
+func signState(st state) string {
+	return (&HttpProxy{stateKey: testStateKey}).encodeState(st)
+}
+
+// testObjectID returns the id of an OAUTH2Proxy like a proxy using testStateKey
+func testObjectID(obj client.ObjectKey) string {
+	return (&HttpProxy{stateKey: testStateKey}).objectID(obj)
+}
+
+func TestState(t *testing.T) {
+	g := NewWithT(t)
+
+	h := New(logr.Discard(), nil, WithStateKey(testStateKey))
+	obj := client.ObjectKey{Namespace: "bar", Name: "foo"}
+
+	encoded := h.encodeState(state{
+		OrigRedirectURI: "https://my-original-uri",
+		ObjectID:        h.objectID(obj),
+	})
+
+	// The state does not contain the namespace and name of the OAUTH2Proxy
+	payload, _, _ := strings.Cut(encoded, ".")
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(b)).NotTo(ContainSubstring("bar"))
+
+	st := state{}
+	g.Expect(h.parseState(encoded, &st)).To(Succeed())
+	g.Expect(st.OrigRedirectURI).To(Equal("https://my-original-uri"))
+	g.Expect(st.ObjectID).To(Equal(h.objectID(obj)))
+
+	// States with a modified payload, without signature or signed by another key are rejected
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"origRedirectURI":"https://attacker"}`))
+	_, signature, _ := strings.Cut(encoded, ".")
+	g.Expect(h.parseState(forged+"."+signature, &state{})).To(MatchError(errInvalidStateSignature))
+	g.Expect(h.parseState(payload, &state{})).To(MatchError(errInvalidStateSignature))
+	g.Expect(New(logr.Discard(), nil).parseState(encoded, &state{})).To(MatchError(errInvalidStateSignature))
+
+	// Ids are stable for the same key only
+	g.Expect(h.objectID(obj)).To(Equal(testObjectID(obj)))
+	g.Expect(h.objectID(obj)).NotTo(Equal(h.objectID(client.ObjectKey{Namespace: "bar", Name: "other"})))
+	g.Expect(New(logr.Discard(), nil).objectID(obj)).NotTo(Equal(h.objectID(obj)))
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// statsBuckets is the number of buckets the stats window is split into
+const statsBuckets = 60
+
+// DefaultStatsWindow is the window the routed requests are counted over by default
+const DefaultStatsWindow = time.Hour
+
+// Stats are the requests routed for an OAUTH2Proxy
+type Stats struct {
+	// LastRouted is the last time a request has been routed, zero if none has been routed yet
+	LastRouted time.Time
+	// Rewrites is the number of authorization redirects rewritten within the stats window
+	Rewrites int64
+	// Callbacks is the number of callbacks redirected to the original redirect_uri within the stats window
+	Callbacks int64
+}
+
+// WithStatsWindow sets the rolling window the routed requests are counted over
+func WithStatsWindow(window time.Duration) Option {
+	return func(h *HttpProxy) {
+		h.statsWindow = window
+	}
+}
+
+// statsBucket holds the counts of a slice of the stats window
+type statsBucket struct {
+	start     time.Time
+	rewrites  int64
+	callbacks int64
+}
+
+// routeStats counts the requests routed for an OAUTH2Proxy within a rolling window.
+// The window is split into buckets which are reset once they are reused.
+type routeStats struct {
+	mutex      sync.Mutex
+	window     time.Duration
+	buckets    [statsBuckets]statsBucket
+	lastRouted time.Time
+}
+
+func newRouteStats(window time.Duration) *routeStats {
+	return &routeStats{
+		window: window,
+	}
+}
+
+// bucket returns the bucket for the given time and resets it if it belongs to an earlier window
+func (s *routeStats) bucket(now time.Time) *statsBucket {
+	size := s.window / statsBuckets
+	if size <= 0 {
+		size = 1
+	}
+
+	start := now.Truncate(size)
+	b := &s.buckets[(start.UnixNano()/int64(size))%statsBuckets]
+	if !b.start.Equal(start) {
+		*b = statsBucket{start: start}
+	}
+
+	return b
+}
+
+// routed records that a request has been routed
+func (s *routeStats) routed(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastRouted = now
+}
+
+// rewrite records a rewritten authorization redirect
+func (s *routeStats) rewrite(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastRouted = now
+	s.bucket(now).rewrites++
+}
+
+// callback records a callback redirected to the original redirect_uri
+func (s *routeStats) callback(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastRouted = now
+	s.bucket(now).callbacks++
+}
+
+// get sums up the buckets within the window ending at now
+func (s *routeStats) get(now time.Time) Stats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats := Stats{
+		LastRouted: s.lastRouted,
+	}
+
+	for _, b := range s.buckets {
+		if !b.start.After(now.Add(-s.window)) {
+			continue
+		}
+
+		stats.Rewrites += b.rewrites
+		stats.Callbacks += b.callbacks
+	}
+
+	return stats
+}
+
+// StatsWindow returns the rolling window the routed requests are counted over
+func (h *HttpProxy) StatsWindow() time.Duration {
+	return h.statsWindow
+}
+
+// Stats returns the routed requests of all registered OAUTH2Proxies
+func (h *HttpProxy) Stats() map[client.ObjectKey]Stats {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := h.now()
+	stats := make(map[client.ObjectKey]Stats, len(h.dst))
+	for _, v := range h.dst {
+		stats[v.Object] = v.stats.get(now)
+	}
+
+	return stats
+}
+
+// recordCallback records a callback for the OAUTH2Proxy which issued the state.
+// Callbacks for OAUTH2Proxies which are not registered anymore are ignored.
+func (h *HttpProxy) recordCallback(obj client.ObjectKey) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, v := range h.dst {
+		if v.Object == obj {
+			v.stats.callback(h.now())
+			return
+		}
+	}
+}
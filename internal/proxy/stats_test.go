@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestRouteStatsWindow(t *testing.T) {
+	g := NewWithT(t)
+
+	now := time.Unix(1700000000, 0)
+	s := newRouteStats(time.Hour)
+
+	s.rewrite(now)
+	s.rewrite(now.Add(30 * time.Minute))
+	s.callback(now.Add(30 * time.Minute))
+	g.Expect(s.get(now.Add(30 * time.Minute))).To(Equal(Stats{
+		LastRouted: now.Add(30 * time.Minute),
+		Rewrites:   2,
+		Callbacks:  1,
+	}))
+
+	// Counts older than the window are dropped
+	g.Expect(s.get(now.Add(time.Hour + time.Minute))).To(Equal(Stats{
+		LastRouted: now.Add(30 * time.Minute),
+		Rewrites:   1,
+		Callbacks:  1,
+	}))
+
+	// Reused buckets are reset
+	s.rewrite(now.Add(2 * time.Hour))
+	g.Expect(s.get(now.Add(2 * time.Hour))).To(Equal(Stats{
+		LastRouted: now.Add(2 * time.Hour),
+		Rewrites:   1,
+	}))
+}
+
+func TestStats(t *testing.T) {
+	g := NewWithT(t)
+
+	obj := client.ObjectKey{Namespace: "stats", Name: "foo"}
+	proxy := New(logr.Discard(), &dummyTransport{
+		transport: func(r *http.Request) (*http.Response, error) {
+			header := http.Header{}
+			if r.URL.Path == "/auth" {
+				header.Add("Location", "https://idp?redirect_uri=https://idp/auth&state=foobar")
+			}
+
+			return &http.Response{
+				StatusCode: http.StatusFound,
+				Header:     header,
+				Body:       io.NopCloser(strings.NewReader("")),
+			}, nil
+		},
+	}, WithStatsWindow(10*time.Minute))
+
+	now := time.Unix(1700000000, 0)
+	proxy.now = func() time.Time {
+		return now
+	}
+
+	_ = proxy.RegisterOrUpdate(&OAUTH2Proxy{
+		Host:        "stats",
+		Service:     "bar",
+		RedirectURI: "https://oauth2proxy-stats",
+		Paths:       []PathMatch{{Path: "/"}},
+		Port:        8080,
+		Object:      obj,
+	})
+
+	g.Expect(proxy.StatsWindow()).To(Equal(10 * time.Minute))
+	g.Expect(proxy.Stats()).To(Equal(map[client.ObjectKey]Stats{obj: {}}))
+
+	// Requests without a redirect are only recorded as routed
+	r, _ := http.NewRequest("GET", "http://stats/other", nil)
+	proxy.ServeHTTP(httptest.NewRecorder(), r)
+	g.Expect(proxy.Stats()[obj]).To(Equal(Stats{LastRouted: now}))
+
+	now = now.Add(time.Second)
+	r, _ = http.NewRequest("GET", "http://stats/auth", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+
+	location, err := url.Parse(w.Result().Header.Get("Location"))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	now = now.Add(time.Second)
+	r, _ = http.NewRequest("GET", fmt.Sprintf("https://oauth2proxy-stats/auth?%s", url.Values{
+		"state": []string{location.Query().Get("state")},
+	}.Encode()), nil)
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	g.Expect(w.Code).To(Equal(http.StatusSeeOther))
+
+	g.Expect(proxy.Stats()[obj]).To(Equal(Stats{
+		LastRouted: now,
+		Rewrites:   1,
+		Callbacks:  1,
+	}))
+
+	now = now.Add(10 * time.Minute)
+	g.Expect(proxy.Stats()[obj]).To(Equal(Stats{
+		LastRouted: now.Add(-10 * time.Minute),
+	}))
+
+	_ = proxy.Unregister(obj)
+	g.Expect(proxy.Stats()).To(BeEmpty())
+}
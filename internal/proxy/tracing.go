@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the spans created by the proxy
+const tracerName = "github.com/DoodleScheduling/oauth2-redirect-controller/internal/proxy"
+
+const (
+	// namespaceAttribute is the namespace of the matched OAUTH2Proxy
+	namespaceAttribute = "oauth2proxy.namespace"
+	// nameAttribute is the name of the matched OAUTH2Proxy
+	nameAttribute = "oauth2proxy.name"
+	// actionAttribute is the Action taken for the request
+	actionAttribute = "oauth2proxy.action"
+	// callbackAttribute marks requests targeting the redirectURI host
+	callbackAttribute = "oauth2proxy.callback"
+	// rewrittenAttribute marks whether the Location header has been rewritten
+	rewrittenAttribute = "oauth2proxy.rewritten"
+	// failureReasonAttribute is the reason a step failed
+	failureReasonAttribute = "oauth2proxy.failure.reason"
+)
+
+// Failure reasons recorded on spans
+const (
+	reasonNoMatchingOAUTH2Proxy  = "NoMatchingOAUTH2Proxy"
+	reasonInvalidRedirectURI     = "InvalidRedirectURI"
+	reasonUpstreamUnavailable    = "UpstreamUnavailable"
+	reasonUpstreamTimeout        = "UpstreamTimeout"
+	reasonCircuitOpen            = "CircuitOpen"
+	reasonInvalidLocation        = "InvalidLocation"
+	reasonInvalidOrigRedirectURI = "InvalidOriginalRedirectURI"
+	reasonInvalidForm            = "InvalidForm"
+	reasonUndecodableState       = "UndecodableState"
+	reasonInvalidStateSignature  = "InvalidStateSignature"
+)
+
+// traceParentKey is the W3C trace context header which is carried in the proxied state
+const traceParentKey = "traceparent"
+
+// traceParent encodes the span context of ctx as W3C traceparent.
+// The state envelope always uses trace context, independent of the propagators configured for http.
+func traceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return carrier.Get(traceParentKey)
+}
+
+// spanLinks returns a link to the span which issued the state, if the state carries one
+func (s *state) spanLinks() []trace.Link {
+	if s.TraceParent == "" {
+		return nil
+	}
+
+	ctx := propagation.TraceContext{}.Extract(context.Background(), propagation.MapCarrier{
+		traceParentKey: s.TraceParent,
+	})
+
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return nil
+	}
+
+	return []trace.Link{{SpanContext: sc}}
+}
+
+// setAttributes sets the given attributes on span after passing them through the Redactor
+func (h *HttpProxy) setAttributes(span trace.Span, attrs ...attribute.KeyValue) {
+	span.SetAttributes(h.redactor.Attributes(attrs...)...)
+}
+
+// fail marks span as failed with the given reason, the error message is redacted
+func (h *HttpProxy) fail(span trace.Span, reason string, err error) {
+	h.setAttributes(span, attribute.String(failureReasonAttribute, reason))
+
+	if err != nil {
+		span.RecordError(errors.New(h.redactor.String(err.Error())))
+	}
+
+	span.SetStatus(codes.Error, reason)
+}
+
+// objectAttributes returns the namespace and name attributes of an OAUTH2Proxy given as namespace/name
+func objectAttributes(object string) []attribute.KeyValue {
+	namespace, name, ok := strings.Cut(object, "/")
+	if !ok {
+		return nil
+	}
+
+	return []attribute.KeyValue{
+		attribute.String(namespaceAttribute, namespace),
+		attribute.String(nameAttribute, name),
+	}
+}
+
+// attributes returns the matched OAUTH2Proxy and the action taken for the request
+func (e *accessLogEntry) attributes() []attribute.KeyValue {
+	return append(objectAttributes(e.Object), attribute.String(actionAttribute, string(e.Action)))
+}
@@ -0,0 +1,95 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/conversion"
+
+	infrav1 "github.com/DoodleScheduling/oauth2-redirect-controller/api/v1"
+	"github.com/DoodleScheduling/oauth2-redirect-controller/api/v1beta1"
+)
+
+func TestConversionWebhook(t *testing.T) {
+	g := NewWithT(t)
+
+	scheme := runtime.NewScheme()
+	_ = infrav1.AddToScheme(scheme)
+	_ = v1beta1.AddToScheme(scheme)
+
+	convertible, err := conversion.IsConvertible(scheme, &infrav1.OAUTH2Proxy{})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(convertible).To(BeTrue())
+
+	src := &v1beta1.OAUTH2Proxy{
+		Spec: v1beta1.OAUTH2ProxySpec{
+			Host:        "idp.example.com",
+			RedirectURI: "https://callback.example.com",
+			Paths:       []string{"/"},
+			Backend: v1beta1.ServiceSelector{
+				ServiceName: "idp",
+				ServicePort: intstr.FromString("http"),
+			},
+		},
+	}
+	src.SetGroupVersionKind(v1beta1.GroupVersion.WithKind("OAUTH2Proxy"))
+	src.SetName("idp")
+
+	raw, err := json.Marshal(src)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	review, err := json.Marshal(apiextensionsv1.ConversionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: apiextensionsv1.SchemeGroupVersion.String(),
+			Kind:       "ConversionReview",
+		},
+		Request: &apiextensionsv1.ConversionRequest{
+			UID:               "uid",
+			DesiredAPIVersion: infrav1.GroupVersion.String(),
+			Objects:           []runtime.RawExtension{{Raw: raw}},
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	w := httptest.NewRecorder()
+	conversion.NewWebhookHandler(scheme).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/convert", bytes.NewReader(review)))
+	g.Expect(w.Code).To(Equal(http.StatusOK))
+
+	var res apiextensionsv1.ConversionReview
+	g.Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+	g.Expect(res.Response.Result.Status).To(Equal("Success"), res.Response.Result.Message)
+	g.Expect(res.Response.ConvertedObjects).To(HaveLen(1))
+
+	var dst infrav1.OAUTH2Proxy
+	g.Expect(json.Unmarshal(res.Response.ConvertedObjects[0].Raw, &dst)).To(Succeed())
+	g.Expect(dst.APIVersion).To(Equal(infrav1.GroupVersion.String()))
+	g.Expect(dst.Spec.Paths).To(Equal([]infrav1.HTTPPathMatch{{Type: infrav1.PathMatchPrefix, Value: "/"}}))
+	g.Expect(dst.Spec.Backend.Service).To(Equal(infrav1.ServiceBackendRef{
+		Name: "idp",
+		Port: infrav1.ServiceBackendPort{Name: "http"},
+	}))
+}
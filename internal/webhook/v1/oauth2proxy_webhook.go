@@ -0,0 +1,383 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	infrav1 "github.com/DoodleScheduling/oauth2-redirect-controller/api/v1"
+)
+
+// SetupOAUTH2ProxyWebhookWithManager registers the defaulting and validating webhooks for OAUTH2Proxies.
+// If ingressAnnotations is set the hosts of annotated Ingresses are considered claimed as well.
+func SetupOAUTH2ProxyWebhookWithManager(mgr ctrl.Manager, ingressAnnotations bool) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&infrav1.OAUTH2Proxy{}).
+		WithDefaulter(&OAUTH2ProxyDefaulter{}).
+		WithValidator(&OAUTH2ProxyValidator{Client: mgr.GetAPIReader(), IngressAnnotations: ingressAnnotations}).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-oauth2-infra-doodle-com-v1-oauth2proxy,mutating=true,failurePolicy=fail,sideEffects=None,groups=oauth2.infra.doodle.com,resources=oauth2proxies,verbs=create;update,versions=v1,name=moauth2proxy-v1.kb.io,admissionReviewVersions=v1
+
+// OAUTH2ProxyDefaulter sets defaults on OAUTH2Proxies
+type OAUTH2ProxyDefaulter struct{}
+
+var _ admission.CustomDefaulter = &OAUTH2ProxyDefaulter{}
+
+// Default rewrites all paths if none are configured, without paths no redirect would be rewritten.
+// Paths without a type are prefixes.
+func (d *OAUTH2ProxyDefaulter) Default(ctx context.Context, obj runtime.Object) error {
+	ph, ok := obj.(*infrav1.OAUTH2Proxy)
+	if !ok {
+		return fmt.Errorf("expected an OAUTH2Proxy, got %T", obj)
+	}
+
+	if len(ph.Spec.Paths) == 0 {
+		ph.Spec.Paths = []infrav1.HTTPPathMatch{{Value: "/"}}
+	}
+
+	for i := range ph.Spec.Paths {
+		if ph.Spec.Paths[i].Type == "" {
+			ph.Spec.Paths[i].Type = infrav1.PathMatchPrefix
+		}
+	}
+
+	return nil
+}
+
+// +kubebuilder:webhook:path=/validate-oauth2-infra-doodle-com-v1-oauth2proxy,mutating=false,failurePolicy=fail,sideEffects=None,groups=oauth2.infra.doodle.com,resources=oauth2proxies,verbs=create;update,versions=v1,name=voauth2proxy-v1.kb.io,admissionReviewVersions=v1
+
+// OAUTH2ProxyValidator validates OAUTH2Proxies.
+// Besides the spec itself it rejects hosts which are already claimed by another OAUTH2Proxy or an annotated Ingress.
+type OAUTH2ProxyValidator struct {
+	// Client should read from the API server directly, a cache might not include objects created just before
+	Client client.Reader
+	// IngressAnnotations considers the hosts of Ingresses annotated with infrav1.IngressRedirectURIAnnotation
+	IngressAnnotations bool
+}
+
+var _ admission.CustomValidator = &OAUTH2ProxyValidator{}
+
+// ValidateCreate validates a new OAUTH2Proxy
+func (v *OAUTH2ProxyValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, v.validate(ctx, obj, true)
+}
+
+// ValidateUpdate validates a changed OAUTH2Proxy.
+// Collisions are only checked if the routed hosts or paths changed, OAUTH2Proxies which already collide can still be updated.
+func (v *OAUTH2ProxyValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	oldPh, ok := oldObj.(*infrav1.OAUTH2Proxy)
+	if !ok {
+		return nil, fmt.Errorf("expected an OAUTH2Proxy, got %T", oldObj)
+	}
+
+	ph, ok := newObj.(*infrav1.OAUTH2Proxy)
+	if !ok {
+		return nil, fmt.Errorf("expected an OAUTH2Proxy, got %T", newObj)
+	}
+
+	routingChanged := ph.Spec.Host != oldPh.Spec.Host || ph.Spec.RedirectURI != oldPh.Spec.RedirectURI ||
+		!slices.Equal(ph.Spec.Paths, oldPh.Spec.Paths)
+
+	return nil, v.validate(ctx, newObj, routingChanged)
+}
+
+// ValidateDelete allows all deletions
+func (v *OAUTH2ProxyValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func (v *OAUTH2ProxyValidator) validate(ctx context.Context, obj runtime.Object, checkCollisions bool) error {
+	ph, ok := obj.(*infrav1.OAUTH2Proxy)
+	if !ok {
+		return fmt.Errorf("expected an OAUTH2Proxy, got %T", obj)
+	}
+
+	spec := field.NewPath("spec")
+	errs := validateHost(ph.Spec.Host, spec.Child("host"))
+	errs = append(errs, validateRedirectURI(ph.Spec.RedirectURI, spec.Child("redirectURI"))...)
+
+	for i, path := range ph.Spec.Paths {
+		if !strings.HasPrefix(path.Value, "/") {
+			errs = append(errs, field.Invalid(spec.Child("paths").Index(i).Child("value"), path.Value, "must start with /"))
+		}
+	}
+
+	errs = append(errs, validateBackend(ph.Spec.Backend, spec.Child("backend"))...)
+
+	if ref := ph.Spec.TLS.SecretRef; ref != nil {
+		errs = append(errs, validateName(ref.Name, spec.Child("tls", "secretRef", "name"))...)
+	}
+
+	// Collisions are only meaningful between well-formed hosts
+	if checkCollisions && len(errs) == 0 {
+		collisions, err := v.validateCollisions(ctx, ph, spec)
+		if err != nil {
+			return apierrors.NewInternalError(err)
+		}
+
+		errs = append(errs, collisions...)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return apierrors.NewInvalid(infrav1.GroupVersion.WithKind("OAUTH2Proxy").GroupKind(), ph.GetName(), errs)
+}
+
+// validateCollisions rejects hosts which would be routed to another OAUTH2Proxy.
+// Multiple OAUTH2Proxies may share the host of their redirectURI as callbacks are matched by the state.
+func (v *OAUTH2ProxyValidator) validateCollisions(ctx context.Context, ph *infrav1.OAUTH2Proxy, spec *field.Path) (field.ErrorList, error) {
+	var list infrav1.OAUTH2ProxyList
+	if err := v.Client.List(ctx, &list); err != nil {
+		return nil, err
+	}
+
+	var errs field.ErrorList
+	redirectHost := hostOf(ph.Spec.RedirectURI)
+
+	for _, other := range list.Items {
+		if other.GetNamespace() == ph.GetNamespace() && other.GetName() == ph.GetName() {
+			continue
+		}
+
+		key := client.ObjectKeyFromObject(&other).String()
+		switch {
+		case other.Spec.Host == ph.Spec.Host:
+			errs = append(errs, field.Duplicate(spec.Child("host"), fmt.Sprintf("%s is already used by %s", ph.Spec.Host, key)))
+		case hostOf(other.Spec.RedirectURI) == ph.Spec.Host:
+			errs = append(errs, field.Invalid(spec.Child("host"), ph.Spec.Host, fmt.Sprintf("already used as redirectURI host by %s", key)))
+		}
+
+		if other.Spec.Host == redirectHost {
+			errs = append(errs, field.Invalid(spec.Child("redirectURI"), ph.Spec.RedirectURI, fmt.Sprintf("host is already used by %s", key)))
+		}
+	}
+
+	if !v.IngressAnnotations {
+		return errs, nil
+	}
+
+	ingressErrs, err := v.validateIngressCollisions(ctx, ph, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(errs, ingressErrs...), nil
+}
+
+// validateIngressCollisions rejects hosts which would be routed to an Ingress annotated with infrav1.IngressRedirectURIAnnotation
+func (v *OAUTH2ProxyValidator) validateIngressCollisions(ctx context.Context, ph *infrav1.OAUTH2Proxy, spec *field.Path) (field.ErrorList, error) {
+	var list networkingv1.IngressList
+	if err := v.Client.List(ctx, &list); err != nil {
+		return nil, err
+	}
+
+	var errs field.ErrorList
+	redirectHost := hostOf(ph.Spec.RedirectURI)
+
+	for _, ing := range list.Items {
+		redirectURI, ok := ing.GetAnnotations()[infrav1.IngressRedirectURIAnnotation]
+		if !ok || !ing.GetDeletionTimestamp().IsZero() {
+			continue
+		}
+
+		key := fmt.Sprintf("Ingress %s", client.ObjectKeyFromObject(&ing))
+		if hostOf(redirectURI) == ph.Spec.Host {
+			errs = append(errs, field.Invalid(spec.Child("host"), ph.Spec.Host, fmt.Sprintf("already used as redirectURI host by %s", key)))
+		}
+
+		hosts := make(map[string]struct{})
+		for _, rule := range ing.Spec.Rules {
+			hosts[rule.Host] = struct{}{}
+		}
+
+		if _, ok := hosts[ph.Spec.Host]; ok {
+			errs = append(errs, field.Duplicate(spec.Child("host"), fmt.Sprintf("%s is already used by %s", ph.Spec.Host, key)))
+		}
+
+		if _, ok := hosts[redirectHost]; ok {
+			errs = append(errs, field.Invalid(spec.Child("redirectURI"), ph.Spec.RedirectURI, fmt.Sprintf("host is already used by %s", key)))
+		}
+	}
+
+	return errs, nil
+}
+
+// validateHost validates a host as found in the Host header, it may include a port
+func validateHost(host string, fldPath *field.Path) field.ErrorList {
+	if host == "" {
+		return field.ErrorList{field.Required(fldPath, "")}
+	}
+
+	name := host
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		name = h
+		if n, err := strconv.Atoi(port); err != nil || len(validation.IsValidPortNum(n)) > 0 {
+			return field.ErrorList{field.Invalid(fldPath, host, "invalid port")}
+		}
+	}
+
+	if msgs := validation.IsDNS1123Subdomain(name); len(msgs) > 0 {
+		return field.ErrorList{field.Invalid(fldPath, host, strings.Join(msgs, ", "))}
+	}
+
+	return nil
+}
+
+func validateRedirectURI(redirectURI string, fldPath *field.Path) field.ErrorList {
+	if redirectURI == "" {
+		return field.ErrorList{field.Required(fldPath, "")}
+	}
+
+	u, err := url.Parse(redirectURI)
+	switch {
+	case err != nil:
+		return field.ErrorList{field.Invalid(fldPath, redirectURI, err.Error())}
+	case u.Scheme != infrav1.SchemeHTTP && u.Scheme != infrav1.SchemeHTTPS:
+		return field.ErrorList{field.Invalid(fldPath, redirectURI, "scheme must be http or https")}
+	}
+
+	return validateHost(u.Host, fldPath)
+}
+
+func validateBackend(backend infrav1.BackendRef, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	service := backend.Service
+	serviceFldPath := fldPath.Child("service")
+
+	switch {
+	case backend.URL != "" && service.Name != "":
+		errs = append(errs, field.Forbidden(fldPath.Child("url"), "may not be set together with service"))
+	case backend.URL != "":
+		errs = append(errs, validateBackendURL(backend.URL, fldPath.Child("url"))...)
+	case service.Name == "":
+		errs = append(errs, field.Required(serviceFldPath.Child("name"), "either service or url must be set"))
+	default:
+		if msgs := validation.IsDNS1035Label(service.Name); len(msgs) > 0 {
+			errs = append(errs, field.Invalid(serviceFldPath.Child("name"), service.Name, strings.Join(msgs, ", ")))
+		}
+
+		if service.Namespace != "" {
+			if msgs := validation.IsDNS1123Label(service.Namespace); len(msgs) > 0 {
+				errs = append(errs, field.Invalid(serviceFldPath.Child("namespace"), service.Namespace, strings.Join(msgs, ", ")))
+			}
+		}
+
+		errs = append(errs, validateServicePort(service.Port, serviceFldPath.Child("port"))...)
+	}
+
+	tlsFldPath := fldPath.Child("protocol", "tls")
+	if ref := backend.Protocol.TLS.CASecretRef; ref != nil {
+		errs = append(errs, validateName(ref.Name, tlsFldPath.Child("caSecretRef", "name"))...)
+	}
+
+	if ref := backend.Protocol.TLS.ClientCertSecretRef; ref != nil {
+		errs = append(errs, validateName(ref.Name, tlsFldPath.Child("clientCertSecretRef", "name"))...)
+	}
+
+	if t := backend.Timeouts; t != nil {
+		errs = append(errs, validateTimeout(t.Connect, fldPath.Child("timeouts", "connect"))...)
+		errs = append(errs, validateTimeout(t.ResponseHeader, fldPath.Child("timeouts", "responseHeader"))...)
+		errs = append(errs, validateTimeout(t.Request, fldPath.Child("timeouts", "request"))...)
+	}
+
+	return errs
+}
+
+func validateBackendURL(rawURL string, fldPath *field.Path) field.ErrorList {
+	u, err := url.Parse(rawURL)
+	switch {
+	case err != nil:
+		return field.ErrorList{field.Invalid(fldPath, rawURL, err.Error())}
+	case u.Scheme != infrav1.SchemeHTTP && u.Scheme != infrav1.SchemeHTTPS:
+		return field.ErrorList{field.Invalid(fldPath, rawURL, "scheme must be http or https")}
+	case u.Hostname() == "":
+		return field.ErrorList{field.Invalid(fldPath, rawURL, "missing host")}
+	case u.User != nil || u.RawQuery != "" || u.Fragment != "":
+		return field.ErrorList{field.Invalid(fldPath, rawURL, "user info, query and fragment are not supported")}
+	}
+
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || len(validation.IsValidPortNum(n)) > 0 {
+			return field.ErrorList{field.Invalid(fldPath, rawURL, "invalid port")}
+		}
+	}
+
+	return nil
+}
+
+func validateServicePort(port infrav1.ServiceBackendPort, fldPath *field.Path) field.ErrorList {
+	switch {
+	case port.Name != "" && port.Number != 0:
+		return field.ErrorList{field.Forbidden(fldPath.Child("number"), "may not be set together with name")}
+	case port.Name != "":
+		if msgs := validation.IsValidPortName(port.Name); len(msgs) > 0 {
+			return field.ErrorList{field.Invalid(fldPath.Child("name"), port.Name, strings.Join(msgs, ", "))}
+		}
+	default:
+		if msgs := validation.IsValidPortNum(int(port.Number)); len(msgs) > 0 {
+			return field.ErrorList{field.Invalid(fldPath.Child("number"), port.Number, strings.Join(msgs, ", "))}
+		}
+	}
+
+	return nil
+}
+
+func validateTimeout(d *metav1.Duration, fldPath *field.Path) field.ErrorList {
+	if d != nil && d.Duration < 0 {
+		return field.ErrorList{field.Invalid(fldPath, d.Duration.String(), "must not be negative")}
+	}
+
+	return nil
+}
+
+func validateName(name string, fldPath *field.Path) field.ErrorList {
+	if msgs := validation.IsDNS1123Subdomain(name); len(msgs) > 0 {
+		return field.ErrorList{field.Invalid(fldPath, name, strings.Join(msgs, ", "))}
+	}
+
+	return nil
+}
+
+// hostOf returns the host of an URL or an empty string if it can not be parsed
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+
+	return u.Host
+}
@@ -0,0 +1,340 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	infrav1 "github.com/DoodleScheduling/oauth2-redirect-controller/api/v1"
+)
+
+func TestDefault(t *testing.T) {
+	g := NewWithT(t)
+
+	ph := &infrav1.OAUTH2Proxy{}
+	g.Expect((&OAUTH2ProxyDefaulter{}).Default(context.Background(), ph)).To(Succeed())
+	g.Expect(ph.Spec.Paths).To(Equal([]infrav1.HTTPPathMatch{{Type: infrav1.PathMatchPrefix, Value: "/"}}))
+
+	ph.Spec.Paths = []infrav1.HTTPPathMatch{{Value: "/login"}, {Type: infrav1.PathMatchExact, Value: "/callback"}}
+	g.Expect((&OAUTH2ProxyDefaulter{}).Default(context.Background(), ph)).To(Succeed())
+	g.Expect(ph.Spec.Paths).To(Equal([]infrav1.HTTPPathMatch{
+		{Type: infrav1.PathMatchPrefix, Value: "/login"},
+		{Type: infrav1.PathMatchExact, Value: "/callback"},
+	}))
+}
+
+func TestValidate(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = infrav1.AddToScheme(scheme)
+	_ = networkingv1.AddToScheme(scheme)
+
+	existing := &infrav1.OAUTH2Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: "existing", Namespace: "other"},
+		Spec: infrav1.OAUTH2ProxySpec{
+			Host:        "taken.example.com",
+			RedirectURI: "https://callback.example.com",
+			Backend: infrav1.BackendRef{
+				Service: infrav1.ServiceBackendRef{
+					Name: "idp",
+					Port: infrav1.ServiceBackendPort{Name: "http"},
+				},
+			},
+		},
+	}
+
+	annotated := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app",
+			Namespace:   "other",
+			Annotations: map[string]string{infrav1.IngressRedirectURIAnnotation: "https://login.example.com"},
+		},
+		Spec: networkingv1.IngressSpec{
+			Rules: []networkingv1.IngressRule{{Host: "app.example.com"}, {Host: "app.example.com"}},
+		},
+	}
+
+	plain := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: "plain", Namespace: "other"},
+		Spec: networkingv1.IngressSpec{
+			Rules: []networkingv1.IngressRule{{Host: "plain.example.com"}},
+		},
+	}
+
+	valid := func() *infrav1.OAUTH2Proxy {
+		return &infrav1.OAUTH2Proxy{
+			ObjectMeta: metav1.ObjectMeta{Name: "idp", Namespace: "default"},
+			Spec: infrav1.OAUTH2ProxySpec{
+				Host:        "idp.example.com",
+				RedirectURI: "https://callback.example.com/callback",
+				Paths:       []infrav1.HTTPPathMatch{{Value: "/"}},
+				Backend: infrav1.BackendRef{
+					Service: infrav1.ServiceBackendRef{
+						Name: "idp",
+						Port: infrav1.ServiceBackendPort{Name: "http"},
+					},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		mutate      func(ph *infrav1.OAUTH2Proxy)
+		expectError string
+	}{
+		{
+			name:   "Valid OAUTH2Proxy sharing the redirectURI host",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {},
+		},
+		{
+			name: "Host with port",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Spec.Host = "idp.example.com:8080"
+			},
+		},
+		{
+			name: "Numeric service port",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Spec.Backend.Service.Port = infrav1.ServiceBackendPort{Number: 8080}
+			},
+		},
+		{
+			name: "URL backend",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Spec.Backend = infrav1.BackendRef{URL: "https://idp.example.org/auth"}
+			},
+		},
+		{
+			name: "Missing host",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Spec.Host = ""
+			},
+			expectError: "spec.host: Required value",
+		},
+		{
+			name: "Invalid host",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Spec.Host = "Not A Host"
+			},
+			expectError: "spec.host: Invalid value",
+		},
+		{
+			name: "Unparsable redirectURI",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Spec.RedirectURI = ":):((#///`"
+			},
+			expectError: "spec.redirectURI: Invalid value",
+		},
+		{
+			name: "Relative redirectURI",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Spec.RedirectURI = "/callback"
+			},
+			expectError: "scheme must be http or https",
+		},
+		{
+			name: "Path without leading slash",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Spec.Paths = []infrav1.HTTPPathMatch{{Value: "login"}}
+			},
+			expectError: "spec.paths[0].value: Invalid value",
+		},
+		{
+			name: "Missing backend",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Spec.Backend = infrav1.BackendRef{}
+			},
+			expectError: "spec.backend.service.name: Required value",
+		},
+		{
+			name: "Service and URL backend",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Spec.Backend.URL = "https://idp.example.org"
+			},
+			expectError: "spec.backend.url: Forbidden",
+		},
+		{
+			name: "Invalid backend URL",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Spec.Backend = infrav1.BackendRef{URL: "ftp://idp.example.org"}
+			},
+			expectError: "spec.backend.url: Invalid value",
+		},
+		{
+			name: "Invalid service port",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Spec.Backend.Service.Port = infrav1.ServiceBackendPort{}
+			},
+			expectError: "spec.backend.service.port.number: Invalid value",
+		},
+		{
+			name: "Service port with name and number",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Spec.Backend.Service.Port.Number = 8080
+			},
+			expectError: "spec.backend.service.port.number: Forbidden",
+		},
+		{
+			name: "Negative timeout",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Spec.Backend.Timeouts = &infrav1.BackendTimeouts{
+					Request: &metav1.Duration{Duration: -1},
+				}
+			},
+			expectError: "spec.backend.timeouts.request: Invalid value",
+		},
+		{
+			name: "Host used by another OAUTH2Proxy",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Spec.Host = "taken.example.com"
+			},
+			expectError: "spec.host: Duplicate value",
+		},
+		{
+			name: "Host used as redirectURI host by another OAUTH2Proxy",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Spec.Host = "callback.example.com"
+				ph.Spec.RedirectURI = "https://other-callback.example.com"
+			},
+			expectError: "already used as redirectURI host by other/existing",
+		},
+		{
+			name: "RedirectURI host used by another OAUTH2Proxy",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Spec.RedirectURI = "https://taken.example.com/callback"
+			},
+			expectError: "host is already used by other/existing",
+		},
+		{
+			name: "Host used by an annotated Ingress",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Spec.Host = "app.example.com"
+			},
+			expectError: "spec.host: Duplicate value: \"app.example.com is already used by Ingress other/app\"",
+		},
+		{
+			name: "Host used as redirectURI host by an annotated Ingress",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Spec.Host = "login.example.com"
+			},
+			expectError: "already used as redirectURI host by Ingress other/app",
+		},
+		{
+			name: "RedirectURI host used by an annotated Ingress",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Spec.RedirectURI = "https://app.example.com/callback"
+			},
+			expectError: "host is already used by Ingress other/app",
+		},
+		{
+			name: "Hosts of Ingresses without annotation are not claimed",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Spec.Host = "plain.example.com"
+			},
+		},
+		{
+			name: "Updating the OAUTH2Proxy itself is not a collision",
+			mutate: func(ph *infrav1.OAUTH2Proxy) {
+				ph.Name = "existing"
+				ph.Namespace = "other"
+				ph.Spec.Host = "taken.example.com"
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			v := &OAUTH2ProxyValidator{
+				Client:             fake.NewClientBuilder().WithScheme(scheme).WithObjects(existing, annotated, plain).Build(),
+				IngressAnnotations: true,
+			}
+
+			ph := valid()
+			test.mutate(ph)
+
+			_, err := v.ValidateCreate(context.Background(), ph)
+			if test.expectError == "" {
+				g.Expect(err).NotTo(HaveOccurred())
+				return
+			}
+
+			g.Expect(apierrors.IsInvalid(err)).To(BeTrue(), err.Error())
+			g.Expect(err.Error()).To(ContainSubstring(test.expectError))
+		})
+	}
+}
+
+func TestValidateUpdateCollision(t *testing.T) {
+	g := NewWithT(t)
+
+	scheme := runtime.NewScheme()
+	_ = infrav1.AddToScheme(scheme)
+
+	proxy := func(name, host string) *infrav1.OAUTH2Proxy {
+		return &infrav1.OAUTH2Proxy{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: infrav1.OAUTH2ProxySpec{
+				Host:        host,
+				RedirectURI: "https://callback.example.com",
+				Backend: infrav1.BackendRef{
+					Service: infrav1.ServiceBackendRef{
+						Name: "idp",
+						Port: infrav1.ServiceBackendPort{Name: "http"},
+					},
+				},
+			},
+		}
+	}
+
+	// Both OAUTH2Proxies existed before the webhook was enabled
+	first := proxy("first", "idp.example.com")
+	second := proxy("second", "idp.example.com")
+
+	v := &OAUTH2ProxyValidator{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(first, second).Build(),
+	}
+
+	// Changes which do not affect the routing are allowed
+	updated := second.DeepCopy()
+	updated.Labels = map[string]string{"team": "identity"}
+	updated.Spec.Backend.Service.Name = "other-idp"
+	_, err := v.ValidateUpdate(context.Background(), second, updated)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// Resolving the collision is allowed
+	updated = second.DeepCopy()
+	updated.Spec.Host = "other-idp.example.com"
+	_, err = v.ValidateUpdate(context.Background(), second, updated)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// Changing the routing to another colliding value is not
+	updated = second.DeepCopy()
+	updated.Spec.Paths = []infrav1.HTTPPathMatch{{Type: infrav1.PathMatchPrefix, Value: "/auth"}}
+	_, err = v.ValidateUpdate(context.Background(), second, updated)
+	g.Expect(apierrors.IsInvalid(err)).To(BeTrue())
+	g.Expect(err.Error()).To(ContainSubstring("spec.host: Duplicate value"))
+}
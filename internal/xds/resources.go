@@ -0,0 +1,521 @@
+package xds
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	extprocfilterv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	routerv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
+	hcmv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	upstreamhttpv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
+	matcherv3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/DoodleScheduling/oauth2-redirect-controller/internal/proxy"
+)
+
+const (
+	// ListenerName is the name of the published listener
+	ListenerName = "oauth2-redirect-proxy"
+	// RouteName is the name of the published route configuration
+	RouteName = "oauth2-redirect-proxy"
+	// ExtProcClusterName is the name of the published cluster of the external processor
+	ExtProcClusterName = "oauth2-redirect-proxy-ext-proc"
+
+	// extProcFilterName is the name of the Envoy ext_proc http filter
+	extProcFilterName = "envoy.filters.http.ext_proc"
+	// httpProtocolOptionsName is the name of the upstream http protocol options extension
+	httpProtocolOptionsName = "envoy.extensions.upstreams.http.v3.HttpProtocolOptions"
+	// defaultConnectTimeout is the connect timeout of clusters without one, Envoy requires a timeout
+	defaultConnectTimeout = 5 * time.Second
+	// caSecretSuffix is appended to the cluster name for the secret holding the CA the upstream is verified against
+	caSecretSuffix = "/ca"
+	// clientCertSecretSuffix is appended to the cluster name for the secret holding the client certificate
+	clientCertSecretSuffix = "/client-certificate"
+)
+
+// Options configure the published resources
+type Options struct {
+	// ListenerPort is the port of the published listener
+	ListenerPort uint32
+	// ExtProcHost is the address of the external processor serving the rewrites
+	ExtProcHost string
+	// ExtProcPort is the port of the external processor
+	ExtProcPort uint32
+	// ExtProcCA are the PEM encoded CA certificates the external processor is verified against.
+	// The external processor is connected to using TLS if set.
+	ExtProcCA []byte
+	// SystemCA is the path to the CA bundle on Envoy which backends without a CA are verified against
+	SystemCA string
+}
+
+// resources returns the listener, route configuration, clusters and secrets routing the registered OAUTH2Proxies.
+// The backends are published as clusters and each host as virtual host, the rewrites are attached to the listener
+// as ext_proc filter which calls the external processor of the controller.
+// Certificates and private keys are published as secrets (SDS) which the clusters reference.
+func resources(registrations []proxy.OAUTH2Proxy, opts Options) (map[resource.Type][]types.Resource, error) {
+	l, err := listener(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	extProc, secrets, err := extProcCluster(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	clusters := []types.Resource{extProc}
+	for _, dst := range registrations {
+		c, clusterSecrets, err := cluster(dst, opts.SystemCA)
+		if err != nil {
+			return nil, err
+		}
+
+		clusters = append(clusters, c)
+		secrets = append(secrets, clusterSecrets...)
+	}
+
+	return map[resource.Type][]types.Resource{
+		resource.ListenerType: {l},
+		resource.RouteType:    {routeConfiguration(registrations)},
+		resource.ClusterType:  clusters,
+		resource.SecretType:   secrets,
+	}, nil
+}
+
+// clusterName returns the name of the cluster of an OAUTH2Proxy
+func clusterName(obj client.ObjectKey) string {
+	return obj.String()
+}
+
+// cluster returns the cluster of the backend of an OAUTH2Proxy and the secrets it references.
+// Ready endpoints are published statically, otherwise the service address is resolved by Envoy.
+// TLS backends without a CA are verified against the system CA bundle on Envoy.
+func cluster(dst proxy.OAUTH2Proxy, systemCA string) (*clusterv3.Cluster, []types.Resource, error) {
+	connectTimeout := dst.Timeouts.Connect
+	if connectTimeout <= 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+
+	discoveryType := clusterv3.Cluster_STRICT_DNS
+	endpoints := []*endpointv3.LbEndpoint{lbEndpoint(dst.Service, dst.Port)}
+
+	if len(dst.Endpoints) > 0 {
+		discoveryType = clusterv3.Cluster_STATIC
+		endpoints = nil
+
+		for _, endpoint := range dst.Endpoints {
+			endpoints = append(endpoints, lbEndpoint(endpoint.Address, endpoint.Port))
+		}
+	}
+
+	c := &clusterv3.Cluster{
+		Name:                 clusterName(dst.Object),
+		ConnectTimeout:       durationpb.New(connectTimeout),
+		ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: discoveryType},
+		LbPolicy:             clusterv3.Cluster_ROUND_ROBIN,
+		LoadAssignment: &endpointv3.ClusterLoadAssignment{
+			ClusterName: clusterName(dst.Object),
+			Endpoints:   []*endpointv3.LocalityLbEndpoints{{LbEndpoints: endpoints}},
+		},
+	}
+
+	if dst.Scheme != "https" {
+		return c, nil, nil
+	}
+
+	serverName := dst.Service
+	if dst.TLS != nil && dst.TLS.ServerName != "" {
+		serverName = dst.TLS.ServerName
+	}
+
+	tlsContext, secrets, err := upstreamTlsContext(c.Name, serverName, dst.TLSCertificates, systemCA)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	transportSocket, err := tlsTransportSocket(tlsContext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.TransportSocket = transportSocket
+	return c, secrets, nil
+}
+
+// upstreamTlsContext returns the TLS configuration of a cluster and the secrets it references.
+// The certificate of the upstream is verified against the server name and the CA if configured,
+// otherwise against the system CA bundle on Envoy. The client certificate is presented if configured.
+// The CA and the client certificate are published as secrets named after the cluster.
+func upstreamTlsContext(name, serverName string, certs proxy.TLSCertificates, systemCA string) (*tlsv3.UpstreamTlsContext, []types.Resource, error) {
+	tlsContext := &tlsv3.UpstreamTlsContext{
+		CommonTlsContext: &tlsv3.CommonTlsContext{},
+	}
+
+	if net.ParseIP(serverName) == nil {
+		tlsContext.Sni = serverName
+	}
+
+	validation := &tlsv3.CertificateValidationContext{}
+	if serverName != "" {
+		sanType := tlsv3.SubjectAltNameMatcher_DNS
+		if net.ParseIP(serverName) != nil {
+			sanType = tlsv3.SubjectAltNameMatcher_IP_ADDRESS
+		}
+
+		validation.MatchTypedSubjectAltNames = []*tlsv3.SubjectAltNameMatcher{
+			{
+				SanType: sanType,
+				Matcher: &matcherv3.StringMatcher{
+					MatchPattern: &matcherv3.StringMatcher_Exact{Exact: serverName},
+				},
+			},
+		}
+	}
+
+	var secrets []types.Resource
+	switch {
+	case len(certs.CA) > 0:
+		// The server name is matched by the cluster while the CA is published as secret
+		caSecret := name + caSecretSuffix
+		tlsContext.CommonTlsContext.ValidationContextType = &tlsv3.CommonTlsContext_CombinedValidationContext{
+			CombinedValidationContext: &tlsv3.CommonTlsContext_CombinedCertificateValidationContext{
+				DefaultValidationContext:         validation,
+				ValidationContextSdsSecretConfig: sdsSecretConfig(caSecret),
+			},
+		}
+
+		secrets = append(secrets, &tlsv3.Secret{
+			Name: caSecret,
+			Type: &tlsv3.Secret_ValidationContext{
+				ValidationContext: &tlsv3.CertificateValidationContext{TrustedCa: inlineBytes(certs.CA)},
+			},
+		})
+	case systemCA != "":
+		validation.TrustedCa = &corev3.DataSource{
+			Specifier: &corev3.DataSource_Filename{Filename: systemCA},
+		}
+
+		tlsContext.CommonTlsContext.ValidationContextType = &tlsv3.CommonTlsContext_ValidationContext{
+			ValidationContext: validation,
+		}
+	default:
+		return nil, nil, fmt.Errorf("cluster %s has neither a CA nor a system CA to verify the upstream", name)
+	}
+
+	if len(certs.Cert) > 0 {
+		certSecret := name + clientCertSecretSuffix
+		tlsContext.CommonTlsContext.TlsCertificateSdsSecretConfigs = []*tlsv3.SdsSecretConfig{sdsSecretConfig(certSecret)}
+
+		secrets = append(secrets, &tlsv3.Secret{
+			Name: certSecret,
+			Type: &tlsv3.Secret_TlsCertificate{
+				TlsCertificate: &tlsv3.TlsCertificate{
+					CertificateChain: inlineBytes(certs.Cert),
+					PrivateKey:       inlineBytes(certs.Key),
+				},
+			},
+		})
+	}
+
+	return tlsContext, secrets, nil
+}
+
+// tlsTransportSocket returns the transport socket connecting to the upstreams of a cluster using TLS
+func tlsTransportSocket(tlsContext *tlsv3.UpstreamTlsContext) (*corev3.TransportSocket, error) {
+	config, err := anypb.New(tlsContext)
+	if err != nil {
+		return nil, err
+	}
+
+	return &corev3.TransportSocket{
+		Name:       wellknown.TransportSocketTLS,
+		ConfigType: &corev3.TransportSocket_TypedConfig{TypedConfig: config},
+	}, nil
+}
+
+// sdsSecretConfig references a secret published over ADS
+func sdsSecretConfig(name string) *tlsv3.SdsSecretConfig {
+	return &tlsv3.SdsSecretConfig{
+		Name: name,
+		SdsConfig: &corev3.ConfigSource{
+			ResourceApiVersion:    corev3.ApiVersion_V3,
+			ConfigSourceSpecifier: &corev3.ConfigSource_Ads{Ads: &corev3.AggregatedConfigSource{}},
+		},
+	}
+}
+
+func inlineBytes(b []byte) *corev3.DataSource {
+	return &corev3.DataSource{
+		Specifier: &corev3.DataSource_InlineBytes{InlineBytes: b},
+	}
+}
+
+// extProcCluster returns the cluster of the external processor, which requires http/2, and the secrets it references.
+// The external processor is connected to using TLS if its CA is configured.
+func extProcCluster(opts Options) (*clusterv3.Cluster, []types.Resource, error) {
+	protocolOptions, err := anypb.New(&upstreamhttpv3.HttpProtocolOptions{
+		UpstreamProtocolOptions: &upstreamhttpv3.HttpProtocolOptions_ExplicitHttpConfig_{
+			ExplicitHttpConfig: &upstreamhttpv3.HttpProtocolOptions_ExplicitHttpConfig{
+				ProtocolConfig: &upstreamhttpv3.HttpProtocolOptions_ExplicitHttpConfig_Http2ProtocolOptions{
+					Http2ProtocolOptions: &corev3.Http2ProtocolOptions{},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := &clusterv3.Cluster{
+		Name:                 ExtProcClusterName,
+		ConnectTimeout:       durationpb.New(defaultConnectTimeout),
+		ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterv3.Cluster_STRICT_DNS},
+		LbPolicy:             clusterv3.Cluster_ROUND_ROBIN,
+		LoadAssignment: &endpointv3.ClusterLoadAssignment{
+			ClusterName: ExtProcClusterName,
+			Endpoints: []*endpointv3.LocalityLbEndpoints{
+				{LbEndpoints: []*endpointv3.LbEndpoint{lbEndpoint(opts.ExtProcHost, int32(opts.ExtProcPort))}},
+			},
+		},
+		TypedExtensionProtocolOptions: map[string]*anypb.Any{
+			httpProtocolOptionsName: protocolOptions,
+		},
+	}
+
+	if len(opts.ExtProcCA) == 0 {
+		return c, nil, nil
+	}
+
+	tlsContext, secrets, err := upstreamTlsContext(c.Name, opts.ExtProcHost, proxy.TLSCertificates{CA: opts.ExtProcCA}, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	transportSocket, err := tlsTransportSocket(tlsContext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.TransportSocket = transportSocket
+	return c, secrets, nil
+}
+
+func lbEndpoint(address string, port int32) *endpointv3.LbEndpoint {
+	return &endpointv3.LbEndpoint{
+		HostIdentifier: &endpointv3.LbEndpoint_Endpoint{
+			Endpoint: &endpointv3.Endpoint{
+				Address: socketAddress(address, uint32(port)),
+			},
+		},
+	}
+}
+
+func socketAddress(address string, port uint32) *corev3.Address {
+	return &corev3.Address{
+		Address: &corev3.Address_SocketAddress{
+			SocketAddress: &corev3.SocketAddress{
+				Address:       address,
+				PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: port},
+			},
+		},
+	}
+}
+
+// routeConfiguration routes each host to the cluster of its OAUTH2Proxy.
+// Callbacks to the redirectURI hosts are answered by the external processor, they are never routed to a cluster.
+// Hosts registered by more than one OAUTH2Proxy are routed to the first one, like the http proxy does.
+func routeConfiguration(registrations []proxy.OAUTH2Proxy) *routev3.RouteConfiguration {
+	hosts := make(map[string]bool)
+	var virtualHosts []*routev3.VirtualHost
+
+	for _, dst := range registrations {
+		if dst.Host == "" || hosts[dst.Host] {
+			continue
+		}
+
+		hosts[dst.Host] = true
+		virtualHosts = append(virtualHosts, &routev3.VirtualHost{
+			Name:    clusterName(dst.Object),
+			Domains: []string{dst.Host},
+			Routes:  backendRoutes(dst),
+		})
+	}
+
+	for _, dst := range registrations {
+		u, err := url.Parse(dst.RedirectURI)
+		if err != nil || u.Host == "" || hosts[u.Host] {
+			continue
+		}
+
+		hosts[u.Host] = true
+		virtualHosts = append(virtualHosts, &routev3.VirtualHost{
+			Name:    fmt.Sprintf("callback/%s", u.Host),
+			Domains: []string{u.Host},
+			Routes: []*routev3.Route{
+				{
+					Match: &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: "/"}},
+					Action: &routev3.Route_DirectResponse{
+						DirectResponse: &routev3.DirectResponseAction{Status: 404},
+					},
+				},
+			},
+		})
+	}
+
+	return &routev3.RouteConfiguration{
+		Name:         RouteName,
+		VirtualHosts: virtualHosts,
+	}
+}
+
+// backendRoutes routes the paths of the host to the backend, like the generated Ingress all paths are routed if none are registered.
+// Callbacks are answered by the external processor before requests are routed, hence they do not require a route.
+// The request timeout and retries of the OAUTH2Proxy are applied, the Envoy default timeout is kept if no timeout is set.
+func backendRoutes(dst proxy.OAUTH2Proxy) []*routev3.Route {
+	action := &routev3.RouteAction{
+		ClusterSpecifier: &routev3.RouteAction_Cluster{Cluster: clusterName(dst.Object)},
+	}
+
+	if dst.Timeouts.Request > 0 {
+		action.Timeout = durationpb.New(dst.Timeouts.Request)
+	}
+
+	// The path is prepended to the whole request path, a prefix rewrite would replace the matched path
+	if dst.Path != "" {
+		action.RegexRewrite = &matcherv3.RegexMatchAndSubstitute{
+			Pattern:      &matcherv3.RegexMatcher{Regex: "^/"},
+			Substitution: strings.TrimSuffix(dst.Path, "/") + "/",
+		}
+	}
+
+	if dst.Retries.Attempts > 0 {
+		action.RetryPolicy = &routev3.RetryPolicy{
+			RetryOn:    "connect-failure",
+			NumRetries: wrapperspb.UInt32(uint32(dst.Retries.Attempts)),
+		}
+
+		if dst.Retries.Backoff > 0 {
+			action.RetryPolicy.RetryBackOff = &routev3.RetryPolicy_RetryBackOff{
+				BaseInterval: durationpb.New(dst.Retries.Backoff),
+			}
+		}
+	}
+
+	paths := dst.Paths
+	if len(paths) == 0 {
+		paths = []proxy.PathMatch{{Path: "/"}}
+	}
+
+	var routes []*routev3.Route
+	for _, path := range paths {
+		match := &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: path.Path}}
+		if path.Exact {
+			match.PathSpecifier = &routev3.RouteMatch_Path{Path: path.Path}
+		}
+
+		routes = append(routes, &routev3.Route{
+			Match:  match,
+			Action: &routev3.Route_Route{Route: action},
+		})
+	}
+
+	return routes
+}
+
+// listener returns the listener serving the route configuration.
+// The ext_proc filter rewrites the responses of the backends and answers callbacks before requests are routed.
+func listener(opts Options) (*listenerv3.Listener, error) {
+	extProc, err := anypb.New(&extprocfilterv3.ExternalProcessor{
+		GrpcService: &corev3.GrpcService{
+			TargetSpecifier: &corev3.GrpcService_EnvoyGrpc_{
+				EnvoyGrpc: &corev3.GrpcService_EnvoyGrpc{ClusterName: ExtProcClusterName},
+			},
+		},
+		ProcessingMode: &extprocfilterv3.ProcessingMode{
+			RequestHeaderMode:  extprocfilterv3.ProcessingMode_SEND,
+			ResponseHeaderMode: extprocfilterv3.ProcessingMode_SEND,
+			RequestBodyMode:    extprocfilterv3.ProcessingMode_NONE,
+			ResponseBodyMode:   extprocfilterv3.ProcessingMode_NONE,
+		},
+		// The request body of form posted callbacks is requested by the external processor
+		AllowModeOverride: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	router, err := anypb.New(&routerv3.Router{})
+	if err != nil {
+		return nil, err
+	}
+
+	manager, err := anypb.New(&hcmv3.HttpConnectionManager{
+		StatPrefix: "oauth2_redirect_proxy",
+		RouteSpecifier: &hcmv3.HttpConnectionManager_Rds{
+			Rds: &hcmv3.Rds{
+				RouteConfigName: RouteName,
+				ConfigSource: &corev3.ConfigSource{
+					ResourceApiVersion:    corev3.ApiVersion_V3,
+					ConfigSourceSpecifier: &corev3.ConfigSource_Ads{Ads: &corev3.AggregatedConfigSource{}},
+				},
+			},
+		},
+		HttpFilters: []*hcmv3.HttpFilter{
+			{Name: extProcFilterName, ConfigType: &hcmv3.HttpFilter_TypedConfig{TypedConfig: extProc}},
+			{Name: wellknown.Router, ConfigType: &hcmv3.HttpFilter_TypedConfig{TypedConfig: router}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &listenerv3.Listener{
+		Name:    ListenerName,
+		Address: socketAddress("0.0.0.0", opts.ListenerPort),
+		FilterChains: []*listenerv3.FilterChain{
+			{
+				Filters: []*listenerv3.Filter{
+					{Name: wellknown.HTTPConnectionManager, ConfigType: &listenerv3.Filter_TypedConfig{TypedConfig: manager}},
+				},
+			},
+		},
+	}, nil
+}
+
+// equal returns true if both sets of resources are the same
+func equal(a, b map[resource.Type][]types.Resource) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for typ, resources := range a {
+		if len(resources) != len(b[typ]) {
+			return false
+		}
+
+		for i := range resources {
+			if !proto.Equal(resources[i], b[typ][i]) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
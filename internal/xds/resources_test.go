@@ -0,0 +1,279 @@
+package xds
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/DoodleScheduling/oauth2-redirect-controller/internal/proxy"
+)
+
+const testSystemCA = "/etc/ssl/certs/ca-certificates.crt"
+
+func TestCluster(t *testing.T) {
+	tests := []struct {
+		name          string
+		dst           proxy.OAUTH2Proxy
+		expectType    clusterv3.Cluster_DiscoveryType
+		expectAddress []string
+		expectTimeout time.Duration
+		expectSNI     string
+	}{
+		{
+			name: "Service address is resolved by Envoy",
+			dst: proxy.OAUTH2Proxy{
+				Service: "idp.default.svc",
+				Port:    80,
+				Object:  client.ObjectKey{Namespace: "default", Name: "idp"},
+			},
+			expectType:    clusterv3.Cluster_STRICT_DNS,
+			expectAddress: []string{"idp.default.svc"},
+			expectTimeout: defaultConnectTimeout,
+		},
+		{
+			name: "Ready endpoints are published statically",
+			dst: proxy.OAUTH2Proxy{
+				Service:   "idp.default.svc",
+				Port:      80,
+				Endpoints: []proxy.Endpoint{{Address: "10.0.0.1", Port: 8080}, {Address: "10.0.0.2", Port: 8080}},
+				Timeouts:  proxy.Timeouts{Connect: time.Second},
+				Object:    client.ObjectKey{Namespace: "default", Name: "idp"},
+			},
+			expectType:    clusterv3.Cluster_STATIC,
+			expectAddress: []string{"10.0.0.1", "10.0.0.2"},
+			expectTimeout: time.Second,
+		},
+		{
+			name: "TLS server name is sent as SNI",
+			dst: proxy.OAUTH2Proxy{
+				Service: "idp.default.svc",
+				Port:    443,
+				Scheme:  "https",
+				TLS:     &tls.Config{ServerName: "idp.example.com"},
+				Object:  client.ObjectKey{Namespace: "default", Name: "idp"},
+			},
+			expectType:    clusterv3.Cluster_STRICT_DNS,
+			expectAddress: []string{"idp.default.svc"},
+			expectTimeout: defaultConnectTimeout,
+			expectSNI:     "idp.example.com",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			c, secrets, err := cluster(test.dst, testSystemCA)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(secrets).To(BeEmpty())
+			g.Expect(c.GetName()).To(Equal("default/idp"))
+			g.Expect(c.GetType()).To(Equal(test.expectType))
+			g.Expect(c.GetConnectTimeout().AsDuration()).To(Equal(test.expectTimeout))
+
+			var addresses []string
+			for _, endpoint := range c.GetLoadAssignment().GetEndpoints()[0].GetLbEndpoints() {
+				addresses = append(addresses, endpoint.GetEndpoint().GetAddress().GetSocketAddress().GetAddress())
+			}
+			g.Expect(addresses).To(Equal(test.expectAddress))
+
+			if test.expectSNI == "" {
+				g.Expect(c.GetTransportSocket()).To(BeNil())
+				return
+			}
+
+			tlsContext := &tlsv3.UpstreamTlsContext{}
+			g.Expect(c.GetTransportSocket().GetTypedConfig().UnmarshalTo(tlsContext)).To(Succeed())
+			g.Expect(tlsContext.GetSni()).To(Equal(test.expectSNI))
+			g.Expect(tlsContext.GetCommonTlsContext().GetTlsCertificateSdsSecretConfigs()).To(BeEmpty())
+
+			// Backends without a CA are verified against the system CA bundle and the server name
+			validation := tlsContext.GetCommonTlsContext().GetValidationContext()
+			g.Expect(validation.GetTrustedCa().GetFilename()).To(Equal(testSystemCA))
+			g.Expect(validation.GetMatchTypedSubjectAltNames()).To(HaveLen(1))
+			g.Expect(validation.GetMatchTypedSubjectAltNames()[0].GetMatcher().GetExact()).To(Equal(test.expectSNI))
+		})
+	}
+}
+
+func TestClusterWithoutCA(t *testing.T) {
+	g := NewWithT(t)
+
+	// Upstreams are never published without verification
+	_, _, err := cluster(proxy.OAUTH2Proxy{
+		Service: "idp.default.svc",
+		Port:    443,
+		Scheme:  "https",
+		Object:  client.ObjectKey{Namespace: "default", Name: "idp"},
+	}, "")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestClusterTLSCertificates(t *testing.T) {
+	g := NewWithT(t)
+
+	c, secrets, err := cluster(proxy.OAUTH2Proxy{
+		Service: "idp.default.svc",
+		Port:    443,
+		Scheme:  "https",
+		TLS:     &tls.Config{ServerName: "idp.example.com"},
+		TLSCertificates: proxy.TLSCertificates{
+			CA:   []byte("ca"),
+			Cert: []byte("cert"),
+			Key:  []byte("key"),
+		},
+		Object: client.ObjectKey{Namespace: "default", Name: "idp"},
+	}, testSystemCA)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	tlsContext := &tlsv3.UpstreamTlsContext{}
+	g.Expect(c.GetTransportSocket().GetTypedConfig().UnmarshalTo(tlsContext)).To(Succeed())
+	g.Expect(tlsContext.GetSni()).To(Equal("idp.example.com"))
+
+	// The certificates are not published inline but referenced as secrets
+	g.Expect(tlsContext.GetCommonTlsContext().GetTlsCertificates()).To(BeEmpty())
+	g.Expect(secrets).To(HaveLen(2))
+
+	// The backend is verified against the CA and the server name
+	combined := tlsContext.GetCommonTlsContext().GetCombinedValidationContext()
+	validation := combined.GetDefaultValidationContext()
+	g.Expect(validation.GetTrustedCa()).To(BeNil())
+	g.Expect(validation.GetMatchTypedSubjectAltNames()).To(HaveLen(1))
+	g.Expect(validation.GetMatchTypedSubjectAltNames()[0].GetSanType()).To(Equal(tlsv3.SubjectAltNameMatcher_DNS))
+	g.Expect(validation.GetMatchTypedSubjectAltNames()[0].GetMatcher().GetExact()).To(Equal("idp.example.com"))
+	g.Expect(combined.GetValidationContextSdsSecretConfig().GetName()).To(Equal("default/idp/ca"))
+	g.Expect(combined.GetValidationContextSdsSecretConfig().GetSdsConfig().GetAds()).NotTo(BeNil())
+
+	ca := secrets[0].(*tlsv3.Secret)
+	g.Expect(ca.GetName()).To(Equal("default/idp/ca"))
+	g.Expect(ca.GetValidationContext().GetTrustedCa().GetInlineBytes()).To(Equal([]byte("ca")))
+
+	// The client certificate is presented
+	g.Expect(tlsContext.GetCommonTlsContext().GetTlsCertificateSdsSecretConfigs()).To(HaveLen(1))
+	g.Expect(tlsContext.GetCommonTlsContext().GetTlsCertificateSdsSecretConfigs()[0].GetName()).To(Equal("default/idp/client-certificate"))
+
+	cert := secrets[1].(*tlsv3.Secret)
+	g.Expect(cert.GetName()).To(Equal("default/idp/client-certificate"))
+	g.Expect(cert.GetTlsCertificate().GetCertificateChain().GetInlineBytes()).To(Equal([]byte("cert")))
+	g.Expect(cert.GetTlsCertificate().GetPrivateKey().GetInlineBytes()).To(Equal([]byte("key")))
+}
+
+func TestExtProcClusterTLS(t *testing.T) {
+	g := NewWithT(t)
+
+	c, secrets, err := extProcCluster(Options{ExtProcHost: "oauth2-redirect-controller.system.svc", ExtProcPort: 9000})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(c.GetTransportSocket()).To(BeNil())
+	g.Expect(secrets).To(BeEmpty())
+
+	c, secrets, err = extProcCluster(Options{ExtProcHost: "oauth2-redirect-controller.system.svc", ExtProcPort: 9000, ExtProcCA: []byte("ca")})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	tlsContext := &tlsv3.UpstreamTlsContext{}
+	g.Expect(c.GetTransportSocket().GetTypedConfig().UnmarshalTo(tlsContext)).To(Succeed())
+	g.Expect(tlsContext.GetSni()).To(Equal("oauth2-redirect-controller.system.svc"))
+
+	validation := tlsContext.GetCommonTlsContext().GetCombinedValidationContext().GetDefaultValidationContext()
+	g.Expect(validation.GetMatchTypedSubjectAltNames()[0].GetMatcher().GetExact()).To(Equal("oauth2-redirect-controller.system.svc"))
+
+	g.Expect(secrets).To(HaveLen(1))
+	g.Expect(secrets[0].(*tlsv3.Secret).GetName()).To(Equal(ExtProcClusterName + "/ca"))
+	g.Expect(secrets[0].(*tlsv3.Secret).GetValidationContext().GetTrustedCa().GetInlineBytes()).To(Equal([]byte("ca")))
+}
+
+func TestRouteConfiguration(t *testing.T) {
+	g := NewWithT(t)
+
+	routes := routeConfiguration([]proxy.OAUTH2Proxy{
+		{
+			Host:        "idp",
+			RedirectURI: "https://oauth2proxy/callback",
+			Paths:       []proxy.PathMatch{{Path: "/authorize"}, {Path: "/login", Exact: true}},
+			Path:        "/prefix",
+			Timeouts:    proxy.Timeouts{Request: 30 * time.Second},
+			Retries:     proxy.RetryPolicy{Attempts: 2, Backoff: 100 * time.Millisecond},
+			Object:      client.ObjectKey{Namespace: "default", Name: "idp"},
+		},
+		{
+			Host:        "other-idp",
+			RedirectURI: "https://idp",
+			Object:      client.ObjectKey{Namespace: "default", Name: "other-idp"},
+		},
+		{
+			Host:   "idp",
+			Object: client.ObjectKey{Namespace: "default", Name: "duplicate"},
+		},
+	})
+
+	g.Expect(routes.GetName()).To(Equal(RouteName))
+	g.Expect(routes.GetVirtualHosts()).To(HaveLen(3))
+
+	// Hosts registered more than once are routed to the first OAUTH2Proxy
+	idp := routes.GetVirtualHosts()[0]
+	g.Expect(idp.GetDomains()).To(Equal([]string{"idp"}))
+
+	// Only the registered paths are routed
+	g.Expect(idp.GetRoutes()).To(HaveLen(2))
+	g.Expect(idp.GetRoutes()[0].GetMatch().GetPrefix()).To(Equal("/authorize"))
+	g.Expect(idp.GetRoutes()[1].GetMatch().GetPath()).To(Equal("/login"))
+
+	action := idp.GetRoutes()[0].GetRoute()
+	g.Expect(action.GetCluster()).To(Equal("default/idp"))
+	g.Expect(action.GetRegexRewrite().GetPattern().GetRegex()).To(Equal("^/"))
+	g.Expect(action.GetRegexRewrite().GetSubstitution()).To(Equal("/prefix/"))
+	g.Expect(action.GetTimeout().AsDuration()).To(Equal(30 * time.Second))
+	g.Expect(action.GetRetryPolicy().GetNumRetries().GetValue()).To(Equal(uint32(2)))
+	g.Expect(action.GetRetryPolicy().GetRetryBackOff().GetBaseInterval().AsDuration()).To(Equal(100 * time.Millisecond))
+
+	otherIdp := routes.GetVirtualHosts()[1]
+	g.Expect(otherIdp.GetDomains()).To(Equal([]string{"other-idp"}))
+	g.Expect(otherIdp.GetRoutes()).To(HaveLen(1))
+	g.Expect(otherIdp.GetRoutes()[0].GetMatch().GetPrefix()).To(Equal("/"))
+	g.Expect(otherIdp.GetRoutes()[0].GetRoute().GetRetryPolicy()).To(BeNil())
+
+	// Without a request timeout the Envoy default timeout is kept
+	g.Expect(otherIdp.GetRoutes()[0].GetRoute().GetTimeout()).To(BeNil())
+
+	// Callbacks are answered by the external processor, other requests to the redirectURI host are not routed
+	callback := routes.GetVirtualHosts()[2]
+	g.Expect(callback.GetDomains()).To(Equal([]string{"oauth2proxy"}))
+	g.Expect(callback.GetRoutes()[0].GetAction()).To(BeAssignableToTypeOf(&routev3.Route_DirectResponse{}))
+	g.Expect(callback.GetRoutes()[0].GetDirectResponse().GetStatus()).To(Equal(uint32(404)))
+}
+
+func TestResources(t *testing.T) {
+	g := NewWithT(t)
+
+	opts := Options{ListenerPort: 8080, ExtProcHost: "oauth2-redirect-controller.system.svc", ExtProcPort: 9000}
+	res, err := resources([]proxy.OAUTH2Proxy{
+		{Host: "idp", Service: "idp.default.svc", Port: 80, Object: client.ObjectKey{Namespace: "default", Name: "idp"}},
+	}, opts)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(res[resource.ListenerType]).To(HaveLen(1))
+	g.Expect(res[resource.RouteType]).To(HaveLen(1))
+	g.Expect(res[resource.ClusterType]).To(HaveLen(2))
+	g.Expect(res[resource.SecretType]).To(BeEmpty())
+
+	extProc := res[resource.ClusterType][0].(*clusterv3.Cluster)
+	g.Expect(extProc.GetName()).To(Equal(ExtProcClusterName))
+	g.Expect(extProc.GetLoadAssignment().GetEndpoints()[0].GetLbEndpoints()[0].GetEndpoint().GetAddress().GetSocketAddress().GetPortValue()).To(Equal(uint32(9000)))
+
+	same, err := resources([]proxy.OAUTH2Proxy{
+		{Host: "idp", Service: "idp.default.svc", Port: 80, Object: client.ObjectKey{Namespace: "default", Name: "idp"}},
+	}, opts)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(equal(res, same)).To(BeTrue())
+
+	changed, err := resources([]proxy.OAUTH2Proxy{
+		{Host: "idp", Service: "idp.default.svc", Port: 8080, Object: client.ObjectKey{Namespace: "default", Name: "idp"}},
+	}, opts)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(equal(res, changed)).To(BeFalse())
+}
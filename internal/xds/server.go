@@ -0,0 +1,146 @@
+package xds
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"github.com/go-logr/logr"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/DoodleScheduling/oauth2-redirect-controller/internal/proxy"
+)
+
+// nodeID is the snapshot key shared by all Envoy nodes, each node is served the same resources
+const nodeID = "oauth2-redirect-proxy"
+
+// Server is an xDS control plane publishing the OAUTH2Proxies registered at the proxy to Envoy.
+// Only the aggregated discovery service (ADS) is served.
+type Server struct {
+	HttpProxy *proxy.HttpProxy
+	Log       logr.Logger
+	// Addr is the address the gRPC server binds to
+	Addr string
+	// TLSConfig of the gRPC server, Envoy is required to present a client certificate
+	// as the published secrets contain the private keys of the backend client certificates.
+	TLSConfig *tls.Config
+	// Options configure the published resources
+	Options Options
+	// Changes signals changed registrations, see proxy.WithRegistrationListener
+	Changes <-chan struct{}
+
+	cache cachev3.SnapshotCache
+	// version of the last published snapshot
+	version uint64
+	// published are the resources of the last published snapshot
+	published map[resource.Type][]types.Resource
+}
+
+// nodeHash maps all Envoy nodes to the same snapshot
+type nodeHash struct{}
+
+// ID implements cachev3.NodeHash
+func (nodeHash) ID(*corev3.Node) string {
+	return nodeID
+}
+
+// Start serves the control plane until the context is canceled, it implements manager.Runnable.
+// The registrations are only known by the leader, hence the control plane is served by the leader only.
+func (s *Server) Start(ctx context.Context) error {
+	if s.TLSConfig == nil || s.TLSConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		return errors.New("the xds server requires mutual TLS")
+	}
+
+	s.cache = cachev3.NewSnapshotCache(true, nodeHash{}, logger{s.Log})
+	if err := s.publish(ctx); err != nil {
+		return err
+	}
+
+	lis, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for the xds server: %w", err)
+	}
+
+	grpcServer := grpc.NewServer(grpc.Creds(credentials.NewTLS(s.TLSConfig)))
+	discoverygrpc.RegisterAggregatedDiscoveryServiceServer(grpcServer, serverv3.NewServer(ctx, s.cache, nil))
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- grpcServer.Serve(lis)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			grpcServer.GracefulStop()
+			return nil
+		case err := <-errs:
+			return err
+		case <-s.Changes:
+			if err := s.publish(ctx); err != nil {
+				s.Log.Error(err, "failed to publish xds snapshot")
+			}
+		}
+	}
+}
+
+// publish sets a new snapshot if the resources of the registrations changed
+func (s *Server) publish(ctx context.Context) error {
+	resources, err := resources(s.HttpProxy.Registrations(), s.Options)
+	if err != nil {
+		return err
+	}
+
+	if s.published != nil && equal(s.published, resources) {
+		return nil
+	}
+
+	snapshot, err := cachev3.NewSnapshot(fmt.Sprintf("%d", s.version+1), resources)
+	if err != nil {
+		return err
+	}
+
+	if err := snapshot.Consistent(); err != nil {
+		return err
+	}
+
+	if err := s.cache.SetSnapshot(ctx, nodeID, snapshot); err != nil {
+		return err
+	}
+
+	s.version++
+	s.published = resources
+	s.Log.V(1).Info("published xds snapshot", "version", s.version, "clusters", len(resources[resource.ClusterType]))
+
+	return nil
+}
+
+// logger adapts logr to the logger of the control plane library
+type logger struct {
+	log logr.Logger
+}
+
+func (l logger) Debugf(format string, args ...interface{}) {
+	l.log.V(1).Info(fmt.Sprintf(format, args...))
+}
+
+func (l logger) Infof(format string, args ...interface{}) {
+	l.log.V(1).Info(fmt.Sprintf(format, args...))
+}
+
+func (l logger) Warnf(format string, args ...interface{}) {
+	l.log.Info(fmt.Sprintf(format, args...))
+}
+
+func (l logger) Errorf(format string, args ...interface{}) {
+	l.log.Error(nil, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,68 @@
+package xds
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/DoodleScheduling/oauth2-redirect-controller/internal/proxy"
+)
+
+func TestServerPublish(t *testing.T) {
+	g := NewWithT(t)
+
+	h := proxy.New(logr.Discard(), nil)
+	s := &Server{
+		HttpProxy: h,
+		Log:       logr.Discard(),
+		Options:   Options{ListenerPort: 8080, ExtProcHost: "localhost", ExtProcPort: 9000},
+		cache:     cachev3.NewSnapshotCache(true, nodeHash{}, logger{logr.Discard()}),
+	}
+
+	g.Expect(s.publish(context.Background())).To(Succeed())
+	snapshot, err := s.cache.GetSnapshot(nodeID)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(snapshot.GetVersion(resource.ClusterType)).To(Equal("1"))
+	g.Expect(snapshot.GetResources(resource.ClusterType)).To(HaveLen(1))
+
+	// Unchanged registrations do not publish a new version
+	g.Expect(s.publish(context.Background())).To(Succeed())
+	snapshot, err = s.cache.GetSnapshot(nodeID)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(snapshot.GetVersion(resource.ClusterType)).To(Equal("1"))
+
+	g.Expect(h.RegisterOrUpdate(&proxy.OAUTH2Proxy{
+		Host:        "idp",
+		Service:     "idp.default.svc",
+		Port:        80,
+		RedirectURI: "https://oauth2proxy",
+		Object:      client.ObjectKey{Namespace: "default", Name: "idp"},
+	})).To(Succeed())
+
+	g.Expect(s.publish(context.Background())).To(Succeed())
+	snapshot, err = s.cache.GetSnapshot(nodeID)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(snapshot.GetVersion(resource.ClusterType)).To(Equal("2"))
+	g.Expect(snapshot.GetResources(resource.ClusterType)).To(HaveKey("default/idp"))
+	g.Expect(snapshot.GetResources(resource.ClusterType)).To(HaveKey(ExtProcClusterName))
+}
+
+func TestServerStartRequiresMutualTLS(t *testing.T) {
+	g := NewWithT(t)
+
+	s := &Server{
+		HttpProxy: proxy.New(logr.Discard(), nil),
+		Log:       logr.Discard(),
+		Addr:      "127.0.0.1:0",
+	}
+	g.Expect(s.Start(context.Background())).To(MatchError(ContainSubstring("mutual TLS")))
+
+	s.TLSConfig = &tls.Config{ClientAuth: tls.NoClientCert}
+	g.Expect(s.Start(context.Background())).To(MatchError(ContainSubstring("mutual TLS")))
+}
@@ -18,36 +18,46 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
+	infrav1 "github.com/DoodleScheduling/oauth2-redirect-controller/api/v1"
 	infrav1beta1 "github.com/DoodleScheduling/oauth2-redirect-controller/api/v1beta1"
 	"github.com/DoodleScheduling/oauth2-redirect-controller/internal/controllers"
 	"github.com/DoodleScheduling/oauth2-redirect-controller/internal/otelsetup"
 	"github.com/DoodleScheduling/oauth2-redirect-controller/internal/proxy"
+	webhookv1 "github.com/DoodleScheduling/oauth2-redirect-controller/internal/webhook/v1"
+	"github.com/DoodleScheduling/oauth2-redirect-controller/internal/xds"
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
 	"github.com/fluxcd/pkg/runtime/client"
 	helper "github.com/fluxcd/pkg/runtime/controller"
 	"github.com/fluxcd/pkg/runtime/leaderelection"
 	"github.com/fluxcd/pkg/runtime/logger"
 	flag "github.com/spf13/pflag"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
-	"go.opentelemetry.io/contrib/propagators/b3"
-	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
-	"go.opentelemetry.io/otel/sdk/resource"
 	"go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
 	ctrlcache "sigs.k8s.io/controller-runtime/pkg/cache"
 	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+	gatewayv1beta1 "sigs.k8s.io/gateway-api/apis/v1beta1"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -62,7 +72,10 @@ func init() {
 	_ = clientgoscheme.AddToScheme(scheme)
 
 	_ = corev1.AddToScheme(scheme)
+	_ = infrav1.AddToScheme(scheme)
 	_ = infrav1beta1.AddToScheme(scheme)
+	_ = gatewayv1.AddToScheme(scheme)
+	_ = gatewayv1beta1.AddToScheme(scheme)
 	// +kubebuilder:scaffold:scheme
 }
 
@@ -70,8 +83,38 @@ var (
 	proxyReadTimeout        = 10 * time.Second
 	proxyWriteTimeout       = 10 * time.Second
 	httpAddr                = ":8080"
+	httpsAddr               string
+	extProcAddr             string
+	extProcTLSCert          string
+	extProcTLSKey           string
+	extProcTLSClientCA      string
+	xdsAddr                 string
+	xdsListenerPort         int
+	xdsExtProcService       string
+	xdsExtProcCA            string
+	xdsSystemCA             string
+	xdsTLSCert              string
+	xdsTLSKey               string
+	xdsTLSClientCA          string
+	tlsUnknownSNI           string
+	tlsDefaultCert          string
+	tlsDefaultKey           string
+	stateKeyFile            string
+	redact                  = true
+	redactParams            []string
+	accessLog               bool
+	accessLogFormat         string
+	statsWindow             time.Duration
+	secretLabelSelector     string
+	ingressAnnotations      bool
+	ingressProxyService     string
+	ingressProxyPort        int
+	statusUpdateInterval    time.Duration
 	metricsAddr             string
 	healthAddr              string
+	enableWebhooks          bool
+	webhookPort             int
+	webhookCertDir          string
 	concurrent              int
 	gracefulShutdownTimeout time.Duration
 	clientOptions           client.Options
@@ -85,12 +128,49 @@ var (
 
 func main() {
 	flag.StringVar(&httpAddr, "http-addr", ":8080", "The address of http server binding to.")
+	flag.StringVar(&httpsAddr, "https-addr", "", "The address of the https server binding to. TLS is not served if empty.")
+	flag.StringVar(&extProcAddr, "ext-proc-addr", "", "The address of the Envoy external processor (ext_proc) gRPC server binding to. The external processor is not served if empty.")
+	flag.StringVar(&extProcTLSCert, "ext-proc-tls-cert", "", "Path to the PEM encoded certificate of the external processor. The external processor is served without TLS if empty.")
+	flag.StringVar(&extProcTLSKey, "ext-proc-tls-key", "", "Path to the PEM encoded private key of the external processor certificate.")
+	flag.StringVar(&extProcTLSClientCA, "ext-proc-tls-client-ca", "", "Path to the PEM encoded CA certificates Envoy's client certificates are verified against. Client certificates are not required if empty.")
+	flag.StringVar(&xdsAddr, "xds-addr", "", "The address of the xDS control plane (ADS) gRPC server binding to. The registered OAUTH2Proxies are not published to Envoy if empty.")
+	flag.IntVar(&xdsListenerPort, "xds-listener-port", 8080, "The port of the listener published to Envoy.")
+	flag.StringVar(&xdsExtProcService, "xds-ext-proc-service", "", "The host:port of the external processor published to Envoy. Required if the xDS control plane is served.")
+	flag.StringVar(&xdsExtProcCA, "xds-ext-proc-ca", "", "Path to the PEM encoded CA certificates Envoy verifies the external processor against. Envoy connects to the external processor without TLS if empty.")
+	flag.StringVar(&xdsSystemCA, "xds-system-ca", "/etc/ssl/certs/ca-certificates.crt", "Path to the CA bundle on Envoy which TLS backends without a CA are verified against.")
+	flag.StringVar(&xdsTLSCert, "xds-tls-cert", "", "Path to the PEM encoded certificate of the xDS control plane. Required if the xDS control plane is served.")
+	flag.StringVar(&xdsTLSKey, "xds-tls-key", "", "Path to the PEM encoded private key of the xDS control plane certificate. Required if the xDS control plane is served.")
+	flag.StringVar(&xdsTLSClientCA, "xds-tls-client-ca", "", "Path to the PEM encoded CA certificates Envoy's client certificates are verified against. Required if the xDS control plane is served.")
+	flag.StringVar(&tlsUnknownSNI, "tls-unknown-sni", string(proxy.UnknownSNIReject), "How to handle TLS handshakes for server names without a certificate. Can be 'reject' or 'default'.")
+	flag.StringVar(&tlsDefaultCert, "tls-default-cert", "", "Path to the PEM encoded certificate served for unknown server names.")
+	flag.StringVar(&tlsDefaultKey, "tls-default-key", "", "Path to the PEM encoded private key of the certificate served for unknown server names.")
+	flag.StringVar(&stateKeyFile, "state-key-file", "", "Path to a file containing the key the proxied state is signed with. All replicas must share the key, a random key is generated if empty.")
 	flag.DurationVar(&proxyReadTimeout, "proxy-read-timeout", 10*time.Second, "Read timeout for proxy requests.")
 	flag.DurationVar(&proxyWriteTimeout, "proxy-write-timeout", 10*time.Second, "Write timeout for proxy requests.")
+	flag.BoolVar(&redact, "redact", true, "Redact OAUTH2 codes, states and tokens from proxy logs and traces.")
+	flag.StringSliceVar(&redactParams, "redact-params", nil, "Additional query and form parameters to redact from proxy logs and traces.")
+	flag.BoolVar(&accessLog, "access-log", false, "Write an access log entry for each proxy request to stdout.")
+	flag.StringVar(&accessLogFormat, "access-log-format", string(proxy.AccessLogFormatJSON), "Access log format. Can be 'json' or 'combined'.")
+	flag.DurationVar(&statsWindow, "stats-window", proxy.DefaultStatsWindow, "The rolling window the rewrites and callbacks reported in the status of OAUTH2Proxies are counted over.")
+	flag.DurationVar(&statusUpdateInterval, "status-update-interval", controllers.DefaultStatusUpdateInterval, "Interval in which the serving stats are patched into the status of OAUTH2Proxies.")
 	flag.StringVar(&metricsAddr, "metrics-addr", ":9556",
 		"The address the metric endpoint binds to.")
 	flag.StringVar(&healthAddr, "health-addr", ":9557",
 		"The address the health endpoint binds to.")
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", false,
+		"Serve the defaulting, validating and conversion webhooks for OAUTH2Proxies.")
+	flag.IntVar(&webhookPort, "webhook-port", 9443,
+		"The port the webhook server binds to.")
+	flag.StringVar(&webhookCertDir, "webhook-cert-dir", "",
+		"The directory containing tls.crt and tls.key of the webhook server. Defaults to the controller-runtime default directory.")
+	flag.StringVar(&secretLabelSelector, "secret-label-selector", "",
+		"Only watch Secrets with matching labels for changes, e.g. 'oauth2.infra.doodle.com/watch=true'. Referenced Secrets without the labels are read but changes to them are not noticed.")
+	flag.BoolVar(&ingressAnnotations, "ingress-annotations", false,
+		"Proxy the hosts of Ingresses annotated with oauth2.infra.doodle.com/redirect-uri. Anyone allowed to annotate an Ingress can then route hosts through the proxy.")
+	flag.StringVar(&ingressProxyService, "ingress-proxy-service", "",
+		"The DNS name of the Service exposing the proxy, Ingresses and HTTPRoutes generated for OAUTH2Proxies route to it. Neither are generated if empty.")
+	flag.IntVar(&ingressProxyPort, "ingress-proxy-port", 80,
+		"The http port of the Service exposing the proxy.")
 	flag.IntVar(&concurrent, "concurrent", 4,
 		"The number of concurrent KeycloakRealm reconciles.")
 	flag.DurationVar(&gracefulShutdownTimeout, "graceful-shutdown-timeout", 600*time.Second,
@@ -118,8 +198,20 @@ func main() {
 		os.Exit(1)
 	}
 
+	secretSelector, err := labels.Parse(secretLabelSelector)
+	if err != nil {
+		setupLog.Error(err, "unable to parse secret label selector")
+		os.Exit(1)
+	}
+
 	opts := ctrl.Options{
 		Scheme: scheme,
+		Client: ctrlclient.Options{
+			Cache: &ctrlclient.CacheOptions{
+				// Only the metadata of Secrets is cached, the data of referenced Secrets is read from the API server
+				DisableFor: []ctrlclient.Object{&corev1.Secret{}},
+			},
+		},
 		Metrics: server.Options{
 			BindAddress: metricsAddr,
 		},
@@ -131,16 +223,29 @@ func main() {
 		RetryPeriod:                   &leaderElectionOptions.RetryPeriod,
 		GracefulShutdownTimeout:       &gracefulShutdownTimeout,
 		LeaderElectionID:              leaderElectionId,
+		WebhookServer: webhook.NewServer(webhook.Options{
+			Port:    webhookPort,
+			CertDir: webhookCertDir,
+		}),
 		Cache: ctrlcache.Options{
 			ByObject: map[ctrlclient.Object]ctrlcache.ByObject{
-				&infrav1beta1.OAUTH2Proxy{}: {Label: watchSelector},
+				&infrav1.OAUTH2Proxy{}: {Label: watchSelector},
+				&corev1.Secret{}:       {Label: secretSelector},
 			},
 		},
 	}
 
+	var cacheNamespaces []string
 	if !watchOptions.AllNamespaces {
+		runtimeNamespace := os.Getenv("RUNTIME_NAMESPACE")
+		if runtimeNamespace == "" {
+			setupLog.Error(nil, "RUNTIME_NAMESPACE must be set unless all namespaces are watched")
+			os.Exit(1)
+		}
+
+		cacheNamespaces = []string{runtimeNamespace}
 		opts.Cache.DefaultNamespaces = make(map[string]ctrlcache.Config)
-		opts.Cache.DefaultNamespaces[os.Getenv("RUNTIME_NAMESPACE")] = ctrlcache.Config{}
+		opts.Cache.DefaultNamespaces[runtimeNamespace] = ctrlcache.Config{}
 	}
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), opts)
@@ -163,57 +268,112 @@ func main() {
 		os.Exit(1)
 	}
 
-	resources, err := resource.New(context.Background(),
-		resource.WithFromEnv(), // pull attributes from OTEL_RESOURCE_ATTRIBUTES and OTEL_SERVICE_NAME environment variables
-		resource.WithProcess(), // This option configures a set of Detectors that discover process information
-	)
-	if err != nil {
-		setupLog.Error(err, "failed creating OTLP resources")
-		os.Exit(1)
+	if enableWebhooks {
+		if err = webhookv1.SetupOAUTH2ProxyWebhookWithManager(mgr, ingressAnnotations); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "OAUTH2Proxy")
+			os.Exit(1)
+		}
+
+		if err = mgr.AddReadyzCheck("webhook", mgr.GetWebhookServer().StartedChecker()); err != nil {
+			setupLog.Error(err, "Could not add webhook readiness probe")
+			os.Exit(1)
+		}
+	}
+
+	var redactor *proxy.Redactor
+	var spanProcessors []trace.SpanProcessor
+	if redact {
+		redactor = proxy.NewRedactor(redactParams...)
+		spanProcessors = append(spanProcessors, redactor.SpanProcessor())
 	}
 
-	client := otlptracegrpc.NewClient()
-	exporter, err := otlptrace.New(context.Background(), client)
+	shutdownTelemetry, err := otelsetup.Setup(context.Background(), otelOptions, spanProcessors...)
 	if err != nil {
-		setupLog.Error(err, "failed creating OTLP trace exporter")
+		setupLog.Error(err, "failed to setup opentelemetry")
 		os.Exit(1)
 	}
 
-	tp := trace.NewTracerProvider(
-		trace.WithBatcher(exporter),
-		trace.WithResource(resources),
-	)
-
-	otel.SetTextMapPropagator(b3.New())
 	defer func() {
-		if err := tp.Shutdown(context.Background()); err != nil {
-			setupLog.Error(err, "failed to shutdown trace provider")
+		if err := shutdownTelemetry(context.Background()); err != nil {
+			setupLog.Error(err, "failed to shutdown opentelemetry")
 		}
 	}()
 
-	otel.SetTracerProvider(tp)
-	proxy := proxy.New(setupLog, &http.Client{
-		Transport: otelhttp.NewTransport(http.DefaultTransport),
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	})
+	// Circuit breaker state changes trigger a reconcile to update the status of the OAUTH2Proxy.
+	// Events are dropped if the controller does not consume them, for example if this instance is not the leader.
+	circuitBreakerEvents := make(chan event.GenericEvent, 1024)
+
+	// Registration changes trigger publishing a new xDS snapshot, pending changes are coalesced
+	registrationChanges := make(chan struct{}, 1)
+
+	proxyOpts := []proxy.Option{
+		proxy.WithRedactor(redactor),
+		proxy.WithStatsWindow(statsWindow),
+		proxy.WithCircuitBreakerListener(func(obj ctrlclient.ObjectKey, state proxy.CircuitState) {
+			select {
+			case circuitBreakerEvents <- event.GenericEvent{Object: &infrav1.OAUTH2Proxy{
+				ObjectMeta: metav1.ObjectMeta{Namespace: obj.Namespace, Name: obj.Name},
+			}}:
+			default:
+			}
+		}),
+		proxy.WithTransportWrapper(func(rt http.RoundTripper) http.RoundTripper {
+			return otelhttp.NewTransport(rt)
+		}),
+		proxy.WithRegistrationListener(func() {
+			select {
+			case registrationChanges <- struct{}{}:
+			default:
+			}
+		}),
+	}
 
-	wrappedHandler := otelhttp.NewHandler(proxy, "oauth2-proxy")
+	if accessLog {
+		accessLogger, err := proxy.NewAccessLogger(os.Stdout, proxy.AccessLogFormat(accessLogFormat))
+		if err != nil {
+			setupLog.Error(err, "failed to setup access log")
+			os.Exit(1)
+		}
 
-	if otelOptions.Endpoint != "" {
-		tp, err := otelsetup.Tracing(context.Background(), otelOptions)
-		defer func() {
-			if err := tp.Shutdown(context.Background()); err != nil {
-				setupLog.Error(err, "failed to shutdown trace provider")
-			}
-		}()
+		proxyOpts = append(proxyOpts, proxy.WithAccessLogger(accessLogger))
+	}
 
+	if stateKeyFile != "" {
+		stateKey, err := os.ReadFile(stateKeyFile)
 		if err != nil {
-			setupLog.Error(err, "failed to setup trace provider")
+			setupLog.Error(err, "failed to read state key")
+			os.Exit(1)
+		}
+
+		if len(stateKey) < 32 {
+			setupLog.Error(fmt.Errorf("key must be at least 32 bytes long, got %d", len(stateKey)), "invalid state key")
+			os.Exit(1)
 		}
+
+		proxyOpts = append(proxyOpts, proxy.WithStateKey(stateKey))
+	}
+
+	var defaultCert *tls.Certificate
+	if tlsDefaultCert != "" || tlsDefaultKey != "" {
+		cert, err := tls.LoadX509KeyPair(tlsDefaultCert, tlsDefaultKey)
+		if err != nil {
+			setupLog.Error(err, "failed to load default certificate")
+			os.Exit(1)
+		}
+
+		defaultCert = &cert
+	}
+
+	certificates, err := proxy.NewCertificateStore(proxy.UnknownSNIPolicy(tlsUnknownSNI), defaultCert)
+	if err != nil {
+		setupLog.Error(err, "failed to setup certificate store")
+		os.Exit(1)
 	}
 
+	httpProxy := proxy.New(setupLog, http.DefaultTransport, proxyOpts...)
+
+	wrappedHandler := otelhttp.NewHandler(httpProxy, "oauth2-proxy")
+
 	s := &http.Server{
 		Addr:           httpAddr,
 		Handler:        wrappedHandler,
@@ -228,21 +388,161 @@ func main() {
 		}
 	}()
 
+	if httpsAddr != "" {
+		tlsServer := &http.Server{
+			Addr:           httpsAddr,
+			Handler:        wrappedHandler,
+			ReadTimeout:    proxyReadTimeout,
+			WriteTimeout:   proxyWriteTimeout,
+			MaxHeaderBytes: 1 << 20,
+			TLSConfig: &tls.Config{
+				GetCertificate: certificates.GetCertificate,
+				MinVersion:     tls.VersionTLS12,
+			},
+		}
+
+		go func() {
+			if err := tlsServer.ListenAndServeTLS("", ""); err != nil {
+				setupLog.Error(err, "HTTPS server error")
+			}
+		}()
+	}
+
+	if extProcAddr != "" {
+		lis, err := net.Listen("tcp", extProcAddr)
+		if err != nil {
+			setupLog.Error(err, "failed to listen for the external processor")
+			os.Exit(1)
+		}
+
+		var grpcOpts []grpc.ServerOption
+		if extProcTLSCert != "" || extProcTLSKey != "" || extProcTLSClientCA != "" {
+			tlsConfig, err := proxy.ServerTLSConfig(extProcTLSCert, extProcTLSKey, extProcTLSClientCA)
+			if err != nil {
+				setupLog.Error(err, "failed to load the external processor certificate")
+				os.Exit(1)
+			}
+
+			grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+
+		grpcServer := grpc.NewServer(grpcOpts...)
+		extprocv3.RegisterExternalProcessorServer(grpcServer, proxy.NewExternalProcessor(httpProxy))
+
+		go func() {
+			if err := grpcServer.Serve(lis); err != nil {
+				setupLog.Error(err, "external processor server error")
+			}
+		}()
+	}
+
 	realmReconciler := &controllers.OAUTH2ProxyReconciler{
-		Client:    mgr.GetClient(),
-		Log:       ctrl.Log.WithName("controllers").WithName("OAUTH2Proxy"),
-		Scheme:    mgr.GetScheme(),
-		Recorder:  mgr.GetEventRecorderFor("OAUTH2Proxy"),
-		HttpProxy: proxy,
+		Client:          mgr.GetClient(),
+		Log:             ctrl.Log.WithName("controllers").WithName("OAUTH2Proxy"),
+		Scheme:          mgr.GetScheme(),
+		Recorder:        mgr.GetEventRecorderFor("OAUTH2Proxy"),
+		HttpProxy:       httpProxy,
+		Certificates:    certificates,
+		ProxyService:    ingressProxyService,
+		ProxyPort:       int32(ingressProxyPort),
+		CacheNamespaces: cacheNamespaces,
 	}
 
 	if err = realmReconciler.SetupWithManager(mgr, controllers.OAUTH2ProxyReconcilerOptions{
 		MaxConcurrentReconciles: concurrent,
+		CircuitBreakerEvents:    circuitBreakerEvents,
 	}); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "OAUTH2ProxyReconciler")
 		os.Exit(1)
 	}
 
+	if ingressAnnotations {
+		ingressReconciler := &controllers.IngressReconciler{
+			Client:    mgr.GetClient(),
+			Log:       ctrl.Log.WithName("controllers").WithName("Ingress"),
+			Recorder:  mgr.GetEventRecorderFor("Ingress"),
+			HttpProxy: httpProxy,
+		}
+
+		if err = ingressReconciler.SetupWithManager(mgr, controllers.IngressReconcilerOptions{
+			MaxConcurrentReconciles: concurrent,
+		}); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "IngressReconciler")
+			os.Exit(1)
+		}
+	}
+
+	// The stats are patched by the leader only, like the status written by the reconciler
+	if err = mgr.Add(&controllers.StatusUpdater{
+		Client:    mgr.GetClient(),
+		HttpProxy: httpProxy,
+		Log:       ctrl.Log.WithName("controllers").WithName("StatusUpdater"),
+		Interval:  statusUpdateInterval,
+	}); err != nil {
+		setupLog.Error(err, "unable to add status updater")
+		os.Exit(1)
+	}
+
+	// The registrations are only known by the leader, hence the control plane is served by the leader only
+	if xdsAddr != "" {
+		host, port, err := net.SplitHostPort(xdsExtProcService)
+		if err != nil {
+			setupLog.Error(err, "invalid xds external processor service", "service", xdsExtProcService)
+			os.Exit(1)
+		}
+
+		extProcPort, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			setupLog.Error(err, "invalid xds external processor port", "port", port)
+			os.Exit(1)
+		}
+
+		// The published secrets contain private keys, Envoy is required to authenticate with a client certificate
+		if xdsTLSCert == "" || xdsTLSKey == "" || xdsTLSClientCA == "" {
+			setupLog.Error(fmt.Errorf("--xds-tls-cert, --xds-tls-key and --xds-tls-client-ca are required"), "the xds server requires mutual TLS")
+			os.Exit(1)
+		}
+
+		// Backends without a CA are verified against the system CA bundle, they are never published unverified
+		if xdsSystemCA == "" {
+			setupLog.Error(fmt.Errorf("--xds-system-ca must not be empty"), "invalid xds system CA")
+			os.Exit(1)
+		}
+
+		tlsConfig, err := proxy.ServerTLSConfig(xdsTLSCert, xdsTLSKey, xdsTLSClientCA)
+		if err != nil {
+			setupLog.Error(err, "failed to load the xds server certificate")
+			os.Exit(1)
+		}
+
+		var extProcCA []byte
+		if xdsExtProcCA != "" {
+			extProcCA, err = os.ReadFile(xdsExtProcCA)
+			if err != nil {
+				setupLog.Error(err, "failed to read the xds external processor CA")
+				os.Exit(1)
+			}
+		}
+
+		if err = mgr.Add(&xds.Server{
+			HttpProxy: httpProxy,
+			Log:       ctrl.Log.WithName("xds"),
+			Addr:      xdsAddr,
+			TLSConfig: tlsConfig,
+			Options: xds.Options{
+				ListenerPort: uint32(xdsListenerPort),
+				ExtProcHost:  host,
+				ExtProcPort:  uint32(extProcPort),
+				ExtProcCA:    extProcCA,
+				SystemCA:     xdsSystemCA,
+			},
+			Changes: registrationChanges,
+		}); err != nil {
+			setupLog.Error(err, "unable to add xds server")
+			os.Exit(1)
+		}
+	}
+
 	// +kubebuilder:scaffold:builder
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {